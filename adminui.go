@@ -0,0 +1,176 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/id"
+)
+
+//go:embed adminui.html
+var adminUIPage []byte
+
+type AdminUserInfo struct {
+	MXID        string `json:"mxid"`
+	Phone       string `json:"phone,omitempty"`
+	Platform    string `json:"platform,omitempty"`
+	HasSession  bool   `json:"has_session"`
+	Connected   bool   `json:"connected"`
+	LoggedIn    bool   `json:"logged_in"`
+	State       string `json:"state,omitempty"`
+	StateError  string `json:"state_error,omitempty"`
+	StateReason string `json:"state_message,omitempty"`
+}
+
+func (prov *ProvisioningAPI) AdminUI(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(adminUIPage)
+}
+
+type AdminUserDetails struct {
+	AdminUserInfo
+	ManagementRoom id.RoomID         `json:"management_room,omitempty"`
+	OfflineQueue   int               `json:"offline_queue"`
+	Backfill       *BackfillProgress `json:"backfill"`
+}
+
+func getAdminUserInfo(user *User) AdminUserInfo {
+	info := AdminUserInfo{
+		MXID:       user.MXID.String(),
+		HasSession: user.Session != nil,
+	}
+	if !user.JID.IsEmpty() {
+		info.Phone = "+" + user.JID.User
+	}
+	if user.Session != nil {
+		info.Platform = user.Session.Platform
+	}
+	if user.Client != nil {
+		info.Connected = user.Client.IsConnected()
+		info.LoggedIn = user.Client.IsLoggedIn()
+	}
+	if user.BridgeState != nil {
+		state := user.BridgeState.GetPrev()
+		info.State = string(state.StateEvent)
+		info.StateError = string(state.Error)
+		info.StateReason = state.Message
+	}
+	return info
+}
+
+// AdminListUsers lists all users who have or had a WhatsApp session on the bridge.
+func (prov *ProvisioningAPI) AdminListUsers(w http.ResponseWriter, _ *http.Request) {
+	users := make([]AdminUserInfo, 0)
+	for _, user := range prov.bridge.GetAllUsers() {
+		if user.JID.IsEmpty() && user.Session == nil {
+			continue
+		}
+		users = append(users, getAdminUserInfo(user))
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"users": users})
+}
+
+// adminTargetUser makes the handler act on the user in the path instead of the user_id query parameter,
+// so that the regular user endpoints can be reused for the admin endpoints.
+func (prov *ProvisioningAPI) adminTargetUser(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := id.UserID(mux.Vars(r)["userID"])
+		user := prov.bridge.getUserByMXID(userID, true)
+		if user == nil {
+			jsonResponse(w, http.StatusNotFound, Error{
+				Error:   "User not found",
+				ErrCode: "user not found",
+			})
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
+	}
+}
+
+// AdminGetUser returns the connection state of a user along with their offline queue and backfill status.
+func (prov *ProvisioningAPI) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	jsonResponse(w, http.StatusOK, AdminUserDetails{
+		AdminUserInfo:  getAdminUserInfo(user),
+		ManagementRoom: user.ManagementRoom,
+		OfflineQueue:   len(user.OfflineQueue()),
+		Backfill:       user.GetBackfillProgress(),
+	})
+}
+
+// AdminDeleteUser logs the user out and deletes everything the bridge stores about them.
+// Their portals are cleaned up with the delete logout cleanup mode unless another mode is given.
+func (prov *ProvisioningAPI) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	cleanupMode := LogoutCleanupDelete
+	if cleanupParam := r.URL.Query().Get("cleanup"); cleanupParam != "" {
+		var ok bool
+		cleanupMode, ok = ParseLogoutCleanupMode(cleanupParam)
+		if !ok {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Invalid cleanup mode, must be one of keep, leave, read-only or delete",
+				ErrCode: "invalid cleanup mode",
+			})
+			return
+		}
+	}
+	var cleanupPortals []*Portal
+	if cleanupMode != LogoutCleanupKeep {
+		cleanupPortals = user.getLogoutCleanupPortals()
+	}
+	if puppet := prov.bridge.GetPuppetByCustomMXID(user.MXID); puppet != nil {
+		err := puppet.SwitchCustomMXID("", "")
+		if err != nil {
+			user.log.Warnln("Failed to disable double puppeting while deleting user:", err)
+		}
+	}
+	if user.IsLoggedIn() {
+		err := user.Client.Logout()
+		if err != nil {
+			user.log.Warnln("Error while logging out before deleting user:", err)
+		}
+	}
+	user.DeleteConnection()
+	user.bridge.Metrics.TrackConnectionState(user.JID, false)
+	user.removeFromJIDMap(status.BridgeState{StateEvent: status.StateLoggedOut})
+	user.DeleteSession()
+	prov.bridge.DeleteUser(user)
+	prov.log.Infofln("Deleted %s through the admin API (portal cleanup mode: %s)", user.MXID, cleanupMode)
+	if cleanupMode != LogoutCleanupKeep {
+		go user.CleanupPortalsAfterLogout(cleanupPortals, cleanupMode)
+	}
+	jsonResponse(w, http.StatusOK, Response{true, "User deleted"})
+}
+
+// AdminErrors returns the Matrix API and WhatsApp send errors counted since the bridge was started.
+func (prov *ProvisioningAPI) AdminErrors(w http.ResponseWriter, _ *http.Request) {
+	since, matrix, whatsapp := prov.bridge.Metrics.ErrorClasses()
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"since":    since.UnixMilli(),
+		"matrix":   matrix,
+		"whatsapp": whatsapp,
+	})
+}
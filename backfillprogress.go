@@ -0,0 +1,135 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// backfillETAMinJobs is the number of jobs that need to be completed before the time left is estimated.
+const backfillETAMinJobs = 3
+
+type BackfillStageProgress struct {
+	Type      string `json:"type"`
+	Chats     int    `json:"chats"`
+	ChatsDone int    `json:"chats_done"`
+	Jobs      int    `json:"jobs"`
+	JobsDone  int    `json:"jobs_done"`
+	InFlight  int    `json:"in_flight"`
+}
+
+type BackfillProgress struct {
+	Enabled       bool                    `json:"enabled"`
+	Stages        []BackfillStageProgress `json:"stages"`
+	RemainingJobs int                     `json:"remaining_jobs"`
+	DeferredMedia int                     `json:"deferred_media"`
+	ETASeconds    int64                   `json:"eta_seconds,omitempty"`
+}
+
+func (bq *BackfillQueue) jobDone() {
+	bq.progressLock.Lock()
+	bq.jobsCompleted++
+	bq.progressLock.Unlock()
+}
+
+// estimateTimeLeft extrapolates the time left for the remaining jobs from the jobs completed since the queue was started.
+func (bq *BackfillQueue) estimateTimeLeft(remainingJobs int) time.Duration {
+	bq.progressLock.Lock()
+	defer bq.progressLock.Unlock()
+	if bq.jobsCompleted < backfillETAMinJobs || remainingJobs == 0 {
+		return 0
+	}
+	perJob := time.Since(bq.progressStart) / time.Duration(bq.jobsCompleted)
+	return perJob * time.Duration(remainingJobs)
+}
+
+// GetBackfillProgress returns the current state of the backfill queue of the user.
+func (user *User) GetBackfillProgress() *BackfillProgress {
+	progress := &BackfillProgress{
+		Enabled: user.bridge.Config.Bridge.HistorySync.Backfill,
+		Stages:  []BackfillStageProgress{},
+	}
+	if !progress.Enabled {
+		return progress
+	}
+	for _, status := range user.bridge.DB.Backfill.GetStatus(user.MXID) {
+		progress.Stages = append(progress.Stages, BackfillStageProgress{
+			Type:      strings.ToLower(status.Type.String()),
+			Chats:     status.Chats,
+			ChatsDone: status.ChatsDone,
+			Jobs:      status.Jobs,
+			JobsDone:  status.JobsDone,
+			InFlight:  status.InFlight,
+		})
+		progress.RemainingJobs += status.Jobs - status.JobsDone
+	}
+	if user.bridge.Config.Bridge.HistorySync.DeferredMedia.Enabled {
+		progress.DeferredMedia = user.bridge.DB.DeferredMedia.Count(user.MXID)
+	}
+	if user.BackfillQueue != nil {
+		progress.ETASeconds = int64(user.BackfillQueue.estimateTimeLeft(progress.RemainingJobs) / time.Second)
+	}
+	return progress
+}
+
+func (progress *BackfillProgress) Markdown() string {
+	var buf strings.Builder
+	buf.WriteString("**Backfill progress**\n\n")
+	for _, stage := range progress.Stages {
+		_, _ = fmt.Fprintf(&buf, "* %s: %d of %d chats done", strings.ToUpper(stage.Type[:1])+stage.Type[1:], stage.ChatsDone, stage.Chats)
+		if stage.InFlight > 0 {
+			_, _ = fmt.Fprintf(&buf, " (%d in progress)", stage.InFlight)
+		}
+		buf.WriteByte('\n')
+	}
+	if progress.DeferredMedia > 0 {
+		_, _ = fmt.Fprintf(&buf, "* %d media files waiting to be downloaded\n", progress.DeferredMedia)
+	}
+	if progress.ETASeconds > 0 {
+		eta := (time.Duration(progress.ETASeconds) * time.Second).Round(time.Minute)
+		if eta < time.Minute {
+			eta = time.Minute
+		}
+		_, _ = fmt.Fprintf(&buf, "\nAbout %s left.", formatDuration(eta))
+	}
+	return buf.String()
+}
+
+// backfillProgressLoop periodically posts the backfill progress to the management room while there's work left,
+// and a final notice once the queue is empty.
+func (user *User) backfillProgressLoop() {
+	interval := time.Duration(user.bridge.Config.Bridge.HistorySync.ProgressInterval) * time.Minute
+	wasActive := false
+	lastRemaining := -1
+	for user.waitOrStop(interval) {
+		if !user.IsLoggedIn() {
+			continue
+		}
+		progress := user.GetBackfillProgress()
+		remaining := progress.RemainingJobs + progress.DeferredMedia
+		if remaining > 0 && remaining != lastRemaining {
+			user.sendMarkdownBridgeAlert("%s", progress.Markdown())
+			wasActive = true
+		} else if remaining == 0 && wasActive {
+			user.sendMarkdownBridgeAlert("Backfill finished, all chats are up to date.")
+			wasActive = false
+		}
+		lastRemaining = remaining
+	}
+}
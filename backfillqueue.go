@@ -17,6 +17,8 @@
 package main
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	log "maunium.net/go/maulogger/v2"
@@ -29,6 +31,11 @@ type BackfillQueue struct {
 	BackfillQuery   *database.BackfillQuery
 	reCheckChannels []chan bool
 	log             log.Logger
+
+	// The number of jobs completed since the queue was started, used to estimate the time left.
+	progressLock  sync.Mutex
+	progressStart time.Time
+	jobsCompleted int
 }
 
 func (bq *BackfillQueue) ReCheck() {
@@ -40,7 +47,7 @@ func (bq *BackfillQueue) ReCheck() {
 	}
 }
 
-func (bq *BackfillQueue) GetNextBackfill(userID id.UserID, backfillTypes []database.BackfillType, waitForBackfillTypes []database.BackfillType, reCheckChannel chan bool) *database.Backfill {
+func (bq *BackfillQueue) GetNextBackfill(ctx context.Context, userID id.UserID, backfillTypes []database.BackfillType, waitForBackfillTypes []database.BackfillType, reCheckChannel chan bool) *database.Backfill {
 	for {
 		if !bq.BackfillQuery.HasUnstartedOrInFlightOfType(userID, waitForBackfillTypes) {
 			// check for immediate when dealing with deferred
@@ -53,6 +60,8 @@ func (bq *BackfillQueue) GetNextBackfill(userID id.UserID, backfillTypes []datab
 		select {
 		case <-reCheckChannel:
 		case <-time.After(time.Minute):
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
@@ -62,7 +71,10 @@ func (user *User) HandleBackfillRequestsLoop(backfillTypes []database.BackfillTy
 	user.BackfillQueue.reCheckChannels = append(user.BackfillQueue.reCheckChannels, reCheckChannel)
 
 	for {
-		req := user.BackfillQueue.GetNextBackfill(user.MXID, backfillTypes, waitForBackfillTypes, reCheckChannel)
+		req := user.BackfillQueue.GetNextBackfill(user.loopCtx, user.MXID, backfillTypes, waitForBackfillTypes, reCheckChannel)
+		if req == nil {
+			return
+		}
 		user.log.Infofln("Handling backfill request %s", req)
 
 		conv := user.bridge.DB.HistorySync.GetConversation(user.MXID, req.Portal)
@@ -91,5 +103,6 @@ func (user *User) HandleBackfillRequestsLoop(backfillTypes []database.BackfillTy
 
 		user.backfillInChunks(req, conv, portal)
 		req.MarkDone()
+		user.BackfillQueue.jobDone()
 	}
 }
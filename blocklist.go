@@ -0,0 +1,199 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// The whatsmeow version used by the bridge has no block list API and ignores block list change
+// notifications, so the list is read and changed with raw blocklist queries, and changes made on
+// the phone are picked up by refreshing the list when connecting and then periodically.
+
+const blocklistRefreshInterval = 30 * time.Minute
+
+var errContactBlocked = errors.New("you have blocked this contact on WhatsApp, use the `unblock` command to unblock them")
+
+func (user *User) fetchBlocklist() (map[types.JID]struct{}, error) {
+	resp, err := user.Client.DangerousInternals().SendIQ(whatsmeow.DangerousInfoQuery{
+		Namespace: "blocklist",
+		Type:      "get",
+		To:        types.ServerJID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := resp.GetOptionalChildByTag("list")
+	if !ok {
+		return nil, fmt.Errorf("response didn't contain a block list")
+	}
+	blocked := make(map[types.JID]struct{})
+	for _, item := range list.GetChildrenByTag("item") {
+		ag := item.AttrGetter()
+		jid := ag.JID("jid")
+		if !ag.OK() {
+			return nil, fmt.Errorf("failed to parse block list item: %w", ag.Error())
+		}
+		blocked[jid.ToNonAD()] = struct{}{}
+	}
+	return blocked, nil
+}
+
+func (user *User) loadBlockedContacts() map[types.JID]struct{} {
+	if user.blockedContacts == nil {
+		user.blockedContacts = user.GetBlockedContacts()
+		if user.blockedContacts == nil {
+			user.blockedContacts = make(map[types.JID]struct{})
+		}
+	}
+	return user.blockedContacts
+}
+
+func (user *User) IsContactBlocked(jid types.JID) bool {
+	user.blockedContactsLock.Lock()
+	defer user.blockedContactsLock.Unlock()
+	_, blocked := user.loadBlockedContacts()[jid.ToNonAD()]
+	return blocked
+}
+
+// SetContactBlocked blocks or unblocks the given contact on WhatsApp.
+func (user *User) SetContactBlocked(jid types.JID, blocked bool) error {
+	jid = jid.ToNonAD()
+	action := "unblock"
+	if blocked {
+		action = "block"
+	}
+	_, err := user.Client.DangerousInternals().SendIQ(whatsmeow.DangerousInfoQuery{
+		Namespace: "blocklist",
+		Type:      "set",
+		To:        types.ServerJID,
+		Content: []waBinary.Node{{
+			Tag:   "item",
+			Attrs: waBinary.Attrs{"jid": jid, "action": action},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to %s contact on WhatsApp: %w", action, err)
+	}
+	user.blockedContactsLock.Lock()
+	defer user.blockedContactsLock.Unlock()
+	if blocked {
+		user.loadBlockedContacts()[jid] = struct{}{}
+	} else {
+		delete(user.loadBlockedContacts(), jid)
+	}
+	err = user.User.SetContactBlocked(jid, blocked)
+	if err != nil {
+		user.log.Warnfln("Failed to save block status of %s: %v", jid, err)
+	}
+	return nil
+}
+
+// RefreshBlocklist fetches the block list from WhatsApp and sends notices to the private chat portals
+// of contacts that were blocked or unblocked elsewhere since the last refresh.
+func (user *User) RefreshBlocklist() error {
+	blocked, err := user.fetchBlocklist()
+	if err != nil {
+		return err
+	}
+	changes := make(map[types.JID]bool)
+	user.blockedContactsLock.Lock()
+	prev := user.loadBlockedContacts()
+	for jid := range blocked {
+		if _, wasBlocked := prev[jid]; !wasBlocked {
+			changes[jid] = true
+		}
+	}
+	for jid := range prev {
+		if _, isBlocked := blocked[jid]; !isBlocked {
+			changes[jid] = false
+		}
+	}
+	user.blockedContacts = blocked
+	if len(changes) > 0 {
+		err = user.User.ReplaceBlockedContacts(blocked)
+	}
+	user.blockedContactsLock.Unlock()
+	if err != nil {
+		user.log.Warnln("Failed to save block list:", err)
+	}
+	for jid, isBlocked := range changes {
+		user.log.Debugfln("Block status of %s changed on WhatsApp (blocked: %t)", jid, isBlocked)
+		if portal := user.GetPortalByJID(jid); len(portal.MXID) > 0 {
+			portal.sendBlockStatusNotice(isBlocked)
+		}
+	}
+	return nil
+}
+
+func (user *User) tryRefreshBlocklist() {
+	if !user.IsLoggedIn() {
+		return
+	}
+	err := user.RefreshBlocklist()
+	if err != nil {
+		user.log.Warnln("Failed to refresh block list:", err)
+	}
+}
+
+func (user *User) blocklistRefreshLoop() {
+	for {
+		time.Sleep(blocklistRefreshInterval)
+		user.tryRefreshBlocklist()
+	}
+}
+
+func (portal *Portal) sendBlockStatusNotice(blocked bool) {
+	body := "This contact was unblocked on WhatsApp, messages will be bridged again."
+	if blocked {
+		body = "This contact was blocked on WhatsApp. Messages from them won't be bridged until you unblock them with the `unblock` command or on your phone."
+	}
+	_, err := portal.sendMainIntentMessage(&event.MessageEventContent{MsgType: event.MsgNotice, Body: body})
+	if err != nil {
+		portal.log.Warnln("Failed to send block status notice:", err)
+	}
+}
+
+// parseContactJID parses a phone number or user JID given to a command.
+func parseContactJID(input string) (types.JID, error) {
+	if strings.ContainsRune(input, '@') {
+		jid, err := types.ParseJID(input)
+		if err != nil || jid.Server != types.DefaultUserServer {
+			return jid, fmt.Errorf("%s is not a valid user JID", input)
+		}
+		return jid.ToNonAD(), nil
+	}
+	number := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, input)
+	if len(number) < 5 {
+		return types.EmptyJID, fmt.Errorf("%s is not a valid phone number", input)
+	}
+	return types.NewJID(number, types.DefaultUserServer), nil
+}
@@ -0,0 +1,133 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// BlurhashInfoKey is the key used to store the blurhash of media in the info object of Matrix events (MSC2448).
+const BlurhashInfoKey = "xyz.amorgan.blurhash"
+
+const (
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+	blurhashCharacters  = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+func blurhashEncode83(sb *strings.Builder, value, length int) {
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+	for i := 0; i < length; i++ {
+		sb.WriteByte(blurhashCharacters[(value/divisor)%83])
+		divisor /= 83
+	}
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value>>8) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+// encodeBlurhash computes the blurhash of the given image. The image should be small (e.g. a thumbnail),
+// as every pixel is visited once per component.
+func encodeBlurhash(img image.Image) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return ""
+	}
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*width+x] = [3]float64{sRGBToLinear(r), sRGBToLinear(g), sRGBToLinear(b)}
+		}
+	}
+
+	var factors [blurhashComponentsX * blurhashComponentsY][3]float64
+	for j := 0; j < blurhashComponentsY; j++ {
+		for i := 0; i < blurhashComponentsX; i++ {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					pixel := linear[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+			scale := normalization / float64(width*height)
+			factors[j*blurhashComponentsX+i] = [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale}
+		}
+	}
+
+	var sb strings.Builder
+	blurhashEncode83(&sb, (blurhashComponentsX-1)+(blurhashComponentsY-1)*9, 1)
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		var actualMaximum float64
+		for _, factor := range factors[1:] {
+			for _, channel := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(channel))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		blurhashEncode83(&sb, quantisedMaximum, 1)
+	} else {
+		blurhashEncode83(&sb, 0, 1)
+	}
+
+	dc := factors[0]
+	blurhashEncode83(&sb, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+
+	for _, factor := range factors[1:] {
+		var quant [3]int
+		for c, channel := range factor {
+			quant[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(channel/maximumValue, 0.5)*9+9.5))))
+		}
+		blurhashEncode83(&sb, quant[0]*19*19+quant[1]*19+quant[2], 2)
+	}
+	return sb.String()
+}
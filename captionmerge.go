@@ -0,0 +1,106 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type pendingCaptionMerge struct {
+	sender  *User
+	evt     *event.Event
+	timings messageTimings
+	timer   *time.Timer
+}
+
+func isCaptionMergeMedia(content *event.MessageEventContent) bool {
+	hasCaption := content.FileName != "" && content.FileName != content.Body
+	return (content.MsgType == event.MsgImage || content.MsgType == event.MsgVideo) && !hasCaption
+}
+
+func isCaptionMergeText(content *event.MessageEventContent) bool {
+	return content.MsgType == event.MsgText && content.RelatesTo == nil && len(content.Body) > 0
+}
+
+// holdForCaptionMerge handles Matrix clients that send the caption of an image or video as a separate text message.
+// Media without a caption is held back for a moment, and if the same user sends a text message right after it,
+// the text is sent to WhatsApp as the caption of the media. Returns true if the event shouldn't be handled now.
+func (portal *Portal) holdForCaptionMerge(sender *User, evt *event.Event, timings messageTimings) bool {
+	if !portal.bridge.Config.Bridge.CaptionMerge.Enabled || evt.Type != event.EventMessage {
+		return false
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return false
+	}
+	portal.captionMergeLock.Lock()
+	pending := portal.captionMerge
+	portal.captionMerge = nil
+	if pending != nil {
+		pending.timer.Stop()
+	}
+	if pending != nil && pending.sender == sender && isCaptionMergeText(content) {
+		portal.captionMergeLock.Unlock()
+		portal.log.Debugfln("Sending %s as the caption of %s", evt.ID, pending.evt.ID)
+		mediaContent := pending.evt.Content.Parsed.(*event.MessageEventContent)
+		if mediaContent.FileName == "" {
+			mediaContent.FileName = mediaContent.Body
+		}
+		mediaContent.Body = content.Body
+		mediaContent.Format = content.Format
+		mediaContent.FormattedBody = content.FormattedBody
+		portal.handleMatrixMessage(pending.sender, pending.evt, pending.timings)
+		// The text event itself isn't sent separately, but it was bridged as the caption
+		go portal.sendMessageMetrics(evt, nil, "", nil)
+		return true
+	}
+	held := false
+	if isCaptionMergeMedia(content) {
+		timeout := time.Duration(portal.bridge.Config.Bridge.CaptionMerge.Timeout) * time.Second
+		portal.captionMerge = &pendingCaptionMerge{
+			sender:  sender,
+			evt:     evt,
+			timings: timings,
+			timer: time.AfterFunc(timeout, func() {
+				// Flush through the portal loop to keep messages in order
+				portal.matrixMessages <- PortalMatrixMessage{user: sender, evt: evt, receivedAt: time.Now(), captionMergeFlush: true}
+			}),
+		}
+		held = true
+	}
+	portal.captionMergeLock.Unlock()
+	if pending != nil {
+		portal.handleMatrixMessage(pending.sender, pending.evt, pending.timings)
+	}
+	return held
+}
+
+// flushCaptionMerge sends held media after no caption arrived in time.
+func (portal *Portal) flushCaptionMerge(evtID id.EventID) {
+	portal.captionMergeLock.Lock()
+	pending := portal.captionMerge
+	if pending == nil || pending.evt.ID != evtID {
+		portal.captionMergeLock.Unlock()
+		return
+	}
+	portal.captionMerge = nil
+	portal.captionMergeLock.Unlock()
+	portal.handleMatrixMessage(pending.sender, pending.evt, pending.timings)
+}
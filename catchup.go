@@ -0,0 +1,118 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// offlineCatchUpState buffers the messages that WhatsApp delivers after reconnecting, between the offline sync
+// preview and completion events, so that they can be deduplicated and bridged in order once all of them have arrived.
+type offlineCatchUpState struct {
+	lock     sync.Mutex
+	active   bool
+	expected int
+	started  time.Time
+	messages []*events.Message
+	timer    *time.Timer
+}
+
+type catchUpMessageKey struct {
+	portal database.PortalKey
+	id     types.MessageID
+}
+
+func (user *User) startOfflineCatchUp(expected int) {
+	if !user.bridge.Config.Bridge.CatchUp.Enabled || expected <= 0 {
+		return
+	}
+	user.catchUp.lock.Lock()
+	defer user.catchUp.lock.Unlock()
+	if user.catchUp.active {
+		user.catchUp.expected += expected
+		return
+	}
+	user.catchUp.active = true
+	user.catchUp.expected = expected
+	user.catchUp.started = time.Now()
+	user.catchUp.messages = make([]*events.Message, 0, expected)
+	timeout := time.Duration(user.bridge.Config.Bridge.CatchUp.Timeout) * time.Second
+	user.catchUp.timer = time.AfterFunc(timeout, func() {
+		user.log.Warnfln("Offline sync didn't complete within %s, bridging buffered messages anyway", timeout)
+		user.finishOfflineCatchUp()
+	})
+}
+
+// bufferOfflineMessage stores the message for the catch-up phase and returns true, or returns false if
+// there's no catch-up in progress and the message should be handled normally.
+func (user *User) bufferOfflineMessage(evt *events.Message) bool {
+	user.catchUp.lock.Lock()
+	defer user.catchUp.lock.Unlock()
+	if !user.catchUp.active {
+		return false
+	}
+	user.catchUp.messages = append(user.catchUp.messages, evt)
+	return true
+}
+
+// finishOfflineCatchUp bridges the buffered offline messages oldest first, skipping any that are already in the
+// message table, and tells the user how many messages were recovered.
+func (user *User) finishOfflineCatchUp() {
+	user.catchUp.lock.Lock()
+	if !user.catchUp.active {
+		user.catchUp.lock.Unlock()
+		return
+	}
+	user.catchUp.active = false
+	user.catchUp.timer.Stop()
+	messages := user.catchUp.messages
+	expected := user.catchUp.expected
+	started := user.catchUp.started
+	user.catchUp.messages = nil
+	user.catchUp.lock.Unlock()
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Info.Timestamp.Before(messages[j].Info.Timestamp)
+	})
+	seen := make(map[catchUpMessageKey]struct{}, len(messages))
+	chats := make(map[database.PortalKey]struct{})
+	duplicates := 0
+	for _, evt := range messages {
+		portal := user.GetPortalByMessageSource(evt.Info.MessageSource)
+		key := catchUpMessageKey{portal.Key, evt.Info.ID}
+		if _, alreadySeen := seen[key]; alreadySeen || user.bridge.DB.Message.GetByJID(portal.Key, evt.Info.ID) != nil {
+			duplicates++
+			continue
+		}
+		seen[key] = struct{}{}
+		chats[portal.Key] = struct{}{}
+		portal.messages <- PortalMessage{evt: evt, source: user}
+	}
+	recovered := len(messages) - duplicates
+	user.log.Infofln("Offline catch-up finished in %s: %d/%d expected messages received, %d bridged in %d chats, %d duplicates skipped",
+		time.Since(started).Round(time.Millisecond), len(messages), expected, recovered, len(chats), duplicates)
+	if recovered > 0 {
+		go user.sendMarkdownBridgeAlert("Recovered %d messages in %d chats that were sent while the bridge was offline.", recovered, len(chats))
+	}
+}
@@ -0,0 +1,233 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+)
+
+// commandAPIWaitTimeout is how long the provisioning API waits for the background work of a command
+// (started with WrappedCommandEvent.Go) before responding that the command is still running.
+const commandAPIWaitTimeout = 30 * time.Second
+
+// commandCapture collects the replies of a bot command that was run through the provisioning API
+// instead of being sent to a Matrix room.
+type commandCapture struct {
+	lock      sync.Mutex
+	replies   []string
+	reactions []string
+	running   sync.WaitGroup
+}
+
+var (
+	// apiCommands contains all registered bot commands by name and alias.
+	apiCommands = make(map[string]*commands.FullHandler)
+	// commandCaptures maps API-initiated command events to their captures, so that wrapCommand can find them.
+	commandCaptures sync.Map
+)
+
+// matrixOnlyCommands are commands that send images or files, or otherwise need a real Matrix room to work.
+var matrixOnlyCommands = map[string]string{
+	"login":      "use the /v1/login endpoint instead",
+	"create":     "it converts the Matrix room it's used in into a WhatsApp group",
+	"debug-logs": "the logs are sent as a file to the Matrix room",
+}
+
+func indexAPICommands(handlers []commands.Handler) {
+	for _, handler := range handlers {
+		fullHandler, ok := handler.(*commands.FullHandler)
+		if !ok {
+			continue
+		}
+		apiCommands[fullHandler.Name] = fullHandler
+		for _, alias := range fullHandler.Aliases {
+			apiCommands[alias] = fullHandler
+		}
+	}
+}
+
+// Reply sends a reply to the command, or stores it in the capture if the command was run through the provisioning API.
+func (ce *WrappedCommandEvent) Reply(msg string, args ...interface{}) {
+	if ce.capture == nil {
+		ce.Event.Reply(msg, args...)
+		return
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	ce.capture.lock.Lock()
+	ce.capture.replies = append(ce.capture.replies, strings.TrimSpace(msg))
+	ce.capture.lock.Unlock()
+}
+
+// React reacts to the command, or stores the reaction in the capture if the command was run through the provisioning API.
+func (ce *WrappedCommandEvent) React(key string) {
+	if ce.capture == nil {
+		ce.Event.React(key)
+		return
+	}
+	ce.capture.lock.Lock()
+	ce.capture.reactions = append(ce.capture.reactions, key)
+	ce.capture.lock.Unlock()
+}
+
+// Go runs background work of a command. Commands run through the provisioning API wait for the work
+// to finish, so that replies sent from it are included in the response.
+func (ce *WrappedCommandEvent) Go(fn func()) {
+	if ce.capture == nil {
+		go fn()
+		return
+	}
+	ce.capture.running.Add(1)
+	go func() {
+		defer ce.capture.running.Done()
+		fn()
+	}()
+}
+
+type ReqCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	RoomID  string   `json:"room_id,omitempty"`
+	ReplyTo string   `json:"reply_to,omitempty"`
+}
+
+type RespCommand struct {
+	Success   bool     `json:"success"`
+	Command   string   `json:"command"`
+	Replies   []string `json:"replies"`
+	Reactions []string `json:"reactions,omitempty"`
+	// Running is true if the command is still running in the background. Replies sent after the response aren't returned.
+	Running bool `json:"running,omitempty"`
+}
+
+// RunCommand runs a bot command as the authenticated user and returns the replies it would have sent to Matrix.
+// The same permission checks are applied as for commands sent to the bridge bot.
+func (prov *ProvisioningAPI) RunCommand(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	var req ReqCommand
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Command) == 0 {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Request body must be a JSON object with a command field",
+			ErrCode: "bad json",
+		})
+		return
+	}
+	name := strings.ToLower(req.Command)
+	handler, ok := apiCommands[name]
+	if !ok {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   fmt.Sprintf("Unknown command %q", req.Command),
+			ErrCode: "M_NOT_FOUND",
+		})
+		return
+	} else if reason, matrixOnly := matrixOnlyCommands[handler.Name]; matrixOnly {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("The %s command can't be used through the API: %s", handler.Name, reason),
+			ErrCode: "unsupported command",
+		})
+		return
+	} else if !user.Whitelisted {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You don't have permission to use this bridge",
+			ErrCode: "M_FORBIDDEN",
+		})
+		return
+	} else if handler.RequiresAdmin && !user.Admin {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "That command is limited to bridge administrators",
+			ErrCode: "M_FORBIDDEN",
+		})
+		return
+	} else if handler.RequiresLogin && !user.IsLoggedIn() {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "That command requires you to be logged in",
+			ErrCode: "not logged in",
+		})
+		return
+	}
+
+	var portal *Portal
+	if len(req.RoomID) > 0 {
+		portal = prov.bridge.GetPortalByMXID(id.RoomID(req.RoomID))
+		if portal == nil || !prov.bridge.StateStore.IsInRoom(portal.MXID, user.MXID) {
+			jsonResponse(w, http.StatusNotFound, Error{
+				Error:   "Portal room not found or you're not in it",
+				ErrCode: "M_NOT_FOUND",
+			})
+			return
+		}
+	} else if handler.RequiresPortal {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "That command must be used with the room_id of a portal",
+			ErrCode: "portal required",
+		})
+		return
+	}
+
+	ce := &commands.Event{
+		Bot:     prov.bridge.Bot,
+		Bridge:  &prov.bridge.Bridge,
+		User:    user,
+		Command: name,
+		Args:    req.Args,
+		RawArgs: strings.Join(req.Args, " "),
+		ReplyTo: id.EventID(req.ReplyTo),
+		Log:     prov.log.Sub("Command"),
+	}
+	if portal != nil {
+		ce.Portal = portal
+		ce.RoomID = portal.MXID
+	}
+	capture := &commandCapture{}
+	commandCaptures.Store(ce, capture)
+	prov.log.Debugfln("%s is running command %s %v through the provisioning API", user.MXID, name, req.Args)
+	handler.Func(ce)
+
+	finished := make(chan struct{})
+	go func() {
+		capture.running.Wait()
+		// The capture is only removed after background work finishes, so that late replies aren't sent to Matrix
+		commandCaptures.Delete(ce)
+		close(finished)
+	}()
+	var running bool
+	select {
+	case <-finished:
+	case <-time.After(commandAPIWaitTimeout):
+		running = true
+	}
+
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	resp := RespCommand{
+		Success:   true,
+		Command:   handler.Name,
+		Replies:   append([]string{}, capture.replies...),
+		Reactions: capture.reactions,
+		Running:   running,
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
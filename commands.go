@@ -30,9 +30,12 @@ import (
 
 	"github.com/skip2/go-qrcode"
 	"github.com/tidwall/gjson"
+	"google.golang.org/protobuf/proto"
 
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/types"
 
 	"maunium.net/go/mautrix"
@@ -50,35 +53,64 @@ type WrappedCommandEvent struct {
 	Bridge *WABridge
 	User   *User
 	Portal *Portal
+
+	// capture is set when the command was run through the provisioning API
+	capture *commandCapture
 }
 
 func (br *WABridge) RegisterCommands() {
 	proc := br.CommandProcessor.(*commands.Processor)
-	proc.AddHandlers(
+	handlers := []commands.Handler{
 		cmdSetRelay,
 		cmdUnsetRelay,
 		cmdInviteLink,
 		cmdResolveLink,
 		cmdJoin,
 		cmdAccept,
+		cmdImportStickers,
+		cmdSticker,
 		cmdCreate,
 		cmdLogin,
+		cmdRequestHistory,
+		cmdDeviceName,
 		cmdLogout,
 		cmdTogglePresence,
+		cmdToggleDMPortals,
 		cmdDeleteSession,
 		cmdReconnect,
+		cmdDebugLogs,
 		cmdDisconnect,
 		cmdPing,
+		cmdWarmup,
+		cmdQueue,
+		cmdErrors,
+		cmdTestSend,
 		cmdDeletePortal,
+		cmdUndeletePortal,
 		cmdDeleteAllPortals,
+		cmdCleanupPortals,
 		cmdBackfill,
 		cmdList,
 		cmdSearch,
 		cmdOpen,
 		cmdPM,
+		cmdBlock,
+		cmdUnblock,
+		cmdContactNumberChanged,
+		cmdMigrateOwnNumber,
+		cmdSelfChat,
 		cmdSync,
+		cmdSyncStatus,
 		cmdDisappearingTimer,
-	)
+		cmdKick,
+		cmdPromote,
+		cmdDemote,
+		cmdSetGroupName,
+		cmdSetGroupPhoto,
+		cmdSetNoticeLanguage,
+	}
+	proc.AddHandlers(handlers...)
+	indexAPICommands(handlers)
 }
 
 func wrapCommand(handler func(*WrappedCommandEvent)) func(*commands.Event) {
@@ -89,7 +121,11 @@ func wrapCommand(handler func(*WrappedCommandEvent)) func(*commands.Event) {
 			portal = ce.Portal.(*Portal)
 		}
 		br := ce.Bridge.Child.(*WABridge)
-		handler(&WrappedCommandEvent{ce, br, user, portal})
+		var capture *commandCapture
+		if val, ok := commandCaptures.Load(ce); ok {
+			capture = val.(*commandCapture)
+		}
+		handler(&WrappedCommandEvent{ce, br, user, portal, capture})
 	}
 }
 
@@ -118,8 +154,10 @@ func fnSetRelay(ce *WrappedCommandEvent) {
 	} else if ce.Bridge.Config.Bridge.Relay.AdminOnly && !ce.User.Admin {
 		ce.Reply("Only admins are allowed to enable relay mode on this instance of the bridge")
 	} else {
+		prevRelayUserID := ce.Portal.RelayUserID
 		ce.Portal.RelayUserID = ce.User.MXID
 		ce.Portal.Update(nil)
+		ce.Portal.LogPortalChange("relay_user_id", prevRelayUserID, ce.Portal.RelayUserID)
 		ce.Reply("Messages from non-logged-in users in this room will now be bridged through your WhatsApp account")
 	}
 }
@@ -140,8 +178,10 @@ func fnUnsetRelay(ce *WrappedCommandEvent) {
 	} else if ce.Bridge.Config.Bridge.Relay.AdminOnly && !ce.User.Admin {
 		ce.Reply("Only admins are allowed to enable relay mode on this instance of the bridge")
 	} else {
+		prevRelayUserID := ce.Portal.RelayUserID
 		ce.Portal.RelayUserID = ""
 		ce.Portal.Update(nil)
+		ce.Portal.LogPortalChange("relay_user_id", prevRelayUserID, ce.Portal.RelayUserID)
 		ce.Reply("Messages from non-logged-in users will no longer be bridged in this room")
 	}
 }
@@ -275,8 +315,9 @@ func parseInviteMeta(data json.RawMessage) (*InviteMeta, error) {
 }
 
 var cmdAccept = &commands.FullHandler{
-	Func: wrapCommand(fnAccept),
-	Name: "accept",
+	Func:    wrapCommand(fnAccept),
+	Name:    "accept",
+	Aliases: []string{"accept-invite"},
 	Help: commands.HelpMeta{
 		Section:     HelpSectionInvites,
 		Description: "Accept a group invite. This can only be used in reply to a group invite message.",
@@ -296,32 +337,129 @@ func fnAccept(ce *WrappedCommandEvent) {
 		ce.Reply("Failed to decrypt reply event")
 	} else if meta, err := parseInviteMeta(rawContent); err != nil || meta == nil {
 		ce.Reply("That doesn't look like a group invite message.")
-	} else if meta.Inviter.User == ce.User.JID.User {
-		ce.Reply("You can't accept your own invites")
-	} else if err = ce.User.Client.JoinGroupWithInvite(meta.JID, meta.Inviter, meta.Code, meta.Expiration); err != nil {
+	} else if err = ce.User.acceptGroupInvite(meta); err != nil {
 		ce.Reply("Failed to accept group invite: %v", err)
 	} else {
 		ce.Reply("Successfully accepted the invite, the portal should be created momentarily")
 	}
 }
 
+var cmdImportStickers = &commands.FullHandler{
+	Func: wrapCommand(fnImportStickers),
+	Name: "import-stickers",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Import a Matrix or Telegram sticker pack (MSC2545 or stickerpicker JSON) to send as WhatsApp stickers.",
+		Args:        "<_pack mxc:// URI_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnImportStickers(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `import-stickers <pack mxc:// URI>`\n\nUpload the pack JSON file to Matrix first to get its mxc:// URI.")
+		return
+	}
+	ce.Reply("Importing sticker pack, this may take a while...")
+	name, imported, err := ce.User.ImportStickerPack(context.Background(), ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to import sticker pack: %v", err)
+		return
+	}
+	ce.Reply("Imported %d stickers from %s. Use `sticker <shortcode>` to send them.", imported, name)
+}
+
+var cmdSticker = &commands.FullHandler{
+	Func: wrapCommand(fnSticker),
+	Name: "sticker",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Send an imported sticker to the current chat, or list imported stickers.",
+		Args:        "[_shortcode_]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnSticker(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		stickers := ce.Bridge.DB.Sticker.GetAll(ce.User.MXID)
+		if len(stickers) == 0 {
+			ce.Reply("You haven't imported any stickers. Use `import-stickers` to import a pack.")
+			return
+		}
+		var lines []string
+		var lastPack string
+		for _, sticker := range stickers {
+			if sticker.Pack != lastPack {
+				lines = append(lines, fmt.Sprintf("**%s** (`%s`)", sticker.Pack, stickerSlug(sticker.Pack)))
+				lastPack = sticker.Pack
+			}
+			lines = append(lines, fmt.Sprintf("* `%s` - %s", sticker.Shortcode, sticker.Body))
+		}
+		ce.Reply(strings.Join(lines, "\n"))
+		return
+	}
+	sticker, err := ce.User.findSticker(ce.Args[0])
+	if err != nil {
+		ce.Reply("%v", err)
+	} else if err = ce.Portal.SendStoredSticker(ce.User, sticker); err != nil {
+		ce.Reply("Failed to send sticker: %v", err)
+	}
+}
+
 var cmdCreate = &commands.FullHandler{
-	Func: wrapCommand(fnCreate),
-	Name: "create",
+	Func:    wrapCommand(fnCreate),
+	Name:    "create",
+	Aliases: []string{"create-group"},
 	Help: commands.HelpMeta{
 		Section:     HelpSectionCreatingPortals,
-		Description: "Create a WhatsApp group chat for the current Matrix room.",
+		Description: "Create a WhatsApp group chat for the current Matrix room. Joined and invited WhatsApp users are added to the group.",
+		Args:        "[_group name_]",
 	},
 	RequiresLogin: true,
 }
 
+// getCreateGroupParticipants returns the WhatsApp users that should be added to a group created from the
+// given room. Ghosts that were only invited are included too, since they can't accept the invite before
+// the group exists on WhatsApp.
+func getCreateGroupParticipants(ce *WrappedCommandEvent) ([]types.JID, error) {
+	members, err := ce.Bot.Members(ce.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	var participants []types.JID
+	participantDedup := make(map[types.JID]bool)
+	participantDedup[ce.User.JID.ToNonAD()] = true
+	participantDedup[types.EmptyJID] = true
+	for _, evt := range members.Chunk {
+		membership, _ := evt.Content.Raw["membership"].(string)
+		if evt.StateKey == nil || (membership != string(event.MembershipJoin) && membership != string(event.MembershipInvite)) {
+			continue
+		}
+		userID := id.UserID(*evt.StateKey)
+		jid, ok := ce.Bridge.ParsePuppetMXID(userID)
+		if !ok {
+			user := ce.Bridge.GetUserByMXID(userID)
+			if user != nil && !user.JID.IsEmpty() {
+				jid = user.JID.ToNonAD()
+			}
+		}
+		if !participantDedup[jid] {
+			participantDedup[jid] = true
+			participants = append(participants, jid)
+		}
+	}
+	return participants, nil
+}
+
 func fnCreate(ce *WrappedCommandEvent) {
 	if ce.Portal != nil {
 		ce.Reply("This is already a portal room")
 		return
 	}
 
-	members, err := ce.Bot.JoinedMembers(ce.RoomID)
+	participants, err := getCreateGroupParticipants(ce)
 	if err != nil {
 		ce.Reply("Failed to get room members: %v", err)
 		return
@@ -333,8 +471,15 @@ func fnCreate(ce *WrappedCommandEvent) {
 		ce.Log.Errorln("Failed to get room name to create group:", err)
 		ce.Reply("Failed to get room name")
 		return
+	}
+	if name := strings.TrimSpace(strings.Join(ce.Args, " ")); len(name) > 0 && name != roomNameEvent.Name {
+		roomNameEvent.Name = name
+		_, err = ce.Bot.SendStateEvent(ce.RoomID, event.StateRoomName, "", &roomNameEvent)
+		if err != nil {
+			ce.Log.Warnln("Failed to set room name to match created group:", err)
+		}
 	} else if len(roomNameEvent.Name) == 0 {
-		ce.Reply("Please set a name for the room first")
+		ce.Reply("Please set a name for the room first, or pass the group name to the command")
 		return
 	}
 
@@ -345,22 +490,10 @@ func fnCreate(ce *WrappedCommandEvent) {
 		return
 	}
 
-	var participants []types.JID
-	participantDedup := make(map[types.JID]bool)
-	participantDedup[ce.User.JID.ToNonAD()] = true
-	participantDedup[types.EmptyJID] = true
-	for userID := range members.Joined {
-		jid, ok := ce.Bridge.ParsePuppetMXID(userID)
-		if !ok {
-			user := ce.Bridge.GetUserByMXID(userID)
-			if user != nil && !user.JID.IsEmpty() {
-				jid = user.JID.ToNonAD()
-			}
-		}
-		if !participantDedup[jid] {
-			participantDedup[jid] = true
-			participants = append(participants, jid)
-		}
+	var avatarEvent event.RoomAvatarEventContent
+	err = ce.Bot.StateEvent(ce.RoomID, event.StateRoomAvatar, "", &avatarEvent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		ce.Log.Warnln("Failed to get room avatar to create group:", err)
 	}
 
 	ce.Log.Infofln("Creating group for %s with name %s and participants %+v", ce.RoomID, roomNameEvent.Name, participants)
@@ -392,10 +525,29 @@ func fnCreate(ce *WrappedCommandEvent) {
 		portal.Encrypted = true
 	}
 
+	if !avatarEvent.URL.IsEmpty() {
+		portal.setGroupPhotoFromRoom(ce.User, avatarEvent.URL)
+	}
+
 	portal.Update(nil)
 	portal.UpdateBridgeInfo()
+	portal.UpdateMatrixRoom(ce.User, resp)
 
-	ce.Reply("Successfully created WhatsApp group %s", portal.Key.JID)
+	added := make(map[string]bool, len(resp.Participants))
+	for _, participant := range resp.Participants {
+		added[participant.JID.User] = true
+	}
+	var missing []string
+	for _, jid := range participants {
+		if !added[jid.User] {
+			missing = append(missing, "+"+jid.User)
+		}
+	}
+	if len(missing) > 0 {
+		ce.Reply("Successfully created WhatsApp group %s, but these users couldn't be added: %s", portal.Key.JID, strings.Join(missing, ", "))
+	} else {
+		ce.Reply("Successfully created WhatsApp group %s", portal.Key.JID)
+	}
 }
 
 var cmdLogin = &commands.FullHandler{
@@ -417,7 +569,7 @@ func fnLogin(ce *WrappedCommandEvent) {
 		return
 	}
 
-	qrChan, err := ce.User.Login(context.Background())
+	qrChan, err := ce.User.Login(context.Background(), ce.User.WantsFullHistorySync())
 	if err != nil {
 		ce.User.log.Errorf("Failed to log in:", err)
 		ce.Reply("Failed to log in: %v", err)
@@ -425,6 +577,7 @@ func fnLogin(ce *WrappedCommandEvent) {
 	}
 
 	var qrEventID id.EventID
+	defer ce.User.SetLoginQR("", 0)
 	for item := range qrChan {
 		switch item.Event {
 		case whatsmeow.QRChannelSuccess.Event:
@@ -441,6 +594,7 @@ func fnLogin(ce *WrappedCommandEvent) {
 		case "error":
 			ce.Reply("Failed to log in: %v", item.Error)
 		case "code":
+			ce.User.SetLoginQR(item.Code, item.Timeout)
 			qrEventID = ce.User.sendQR(ce, item.Code, qrEventID)
 		}
 	}
@@ -488,12 +642,120 @@ func (user *User) uploadQR(ce *WrappedCommandEvent, code string) (id.ContentURI,
 	return resp.ContentURI, true
 }
 
+var cmdDebugLogs = &commands.FullHandler{
+	Func: wrapCommand(fnDebugLogs),
+	Name: "debug-logs",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Write debug logs of your session to the bridge log for the given duration. Admins can enable them for other users.",
+		Args:        "<_duration_> [_Matrix user ID_]",
+	},
+}
+
+func fnDebugLogs(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `debug-logs <duration> [Matrix user ID]`")
+		return
+	}
+	duration, err := time.ParseDuration(ce.Args[0])
+	if err != nil || duration <= 0 {
+		ce.Reply("Invalid duration %q, use a format like `5m`", ce.Args[0])
+		return
+	} else if duration > maxDebugLogDuration {
+		ce.Reply("Debug logs can be enabled for at most %s", formatDuration(maxDebugLogDuration))
+		return
+	}
+	target := ce.User
+	if len(ce.Args) > 1 {
+		if !ce.User.Admin {
+			ce.Reply("Only bridge admins can enable debug logs for other users")
+			return
+		}
+		target = ce.Bridge.GetUserByMXIDIfExists(id.UserID(ce.Args[1]))
+		if target == nil {
+			ce.Reply("User %s not found", ce.Args[1])
+			return
+		}
+	}
+	if err = target.EnableDebugLogs(duration); err != nil {
+		ce.Reply("Failed to enable debug logs: %v", err)
+	} else {
+		ce.Reply("Debug logs of %s will be written to the bridge log for the next %s", target.MXID, formatDuration(duration))
+	}
+}
+
+var cmdRequestHistory = &commands.FullHandler{
+	Func: wrapCommand(fnRequestHistory),
+	Name: "request-history",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Request a full history sync (up to a year of messages) on your next login, instead of only recent chats.",
+		Args:        "[on | off]",
+	},
+}
+
+func fnRequestHistory(ce *WrappedCommandEvent) {
+	if ce.User.Session != nil {
+		ce.Reply("WhatsApp only sends history when a device is linked. " +
+			"To get the full history, `logout`, run `request-history` and then `login` again.")
+		return
+	}
+	requestFullHistory := true
+	if len(ce.Args) > 0 {
+		switch strings.ToLower(ce.Args[0]) {
+		case "on", "true", "yes":
+		case "off", "false", "no":
+			requestFullHistory = false
+		default:
+			ce.Reply("**Usage:** `request-history [on | off]`")
+			return
+		}
+	}
+	ce.User.Settings.RequestFullHistory = &requestFullHistory
+	ce.User.Settings.Upsert()
+	if ce.User.WantsFullHistorySync() {
+		ce.Reply("Your next login will request a full history sync. Use `login` to link your WhatsApp account.")
+	} else {
+		ce.Reply("Your next login will only sync recent chats.")
+	}
+}
+
+var cmdDeviceName = &commands.FullHandler{
+	Func: wrapCommand(fnDeviceName),
+	Name: "device-name",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "View or change the name shown for the bridge in the linked devices list of the WhatsApp app.",
+		Args:        "[<name> | reset]",
+	},
+}
+
+func fnDeviceName(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Your linked device will be called `%s`.", ce.User.DeviceName())
+		return
+	}
+	name := strings.TrimSpace(strings.Join(ce.Args, " "))
+	if strings.ToLower(name) == "reset" {
+		name = ""
+	} else if len(name) > maxDeviceNameLength {
+		ce.Reply("The device name can't be longer than %d characters.", maxDeviceNameLength)
+		return
+	}
+	ce.User.SetDeviceName(name)
+	ce.Reply("Your linked device will be called `%s`.", ce.User.DeviceName())
+	if ce.User.Session != nil {
+		ce.Reply("WhatsApp only receives the device name when linking, so it will be used the next time you log in.")
+	}
+}
+
 var cmdLogout = &commands.FullHandler{
 	Func: wrapCommand(fnLogout),
 	Name: "logout",
 	Help: commands.HelpMeta{
 		Section:     commands.HelpSectionAuth,
-		Description: "Unlink the bridge from your WhatsApp account.",
+		Description: "Unlink the bridge from your WhatsApp account. Optionally choose what to do with your portal rooms.",
+		Args:        "[keep|leave|read-only|delete]",
 	},
 }
 
@@ -505,6 +767,24 @@ func fnLogout(ce *WrappedCommandEvent) {
 		ce.Reply("You are not connected to WhatsApp. Use the `reconnect` command to reconnect, or `delete-session` to forget all login information.")
 		return
 	}
+	cleanupMode := ce.Bridge.DefaultLogoutCleanupMode()
+	if len(ce.Args) > 0 {
+		var ok bool
+		cleanupMode, ok = ParseLogoutCleanupMode(ce.Args[0])
+		if !ok {
+			ce.Reply("**Usage:** `logout [keep|leave|read-only|delete]`\n\n" +
+				"* `keep` leaves your portal rooms as they are.\n" +
+				"* `leave` kicks you and the WhatsApp users from the rooms.\n" +
+				"* `read-only` keeps the rooms, but prevents sending messages in them.\n" +
+				"* `delete` leaves the rooms and deletes the portals and their messages from the bridge.\n\n" +
+				"Portals shared with other logged-in users are not modified, but you will be kicked from them in the `leave` and `delete` modes.")
+			return
+		}
+	}
+	var cleanupPortals []*Portal
+	if cleanupMode != LogoutCleanupKeep {
+		cleanupPortals = ce.User.getLogoutCleanupPortals()
+	}
 	puppet := ce.Bridge.GetPuppetByJID(ce.User.JID)
 	if puppet.CustomMXID != "" {
 		err := puppet.SwitchCustomMXID("", "")
@@ -522,7 +802,15 @@ func fnLogout(ce *WrappedCommandEvent) {
 	ce.User.removeFromJIDMap(status.BridgeState{StateEvent: status.StateLoggedOut})
 	ce.User.DeleteConnection()
 	ce.User.DeleteSession()
-	ce.Reply("Logged out successfully.")
+	if cleanupMode == LogoutCleanupKeep {
+		ce.Reply("Logged out successfully.")
+		return
+	}
+	ce.Reply("Logged out successfully. Cleaning up portal rooms in the background (mode: `%s`)...", cleanupMode)
+	ce.Go(func() {
+		result := ce.User.CleanupPortalsAfterLogout(cleanupPortals, cleanupMode)
+		ce.Reply("Finished cleaning up %d portals. You were kicked from %d portals shared with other users.", result.Cleaned, result.Left)
+	})
 }
 
 var cmdTogglePresence = &commands.FullHandler{
@@ -560,6 +848,40 @@ func fnTogglePresence(ce *WrappedCommandEvent) {
 		}
 	}
 	customPuppet.Update()
+	enablePresence := customPuppet.EnablePresence
+	ce.User.Settings.EnablePresence = &enablePresence
+	ce.User.Settings.Upsert()
+}
+
+var cmdToggleDMPortals = &commands.FullHandler{
+	Func: wrapCommand(fnToggleDMPortals),
+	Name: "toggle-dm-portals",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Toggle automatically creating private chat portals for all contacts after login.",
+	},
+}
+
+func fnToggleDMPortals(ce *WrappedCommandEvent) {
+	enabled := !ce.User.ShouldAutoCreateDMPortals()
+	ce.User.AutoCreateDMPortals = &enabled
+	ce.User.Update()
+	if !enabled {
+		ce.Reply("Disabled automatically creating private chat portals for contacts")
+		return
+	}
+	ce.Reply("Enabled automatically creating private chat portals for contacts")
+	if ce.User.IsLoggedIn() {
+		ce.Reply("Creating portals for existing contacts in the background...")
+		ce.Go(func() {
+			err := ce.User.CreateContactPortals()
+			if err != nil {
+				ce.Reply("Failed to create portals for contacts: %v", err)
+			} else {
+				ce.Reply("Finished creating portals for contacts")
+			}
+		})
+	}
 }
 
 var cmdDeleteSession = &commands.FullHandler{
@@ -627,11 +949,12 @@ func fnDisconnect(ce *WrappedCommandEvent) {
 }
 
 var cmdPing = &commands.FullHandler{
-	Func: wrapCommand(fnPing),
-	Name: "ping",
+	Func:    wrapCommand(fnPing),
+	Name:    "ping",
+	Aliases: []string{"status"},
 	Help: commands.HelpMeta{
 		Section:     HelpSectionConnectionManagement,
-		Description: "Check your connection to WhatsApp.",
+		Description: "Check your connection to WhatsApp and show diagnostic info about your session.",
 	},
 }
 
@@ -642,13 +965,257 @@ func fnPing(ce *WrappedCommandEvent) {
 		} else {
 			ce.Reply("You're not logged into WhatsApp.")
 		}
-	} else if ce.User.Client == nil || !ce.User.Client.IsConnected() {
-		ce.Reply("You're logged in as +%s (device #%d), but you don't have a WhatsApp connection.", ce.User.JID.User, ce.User.JID.Device)
+		return
+	}
+	var report strings.Builder
+	report.WriteString("#### WhatsApp bridge status\n\n")
+	for _, row := range getStatusReport(ce.User) {
+		_, _ = fmt.Fprintf(&report, "* **%s:** %s\n", row[0], row[1])
+	}
+	ce.Reply(report.String())
+}
+
+// getStatusReport collects the details that are useful for diagnosing connection problems as label-value pairs.
+func getStatusReport(user *User) (rows [][2]string) {
+	add := func(label, value string, args ...interface{}) {
+		rows = append(rows, [2]string{label, fmt.Sprintf(value, args...)})
+	}
+
+	add("Account", "+%s (device #%d)", user.JID.User, user.JID.Device)
+	if user.Client == nil || !user.Client.IsConnected() {
+		add("Connection", "not connected to WhatsApp")
+	} else if !user.Client.IsLoggedIn() {
+		add("Connection", "connected, but not logged in")
+	} else {
+		add("Connection", "connected")
+	}
+	if user.BridgeState != nil {
+		state := user.BridgeState.GetPrev()
+		if len(state.StateEvent) > 0 {
+			value := string(state.StateEvent)
+			if len(state.Error) > 0 {
+				value += fmt.Sprintf(" (%s)", state.Error)
+			}
+			if len(state.Message) > 0 {
+				value += ": " + state.Message
+			}
+			add("Bridge state", value)
+		}
+	}
+
+	if len(user.Session.PushName) > 0 {
+		add("Name", user.Session.PushName)
+	}
+	if len(user.Session.Platform) > 0 {
+		add("Phone platform", user.Session.Platform)
+	} else {
+		add("Phone platform", "unknown")
+	}
+	add("Linked device name", user.DeviceName())
+	add("WhatsApp web version", store.GetWAVersion().String())
+	if user.PhoneLastSeen.IsZero() {
+		add("Phone last seen", "never")
 	} else {
-		ce.Reply("Logged in as +%s (device #%d), connection to WhatsApp OK (probably)", ce.User.JID.User, ce.User.JID.Device)
-		if !ce.User.PhoneRecentlySeen(false) {
-			ce.Reply("Phone hasn't been seen in %s", formatDisconnectTime(time.Now().Sub(ce.User.PhoneLastSeen)))
+		add("Phone last seen", "%s ago", formatDuration(time.Since(user.PhoneLastSeen)))
+	}
+
+	if lastSync, lastSyncName := user.getLastAppStateSync(); lastSync.IsZero() {
+		add("Last app state sync", "not since the bridge was started")
+	} else {
+		add("Last app state sync", "%s ago (%s)", formatDuration(time.Since(lastSync)), lastSyncName)
+	}
+	add("Send queue", "%d messages waiting for a connection", len(user.OfflineQueue()))
+
+	backfill := user.GetBackfillProgress()
+	if !backfill.Enabled {
+		add("Backfill", "disabled")
+	} else if backfill.RemainingJobs == 0 && backfill.DeferredMedia == 0 {
+		add("Backfill", "idle")
+	} else {
+		value := fmt.Sprintf("%d jobs and %d deferred media downloads remaining", backfill.RemainingJobs, backfill.DeferredMedia)
+		if backfill.ETASeconds > 0 {
+			value += fmt.Sprintf(", about %s left", formatDuration(time.Duration(backfill.ETASeconds)*time.Second))
+		}
+		add("Backfill", value)
+	}
+	return
+}
+
+var cmdWarmup = &commands.FullHandler{
+	Func: wrapCommand(fnWarmup),
+	Name: "warmup",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Check the sending limits of a newly linked WhatsApp account, or end the warmup period early (admin only).",
+		Args:        "[end [_Matrix user ID_]]",
+	},
+	RequiresLogin: true,
+}
+
+func fnWarmup(ce *WrappedCommandEvent) {
+	target := ce.User
+	if len(ce.Args) > 0 && strings.ToLower(ce.Args[0]) == "end" {
+		if !ce.User.Admin {
+			ce.Reply("Only bridge admins can end the warmup period")
+			return
+		} else if len(ce.Args) > 1 {
+			target = ce.Bridge.GetUserByMXIDIfExists(id.UserID(ce.Args[1]))
+			if target == nil {
+				ce.Reply("User %s not found", ce.Args[1])
+				return
+			}
+		}
+		target.EndWarmup()
+		ce.Reply("Ended the warmup period of %s, outgoing messages are no longer limited", target.MXID)
+		return
+	} else if len(ce.Args) > 0 {
+		ce.Reply("**Usage:** `warmup [end [user ID]]`")
+		return
+	}
+	warmupEnd := target.WarmupEnd()
+	if warmupEnd.IsZero() {
+		ce.Reply("Your account isn't in the warmup period, outgoing messages are not limited")
+		return
+	}
+	cfg := ce.Bridge.Config.Bridge.Warmup
+	messages, newChats := target.WarmupUsage()
+	msg := fmt.Sprintf("Your WhatsApp account was linked recently, so outgoing messages are limited for %s more.\n\n", formatDuration(time.Until(warmupEnd)))
+	if cfg.MessagesPerHour > 0 {
+		msg += fmt.Sprintf("* Messages in the past hour: %d/%d\n", messages, cfg.MessagesPerHour)
+	}
+	if cfg.NewChatsPerDay > 0 {
+		msg += fmt.Sprintf("* New chats in the past day: %d/%d\n", newChats, cfg.NewChatsPerDay)
+	}
+	ce.Reply(msg)
+}
+
+var cmdQueue = &commands.FullHandler{
+	Func: wrapCommand(fnQueue),
+	Name: "queue",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "View messages waiting to be sent after reconnecting to WhatsApp, send them now or drop one of them.",
+		Args:        "[flush | drop <_queue ID_>]",
+	},
+}
+
+const queuePreviewLength = 50
+
+func fnQueue(ce *WrappedCommandEvent) {
+	if !ce.Bridge.Config.Bridge.OfflineQueue.Enabled {
+		ce.Reply("The offline queue is not enabled on this bridge, messages sent while disconnected fail immediately")
+		return
+	}
+	if len(ce.Args) > 0 {
+		switch strings.ToLower(ce.Args[0]) {
+		case "flush":
+			if !ce.User.IsLoggedIn() {
+				ce.Reply("You're not connected to WhatsApp, the queue will be sent automatically after reconnecting")
+			} else {
+				ce.Reply("Sending %d queued messages", ce.User.FlushOfflineQueue())
+			}
+		case "drop":
+			queueID, err := strconv.Atoi(strings.TrimPrefix(strings.Join(ce.Args[1:], ""), "#"))
+			if err != nil {
+				ce.Reply("**Usage:** `queue drop <queue ID>`")
+			} else if item := ce.User.DropQueuedMessage(queueID); item == nil {
+				ce.Reply("Message #%d not found in the queue", queueID)
+			} else {
+				ce.Reply("Removed message #%d from the queue", queueID)
+			}
+		default:
+			ce.Reply("**Usage:** `queue [flush | drop <queue ID>]`")
+		}
+		return
+	}
+	items := ce.User.OfflineQueue()
+	if len(items) == 0 {
+		ce.Reply("There are no messages waiting to be sent")
+		return
+	}
+	var portals []*Portal
+	byPortal := make(map[*Portal][]*queuedMessage)
+	for _, item := range items {
+		if _, ok := byPortal[item.Portal]; !ok {
+			portals = append(portals, item.Portal)
+		}
+		byPortal[item.Portal] = append(byPortal[item.Portal], item)
+	}
+	var msg strings.Builder
+	_, _ = fmt.Fprintf(&msg, "%d messages will be sent after reconnecting:\n", len(items))
+	for _, portal := range portals {
+		name := portal.Name
+		if len(name) == 0 {
+			name = portal.Key.JID.String()
 		}
+		_, _ = fmt.Fprintf(&msg, "\n**%s**\n\n", name)
+		for _, item := range byPortal[portal] {
+			preview := []rune(item.Event.Content.AsMessage().Body)
+			if len(preview) > queuePreviewLength {
+				preview = append(preview[:queuePreviewLength], '…')
+			}
+			_, _ = fmt.Fprintf(&msg, "* #%d (%s ago): %s\n", item.ID, formatDuration(time.Since(item.QueuedAt)), string(preview))
+		}
+	}
+	ce.Reply(msg.String())
+}
+
+var cmdErrors = &commands.FullHandler{
+	Func: wrapCommand(fnErrors),
+	Name: "errors",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Show a summary of homeserver API and WhatsApp sending errors since the bridge was started.",
+	},
+	RequiresAdmin: true,
+}
+
+func fnErrors(ce *WrappedCommandEvent) {
+	ce.Reply(ce.Bridge.Metrics.ErrorSummary())
+}
+
+var cmdTestSend = &commands.FullHandler{
+	Func: wrapCommand(fnTestSend),
+	Name: "test-send",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Send a test message to your own WhatsApp number and report how long each step took.",
+	},
+	RequiresLogin: true,
+}
+
+const testSendReceiptTimeout = 30 * time.Second
+
+func fnTestSend(ce *WrappedCommandEvent) {
+	if ce.User.Client == nil || !ce.User.Client.IsConnected() {
+		ce.Reply("You don't have a WhatsApp connection. Perhaps you wanted to `reconnect`?")
+		return
+	}
+	msgID := whatsmeow.GenerateMessageID()
+	receipts := ce.User.addTestSendWaiter(msgID)
+	defer ce.User.removeTestSendWaiter(msgID)
+
+	start := time.Now()
+	resp, err := ce.User.Client.SendMessage(context.Background(), ce.User.JID.ToNonAD(), msgID, &waProto.Message{
+		Conversation: proto.String(fmt.Sprintf("Bridge test message sent at %s", start.Format(time.RFC1123))),
+	})
+	ackDuration := niceRound(time.Since(start))
+	if err != nil {
+		ce.Reply("Failed to send test message: %v", err)
+		return
+	}
+	timings := resp.DebugTimings
+	ce.Reply("Test message `%s` was acknowledged by the WhatsApp server after %s "+
+		"(encrypt: %s, send: %s, server response: %s). Waiting for your phone to receive it...",
+		msgID, ackDuration, niceRound(timings.PeerEncrypt), niceRound(timings.Send), niceRound(timings.Resp))
+
+	select {
+	case receipt := <-receipts:
+		ce.Reply("Your device #%d received the test message %s after sending it (%s after the server acknowledged it).",
+			receipt.Sender.Device, niceRound(time.Since(start)), niceRound(time.Since(start)-ackDuration))
+	case <-time.After(testSendReceiptTimeout):
+		ce.Reply("None of your devices confirmed receiving the test message within %s. "+
+			"Check that your phone is online and connected to the internet.", testSendReceiptTimeout)
 	}
 }
 
@@ -696,24 +1263,77 @@ func fnDeletePortal(ce *WrappedCommandEvent) {
 	ce.Portal.Cleanup(false)
 }
 
-var cmdDeleteAllPortals = &commands.FullHandler{
-	Func: wrapCommand(fnDeleteAllPortals),
-	Name: "delete-all-portals",
+var cmdUndeletePortal = &commands.FullHandler{
+	Func: wrapCommand(fnUndeletePortal),
+	Name: "undelete-portal",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionPortalManagement,
-		Description: "Delete all portals.",
+		Description: "Restore a recently deleted portal and create a new room for it.",
+		Args:        "<_JID_>",
 	},
+	RequiresLogin: true,
 }
 
-func fnDeleteAllPortals(ce *WrappedCommandEvent) {
-	portals := ce.Bridge.GetAllPortals()
-	var portalsToDelete []*Portal
-
-	if ce.User.Admin {
-		portalsToDelete = portals
-	} else {
-		portalsToDelete = portals[:0]
-		for _, portal := range portals {
+func fnUndeletePortal(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `undelete-portal <JID>`")
+		return
+	} else if !ce.Bridge.DB.SoftDelete {
+		ce.Reply("Soft deletion is not enabled, so deleted portals can't be restored")
+		return
+	}
+	var jid types.JID
+	if strings.ContainsRune(ce.Args[0], '@') {
+		jid, _ = types.ParseJID(ce.Args[0])
+	} else if strings.ContainsRune(ce.Args[0], '-') || len(ce.Args[0]) >= 15 {
+		jid = types.NewJID(ce.Args[0], types.GroupServer)
+	} else {
+		jid = types.NewJID(strings.TrimPrefix(ce.Args[0], "+"), types.DefaultUserServer)
+	}
+	if jid.IsEmpty() {
+		ce.Reply("That does not look like a WhatsApp JID")
+		return
+	}
+	key := database.NewPortalKey(jid, ce.User.JID)
+	if ce.Bridge.DB.Portal.GetByJID(key) != nil {
+		ce.Reply("A portal for %s already exists", key.JID)
+		return
+	}
+	dbPortal := ce.Bridge.DB.Portal.GetDeleted(key)
+	if dbPortal == nil {
+		ce.Reply("No deleted portal found for %s. It may have been purged already.", key.JID)
+		return
+	} else if err := dbPortal.Undelete(); err != nil {
+		ce.Reply("Failed to restore portal: %v", err)
+		return
+	}
+	ce.Log.Infoln(ce.User.MXID, "restored deleted portal", key)
+	portal := ce.Bridge.GetPortalByJID(key)
+	if err := portal.CreateMatrixRoom(ce.User, nil, false, true); err != nil {
+		ce.Reply("Portal restored, but failed to create room: %v", err)
+	} else {
+		ce.Reply("Portal restored.")
+	}
+}
+
+var cmdDeleteAllPortals = &commands.FullHandler{
+	Func: wrapCommand(fnDeleteAllPortals),
+	Name: "delete-all-portals",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Delete all portals.",
+	},
+}
+
+func fnDeleteAllPortals(ce *WrappedCommandEvent) {
+	portals := ce.Bridge.GetAllPortals()
+	var portalsToDelete []*Portal
+
+	if ce.User.Admin {
+		portalsToDelete = portals
+	} else {
+		portalsToDelete = portals[:0]
+		for _, portal := range portals {
 			if canDeletePortal(portal, ce.User.MXID) {
 				portalsToDelete = append(portalsToDelete, portal)
 			}
@@ -749,12 +1369,72 @@ func fnDeleteAllPortals(ce *WrappedCommandEvent) {
 	}
 	ce.Reply("Finished deleting portal info. Now cleaning up rooms in background.")
 
-	go func() {
+	ce.Go(func() {
 		for _, portal := range portalsToDelete {
 			portal.Cleanup(false)
 		}
 		ce.Reply("Finished background cleanup of deleted portal rooms.")
-	}()
+	})
+}
+
+var cmdCleanupPortals = &commands.FullHandler{
+	Func: wrapCommand(fnCleanupPortals),
+	Name: "cleanup-portals",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Clean up portals whose WhatsApp group no longer exists or which you were removed from.",
+		Args:        "[--dry-run] [--leave]",
+	},
+	RequiresLogin: true,
+}
+
+func fnCleanupPortals(ce *WrappedCommandEvent) {
+	var dryRun, leave bool
+	for _, arg := range ce.Args {
+		switch strings.ToLower(arg) {
+		case "--dry-run":
+			dryRun = true
+		case "--leave":
+			leave = true
+		default:
+			ce.Reply("**Usage:** `cleanup-portals [--dry-run] [--leave]`")
+			return
+		}
+	}
+
+	portals := ce.Bridge.GetAllPortals()
+	if !ce.User.Admin {
+		filtered := portals[:0]
+		for _, portal := range portals {
+			if canDeletePortal(portal, ce.User.MXID) {
+				filtered = append(filtered, portal)
+			}
+		}
+		portals = filtered
+	}
+	ce.Reply("Checking %d portals, this may take a while...", len(portals))
+	dead := ce.Bridge.FindDeadPortals(portals)
+	if len(dead) == 0 {
+		ce.Reply("Didn't find any dead portals")
+		return
+	}
+	lines := make([]string, len(dead))
+	for i, portal := range dead {
+		name := portal.Portal.Name
+		if len(name) == 0 {
+			name = portal.Portal.Key.JID.String()
+		}
+		lines[i] = fmt.Sprintf("* [%s](https://matrix.to/#/%s): %s", name, portal.Portal.MXID, portal.Reason)
+	}
+	if dryRun {
+		ce.Reply("Found %d dead portals:\n\n%s\n\nRun `cleanup-portals` without `--dry-run` to clean them up.", len(dead), strings.Join(lines, "\n"))
+		return
+	}
+	ce.Reply("Cleaning up %d dead portals:\n\n%s", len(dead), strings.Join(lines, "\n"))
+	for _, portal := range dead {
+		ce.Bridge.CleanupDeadPortal(portal, leave)
+	}
+	ce.Reply("Finished cleaning up dead portals.")
 }
 
 var cmdBackfill = &commands.FullHandler{
@@ -762,39 +1442,48 @@ var cmdBackfill = &commands.FullHandler{
 	Name: "backfill",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionPortalManagement,
-		Description: "Backfill all messages the portal.",
-		Args:        "[_batch size_] [_batch delay_]",
+		Description: "Backfill older messages in the portal from the stored history sync data.",
+		Args:        "[_count_ | all] [_batch size_] [_batch delay_]",
 	},
 	RequiresPortal: true,
 }
 
 func fnBackfill(ce *WrappedCommandEvent) {
-	if !ce.Bridge.Config.Bridge.HistorySync.Backfill {
-		ce.Reply("Backfill is not enabled for this bridge.")
-		return
-	}
+	count := -1
 	batchSize := 100
 	batchDelay := 5
-	if len(ce.Args) >= 1 {
+	if len(ce.Args) >= 1 && strings.ToLower(ce.Args[0]) != "all" {
 		var err error
-		batchSize, err = strconv.Atoi(ce.Args[0])
-		if err != nil || batchSize < 1 {
-			ce.Reply("\"%s\" isn't a valid batch size", ce.Args[0])
+		count, err = strconv.Atoi(ce.Args[0])
+		if err != nil || count < 1 {
+			ce.Reply("\"%s\" isn't a valid message count", ce.Args[0])
 			return
 		}
 	}
 	if len(ce.Args) >= 2 {
 		var err error
-		batchDelay, err = strconv.Atoi(ce.Args[0])
-		if err != nil || batchSize < 0 {
-			ce.Reply("\"%s\" isn't a valid batch delay", ce.Args[1])
+		batchSize, err = strconv.Atoi(ce.Args[1])
+		if err != nil || batchSize < 1 {
+			ce.Reply("\"%s\" isn't a valid batch size", ce.Args[1])
 			return
 		}
 	}
-	backfillMessages := ce.Portal.bridge.DB.Backfill.NewWithValues(ce.User.MXID, database.BackfillImmediate, 0, &ce.Portal.Key, nil, batchSize, -1, batchDelay)
-	backfillMessages.Insert()
-
-	ce.User.BackfillQueue.ReCheck()
+	if len(ce.Args) >= 3 {
+		var err error
+		batchDelay, err = strconv.Atoi(ce.Args[2])
+		if err != nil || batchDelay < 0 {
+			ce.Reply("\"%s\" isn't a valid batch delay", ce.Args[2])
+			return
+		}
+	}
+	err := ce.User.RequestPortalBackfill(ce.Portal, count, batchSize, batchDelay)
+	if err != nil {
+		ce.Reply("Can't backfill: %v", err)
+	} else if count > 0 {
+		ce.Reply("Backfilling up to %d older messages", count)
+	} else {
+		ce.Reply("Backfilling all older messages")
+	}
 }
 
 func matchesQuery(str string, query string) bool {
@@ -804,7 +1493,12 @@ func matchesQuery(str string, query string) bool {
 	return strings.Contains(strings.ToLower(str), query)
 }
 
-func formatContacts(bridge *WABridge, input map[types.JID]types.ContactInfo, query string) (result []string) {
+type listEntry struct {
+	JID  types.JID
+	Text string
+}
+
+func formatContacts(bridge *WABridge, input map[types.JID]types.ContactInfo, query string) (result []listEntry) {
 	hasQuery := len(query) > 0
 	for jid, contact := range input {
 		if len(contact.FullName) == 0 {
@@ -817,68 +1511,133 @@ func formatContacts(bridge *WABridge, input map[types.JID]types.ContactInfo, que
 		}
 
 		if !hasQuery || matchesQuery(pushName, query) || matchesQuery(contact.FullName, query) || matchesQuery(jid.User, query) {
-			result = append(result, fmt.Sprintf("* %s / [%s](https://matrix.to/#/%s) - `+%s`", contact.FullName, pushName, puppet.MXID, jid.User))
+			result = append(result, listEntry{
+				JID:  jid,
+				Text: fmt.Sprintf("%s / [%s](https://matrix.to/#/%s) - `+%s`", contact.FullName, pushName, puppet.MXID, jid.User),
+			})
 		}
 	}
-	sort.Sort(sort.StringSlice(result))
+	sortListEntries(result)
 	return
 }
 
-func formatGroups(input []*types.GroupInfo, query string) (result []string) {
+func formatGroups(input []*types.GroupInfo, query string) (result []listEntry) {
 	hasQuery := len(query) > 0
 	for _, group := range input {
 		if !hasQuery || matchesQuery(group.GroupName.Name, query) || matchesQuery(group.JID.User, query) {
-			result = append(result, fmt.Sprintf("* %s - `%s`", group.GroupName.Name, group.JID.User))
+			result = append(result, listEntry{
+				JID:  group.JID,
+				Text: fmt.Sprintf("%s - `%s`", group.GroupName.Name, group.JID.User),
+			})
 		}
 	}
-	sort.Sort(sort.StringSlice(result))
+	sortListEntries(result)
 	return
 }
 
+func sortListEntries(entries []listEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Text < entries[j].Text
+	})
+}
+
+const (
+	listStatusBridged    = "✅"
+	listStatusNotBridged = "➖"
+	listStatusBlocked    = "⛔"
+)
+
+// getListEntryStatus returns an indicator of whether the chat has a portal room. It's only called for the
+// entries on the requested page, so that listing doesn't need a database query for every contact and group.
+func getListEntryStatus(user *User, entry listEntry, privateChats map[types.JID]id.RoomID) string {
+	if entry.JID.Server == types.DefaultUserServer {
+		if user.IsContactBlocked(entry.JID) {
+			return listStatusBlocked
+		} else if len(privateChats[entry.JID]) > 0 {
+			return listStatusBridged
+		}
+		return listStatusNotBridged
+	}
+	portal := user.bridge.DB.Portal.GetByJID(database.NewPortalKey(entry.JID, user.JID))
+	if portal != nil && len(portal.MXID) > 0 {
+		return listStatusBridged
+	}
+	return listStatusNotBridged
+}
+
+const (
+	listUsage           = "**Usage:** `list <contacts|groups> [page] [items per page] [--filter <filter>]`"
+	defaultListPageSize = 50
+)
+
 var cmdList = &commands.FullHandler{
 	Func: wrapCommand(fnList),
 	Name: "list",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionMiscellaneous,
-		Description: "Get a list of all contacts and groups.",
-		Args:        "<`contacts`|`groups`> [_page_] [_items per page_]",
+		Description: "Get a list of contacts or groups, optionally filtered by name or number, with their bridging status.",
+		Args:        "<`contacts`|`groups`> [_page_] [_items per page_] [`--filter` _filter_]",
 	},
 	RequiresLogin: true,
 }
 
 func fnList(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
-		ce.Reply("**Usage:** `list <contacts|groups> [page] [items per page]`")
+		ce.Reply(listUsage)
 		return
 	}
 	mode := strings.ToLower(ce.Args[0])
 	if mode[0] != 'g' && mode[0] != 'c' {
-		ce.Reply("**Usage:** `list <contacts|groups> [page] [items per page]`")
+		ce.Reply(listUsage)
 		return
 	}
-	var err error
 	page := 1
-	max := 100
-	if len(ce.Args) > 1 {
-		page, err = strconv.Atoi(ce.Args[1])
-		if err != nil || page <= 0 {
-			ce.Reply("\"%s\" isn't a valid page number", ce.Args[1])
-			return
+	max := defaultListPageSize
+	args := ce.Args[1:]
+	var filterArgs []string
+	// Everything after --filter is the filter, so that numeric filters (like parts of phone numbers)
+	// aren't mistaken for the page number. The page and page size are optional positional numbers.
+	for i, arg := range args {
+		if arg == "--filter" {
+			filterArgs = args[i+1:]
+			args = args[:i]
+			break
 		}
 	}
-	if len(ce.Args) > 2 {
-		max, err = strconv.Atoi(ce.Args[2])
-		if err != nil || max <= 0 {
-			ce.Reply("\"%s\" isn't a valid number of items per page", ce.Args[2])
-			return
-		} else if max > 400 {
-			ce.Reply("Warning: a high number of items per page may fail to send a reply")
+	if len(args) > 0 {
+		if parsed, err := strconv.Atoi(args[0]); err == nil {
+			if parsed <= 0 {
+				ce.Reply("\"%s\" isn't a valid page number", args[0])
+				return
+			}
+			page = parsed
+			args = args[1:]
+			if len(args) > 0 {
+				if parsed, err = strconv.Atoi(args[0]); err == nil {
+					if parsed <= 0 {
+						ce.Reply("\"%s\" isn't a valid number of items per page", args[0])
+						return
+					} else if parsed > 400 {
+						ce.Reply("Warning: a high number of items per page may fail to send a reply")
+					}
+					max = parsed
+					args = args[1:]
+				}
+			}
 		}
 	}
+	if len(args) > 0 && filterArgs == nil {
+		// Text filters without --filter are allowed for convenience
+		filterArgs = args
+	} else if len(args) > 0 {
+		ce.Reply(listUsage)
+		return
+	}
+	query := strings.ToLower(strings.TrimSpace(strings.Join(filterArgs, " ")))
 
 	contacts := mode[0] == 'c'
 	typeName := "Groups"
-	var result []string
+	var result []listEntry
 	if contacts {
 		typeName = "Contacts"
 		contactList, err := ce.User.Client.Store.Contacts.GetAllContacts()
@@ -886,18 +1645,22 @@ func fnList(ce *WrappedCommandEvent) {
 			ce.Reply("Failed to get contacts: %s", err)
 			return
 		}
-		result = formatContacts(ce.User.bridge, contactList, "")
+		result = formatContacts(ce.User.bridge, contactList, query)
 	} else {
-		groupList, err := ce.User.Client.GetJoinedGroups()
+		groupList, err := ce.User.getCachedGroupList()
 		if err != nil {
 			ce.Reply("Failed to get groups: %s", err)
 			return
 		}
-		result = formatGroups(groupList, "")
+		result = formatGroups(groupList, query)
 	}
 
 	if len(result) == 0 {
-		ce.Reply("No %s found", strings.ToLower(typeName))
+		if len(query) > 0 {
+			ce.Reply("No %s matching \"%s\" found", strings.ToLower(typeName), query)
+		} else {
+			ce.Reply("No %s found", strings.ToLower(typeName))
+		}
 		return
 	}
 	pages := int(math.Ceil(float64(len(result)) / float64(max)))
@@ -914,7 +1677,37 @@ func fnList(ce *WrappedCommandEvent) {
 		lastIndex = len(result)
 	}
 	result = result[(page-1)*max : lastIndex]
-	ce.Reply("### %s (page %d of %d)\n\n%s", typeName, page, pages, strings.Join(result, "\n"))
+
+	privateChats := make(map[types.JID]id.RoomID)
+	if contacts {
+		for _, portal := range ce.Bridge.DB.Portal.FindPrivateChats(ce.User.JID.ToNonAD()) {
+			privateChats[portal.Key.JID] = portal.MXID
+		}
+	}
+	lines := make([]string, len(result))
+	for i, entry := range result {
+		lines[i] = fmt.Sprintf("* %s %s", getListEntryStatus(ce.User, entry, privateChats), entry.Text)
+	}
+
+	title := fmt.Sprintf("%s (page %d of %d)", typeName, page, pages)
+	if len(query) > 0 {
+		title = fmt.Sprintf("%s matching \"%s\" (page %d of %d)", typeName, query, page, pages)
+	}
+	footer := fmt.Sprintf("%s bridged, %s not bridged", listStatusBridged, listStatusNotBridged)
+	if contacts {
+		footer += fmt.Sprintf(", %s blocked", listStatusBlocked)
+	}
+	if page < pages {
+		nextCommand := fmt.Sprintf("list %s %d", strings.ToLower(typeName), page+1)
+		if max != defaultListPageSize || len(query) > 0 {
+			nextCommand += fmt.Sprintf(" %d", max)
+		}
+		if len(query) > 0 {
+			nextCommand += " " + query
+		}
+		footer += fmt.Sprintf(". Use `%s` to see the next page.", nextCommand)
+	}
+	ce.Reply("### %s\n\n%s\n\n%s", title, strings.Join(lines, "\n"), footer)
 }
 
 var cmdSearch = &commands.FullHandler{
@@ -922,7 +1715,7 @@ var cmdSearch = &commands.FullHandler{
 	Name: "search",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionMiscellaneous,
-		Description: "Search for contacts or groups.",
+		Description: "Search for contacts or groups by name or phone number. Reply with the number of a result to open a chat.",
 		Args:        "<_query_>",
 	},
 	RequiresLogin: true,
@@ -934,35 +1727,54 @@ func fnSearch(ce *WrappedCommandEvent) {
 		return
 	}
 
-	contactList, err := ce.User.Client.Store.Contacts.GetAllContacts()
+	query := strings.ToLower(strings.TrimSpace(strings.Join(ce.Args, " ")))
+	results, err := ce.User.searchContactsAndGroups(query)
 	if err != nil {
-		ce.Reply("Failed to get contacts: %s", err)
+		ce.Reply("Search failed: %v", err)
 		return
-	}
-	groupList, err := ce.User.Client.GetJoinedGroups()
-	if err != nil {
-		ce.Reply("Failed to get groups: %s", err)
+	} else if len(results) == 0 {
+		ce.User.clearSearch()
+		ce.Reply("No contacts or groups found")
 		return
 	}
+	ce.User.startSearch(query, results)
+	ce.Reply(ce.User.formatSearchPage())
+}
 
-	query := strings.ToLower(strings.TrimSpace(strings.Join(ce.Args, " ")))
-	formattedContacts := strings.Join(formatContacts(ce.User.bridge, contactList, query), "\n")
-	formattedGroups := strings.Join(formatGroups(groupList, query), "\n")
+var cmdSearchSelect = &commands.FullHandler{
+	Func: wrapCommand(fnSearchSelect),
+	Name: "search-select",
+}
 
-	result := make([]string, 0, 2)
-	if len(formattedContacts) > 0 {
-		result = append(result, "### Contacts\n\n"+formattedContacts)
+func fnSearchSelect(ce *WrappedCommandEvent) {
+	message := strings.TrimSpace(strings.Join(append([]string{ce.Command}, ce.Args...), " "))
+	input := strings.ToLower(message)
+	if input == "next" || input == "more" {
+		if !ce.User.nextSearchPage() {
+			ce.Reply("There are no more results.")
+			return
+		}
+		ce.Reply(ce.User.formatSearchPage())
+		return
 	}
-	if len(formattedGroups) > 0 {
-		result = append(result, "### Groups\n\n"+formattedGroups)
+	index, err := strconv.Atoi(input)
+	if err != nil {
+		// Not a choice from the search results, so cancel the search and handle the message as a normal command
+		ce.User.clearSearch()
+		ce.Processor.Handle(ce.RoomID, ce.EventID, ce.User, message, ce.ReplyTo)
+		return
 	}
-
-	if len(result) == 0 {
-		ce.Reply("No contacts or groups found")
+	result := ce.User.getSearchResult(index)
+	if result == nil {
+		ce.Reply("%d isn't one of the search results. Reply with a number from the list or `next` for more results. Any other command cancels the search.", index)
 		return
 	}
-
-	ce.Reply(strings.Join(result, "\n\n"))
+	ce.User.clearSearch()
+	if result.IsGroup {
+		openGroupPortal(ce, result.JID)
+	} else {
+		startPMFromCommand(ce, result.JID)
+	}
 }
 
 var cmdOpen = &commands.FullHandler{
@@ -993,6 +1805,10 @@ func fnOpen(ce *WrappedCommandEvent) {
 		return
 	}
 
+	openGroupPortal(ce, jid)
+}
+
+func openGroupPortal(ce *WrappedCommandEvent, jid types.JID) {
 	info, err := ce.User.Client.GetGroupInfo(jid)
 	if err != nil {
 		ce.Reply("Failed to get group info: %v", err)
@@ -1030,8 +1846,6 @@ func fnPM(ce *WrappedCommandEvent) {
 		return
 	}
 
-	user := ce.User
-
 	number := strings.Join(ce.Args, "")
 	resp, err := ce.User.Client.IsOnWhatsApp([]string{number})
 	if err != nil {
@@ -1047,7 +1861,11 @@ func fnPM(ce *WrappedCommandEvent) {
 		return
 	}
 
-	portal, puppet, justCreated, err := user.StartPM(targetUser.JID, "manual PM command")
+	startPMFromCommand(ce, targetUser.JID)
+}
+
+func startPMFromCommand(ce *WrappedCommandEvent, jid types.JID) {
+	portal, puppet, justCreated, err := ce.User.StartPM(jid, "manual PM command")
 	if err != nil {
 		ce.Reply("Failed to create portal room: %v", err)
 	} else if !justCreated {
@@ -1057,92 +1875,417 @@ func fnPM(ce *WrappedCommandEvent) {
 	}
 }
 
+var cmdBlock = &commands.FullHandler{
+	Func: wrapCommand(fnBlock),
+	Name: "block",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Block a contact on WhatsApp. Defaults to the contact of the current private chat portal.",
+		Args:        "[_phone number_]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdUnblock = &commands.FullHandler{
+	Func: wrapCommand(fnBlock),
+	Name: "unblock",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Unblock a contact on WhatsApp. Defaults to the contact of the current private chat portal.",
+		Args:        "[_phone number_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnBlock(ce *WrappedCommandEvent) {
+	block := ce.Command == "block"
+	var jid types.JID
+	if len(ce.Args) > 0 {
+		var err error
+		jid, err = parseContactJID(strings.Join(ce.Args, ""))
+		if err != nil {
+			ce.Reply("%v", err)
+			return
+		}
+	} else if ce.Portal != nil && ce.Portal.IsPrivateChat() {
+		jid = ce.Portal.Key.JID
+	} else {
+		ce.Reply("**Usage:** `%s <phone number>` (the phone number can be omitted in private chat portals)", ce.Command)
+		return
+	}
+
+	if ce.User.IsContactBlocked(jid) == block {
+		if block {
+			ce.Reply("+%s is already blocked", jid.User)
+		} else {
+			ce.Reply("+%s is not blocked", jid.User)
+		}
+		return
+	}
+	err := ce.User.SetContactBlocked(jid, block)
+	if err != nil {
+		ce.Reply("Failed to change block status: %v", err)
+		return
+	}
+	if portal := ce.User.GetPortalByJID(jid); len(portal.MXID) > 0 {
+		portal.sendBlockStatusNotice(block)
+	}
+	if block {
+		ce.Reply("Blocked +%s on WhatsApp", jid.User)
+	} else {
+		ce.Reply("Unblocked +%s on WhatsApp", jid.User)
+	}
+}
+
+var cmdContactNumberChanged = &commands.FullHandler{
+	Func: wrapCommand(fnContactNumberChanged),
+	Name: "contact-number-changed",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Move the private chat with a contact who changed their phone number to the new number.",
+		Args:        "<old phone number> <new phone number>",
+	},
+	RequiresLogin: true,
+}
+
+func fnContactNumberChanged(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 2 {
+		ce.Reply("**Usage:** `contact-number-changed <old phone number> <new phone number>`")
+		return
+	}
+	oldJID := types.NewJID(strings.TrimLeft(ce.Args[0], "+"), types.DefaultUserServer)
+	resp, err := ce.User.Client.IsOnWhatsApp([]string{ce.Args[1]})
+	if err != nil {
+		ce.Reply("Failed to check if the new number is on WhatsApp: %v", err)
+		return
+	} else if len(resp) == 0 || !resp[0].IsIn {
+		ce.Reply("The server said %s is not on WhatsApp", ce.Args[1])
+		return
+	}
+	newJID := resp[0].JID
+	if oldJID.User == newJID.User {
+		ce.Reply("The old and new numbers are the same")
+		return
+	}
+	ce.User.MoveContactPrivateChat(oldJID, newJID, time.Now())
+	portal := ce.User.GetPortalByJID(newJID)
+	if len(portal.MXID) > 0 {
+		ce.Reply("Moved the contact to +%s, the private chat continues in [the existing room](https://matrix.to/#/%s)", newJID.User, portal.MXID)
+	} else {
+		ce.Reply("You didn't have a private chat portal with +%s, so there was nothing to move to +%s", oldJID.User, newJID.User)
+	}
+}
+
+var cmdMigrateOwnNumber = &commands.FullHandler{
+	Func: wrapCommand(fnMigrateOwnNumber),
+	Name: "migrate-own-number",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Move your private chats from the phone number you were previously logged in with to the current one.",
+	},
+	RequiresLogin: true,
+}
+
+func fnMigrateOwnNumber(ce *WrappedCommandEvent) {
+	moved, skipped, err := ce.User.MigrateOwnNumber()
+	if errors.Is(err, errNoPreviousNumber) {
+		ce.Reply("You haven't been logged in with a different phone number before")
+	} else if err != nil {
+		ce.Reply("Failed to migrate chats: %v (moved %d chats before the error)", err, moved)
+	} else if skipped > 0 {
+		ce.Reply("Moved %d private chats to +%s. %d chats were skipped, as they already have a room for the new number.", moved, ce.User.JID.User, skipped)
+	} else {
+		ce.Reply("Moved %d private chats to +%s", moved, ce.User.JID.User)
+	}
+}
+
+var cmdSelfChat = &commands.FullHandler{
+	Func:    wrapCommand(fnSelfChat),
+	Name:    "self-chat",
+	Aliases: []string{"notes", "message-yourself"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Open a portal to the WhatsApp \"message yourself\" chat.",
+	},
+	RequiresLogin: true,
+}
+
+func fnSelfChat(ce *WrappedCommandEvent) {
+	portal, _, justCreated, err := ce.User.StartPM(ce.User.JID.ToNonAD(), "manual self-chat command")
+	if err != nil {
+		ce.Reply("Failed to create portal room: %v", err)
+	} else if !justCreated {
+		ce.Reply("You already have a self-chat portal at [%s](https://matrix.to/#/%s)", portal.Name, portal.MXID)
+	} else {
+		ce.Reply("Created self-chat portal room and invited you to it.")
+	}
+}
+
 var cmdSync = &commands.FullHandler{
 	Func: wrapCommand(fnSync),
 	Name: "sync",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionMiscellaneous,
 		Description: "Synchronize data from WhatsApp.",
-		Args:        "<appstate/contacts/groups/space> [--create-portals]",
+		Args:        "<contacts/groups/avatars/appstate/space> [--create] [--full]",
 	},
 	RequiresLogin: true,
 }
 
+const syncUsage = "**Usage:** `sync <subcommand> [flags]`\n\n" +
+	"* `contacts [--full] [--contact-avatars] [--create]` - sync contact names, `--full` resyncs all contacts instead of only changed ones, `--contact-avatars` also forces refetching their avatars and `--create` creates portals for contacts without one.\n" +
+	"* `groups [--create]` - sync group info, `--create` creates portals for groups without one.\n" +
+	"* `avatars [--contacts|--groups]` - refetch contact and/or group avatars in the background.\n" +
+	"* `appstate [--create]` - resync the WhatsApp app state, `--create` also creates portals for new contacts.\n" +
+	"* `space` - add missing private chats to your personal filtering space."
+
+type syncFlags struct {
+	create         bool
+	full           bool
+	contacts       bool
+	groups         bool
+	contactAvatars bool
+}
+
+// syncAllowedFlags lists the flags that each sync subcommand accepts.
+var syncAllowedFlags = map[string][]string{
+	"contacts": {"--full", "--contact-avatars", "--create"},
+	"groups":   {"--create"},
+	"avatars":  {"--contacts", "--groups"},
+	"appstate": {"--create"},
+	"space":    nil,
+}
+
+func parseSyncFlags(subcommand string, args []string) (flags syncFlags, err error) {
+	for _, arg := range args {
+		flag := strings.ToLower(arg)
+		switch flag {
+		case "--create", "--create-portals":
+			flag = "--create"
+			flags.create = true
+		case "--full":
+			flags.full = true
+		case "--contacts":
+			flags.contacts = true
+		case "--contact-avatars":
+			flags.contactAvatars = true
+			flags.full = true
+		case "--groups":
+			flags.groups = true
+		default:
+			return flags, fmt.Errorf("unknown flag `%s`", arg)
+		}
+		allowed := false
+		for _, allowedFlag := range syncAllowedFlags[subcommand] {
+			if flag == allowedFlag {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return flags, fmt.Errorf("`sync %s` doesn't support the `%s` flag", subcommand, arg)
+		}
+	}
+	return
+}
+
 func fnSync(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
-		ce.Reply("**Usage:** `sync <appstate/contacts/avatars/groups/space> [--contact-avatars] [--create-portals]`")
+		ce.Reply(syncUsage)
 		return
 	}
-	args := strings.ToLower(strings.Join(ce.Args, " "))
-	contacts := strings.Contains(args, "contacts")
-	appState := strings.Contains(args, "appstate")
-	space := strings.Contains(args, "space")
-	groups := strings.Contains(args, "groups") || space
-	createPortals := strings.Contains(args, "--create-portals")
-	contactAvatars := strings.Contains(args, "--contact-avatars")
-	if contactAvatars && (!contacts || appState) {
-		ce.Reply("`--contact-avatars` can only be used with `sync contacts`")
+	subcommand := strings.ToLower(ce.Args[0])
+	if _, ok := syncAllowedFlags[subcommand]; !ok {
+		ce.Reply(syncUsage)
+		return
+	}
+	flags, err := parseSyncFlags(subcommand, ce.Args[1:])
+	if err != nil {
+		ce.Reply("%s\n\n%s", strings.ToUpper(err.Error()[:1])+err.Error()[1:], syncUsage)
 		return
 	}
+	switch subcommand {
+	case "contacts":
+		syncContacts(ce, flags)
+	case "groups":
+		syncGroups(ce, flags)
+	case "avatars":
+		syncAvatars(ce, flags)
+	case "appstate":
+		syncAppState(ce, flags)
+	case "space":
+		syncSpace(ce)
+	}
+}
 
-	if appState {
-		for _, name := range appstate.AllPatchNames {
-			err := ce.User.Client.FetchAppState(name, true, false)
-			if errors.Is(err, appstate.ErrKeyNotFound) {
-				ce.Reply("Key not found error syncing app state %s: %v\n\nKey requests are sent automatically, and the sync should happen in the background after your phone responds.", name, err)
-				return
-			} else if err != nil {
-				ce.Reply("Error syncing app state %s: %v", name, err)
-			} else if name == appstate.WAPatchCriticalUnblockLow {
-				ce.Reply("Synced app state %s, contact sync running in background", name)
-			} else {
-				ce.Reply("Synced app state %s", name)
-			}
+func syncContacts(ce *WrappedCommandEvent, flags syncFlags) {
+	if flags.full {
+		err := ce.User.ResyncContacts(flags.contactAvatars)
+		if errors.Is(err, errContactResyncInProgress) {
+			ce.Reply("A contact resync is already in progress, use `sync-status` to see its progress")
+			return
+		} else if err != nil {
+			ce.Reply("Error resyncing contacts: %v", err)
+			return
 		}
-	} else if contacts {
-		err := ce.User.ResyncContacts(contactAvatars)
+		ce.Reply("Resynced contacts")
+	} else {
+		fullResync, err := ce.User.ResyncChangedContacts()
 		if err != nil {
 			ce.Reply("Error resyncing contacts: %v", err)
-		} else {
+			return
+		} else if fullResync {
 			ce.Reply("Resynced contacts")
+		} else {
+			ce.Reply("Contacts are up to date, changes are synced as they come in. Use `--full` to resync all contacts anyway.")
+		}
+	}
+	if flags.create {
+		createContactPortals(ce)
+	}
+}
+
+func createContactPortals(ce *WrappedCommandEvent) {
+	ce.Reply("Creating portals for contacts in the background")
+	ce.Go(func() {
+		err := ce.User.CreateContactPortals()
+		if err != nil {
+			ce.User.log.Warnln("Failed to create contact portals:", err)
+		}
+	})
+}
+
+func syncGroups(ce *WrappedCommandEvent, flags syncFlags) {
+	err := ce.User.ResyncGroups(flags.create)
+	if err != nil {
+		ce.Reply("Error resyncing groups: %v", err)
+	} else if flags.create {
+		ce.Reply("Resynced groups and created missing portals")
+	} else {
+		ce.Reply("Resynced groups")
+	}
+}
+
+// groupAvatarSyncInterval is the delay between group avatar requests in `sync avatars`,
+// so that refetching all avatars doesn't flood WhatsApp with requests.
+const groupAvatarSyncInterval = 2 * time.Second
+
+func syncAvatars(ce *WrappedCommandEvent, flags syncFlags) {
+	bothTypes := !flags.contacts && !flags.groups
+	if flags.contacts || bothTypes {
+		if ce.User.ContactSyncStatus().Running {
+			ce.Reply("A contact resync is already in progress, use `sync-status` to see its progress")
+		} else {
+			ce.Reply("Refetching contact avatars in the background, use `sync-status` to see the progress")
+			ce.Go(func() {
+				err := ce.User.ResyncContacts(true)
+				if err != nil {
+					ce.User.log.Warnln("Failed to refetch contact avatars:", err)
+				}
+			})
 		}
 	}
-	if space {
-		if !ce.Bridge.Config.Bridge.PersonalFilteringSpaces {
-			ce.Reply("Personal filtering spaces are not enabled on this instance of the bridge")
+	if flags.groups || bothTypes {
+		groups, err := ce.User.getCachedGroupList()
+		if err != nil {
+			ce.Reply("Failed to get groups: %v", err)
 			return
 		}
-		keys := ce.Bridge.DB.Portal.FindPrivateChatsNotInSpace(ce.User.JID)
-		count := 0
-		for _, key := range keys {
-			portal := ce.Bridge.GetPortalByJID(key)
-			portal.addToSpace(ce.User)
-			count++
+		ce.Reply("Refetching avatars of %d groups in the background", len(groups))
+		ce.Go(func() {
+			ce.User.syncGroupAvatars(groups)
+		})
+	}
+}
+
+func (user *User) syncGroupAvatars(groups []*types.GroupInfo) {
+	changed := 0
+	for i, group := range groups {
+		if i > 0 {
+			time.Sleep(groupAvatarSyncInterval)
+		}
+		if !user.IsLoggedIn() {
+			user.log.Debugln("Stopping group avatar sync, user is no longer logged in")
+			return
 		}
-		plural := "s"
-		if count == 1 {
-			plural = ""
+		portal := user.GetPortalByJID(group.JID)
+		if len(portal.MXID) > 0 && portal.UpdateAvatar(user, types.EmptyJID, true) {
+			changed++
 		}
-		ce.Reply("Added %d DM room%s to space", count, plural)
 	}
-	if groups {
-		err := ce.User.ResyncGroups(createPortals)
-		if err != nil {
-			ce.Reply("Error resyncing groups: %v", err)
+	user.log.Infofln("Checked %d group avatars, %d were changed", len(groups), changed)
+}
+
+func syncAppState(ce *WrappedCommandEvent, flags syncFlags) {
+	for _, name := range appstate.AllPatchNames {
+		err := ce.User.Client.FetchAppState(name, true, false)
+		if errors.Is(err, appstate.ErrKeyNotFound) {
+			ce.Reply("Key not found error syncing app state %s: %v\n\nKey requests are sent automatically, and the sync should happen in the background after your phone responds.", name, err)
+			return
+		} else if err != nil {
+			ce.Reply("Error syncing app state %s: %v", name, err)
+		} else if name == appstate.WAPatchCriticalUnblockLow {
+			ce.Reply("Synced app state %s, contact sync running in background", name)
 		} else {
-			ce.Reply("Resynced groups")
+			ce.Reply("Synced app state %s", name)
+		}
+	}
+	if flags.create {
+		createContactPortals(ce)
+	}
+}
+
+func syncSpace(ce *WrappedCommandEvent) {
+	if !ce.Bridge.Config.Bridge.PersonalFilteringSpaces {
+		ce.Reply("Personal filtering spaces are not enabled on this instance of the bridge")
+		return
+	}
+	count := ce.User.AddMissingPortalsToSpace()
+	plural := "s"
+	if count == 1 {
+		plural = ""
+	}
+	ce.Reply("Added %d DM room%s to space", count, plural)
+}
+
+var cmdSyncStatus = &commands.FullHandler{
+	Func: wrapCommand(fnSyncStatus),
+	Name: "sync-status",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Show the progress of the current or most recent full contact resync.",
+	},
+	RequiresLogin: true,
+}
+
+func fnSyncStatus(ce *WrappedCommandEvent) {
+	status := ce.User.ContactSyncStatus()
+	if status.Started.IsZero() {
+		ce.Reply("No contact resync has been done since the bridge was started")
+	} else if status.Running {
+		msg := fmt.Sprintf("Contact resync in progress: %d/%d contacts synced, started %s ago",
+			status.Synced+status.Skipped, status.Total, formatDuration(time.Since(status.Started)))
+		if status.Skipped > 0 {
+			msg += fmt.Sprintf(" (resumed with %d contacts already synced before the restart)", status.Skipped)
 		}
+		ce.Reply(msg)
+	} else if status.Synced+status.Skipped < status.Total {
+		ce.Reply("The last contact resync stopped after %d/%d contacts. It will continue from there on the next resync.",
+			status.Synced+status.Skipped, status.Total)
+	} else {
+		ce.Reply("The last contact resync finished %s ago, %d contacts were synced in %s",
+			formatDuration(time.Since(status.Finished)), status.Total, formatDuration(status.Finished.Sub(status.Started)))
 	}
 }
 
 var cmdDisappearingTimer = &commands.FullHandler{
 	Func:    wrapCommand(fnDisappearingTimer),
 	Name:    "disappearing-timer",
-	Aliases: []string{"disappear-timer"},
+	Aliases: []string{"disappear-timer", "disappearing"},
 	Help: commands.HelpMeta{
 		Section:     HelpSectionPortalManagement,
-		Description: "Set future messages in the room to disappear after the given time.",
-		Args:        "<off/1d/7d/90d>",
+		Description: "Set future messages in the room to disappear after the given time, or show the current timer.",
+		Args:        "[off/24h/7d/90d]",
 	},
 	RequiresLogin:  true,
 	RequiresPortal: true,
@@ -1150,14 +2293,31 @@ var cmdDisappearingTimer = &commands.FullHandler{
 
 func fnDisappearingTimer(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
-		ce.Reply("**Usage:** `disappearing-timer <off/1d/7d/90d>`")
+		if ce.Portal.ExpirationTime == 0 {
+			ce.Reply("Disappearing messages are off in this chat.\n\n**Usage:** `disappearing <off/24h/7d/90d>`")
+		} else {
+			ce.Reply("Messages in this chat disappear after %s.\n\n**Usage:** `disappearing <off/24h/7d/90d>`", formatDuration(time.Duration(ce.Portal.ExpirationTime)*time.Second))
+		}
 		return
 	}
-	duration, ok := whatsmeow.ParseDisappearingTimerString(ce.Args[0])
+	timerString := strings.ToLower(ce.Args[0])
+	if timerString == "24h" {
+		timerString = "1d"
+	}
+	duration, ok := whatsmeow.ParseDisappearingTimerString(timerString)
 	if !ok {
-		ce.Reply("Invalid timer '%s'", ce.Args[0])
+		ce.Reply("Invalid timer '%s', must be one of off, 24h, 7d or 90d", ce.Args[0])
+		return
+	} else if uint32(duration.Seconds()) == ce.Portal.ExpirationTime {
+		ce.Reply("The disappearing timer is already set to that")
 		return
 	}
+	if ce.Portal.IsGroupChat() {
+		// Changing the timer of a group counts as changing its settings, so it requires admin if the group is locked.
+		if _, ok = getGroupAdminInfo(ce, true); !ok {
+			return
+		}
+	}
 	prevExpirationTime := ce.Portal.ExpirationTime
 	ce.Portal.ExpirationTime = uint32(duration.Seconds())
 	err := ce.User.Client.SetDisappearingTimer(ce.Portal.Key.JID, duration)
@@ -1167,9 +2327,276 @@ func fnDisappearingTimer(ce *WrappedCommandEvent) {
 		return
 	}
 	ce.Portal.Update(nil)
-	if !ce.Portal.IsPrivateChat() && !ce.Bridge.Config.Bridge.DisappearingMessagesInGroups {
-		ce.Reply("Disappearing timer changed successfully, but this bridge is not configured to disappear messages in group chats.")
-	} else {
-		ce.React("✅")
+	ce.Portal.UpdateDisappearingTimerState()
+	ce.Reply(ce.Portal.formatDisappearingMessageNotice())
+}
+
+// getGroupAdminInfo fetches the current info of the group in the command's portal and checks
+// whether the user is allowed to change it. Admin status is taken from WhatsApp, not from the
+// Matrix power levels, since those may be out of date or not map to WhatsApp roles at all.
+// Group metadata can be changed by all participants unless the group is locked.
+func getGroupAdminInfo(ce *WrappedCommandEvent, metadataOnly bool) (*types.GroupInfo, bool) {
+	if !ce.Portal.IsGroupChat() {
+		ce.Reply("This command can only be used in group chat portals")
+		return nil, false
+	}
+	info, err := ce.User.Client.GetGroupInfo(ce.Portal.Key.JID)
+	if err != nil {
+		ce.Reply("Failed to get group info: %v", err)
+		return nil, false
+	} else if metadataOnly && !info.IsLocked {
+		return info, true
+	}
+	for _, participant := range info.Participants {
+		if participant.JID.User == ce.User.JID.User {
+			if participant.IsAdmin || participant.IsSuperAdmin {
+				return info, true
+			}
+			break
+		}
+	}
+	ce.Reply("You must be an admin of the group on WhatsApp to do that")
+	return nil, false
+}
+
+// parseGroupCommandTarget finds the WhatsApp user that a group management command refers to.
+// The target can be a ghost or logged-in bridge user's Matrix ID, a phone number or a user JID.
+func parseGroupCommandTarget(ce *WrappedCommandEvent, arg string) (types.JID, bool) {
+	if strings.HasPrefix(arg, "@") {
+		userID := id.UserID(arg)
+		if jid, ok := ce.Bridge.ParsePuppetMXID(userID); ok {
+			return jid, true
+		} else if user := ce.Bridge.GetUserByMXIDIfExists(userID); user != nil && !user.JID.IsEmpty() {
+			return user.JID.ToNonAD(), true
+		}
+		ce.Reply("%s is not a WhatsApp user", userID)
+		return types.EmptyJID, false
+	}
+	jid, err := parseContactJID(arg)
+	if err != nil {
+		ce.Reply("%v", err)
+		return types.EmptyJID, false
+	}
+	return jid, true
+}
+
+var cmdKick = &commands.FullHandler{
+	Func: wrapCommand(fnChangeParticipant),
+	Name: "kick",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Remove a participant from the WhatsApp group.",
+		Args:        "<_Matrix user ID or phone number_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+var cmdPromote = &commands.FullHandler{
+	Func: wrapCommand(fnChangeParticipant),
+	Name: "promote",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Make a participant an admin of the WhatsApp group.",
+		Args:        "<_Matrix user ID or phone number_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+var cmdDemote = &commands.FullHandler{
+	Func: wrapCommand(fnChangeParticipant),
+	Name: "demote",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Remove the admin status of a participant of the WhatsApp group.",
+		Args:        "<_Matrix user ID or phone number_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnChangeParticipant(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `%s <Matrix user ID or phone number>`", ce.Command)
+		return
+	}
+	var change whatsmeow.ParticipantChange
+	var verb string
+	switch ce.Command {
+	case "kick":
+		change, verb = whatsmeow.ParticipantChangeRemove, "Removed"
+	case "promote":
+		change, verb = whatsmeow.ParticipantChangePromote, "Promoted"
+	case "demote":
+		change, verb = whatsmeow.ParticipantChangeDemote, "Demoted"
+	}
+	target, ok := parseGroupCommandTarget(ce, strings.Join(ce.Args, ""))
+	if !ok {
+		return
+	}
+	info, ok := getGroupAdminInfo(ce, false)
+	if !ok {
+		return
+	}
+	var participant *types.GroupParticipant
+	for i := range info.Participants {
+		if info.Participants[i].JID.User == target.User {
+			participant = &info.Participants[i]
+			break
+		}
+	}
+	if participant == nil {
+		ce.Reply("+%s is not a participant of this group", target.User)
+		return
+	} else if participant.IsSuperAdmin && change != whatsmeow.ParticipantChangePromote {
+		ce.Reply("+%s created the group and can't be removed or demoted", target.User)
+		return
+	} else if change == whatsmeow.ParticipantChangePromote && participant.IsAdmin {
+		ce.Reply("+%s is already an admin", target.User)
+		return
+	} else if change == whatsmeow.ParticipantChangeDemote && !participant.IsAdmin {
+		ce.Reply("+%s is not an admin", target.User)
+		return
+	}
+	_, err := ce.User.Client.UpdateGroupParticipants(ce.Portal.Key.JID, map[types.JID]whatsmeow.ParticipantChange{
+		target: change,
+	})
+	if err != nil {
+		ce.Reply("Failed to %s +%s: %v", ce.Command, target.User, err)
+		return
+	}
+	ce.Reply("%s +%s", verb, target.User)
+}
+
+var cmdSetGroupName = &commands.FullHandler{
+	Func: wrapCommand(fnSetGroupName),
+	Name: "set-group-name",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Change the name of the WhatsApp group.",
+		Args:        "<_name_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnSetGroupName(ce *WrappedCommandEvent) {
+	name := strings.TrimSpace(strings.Join(ce.Args, " "))
+	if len(name) == 0 {
+		ce.Reply("**Usage:** `set-group-name <name>`")
+		return
+	}
+	if _, ok := getGroupAdminInfo(ce, true); !ok {
+		return
+	}
+	err := ce.User.Client.SetGroupName(ce.Portal.Key.JID, name)
+	if err != nil {
+		ce.Reply("Failed to change group name: %v", err)
+		return
 	}
+	ce.React("✅")
+}
+
+var cmdSetGroupPhoto = &commands.FullHandler{
+	Func:    wrapCommand(fnSetGroupPhoto),
+	Name:    "set-group-photo",
+	Aliases: []string{"set-group-avatar"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Change the photo of the WhatsApp group to the given JPEG image, or to the current room avatar if no image is given.",
+		Args:        "[_mxc URI_|`remove`]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnSetGroupPhoto(ce *WrappedCommandEvent) {
+	if _, ok := getGroupAdminInfo(ce, true); !ok {
+		return
+	}
+	var avatarURL id.ContentURI
+	if len(ce.Args) == 0 {
+		var content event.RoomAvatarEventContent
+		err := ce.Bot.StateEvent(ce.RoomID, event.StateRoomAvatar, "", &content)
+		if err != nil || content.URL.IsEmpty() {
+			ce.Reply("The room doesn't have an avatar. Set one first or pass an mxc URI to the command.")
+			return
+		}
+		avatarURL = content.URL
+	} else if strings.ToLower(ce.Args[0]) != "remove" {
+		var err error
+		avatarURL, err = id.ParseContentURI(ce.Args[0])
+		if err != nil {
+			ce.Reply("%s is not a valid mxc URI", ce.Args[0])
+			return
+		}
+	}
+	var data []byte
+	if !avatarURL.IsEmpty() {
+		var err error
+		data, err = ce.Bot.DownloadBytes(avatarURL)
+		if err != nil {
+			ce.Reply("Failed to download image: %v", err)
+			return
+		}
+	}
+	_, err := ce.User.Client.SetGroupPhoto(ce.Portal.Key.JID, data)
+	if err != nil {
+		ce.Reply("Failed to change group photo: %v", err)
+		return
+	}
+	ce.React("✅")
+}
+
+var cmdSetNoticeLanguage = &commands.FullHandler{
+	Func:    wrapCommand(fnSetNoticeLanguage),
+	Name:    "set-notice-language",
+	Aliases: []string{"notice-language"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Set the language of system notices sent to this room.",
+		Args:        "[language code/default]",
+	},
+	RequiresPortal: true,
+}
+
+// canChangeNoticeLanguage checks if the user is a bridge admin, the relay user of the portal
+// or has a high enough power level to change the room settings.
+func canChangeNoticeLanguage(ce *WrappedCommandEvent) bool {
+	if ce.User.Admin || (len(ce.Portal.RelayUserID) > 0 && ce.Portal.RelayUserID == ce.User.MXID) {
+		return true
+	} else if len(ce.Portal.MXID) == 0 {
+		return false
+	}
+	levels, err := ce.Portal.MainIntent().PowerLevels(ce.Portal.MXID)
+	if err != nil {
+		ce.Portal.log.Warnfln("Failed to get power levels to check if %s can change the notice language: %v", ce.User.MXID, err)
+		return false
+	}
+	return levels.GetUserLevel(ce.User.MXID) >= levels.GetEventLevel(PortalChangelogEvent)
+}
+
+func fnSetNoticeLanguage(ce *WrappedCommandEvent) {
+	supported := strings.Join(supportedNoticeLanguages(), ", ")
+	if len(ce.Args) == 0 {
+		ce.Reply("Notices in this room are sent in `%s`. Supported languages: %s", ce.Portal.getNoticeLanguage(), supported)
+		return
+	}
+	if !canChangeNoticeLanguage(ce) {
+		ce.Reply("Only bridge admins, the relay user of this room and users who can change the room settings can set the notice language")
+		return
+	}
+	lang := normalizeNoticeLanguage(ce.Args[0])
+	if lang == "default" {
+		lang = ""
+	} else if !isSupportedNoticeLanguage(lang) {
+		ce.Reply("Unsupported language `%s`. Supported languages: %s", ce.Args[0], supported)
+		return
+	}
+	prevLang := ce.Portal.NoticeLanguage
+	ce.Portal.NoticeLanguage = lang
+	ce.Portal.Update(nil)
+	ce.Portal.LogPortalChange("notice_language", prevLang, lang)
+	ce.Reply("Notices in this room will now be sent in `%s`", ce.Portal.getNoticeLanguage())
 }
@@ -49,12 +49,15 @@ type BridgeConfig struct {
 
 	PersonalFilteringSpaces bool `yaml:"personal_filtering_spaces"`
 
-	DeliveryReceipts      bool `yaml:"delivery_receipts"`
-	MessageStatusEvents   bool `yaml:"message_status_events"`
-	MessageErrorNotices   bool `yaml:"message_error_notices"`
-	PortalMessageBuffer   int  `yaml:"portal_message_buffer"`
-	CallStartNotices      bool `yaml:"call_start_notices"`
-	IdentityChangeNotices bool `yaml:"identity_change_notices"`
+	DeliveryReceipts      bool   `yaml:"delivery_receipts"`
+	MessageStatusEvents   bool   `yaml:"message_status_events"`
+	MessageErrorNotices   bool   `yaml:"message_error_notices"`
+	PortalMessageBuffer   int    `yaml:"portal_message_buffer"`
+	ContactSyncWorkers    int    `yaml:"contact_sync_workers"`
+	MediaMemoryLimit      int    `yaml:"media_memory_limit"`
+	CallStartNotices      bool   `yaml:"call_start_notices"`
+	IdentityChangeNotices bool   `yaml:"identity_change_notices"`
+	DefaultNoticeLanguage string `yaml:"default_notice_language"`
 
 	HistorySync struct {
 		CreatePortals bool `yaml:"create_portals"`
@@ -63,18 +66,31 @@ type BridgeConfig struct {
 		DoublePuppetBackfill    bool `yaml:"double_puppet_backfill"`
 		RequestFullSync         bool `yaml:"request_full_sync"`
 		MaxInitialConversations int  `yaml:"max_initial_conversations"`
+		ReplayGroupChanges      bool `yaml:"replay_group_changes"`
 
 		Immediate struct {
 			WorkerCount int `yaml:"worker_count"`
 			MaxEvents   int `yaml:"max_events"`
 		} `yaml:"immediate"`
 
+		Priority struct {
+			DMsFirst       bool `yaml:"dms_first"`
+			LargeGroupSize int  `yaml:"large_group_size"`
+		} `yaml:"priority"`
+
+		ProgressInterval int `yaml:"progress_interval"`
+
 		MediaRequests struct {
 			AutoRequestMedia bool               `yaml:"auto_request_media"`
 			RequestMethod    MediaRequestMethod `yaml:"request_method"`
 			RequestLocalTime int                `yaml:"request_local_time"`
 		} `yaml:"media_requests"`
 
+		DeferredMedia struct {
+			Enabled bool `yaml:"enabled"`
+			Delay   int  `yaml:"delay"`
+		} `yaml:"deferred_media"`
+
 		Deferred []DeferredConfig `yaml:"deferred"`
 	} `yaml:"history_sync"`
 	UserAvatarSync    bool `yaml:"user_avatar_sync"`
@@ -118,7 +134,106 @@ type BridgeConfig struct {
 		Deadline   time.Duration `yaml:"-"`
 	} `yaml:"message_handling_timeout"`
 
+	ViewOnce struct {
+		Enabled         bool `yaml:"enabled"`
+		RedactAfterRead bool `yaml:"redact_after_read"`
+		RedactDelay     int  `yaml:"redact_delay"`
+	} `yaml:"view_once"`
+
+	DeadPortalCleanup struct {
+		Enabled      bool `yaml:"enabled"`
+		Interval     int  `yaml:"interval"`
+		RemovedAfter int  `yaml:"removed_after"`
+		LeaveRooms   bool `yaml:"leave_rooms"`
+		DryRun       bool `yaml:"dry_run"`
+	} `yaml:"dead_portal_cleanup"`
+
+	SoftDelete struct {
+		Enabled     bool `yaml:"enabled"`
+		GracePeriod int  `yaml:"grace_period"`
+	} `yaml:"soft_delete"`
+
+	AutoCreateDMPortals struct {
+		Enabled bool `yaml:"enabled"`
+		Delay   int  `yaml:"delay"`
+	} `yaml:"auto_create_dm_portals"`
+
+	DepartedContacts struct {
+		Enabled      bool `yaml:"enabled"`
+		ArchiveRooms bool `yaml:"archive_rooms"`
+	} `yaml:"departed_contacts"`
+
+	DeferredStartupSync struct {
+		Enabled bool `yaml:"enabled"`
+		Delay   int  `yaml:"delay"`
+	} `yaml:"deferred_startup_sync"`
+
+	CaptionMerge struct {
+		Enabled bool `yaml:"enabled"`
+		Timeout int  `yaml:"timeout"`
+	} `yaml:"caption_merge"`
+
+	DirectMedia struct {
+		Enabled           bool   `yaml:"enabled"`
+		ServerName        string `yaml:"server_name"`
+		WellKnownResponse string `yaml:"well_known_response"`
+		KeyServer         string `yaml:"key_server"`
+	} `yaml:"direct_media"`
+
+	MediaConversion struct {
+		MaxWorkers          int    `yaml:"max_workers"`
+		Timeout             int    `yaml:"timeout"`
+		TempDir             string `yaml:"temp_dir"`
+		IncomingVoiceFormat string `yaml:"incoming_voice_format"`
+	} `yaml:"media_conversion"`
+
+	MediaSizeLimits struct {
+		Incoming  int    `yaml:"incoming"`
+		Outgoing  int    `yaml:"outgoing"`
+		PublicURL string `yaml:"public_url"`
+	} `yaml:"media_size_limits"`
+
+	Warmup struct {
+		Days            int `yaml:"days"`
+		MessagesPerHour int `yaml:"messages_per_hour"`
+		NewChatsPerDay  int `yaml:"new_chats_per_day"`
+	} `yaml:"warmup"`
+
+	OfflineQueue struct {
+		Enabled bool `yaml:"enabled"`
+		MaxSize int  `yaml:"max_size"`
+		MaxAge  int  `yaml:"max_age"`
+	} `yaml:"offline_queue"`
+
+	CatchUp struct {
+		Enabled bool `yaml:"enabled"`
+		Timeout int  `yaml:"timeout"`
+	} `yaml:"catch_up"`
+
+	LogoutCleanup string `yaml:"logout_cleanup"`
+
+	ResourcePressure struct {
+		Enabled         bool    `yaml:"enabled"`
+		MemoryThreshold int     `yaml:"memory_threshold"`
+		LoadThreshold   float64 `yaml:"load_threshold"`
+		CheckInterval   int     `yaml:"check_interval"`
+		TrickleDelay    int     `yaml:"trickle_delay"`
+	} `yaml:"resource_pressure"`
+
 	DisableStatusBroadcastSend   bool `yaml:"disable_status_broadcast_send"`
+	StatusBroadcastThreads       bool `yaml:"status_broadcast_threads"`
+	RepliesAsThreads             bool `yaml:"replies_as_threads"`
+	LiveLocationBeacons          bool `yaml:"live_location_beacons"`
+	BroadcastListPortals         bool `yaml:"broadcast_list_portals"`
+	PortalChangelogEvents        bool `yaml:"portal_changelog_events"`
+	ForwardedPrefix              bool `yaml:"forwarded_prefix"`
+	MarkResentAsForwarded        bool `yaml:"mark_resent_as_forwarded"`
+	ReinviteKickedGhosts         bool `yaml:"reinvite_kicked_ghosts"`
+	RequestExpiredMedia          bool `yaml:"request_expired_media"`
+	GenerateMediaThumbnails      bool `yaml:"generate_media_thumbnails"`
+	MediaDeduplication           bool `yaml:"media_deduplication"`
+	AudioWaveforms               bool `yaml:"audio_waveforms"`
+	DisappearingMessagesRedact   bool `yaml:"disappearing_messages_redact"`
 	DisappearingMessagesInGroups bool `yaml:"disappearing_messages_in_groups"`
 
 	DisableBridgeAlerts   bool `yaml:"disable_bridge_alerts"`
@@ -131,8 +246,10 @@ type BridgeConfig struct {
 	Encryption bridgeconfig.EncryptionConfig `yaml:"encryption"`
 
 	Provisioning struct {
-		Prefix       string `yaml:"prefix"`
-		SharedSecret string `yaml:"shared_secret"`
+		Prefix       string              `yaml:"prefix"`
+		SharedSecret string              `yaml:"shared_secret"`
+		Tokens       []ProvisioningToken `yaml:"tokens"`
+		AdminUI      bool                `yaml:"admin_ui"`
 	} `yaml:"provisioning"`
 
 	Permissions bridgeconfig.PermissionConfig `yaml:"permissions"`
@@ -271,13 +388,53 @@ func (bc BridgeConfig) FormatUsername(username string) string {
 	return buf.String()
 }
 
+type ProvisioningScope string
+
+const (
+	ProvisioningScopeLogin        ProvisioningScope = "login"
+	ProvisioningScopePortalsRead  ProvisioningScope = "portals_read"
+	ProvisioningScopePortalsWrite ProvisioningScope = "portals_write"
+	ProvisioningScopeMetrics      ProvisioningScope = "metrics"
+	ProvisioningScopeCommands     ProvisioningScope = "commands"
+	// ProvisioningScopeAdmin grants access to all endpoints, like the shared secret.
+	ProvisioningScopeAdmin ProvisioningScope = "admin"
+)
+
+type ProvisioningToken struct {
+	Token  string              `yaml:"token"`
+	Scopes []ProvisioningScope `yaml:"scopes"`
+}
+
+// HasScope checks if the token is allowed to access endpoints that require the given scope.
+func (pt *ProvisioningToken) HasScope(scope ProvisioningScope) bool {
+	for _, tokenScope := range pt.Scopes {
+		if tokenScope == scope || tokenScope == ProvisioningScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
 type RelaybotConfig struct {
 	Enabled          bool                         `yaml:"enabled"`
 	AdminOnly        bool                         `yaml:"admin_only"`
+	Identity         RelayIdentity                `yaml:"identity"`
+	BotAccount       id.UserID                    `yaml:"bot_account"`
 	MessageFormats   map[event.MessageType]string `yaml:"message_formats"`
+	ConfirmThreshold int                          `yaml:"confirm_threshold"`
+	ConfirmTimeout   int                          `yaml:"confirm_timeout"`
 	messageTemplates *template.Template           `yaml:"-"`
 }
 
+type RelayIdentity string
+
+const (
+	// RelayIdentityOwner sends relayed messages from the WhatsApp account of the user who ran set-relay in the portal.
+	RelayIdentityOwner RelayIdentity = "owner"
+	// RelayIdentityBot sends relayed messages from a dedicated WhatsApp account configured in bot_account.
+	RelayIdentityBot RelayIdentity = "bot"
+)
+
 type umRelaybotConfig RelaybotConfig
 
 func (rc *RelaybotConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -305,7 +462,10 @@ type Sender struct {
 type formatData struct {
 	Sender  Sender
 	Message string
-	Content *event.MessageEventContent
+	// Caption is the HTML caption of media messages, or empty if the media doesn't have one.
+	Caption  string
+	FileName string
+	Content  *event.MessageEventContent
 }
 
 func (rc *RelaybotConfig) FormatMessage(content *event.MessageEventContent, sender id.UserID, member event.MemberEventContent) (string, error) {
@@ -313,14 +473,25 @@ func (rc *RelaybotConfig) FormatMessage(content *event.MessageEventContent, send
 		member.Displayname = sender.String()
 	}
 	member.Displayname = template.HTMLEscapeString(member.Displayname)
-	var output strings.Builder
-	err := rc.messageTemplates.ExecuteTemplate(&output, string(content.MsgType), formatData{
+	data := formatData{
 		Sender: Sender{
 			UserID:             template.HTMLEscapeString(sender.String()),
 			MemberEventContent: member,
 		},
-		Content: content,
-		Message: content.FormattedBody,
-	})
+		Content:  content,
+		Message:  content.FormattedBody,
+		FileName: template.HTMLEscapeString(content.Body),
+	}
+	if content.FileName != "" && content.Body != content.FileName {
+		data.Caption = content.FormattedBody
+		data.FileName = template.HTMLEscapeString(content.FileName)
+	}
+	templateName := string(content.MsgType)
+	if rc.messageTemplates.Lookup(templateName) == nil {
+		// Fall back to the text format for message types without a format, e.g. stickers
+		templateName = string(event.MsgText)
+	}
+	var output strings.Builder
+	err := rc.messageTemplates.ExecuteTemplate(&output, templateName, data)
 	return output.String(), err
 }
@@ -17,6 +17,9 @@
 package config
 
 import (
+	"strings"
+	"text/template"
+
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/id"
 )
@@ -38,6 +41,20 @@ type Config struct {
 		Listen  string `yaml:"listen"`
 	} `yaml:"metrics"`
 
+	Listener struct {
+		TLSCert    string   `yaml:"tls_cert"`
+		TLSKey     string   `yaml:"tls_key"`
+		AllowedIPs []string `yaml:"allowed_ips"`
+
+		ACME struct {
+			Enabled         bool   `yaml:"enabled"`
+			Domain          string `yaml:"domain"`
+			Email           string `yaml:"email"`
+			CacheDir        string `yaml:"cache_dir"`
+			ChallengeListen string `yaml:"challenge_listen"`
+		} `yaml:"acme"`
+	} `yaml:"listener"`
+
 	WhatsApp struct {
 		OSName      string `yaml:"os_name"`
 		BrowserName string `yaml:"browser_name"`
@@ -46,6 +63,33 @@ type Config struct {
 	Bridge BridgeConfig `yaml:"bridge"`
 }
 
+type DeviceNameArgs struct {
+	HomeserverDomain string
+	UserID           id.UserID
+	Localpart        string
+}
+
+// FormatDeviceName fills the os_name template for the given user. The user ID may be empty
+// when formatting the default name that isn't tied to any user.
+func (config *Config) FormatDeviceName(userID id.UserID) string {
+	tpl, err := template.New("os_name").Parse(config.WhatsApp.OSName)
+	if err != nil {
+		return config.WhatsApp.OSName
+	}
+	args := DeviceNameArgs{
+		HomeserverDomain: config.Homeserver.Domain,
+		UserID:           userID,
+	}
+	if len(userID) > 0 {
+		args.Localpart, _, _ = userID.Parse()
+	}
+	var buf strings.Builder
+	if err = tpl.Execute(&buf, args); err != nil {
+		return config.WhatsApp.OSName
+	}
+	return buf.String()
+}
+
 func (config *Config) CanAutoDoublePuppet(userID id.UserID) bool {
 	_, homeserver, _ := userID.Parse()
 	_, hasSecret := config.Bridge.LoginSharedSecretMap[homeserver]
@@ -32,6 +32,15 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "metrics", "enabled")
 	helper.Copy(up.Str, "metrics", "listen")
 
+	helper.Copy(up.Str|up.Null, "listener", "tls_cert")
+	helper.Copy(up.Str|up.Null, "listener", "tls_key")
+	helper.Copy(up.List, "listener", "allowed_ips")
+	helper.Copy(up.Bool, "listener", "acme", "enabled")
+	helper.Copy(up.Str|up.Null, "listener", "acme", "domain")
+	helper.Copy(up.Str|up.Null, "listener", "acme", "email")
+	helper.Copy(up.Str, "listener", "acme", "cache_dir")
+	helper.Copy(up.Str, "listener", "acme", "challenge_listen")
+
 	helper.Copy(up.Str, "whatsapp", "os_name")
 	helper.Copy(up.Str, "whatsapp", "browser_name")
 
@@ -42,18 +51,27 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "message_status_events")
 	helper.Copy(up.Bool, "bridge", "message_error_notices")
 	helper.Copy(up.Int, "bridge", "portal_message_buffer")
+	helper.Copy(up.Int, "bridge", "contact_sync_workers")
+	helper.Copy(up.Int, "bridge", "media_memory_limit")
 	helper.Copy(up.Bool, "bridge", "call_start_notices")
 	helper.Copy(up.Bool, "bridge", "identity_change_notices")
+	helper.Copy(up.Str, "bridge", "default_notice_language")
 	helper.Copy(up.Bool, "bridge", "history_sync", "create_portals")
 	helper.Copy(up.Bool, "bridge", "history_sync", "backfill")
 	helper.Copy(up.Bool, "bridge", "history_sync", "double_puppet_backfill")
 	helper.Copy(up.Bool, "bridge", "history_sync", "request_full_sync")
+	helper.Copy(up.Bool, "bridge", "history_sync", "replay_group_changes")
 	helper.Copy(up.Bool, "bridge", "history_sync", "media_requests", "auto_request_media")
 	helper.Copy(up.Str, "bridge", "history_sync", "media_requests", "request_method")
 	helper.Copy(up.Int, "bridge", "history_sync", "media_requests", "request_local_time")
+	helper.Copy(up.Bool, "bridge", "history_sync", "deferred_media", "enabled")
+	helper.Copy(up.Int, "bridge", "history_sync", "deferred_media", "delay")
 	helper.Copy(up.Int, "bridge", "history_sync", "max_initial_conversations")
 	helper.Copy(up.Int, "bridge", "history_sync", "immediate", "worker_count")
 	helper.Copy(up.Int, "bridge", "history_sync", "immediate", "max_events")
+	helper.Copy(up.Bool, "bridge", "history_sync", "priority", "dms_first")
+	helper.Copy(up.Int, "bridge", "history_sync", "priority", "large_group_size")
+	helper.Copy(up.Int, "bridge", "history_sync", "progress_interval")
 	helper.Copy(up.List, "bridge", "history_sync", "deferred")
 	helper.Copy(up.Bool, "bridge", "user_avatar_sync")
 	helper.Copy(up.Bool, "bridge", "bridge_matrix_leave")
@@ -83,10 +101,66 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "disable_status_broadcast_send")
 	helper.Copy(up.Bool, "bridge", "mute_status_broadcast")
 	helper.Copy(up.Str|up.Null, "bridge", "status_broadcast_tag")
+	helper.Copy(up.Bool, "bridge", "status_broadcast_threads")
+	helper.Copy(up.Bool, "bridge", "replies_as_threads")
+	helper.Copy(up.Bool, "bridge", "live_location_beacons")
+	helper.Copy(up.Bool, "bridge", "broadcast_list_portals")
+	helper.Copy(up.Bool, "bridge", "portal_changelog_events")
+	helper.Copy(up.Bool, "bridge", "forwarded_prefix")
+	helper.Copy(up.Bool, "bridge", "mark_resent_as_forwarded")
+	helper.Copy(up.Bool, "bridge", "reinvite_kicked_ghosts")
+	helper.Copy(up.Bool, "bridge", "request_expired_media")
+	helper.Copy(up.Bool, "bridge", "generate_media_thumbnails")
+	helper.Copy(up.Bool, "bridge", "media_deduplication")
+	helper.Copy(up.Bool, "bridge", "audio_waveforms")
 	helper.Copy(up.Bool, "bridge", "whatsapp_thumbnail")
 	helper.Copy(up.Bool, "bridge", "allow_user_invite")
 	helper.Copy(up.Str, "bridge", "command_prefix")
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
+	helper.Copy(up.Bool, "bridge", "view_once", "enabled")
+	helper.Copy(up.Bool, "bridge", "view_once", "redact_after_read")
+	helper.Copy(up.Int, "bridge", "view_once", "redact_delay")
+	helper.Copy(up.Bool, "bridge", "dead_portal_cleanup", "enabled")
+	helper.Copy(up.Int, "bridge", "dead_portal_cleanup", "interval")
+	helper.Copy(up.Int, "bridge", "dead_portal_cleanup", "removed_after")
+	helper.Copy(up.Bool, "bridge", "dead_portal_cleanup", "leave_rooms")
+	helper.Copy(up.Bool, "bridge", "dead_portal_cleanup", "dry_run")
+	helper.Copy(up.Bool, "bridge", "soft_delete", "enabled")
+	helper.Copy(up.Int, "bridge", "soft_delete", "grace_period")
+	helper.Copy(up.Bool, "bridge", "auto_create_dm_portals", "enabled")
+	helper.Copy(up.Int, "bridge", "auto_create_dm_portals", "delay")
+	helper.Copy(up.Bool, "bridge", "departed_contacts", "enabled")
+	helper.Copy(up.Bool, "bridge", "departed_contacts", "archive_rooms")
+	helper.Copy(up.Bool, "bridge", "deferred_startup_sync", "enabled")
+	helper.Copy(up.Int, "bridge", "deferred_startup_sync", "delay")
+	helper.Copy(up.Bool, "bridge", "caption_merge", "enabled")
+	helper.Copy(up.Int, "bridge", "caption_merge", "timeout")
+	helper.Copy(up.Bool, "bridge", "direct_media", "enabled")
+	helper.Copy(up.Str, "bridge", "direct_media", "server_name")
+	helper.Copy(up.Str|up.Null, "bridge", "direct_media", "well_known_response")
+	helper.Copy(up.Str|up.Null, "bridge", "direct_media", "key_server")
+	helper.Copy(up.Int, "bridge", "media_conversion", "max_workers")
+	helper.Copy(up.Int, "bridge", "media_conversion", "timeout")
+	helper.Copy(up.Str|up.Null, "bridge", "media_conversion", "temp_dir")
+	helper.Copy(up.Str|up.Null, "bridge", "media_conversion", "incoming_voice_format")
+	helper.Copy(up.Int, "bridge", "media_size_limits", "incoming")
+	helper.Copy(up.Int, "bridge", "media_size_limits", "outgoing")
+	helper.Copy(up.Str|up.Null, "bridge", "media_size_limits", "public_url")
+	helper.Copy(up.Int, "bridge", "warmup", "days")
+	helper.Copy(up.Int, "bridge", "warmup", "messages_per_hour")
+	helper.Copy(up.Int, "bridge", "warmup", "new_chats_per_day")
+	helper.Copy(up.Bool, "bridge", "offline_queue", "enabled")
+	helper.Copy(up.Int, "bridge", "offline_queue", "max_size")
+	helper.Copy(up.Int, "bridge", "offline_queue", "max_age")
+	helper.Copy(up.Bool, "bridge", "catch_up", "enabled")
+	helper.Copy(up.Int, "bridge", "catch_up", "timeout")
+	helper.Copy(up.Str, "bridge", "logout_cleanup")
+	helper.Copy(up.Bool, "bridge", "resource_pressure", "enabled")
+	helper.Copy(up.Int, "bridge", "resource_pressure", "memory_threshold")
+	helper.Copy(up.Float, "bridge", "resource_pressure", "load_threshold")
+	helper.Copy(up.Int, "bridge", "resource_pressure", "check_interval")
+	helper.Copy(up.Int, "bridge", "resource_pressure", "trickle_delay")
+	helper.Copy(up.Bool, "bridge", "disappearing_messages_redact")
 	helper.Copy(up.Bool, "bridge", "disappearing_messages_in_groups")
 	helper.Copy(up.Bool, "bridge", "disable_bridge_alerts")
 	helper.Copy(up.Bool, "bridge", "crash_on_stream_replaced")
@@ -135,10 +209,16 @@ func DoUpgrade(helper *up.Helper) {
 	} else {
 		helper.Copy(up.Str, "bridge", "provisioning", "shared_secret")
 	}
+	helper.Copy(up.List, "bridge", "provisioning", "tokens")
+	helper.Copy(up.Bool, "bridge", "provisioning", "admin_ui")
 	helper.Copy(up.Map, "bridge", "permissions")
 	helper.Copy(up.Bool, "bridge", "relay", "enabled")
 	helper.Copy(up.Bool, "bridge", "relay", "admin_only")
+	helper.Copy(up.Str, "bridge", "relay", "identity")
+	helper.Copy(up.Str|up.Null, "bridge", "relay", "bot_account")
 	helper.Copy(up.Map, "bridge", "relay", "message_formats")
+	helper.Copy(up.Int, "bridge", "relay", "confirm_threshold")
+	helper.Copy(up.Int, "bridge", "relay", "confirm_timeout")
 }
 
 var SpacedBlocks = [][]string{
@@ -150,6 +230,7 @@ var SpacedBlocks = [][]string{
 	{"appservice", "as_token"},
 	{"segment_key"},
 	{"metrics"},
+	{"listener"},
 	{"whatsapp"},
 	{"bridge"},
 	{"bridge", "command_prefix"},
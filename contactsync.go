@@ -0,0 +1,124 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const contactResyncProgressInterval = 100
+
+var errContactResyncInProgress = errors.New("a contact resync is already in progress")
+
+// contactSyncProgress describes the current or most recent full contact resync of a user.
+type contactSyncProgress struct {
+	Running  bool
+	Total    int
+	Skipped  int
+	Synced   int
+	Started  time.Time
+	Finished time.Time
+}
+
+func (user *User) ContactSyncStatus() contactSyncProgress {
+	user.contactSyncLock.Lock()
+	defer user.contactSyncLock.Unlock()
+	return user.contactSync
+}
+
+func (user *User) contactSynced() (synced, total int) {
+	user.contactSyncLock.Lock()
+	defer user.contactSyncLock.Unlock()
+	user.contactSync.Synced++
+	return user.contactSync.Synced + user.contactSync.Skipped, user.contactSync.Total
+}
+
+// ResyncContacts syncs the names and avatars of all puppets in the user's contact list.
+//
+// Contacts are synced in parallel with the configured number of workers, and each synced contact is stored
+// in the database, so a resync that was interrupted by a restart skips the contacts that were already done.
+func (user *User) ResyncContacts(forceAvatarSync bool) error {
+	user.contactSyncLock.Lock()
+	if user.contactSync.Running {
+		user.contactSyncLock.Unlock()
+		return errContactResyncInProgress
+	}
+	user.contactSync = contactSyncProgress{Running: true, Started: time.Now()}
+	user.contactSyncLock.Unlock()
+	defer func() {
+		user.contactSyncLock.Lock()
+		user.contactSync.Running = false
+		user.contactSync.Finished = time.Now()
+		user.contactSyncLock.Unlock()
+	}()
+
+	contacts, err := user.Client.Store.Contacts.GetAllContacts()
+	if err != nil {
+		return fmt.Errorf("failed to get cached contacts: %w", err)
+	}
+	done := user.GetContactSyncProgress()
+	queue := make(chan types.JID, len(contacts))
+	for jid := range contacts {
+		if _, alreadySynced := done[jid]; !alreadySynced {
+			queue <- jid
+		}
+	}
+	close(queue)
+	user.contactSyncLock.Lock()
+	user.contactSync.Total = len(contacts)
+	user.contactSync.Skipped = len(contacts) - len(queue)
+	user.contactSyncLock.Unlock()
+	if len(done) > 0 {
+		user.log.Infofln("Resuming contact resync: %d/%d contacts were already synced before the restart", len(contacts)-len(queue), len(contacts))
+	} else {
+		user.log.Infofln("Resyncing displaynames with %d contacts", len(contacts))
+	}
+
+	workers := user.bridge.Config.Bridge.ContactSyncWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for jid := range queue {
+				contact := contacts[jid]
+				puppet := user.bridge.GetPuppetByJID(jid)
+				if puppet != nil {
+					puppet.Sync(user, &contact, forceAvatarSync, true)
+				} else {
+					user.log.Warnfln("Got a nil puppet for %s while syncing contacts", jid)
+				}
+				user.MarkContactSynced(jid)
+				synced, total := user.contactSynced()
+				if synced%contactResyncProgressInterval == 0 {
+					user.log.Infofln("Resynced %d/%d contacts", synced, total)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	user.ClearContactSyncProgress()
+	return nil
+}
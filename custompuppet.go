@@ -22,6 +22,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -35,6 +36,15 @@ var (
 	ErrMismatchingMXID = errors.New("whoami result does not match custom mxid")
 )
 
+const (
+	// asTokenSecretPrefix marks login shared secrets that are the token of an appservice whose namespace
+	// covers the real users, which the bridge uses to masquerade as them instead of logging in.
+	asTokenSecretPrefix = "as_token:"
+	// appserviceDoublePuppetToken is stored as the access token of double puppets that use appservice
+	// masquerading, so that the real token is always read from the config and never stored in the database.
+	appserviceDoublePuppetToken = "appservice-config"
+)
+
 func (puppet *Puppet) SwitchCustomMXID(accessToken string, mxid id.UserID) error {
 	prevCustomMXID := puppet.CustomMXID
 	if puppet.customIntent != nil {
@@ -54,8 +64,9 @@ func (puppet *Puppet) SwitchCustomMXID(accessToken string, mxid id.UserID) error
 	if len(puppet.CustomMXID) > 0 {
 		puppet.bridge.puppetsByCustomMXID[puppet.CustomMXID] = puppet
 	}
-	puppet.EnablePresence = puppet.bridge.Config.Bridge.DefaultBridgePresence
-	puppet.EnableReceipts = puppet.bridge.Config.Bridge.DefaultBridgeReceipts
+	settings := puppet.bridge.DB.Settings.Get(puppet.CustomMXID)
+	puppet.EnablePresence = boolOrDefault(settings.EnablePresence, puppet.bridge.Config.Bridge.DefaultBridgePresence)
+	puppet.EnableReceipts = boolOrDefault(settings.EnableReceipts, puppet.bridge.Config.Bridge.DefaultBridgeReceipts)
 	puppet.bridge.AS.StateStore.MarkRegistered(puppet.CustomMXID)
 	puppet.Update()
 	// TODO leave rooms with default puppet
@@ -66,6 +77,10 @@ func (puppet *Puppet) loginWithSharedSecret(mxid id.UserID) (string, error) {
 	_, homeserver, _ := mxid.Parse()
 	puppet.log.Debugfln("Logging into %s with shared secret", mxid)
 	loginSecret := puppet.bridge.Config.Bridge.LoginSharedSecretMap[homeserver]
+	if strings.HasPrefix(loginSecret, asTokenSecretPrefix) {
+		// No login needed, requests are sent with the appservice token and ?user_id=
+		return appserviceDoublePuppetToken, nil
+	}
 	client, err := puppet.bridge.newDoublePuppetClient(mxid, "")
 	if err != nil {
 		return "", fmt.Errorf("failed to create mautrix client to log in: %v", err)
@@ -111,10 +126,22 @@ func (br *WABridge) newDoublePuppetClient(mxid id.UserID, accessToken string) (*
 			return nil, fmt.Errorf("double puppeting from %s is not allowed", homeserver)
 		}
 	}
+	var masquerade bool
+	if accessToken == appserviceDoublePuppetToken {
+		loginSecret := br.Config.Bridge.LoginSharedSecretMap[homeserver]
+		if !strings.HasPrefix(loginSecret, asTokenSecretPrefix) {
+			return nil, fmt.Errorf("appservice double puppeting is no longer configured for %s", homeserver)
+		}
+		accessToken = strings.TrimPrefix(loginSecret, asTokenSecretPrefix)
+		masquerade = true
+	}
 	client, err := mautrix.NewClient(homeserverURL, mxid, accessToken)
 	if err != nil {
 		return nil, err
 	}
+	if masquerade {
+		client.AppServiceUserID = mxid
+	}
 	client.Logger = br.AS.Log.Sub(mxid.String())
 	client.Client = br.AS.HTTPClient
 	client.DefaultHTTPRetries = br.AS.DefaultHTTPRetries
@@ -160,7 +187,13 @@ func (puppet *Puppet) StartCustomMXID(reloginOnFail bool) error {
 	resp, err := intent.Whoami()
 	if err != nil {
 		if !reloginOnFail || (errors.Is(err, mautrix.MUnknownToken) && !puppet.tryRelogin(err, "initializing double puppeting")) {
-			puppet.clearCustomMXID()
+			if reloginOnFail && errors.Is(err, mautrix.MUnknownToken) {
+				go puppet.notifyDoublePuppetingDisabled(puppet.CustomMXID, err)
+				puppet.clearCustomMXID()
+				puppet.Update()
+			} else {
+				puppet.clearCustomMXID()
+			}
 			return err
 		}
 		intent.AccessToken = puppet.AccessToken
@@ -235,6 +268,9 @@ func (puppet *Puppet) ProcessResponse(resp *mautrix.RespSync, _ string) error {
 func (puppet *Puppet) tryRelogin(cause error, action string) bool {
 	if !puppet.bridge.Config.CanAutoDoublePuppet(puppet.CustomMXID) {
 		return false
+	} else if puppet.AccessToken == appserviceDoublePuppetToken {
+		// Logging in again doesn't help if the appservice token itself was rejected
+		return false
 	}
 	puppet.log.Debugfln("Trying to relogin after '%v' while %s", cause, action)
 	accessToken, err := puppet.loginWithSharedSecret(puppet.CustomMXID)
@@ -244,16 +280,60 @@ func (puppet *Puppet) tryRelogin(cause error, action string) bool {
 	}
 	puppet.log.Infofln("Successfully relogined after '%v' while %s", cause, action)
 	puppet.AccessToken = accessToken
+	puppet.Update()
 	return true
 }
 
+// handleInvalidToken is called when the homeserver rejects the access token of the double puppet. It tries to log in
+// again with the shared secret, and if that's not possible, disables double puppeting and tells the user about it.
+//
+// failedToken is the token that was rejected. If another failure already replaced it while this one was waiting
+// for the lock, the new token is used instead of logging in again.
+func (puppet *Puppet) handleInvalidToken(failedToken string, cause error, action string) bool {
+	puppet.tokenLock.Lock()
+	defer puppet.tokenLock.Unlock()
+	if puppet.customIntent == nil {
+		return false
+	} else if puppet.AccessToken != failedToken {
+		puppet.log.Debugfln("Not relogging in after '%v' while %s, the access token was already replaced", cause, action)
+		puppet.customIntent.AccessToken = puppet.AccessToken
+		return true
+	} else if puppet.tryRelogin(cause, action) {
+		puppet.customIntent.AccessToken = puppet.AccessToken
+		return true
+	}
+	mxid := puppet.CustomMXID
+	go func() {
+		err := puppet.SwitchCustomMXID("", "")
+		if err != nil {
+			puppet.log.Warnfln("Failed to disable double puppeting for %s: %v", mxid, err)
+		}
+		puppet.notifyDoublePuppetingDisabled(mxid, cause)
+	}()
+	return false
+}
+
+func (puppet *Puppet) notifyDoublePuppetingDisabled(mxid id.UserID, cause error) {
+	puppet.log.Warnfln("Double puppeting for %s was disabled because the access token is no longer valid: %v", mxid, cause)
+	user := puppet.bridge.GetUserByMXID(mxid)
+	if user == nil {
+		return
+	}
+	user.sendMarkdownBridgeAlert("Your Matrix access token for double puppeting is no longer valid and the bridge " +
+		"couldn't log in again automatically, so double puppeting has been disabled. " +
+		"Use `login-matrix` to enable it again.")
+}
+
 func (puppet *Puppet) OnFailedSync(_ *mautrix.RespSync, err error) (time.Duration, error) {
 	puppet.log.Warnln("Sync error:", err)
 	if errors.Is(err, mautrix.MUnknownToken) {
-		if !puppet.tryRelogin(err, "syncing") {
+		var failedToken string
+		if intent := puppet.customIntent; intent != nil {
+			failedToken = intent.AccessToken
+		}
+		if !puppet.handleInvalidToken(failedToken, err, "syncing") {
 			return 0, err
 		}
-		puppet.customIntent.AccessToken = puppet.AccessToken
 		return 0, nil
 	}
 	return 10 * time.Second, nil
@@ -176,6 +176,53 @@ func (bq *BackfillQuery) DeleteAllForPortal(userID id.UserID, portalKey PortalKe
 	}
 }
 
+const getBackfillStatusQuery = `
+	SELECT type, COUNT(*), SUM(jobs), SUM(done), SUM(in_flight), SUM(CASE WHEN done=jobs THEN 1 ELSE 0 END)
+	FROM (
+		SELECT type, portal_jid, portal_receiver, COUNT(*) AS jobs,
+			SUM(CASE WHEN completed_at IS NOT NULL THEN 1 ELSE 0 END) AS done,
+			SUM(CASE WHEN dispatch_time IS NOT NULL AND completed_at IS NULL THEN 1 ELSE 0 END) AS in_flight
+		FROM backfill_queue
+		WHERE user_mxid=$1
+		GROUP BY type, portal_jid, portal_receiver
+	) AS chats
+	GROUP BY type
+	ORDER BY type
+`
+
+// BackfillStatus summarizes the backfill queue of a user for a single backfill type.
+type BackfillStatus struct {
+	Type      BackfillType
+	Chats     int
+	ChatsDone int
+	Jobs      int
+	JobsDone  int
+	InFlight  int
+}
+
+// GetStatus returns a summary of the backfill queue of the given user for each backfill type that has jobs.
+func (bq *BackfillQuery) GetStatus(userID id.UserID) (statuses []*BackfillStatus) {
+	bq.backfillQueryLock.Lock()
+	defer bq.backfillQueryLock.Unlock()
+
+	rows, err := bq.db.Query(getBackfillStatusQuery, userID)
+	if err != nil || rows == nil {
+		bq.log.Warnfln("Failed to query backfill queue status of %s: %v", userID, err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status BackfillStatus
+		err = rows.Scan(&status.Type, &status.Chats, &status.Jobs, &status.JobsDone, &status.InFlight, &status.ChatsDone)
+		if err != nil {
+			bq.log.Warnfln("Failed to scan backfill queue status of %s: %v", userID, err)
+			return nil
+		}
+		statuses = append(statuses, &status)
+	}
+	return
+}
+
 type Backfill struct {
 	db  *Database
 	log log.Logger
@@ -38,16 +38,27 @@ func init() {
 type Database struct {
 	*dbutil.Database
 
+	// SoftDelete makes deleting portals and messages only mark the rows as deleted,
+	// so that they can be restored until PurgeDeleted removes them.
+	SoftDelete bool
+
 	User     *UserQuery
+	Settings *UserSettingsQuery
 	Portal   *PortalQuery
 	Puppet   *PuppetQuery
 	Message  *MessageQuery
 	Reaction *ReactionQuery
 
+	Sticker            *StickerQuery
+	InteractiveMessage *InteractiveMessageQuery
+	DirectMedia        *DirectMediaQuery
+	ReuploadedMedia    *ReuploadedMediaQuery
+
 	DisappearingMessage  *DisappearingMessageQuery
 	Backfill             *BackfillQuery
 	HistorySync          *HistorySyncQuery
 	MediaBackfillRequest *MediaBackfillRequestQuery
+	DeferredMedia        *DeferredMediaQuery
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -57,6 +68,10 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("User"),
 	}
+	db.Settings = &UserSettingsQuery{
+		db:  db,
+		log: log.Sub("UserSettings"),
+	}
 	db.Portal = &PortalQuery{
 		db:  db,
 		log: log.Sub("Portal"),
@@ -73,6 +88,22 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("Reaction"),
 	}
+	db.Sticker = &StickerQuery{
+		db:  db,
+		log: log.Sub("Sticker"),
+	}
+	db.InteractiveMessage = &InteractiveMessageQuery{
+		db:  db,
+		log: log.Sub("InteractiveMessage"),
+	}
+	db.DirectMedia = &DirectMediaQuery{
+		db:  db,
+		log: log.Sub("DirectMedia"),
+	}
+	db.ReuploadedMedia = &ReuploadedMediaQuery{
+		db:  db,
+		log: log.Sub("ReuploadedMedia"),
+	}
 	db.DisappearingMessage = &DisappearingMessageQuery{
 		db:  db,
 		log: log.Sub("DisappearingMessage"),
@@ -89,6 +120,10 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("MediaBackfillRequest"),
 	}
+	db.DeferredMedia = &DeferredMediaQuery{
+		db:  db,
+		log: log.Sub("DeferredMedia"),
+	}
 	return db
 }
 
@@ -116,3 +151,18 @@ func (db *Database) HandleSignalStoreError(device *store.Device, action string,
 	device.Log.Errorf("Failed to %s: %v", action, err)
 	return false
 }
+
+// PurgeDeleted permanently removes portals and messages that were soft-deleted before the given time.
+func (db *Database) PurgeDeleted(before time.Time) (portals, messages int64, err error) {
+	res, err := db.Exec("DELETE FROM message WHERE deleted_at IS NOT NULL AND deleted_at<$1", before.Unix())
+	if err != nil {
+		return
+	}
+	messages, _ = res.RowsAffected()
+	res, err = db.Exec("DELETE FROM portal WHERE deleted_at IS NOT NULL AND deleted_at<$1", before.Unix())
+	if err != nil {
+		return
+	}
+	portals, _ = res.RowsAffected()
+	return
+}
@@ -0,0 +1,125 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// DeferredMediaQuery stores media messages that were backfilled with a placeholder
+// and still need to have their files downloaded and bridged.
+type DeferredMediaQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (dmq *DeferredMediaQuery) New() *DeferredMedia {
+	return &DeferredMedia{
+		db:  dmq.db,
+		log: dmq.log,
+	}
+}
+
+const (
+	// Newest messages first, as those are the most likely to be looked at.
+	getNextDeferredMediaQuery = `
+		SELECT user_mxid, portal_jid, portal_receiver, message_id, timestamp FROM deferred_media
+		WHERE user_mxid=$1
+		ORDER BY timestamp DESC
+		LIMIT 1
+	`
+	countDeferredMediaQuery = `
+		SELECT COUNT(*) FROM deferred_media WHERE user_mxid=$1
+	`
+	insertDeferredMediaQuery = `
+		INSERT INTO deferred_media (user_mxid, portal_jid, portal_receiver, message_id, timestamp) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (portal_jid, portal_receiver, message_id) DO NOTHING
+	`
+	deleteDeferredMediaQuery = `
+		DELETE FROM deferred_media WHERE portal_jid=$1 AND portal_receiver=$2 AND message_id=$3
+	`
+	deleteAllDeferredMediaQuery = `
+		DELETE FROM deferred_media WHERE user_mxid=$1
+	`
+)
+
+func (dmq *DeferredMediaQuery) GetNext(userID id.UserID) *DeferredMedia {
+	return dmq.New().Scan(dmq.db.QueryRow(getNextDeferredMediaQuery, userID))
+}
+
+func (dmq *DeferredMediaQuery) Count(userID id.UserID) (count int) {
+	err := dmq.db.QueryRow(countDeferredMediaQuery, userID).Scan(&count)
+	if err != nil {
+		dmq.log.Warnfln("Failed to count deferred media of %s: %v", userID, err)
+	}
+	return
+}
+
+func (dmq *DeferredMediaQuery) DeleteAll(userID id.UserID) {
+	_, err := dmq.db.Exec(deleteAllDeferredMediaQuery, userID)
+	if err != nil {
+		dmq.log.Warnfln("Failed to delete deferred media of %s: %v", userID, err)
+	}
+}
+
+type DeferredMedia struct {
+	db  *Database
+	log log.Logger
+
+	UserID    id.UserID
+	PortalKey PortalKey
+	MessageID types.MessageID
+	Timestamp time.Time
+}
+
+func (dm *DeferredMedia) Scan(row dbutil.Scannable) *DeferredMedia {
+	var ts int64
+	err := row.Scan(&dm.UserID, &dm.PortalKey.JID, &dm.PortalKey.Receiver, &dm.MessageID, &ts)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			dm.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	if ts != 0 {
+		dm.Timestamp = time.Unix(ts, 0)
+	}
+	return dm
+}
+
+func (dm *DeferredMedia) Insert() {
+	_, err := dm.db.Exec(insertDeferredMediaQuery, dm.UserID, dm.PortalKey.JID, dm.PortalKey.Receiver, dm.MessageID, dm.Timestamp.Unix())
+	if err != nil {
+		dm.log.Warnfln("Failed to insert deferred media %s in %s: %v", dm.MessageID, dm.PortalKey, err)
+	}
+}
+
+func (dm *DeferredMedia) Delete() {
+	_, err := dm.db.Exec(deleteDeferredMediaQuery, dm.PortalKey.JID, dm.PortalKey.Receiver, dm.MessageID)
+	if err != nil {
+		dm.log.Warnfln("Failed to delete deferred media %s in %s: %v", dm.MessageID, dm.PortalKey, err)
+	}
+}
@@ -0,0 +1,95 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// DirectMediaQuery stores the download info of WhatsApp media that is served directly by the bridge
+// instead of being reuploaded to the homeserver.
+type DirectMediaQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (dmq *DirectMediaQuery) New() *DirectMedia {
+	return &DirectMedia{
+		db:  dmq.db,
+		log: dmq.log,
+	}
+}
+
+const (
+	getDirectMediaQuery = `
+		SELECT media_id, user_mxid, message FROM direct_media WHERE media_id=$1
+	`
+	upsertDirectMediaQuery = `
+		INSERT INTO direct_media (media_id, user_mxid, message) VALUES ($1, $2, $3)
+		ON CONFLICT (media_id) DO UPDATE SET user_mxid=excluded.user_mxid, message=excluded.message
+	`
+)
+
+func (dmq *DirectMediaQuery) Get(mediaID string) *DirectMedia {
+	return dmq.New().Scan(dmq.db.QueryRow(getDirectMediaQuery, mediaID))
+}
+
+type DirectMedia struct {
+	db  *Database
+	log log.Logger
+
+	MediaID  string
+	UserMXID id.UserID
+	// Message contains only the media message, which has the keys needed to download the file.
+	Message *waProto.Message
+}
+
+func (dm *DirectMedia) Scan(row dbutil.Scannable) *DirectMedia {
+	var raw []byte
+	err := row.Scan(&dm.MediaID, &dm.UserMXID, &raw)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			dm.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	dm.Message = &waProto.Message{}
+	if err = proto.Unmarshal(raw, dm.Message); err != nil {
+		dm.log.Warnfln("Failed to unmarshal direct media %s: %v", dm.MediaID, err)
+		return nil
+	}
+	return dm
+}
+
+func (dm *DirectMedia) Upsert() error {
+	raw, err := proto.Marshal(dm.Message)
+	if err != nil {
+		return err
+	}
+	_, err = dm.db.Exec(upsertDirectMediaQuery, dm.MediaID, dm.UserMXID, raw)
+	return err
+}
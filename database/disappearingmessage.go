@@ -54,15 +54,23 @@ func (dmq *DisappearingMessageQuery) NewWithValues(roomID id.RoomID, eventID id.
 }
 
 const (
+	getDisappearingMessageQuery = `
+		SELECT room_id, event_id, expire_in, expire_at, kept, keep_annotation FROM disappearing_message WHERE room_id=$1 AND event_id=$2
+	`
 	getAllScheduledDisappearingMessagesQuery = `
-		SELECT room_id, event_id, expire_in, expire_at FROM disappearing_message WHERE expire_at IS NOT NULL AND expire_at <= $1
+		SELECT room_id, event_id, expire_in, expire_at, kept, keep_annotation FROM disappearing_message
+		WHERE expire_at IS NOT NULL AND expire_at <= $1 AND kept=false
 	`
 	startUnscheduledDisappearingMessagesInRoomQuery = `
-		UPDATE disappearing_message SET expire_at=$1+expire_in WHERE room_id=$2 AND expire_at IS NULL
-		RETURNING room_id, event_id, expire_in, expire_at
+		UPDATE disappearing_message SET expire_at=$1+expire_in WHERE room_id=$2 AND expire_at IS NULL AND kept=false
+		RETURNING room_id, event_id, expire_in, expire_at, kept, keep_annotation
 	`
 )
 
+func (dmq *DisappearingMessageQuery) Get(roomID id.RoomID, eventID id.EventID) *DisappearingMessage {
+	return dmq.New().Scan(dmq.db.QueryRow(getDisappearingMessageQuery, roomID, eventID))
+}
+
 func (dmq *DisappearingMessageQuery) GetUpcomingScheduled(duration time.Duration) (messages []*DisappearingMessage) {
 	rows, err := dmq.db.Query(getAllScheduledDisappearingMessagesQuery, time.Now().Add(duration).UnixMilli())
 	if err != nil || rows == nil {
@@ -93,12 +101,17 @@ type DisappearingMessage struct {
 	EventID  id.EventID
 	ExpireIn time.Duration
 	ExpireAt time.Time
+
+	// Kept messages were kept in the chat by a participant, so they won't disappear until they're un-kept.
+	Kept           bool
+	KeepAnnotation id.EventID
 }
 
 func (msg *DisappearingMessage) Scan(row dbutil.Scannable) *DisappearingMessage {
 	var expireIn int64
 	var expireAt sql.NullInt64
-	err := row.Scan(&msg.RoomID, &msg.EventID, &expireIn, &expireAt)
+	var keepAnnotation sql.NullString
+	err := row.Scan(&msg.RoomID, &msg.EventID, &expireIn, &expireAt, &msg.Kept, &keepAnnotation)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			msg.log.Errorln("Database scan failed:", err)
@@ -109,6 +122,7 @@ func (msg *DisappearingMessage) Scan(row dbutil.Scannable) *DisappearingMessage
 	if expireAt.Valid {
 		msg.ExpireAt = time.UnixMilli(expireAt.Int64)
 	}
+	msg.KeepAnnotation = id.EventID(keepAnnotation.String)
 	return msg
 }
 
@@ -133,6 +147,30 @@ func (msg *DisappearingMessage) StartTimer() {
 	}
 }
 
+// SetKept marks the message as kept or un-kept. Un-kept messages get the given new expiry time if it's not zero.
+func (msg *DisappearingMessage) SetKept(kept bool, annotation id.EventID, expireAt time.Time) {
+	msg.Kept = kept
+	msg.KeepAnnotation = annotation
+	if !expireAt.IsZero() {
+		msg.ExpireAt = expireAt
+	}
+	var expireAtVal sql.NullInt64
+	if !msg.ExpireAt.IsZero() {
+		expireAtVal.Valid = true
+		expireAtVal.Int64 = msg.ExpireAt.UnixMilli()
+	}
+	var annotationVal sql.NullString
+	if len(annotation) > 0 {
+		annotationVal.Valid = true
+		annotationVal.String = annotation.String()
+	}
+	_, err := msg.db.Exec("UPDATE disappearing_message SET kept=$1, keep_annotation=$2, expire_at=$3 WHERE room_id=$4 AND event_id=$5",
+		kept, annotationVal, expireAtVal, msg.RoomID, msg.EventID)
+	if err != nil {
+		msg.log.Warnfln("Failed to update kept status of %s/%s: %v", msg.RoomID, msg.EventID, err)
+	}
+}
+
 func (msg *DisappearingMessage) Delete() {
 	_, err := msg.db.Exec("DELETE FROM disappearing_message WHERE room_id=$1 AND event_id=$2", msg.RoomID, msg.EventID)
 	if err != nil {
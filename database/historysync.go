@@ -54,6 +54,8 @@ type HistorySyncConversation struct {
 	EphemeralExpiration      *uint32
 	MarkedAsUnread           bool
 	UnreadCount              uint32
+	// ParticipantCount is only known for groups, it's zero for private chats.
+	ParticipantCount int
 }
 
 func (hsq *HistorySyncQuery) NewConversation() *HistorySyncConversation {
@@ -97,14 +99,14 @@ func (hsq *HistorySyncQuery) NewConversationWithValues(
 
 const (
 	getNMostRecentConversations = `
-		SELECT user_mxid, conversation_id, portal_jid, portal_receiver, last_message_timestamp, archived, pinned, mute_end_time, disappearing_mode, end_of_history_transfer_type, ephemeral_expiration, marked_as_unread, unread_count
+		SELECT user_mxid, conversation_id, portal_jid, portal_receiver, last_message_timestamp, archived, pinned, mute_end_time, disappearing_mode, end_of_history_transfer_type, ephemeral_expiration, marked_as_unread, unread_count, participant_count
 		  FROM history_sync_conversation
 		 WHERE user_mxid=$1
 		 ORDER BY last_message_timestamp DESC
 		 LIMIT $2
 	`
 	getConversationByPortal = `
-		SELECT user_mxid, conversation_id, portal_jid, portal_receiver, last_message_timestamp, archived, pinned, mute_end_time, disappearing_mode, end_of_history_transfer_type, ephemeral_expiration, marked_as_unread, unread_count
+		SELECT user_mxid, conversation_id, portal_jid, portal_receiver, last_message_timestamp, archived, pinned, mute_end_time, disappearing_mode, end_of_history_transfer_type, ephemeral_expiration, marked_as_unread, unread_count, participant_count
 		  FROM history_sync_conversation
 		 WHERE user_mxid=$1
 		   AND portal_jid=$2
@@ -114,15 +116,19 @@ const (
 
 func (hsc *HistorySyncConversation) Upsert() {
 	_, err := hsc.db.Exec(`
-		INSERT INTO history_sync_conversation (user_mxid, conversation_id, portal_jid, portal_receiver, last_message_timestamp, archived, pinned, mute_end_time, disappearing_mode, end_of_history_transfer_type, ephemeral_expiration, marked_as_unread, unread_count)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		INSERT INTO history_sync_conversation (user_mxid, conversation_id, portal_jid, portal_receiver, last_message_timestamp, archived, pinned, mute_end_time, disappearing_mode, end_of_history_transfer_type, ephemeral_expiration, marked_as_unread, unread_count, participant_count)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 		ON CONFLICT (user_mxid, conversation_id)
 		DO UPDATE SET
 			last_message_timestamp=CASE
 				WHEN EXCLUDED.last_message_timestamp > history_sync_conversation.last_message_timestamp THEN EXCLUDED.last_message_timestamp
 				ELSE history_sync_conversation.last_message_timestamp
 			END,
-			end_of_history_transfer_type=EXCLUDED.end_of_history_transfer_type
+			end_of_history_transfer_type=EXCLUDED.end_of_history_transfer_type,
+			participant_count=CASE
+				WHEN EXCLUDED.participant_count > 0 THEN EXCLUDED.participant_count
+				ELSE history_sync_conversation.participant_count
+			END
 	`,
 		hsc.UserID,
 		hsc.ConversationID,
@@ -136,7 +142,8 @@ func (hsc *HistorySyncConversation) Upsert() {
 		hsc.EndOfHistoryTransferType,
 		hsc.EphemeralExpiration,
 		hsc.MarkedAsUnread,
-		hsc.UnreadCount)
+		hsc.UnreadCount,
+		hsc.ParticipantCount)
 	if err != nil {
 		hsc.log.Warnfln("Failed to insert history sync conversation %s/%s: %v", hsc.UserID, hsc.ConversationID, err)
 	}
@@ -156,7 +163,8 @@ func (hsc *HistorySyncConversation) Scan(row dbutil.Scannable) *HistorySyncConve
 		&hsc.EndOfHistoryTransferType,
 		&hsc.EphemeralExpiration,
 		&hsc.MarkedAsUnread,
-		&hsc.UnreadCount)
+		&hsc.UnreadCount,
+		&hsc.ParticipantCount)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			hsc.log.Errorln("Database scan failed:", err)
@@ -0,0 +1,128 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// PendingHistorySync is a history sync payload that has been received but not fully stored yet.
+// Payloads are saved as soon as they arrive and only deleted after every conversation has been
+// processed, so that an interrupted import is resumed on the next start instead of being lost.
+type PendingHistorySync struct {
+	db  *Database
+	log log.Logger
+
+	UserID     id.UserID
+	ReceivedAt int64
+	Data       *waProto.HistorySync
+	Processed  int
+}
+
+const (
+	insertPendingHistorySyncQuery = `
+		INSERT INTO history_sync_pending (user_mxid, received_at, data, processed) VALUES ($1, $2, $3, 0)
+	`
+	getPendingHistorySyncsQuery = `
+		SELECT user_mxid, received_at, data, processed FROM history_sync_pending WHERE user_mxid=$1 ORDER BY received_at
+	`
+)
+
+// NewPending stores a received history sync payload. The payload is returned even if storing it fails,
+// so that it can still be processed.
+func (hsq *HistorySyncQuery) NewPending(userID id.UserID, data *waProto.HistorySync) (*PendingHistorySync, error) {
+	pending := &PendingHistorySync{
+		db:         hsq.db,
+		log:        hsq.log,
+		UserID:     userID,
+		ReceivedAt: time.Now().UnixNano(),
+		Data:       data,
+	}
+	raw, err := proto.Marshal(data)
+	if err != nil {
+		return pending, err
+	}
+	_, err = hsq.db.Exec(insertPendingHistorySyncQuery, pending.UserID, pending.ReceivedAt, raw)
+	return pending, err
+}
+
+// GetPending returns the history sync payloads of the user that weren't fully processed before the last shutdown.
+func (hsq *HistorySyncQuery) GetPending(userID id.UserID) (pending []*PendingHistorySync) {
+	rows, err := hsq.db.Query(getPendingHistorySyncsQuery, userID)
+	if err != nil || rows == nil {
+		return nil
+	}
+	var undecodable []*PendingHistorySync
+	for rows.Next() {
+		item := (&PendingHistorySync{db: hsq.db, log: hsq.log}).Scan(rows)
+		if item == nil {
+			continue
+		} else if item.Data == nil {
+			undecodable = append(undecodable, item)
+		} else {
+			pending = append(pending, item)
+		}
+	}
+	// Deleting while the cursor is open can block with SQLite, so undecodable payloads are deleted afterwards
+	_ = rows.Close()
+	for _, item := range undecodable {
+		item.Delete()
+	}
+	return
+}
+
+func (phs *PendingHistorySync) Scan(row dbutil.Scannable) *PendingHistorySync {
+	var raw []byte
+	err := row.Scan(&phs.UserID, &phs.ReceivedAt, &raw, &phs.Processed)
+	if err != nil {
+		phs.log.Errorln("Database scan failed:", err)
+		return nil
+	}
+	phs.Data = &waProto.HistorySync{}
+	if err = proto.Unmarshal(raw, phs.Data); err != nil {
+		// Data is left nil so that the caller can delete the payload
+		phs.log.Errorfln("Failed to unmarshal pending history sync of %s from %d: %v", phs.UserID, phs.ReceivedAt, err)
+		phs.Data = nil
+	}
+	return phs
+}
+
+// MarkProcessed stores how many conversations of the payload have been stored.
+func (phs *PendingHistorySync) MarkProcessed(count int) {
+	phs.Processed = count
+	_, err := phs.db.Exec("UPDATE history_sync_pending SET processed=$1 WHERE user_mxid=$2 AND received_at=$3", count, phs.UserID, phs.ReceivedAt)
+	if err != nil {
+		phs.log.Warnfln("Failed to update progress of pending history sync of %s from %d: %v", phs.UserID, phs.ReceivedAt, err)
+	}
+}
+
+// Delete removes the payload after it has been fully processed.
+func (phs *PendingHistorySync) Delete() {
+	_, err := phs.db.Exec("DELETE FROM history_sync_pending WHERE user_mxid=$1 AND received_at=$2", phs.UserID, phs.ReceivedAt)
+	if err != nil {
+		phs.log.Warnfln("Failed to delete pending history sync of %s from %d: %v", phs.UserID, phs.ReceivedAt, err)
+	}
+}
@@ -0,0 +1,125 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type InteractiveKind string
+
+const (
+	InteractiveButtons  InteractiveKind = "buttons"
+	InteractiveTemplate InteractiveKind = "template"
+	InteractiveList     InteractiveKind = "list"
+)
+
+// InteractiveMessageQuery stores the selectable options of bridged business messages (buttons, templates and lists),
+// so that Matrix replies to them can be sent as the corresponding WhatsApp response message.
+type InteractiveMessageQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (imq *InteractiveMessageQuery) New() *InteractiveMessage {
+	return &InteractiveMessage{
+		db:  imq.db,
+		log: imq.log,
+	}
+}
+
+const (
+	getInteractiveMessageQuery = `
+		SELECT chat_jid, chat_receiver, jid, kind, options FROM interactive_message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3
+	`
+	upsertInteractiveMessageQuery = `
+		INSERT INTO interactive_message (chat_jid, chat_receiver, jid, kind, options) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (chat_jid, chat_receiver, jid) DO UPDATE SET kind=excluded.kind, options=excluded.options
+	`
+)
+
+func (imq *InteractiveMessageQuery) GetByJID(chat PortalKey, jid string) *InteractiveMessage {
+	return imq.New().Scan(imq.db.QueryRow(getInteractiveMessageQuery, chat.JID, chat.Receiver, jid))
+}
+
+type InteractiveOption struct {
+	// Number is the position of the option in the list shown on Matrix.
+	Number      int    `json:"number"`
+	ID          string `json:"id"`
+	Text        string `json:"text"`
+	Description string `json:"description,omitempty"`
+	Index       int    `json:"index"`
+}
+
+type InteractiveMessage struct {
+	db  *Database
+	log log.Logger
+
+	Chat    PortalKey
+	JID     string
+	Kind    InteractiveKind
+	Options []InteractiveOption
+}
+
+func (im *InteractiveMessage) Scan(row dbutil.Scannable) *InteractiveMessage {
+	var rawOptions string
+	err := row.Scan(&im.Chat.JID, &im.Chat.Receiver, &im.JID, &im.Kind, &rawOptions)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			im.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	err = json.Unmarshal([]byte(rawOptions), &im.Options)
+	if err != nil {
+		im.log.Warnfln("Failed to parse options of %s in %s: %v", im.JID, im.Chat, err)
+		return nil
+	}
+	return im
+}
+
+func (im *InteractiveMessage) Upsert() {
+	rawOptions, err := json.Marshal(im.Options)
+	if err != nil {
+		im.log.Warnfln("Failed to marshal options of %s in %s: %v", im.JID, im.Chat, err)
+		return
+	}
+	_, err = im.db.Exec(upsertInteractiveMessageQuery, im.Chat.JID, im.Chat.Receiver, im.JID, im.Kind, string(rawOptions))
+	if err != nil {
+		im.log.Warnfln("Failed to upsert options of %s in %s: %v", im.JID, im.Chat, err)
+	}
+}
+
+// Match finds the option selected by a text reply, which can either be the option text or its number in the list.
+func (im *InteractiveMessage) Match(text string) *InteractiveOption {
+	text = strings.TrimSpace(text)
+	num, err := strconv.Atoi(text)
+	for i, option := range im.Options {
+		if (err == nil && option.Number == num) || strings.EqualFold(option.Text, text) {
+			return &im.Options[i]
+		}
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -45,27 +46,39 @@ func (mq *MessageQuery) New() *Message {
 const (
 	getAllMessagesQuery = `
 		SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, type, error, broadcast_list_jid FROM message
-		WHERE chat_jid=$1 AND chat_receiver=$2
+		WHERE chat_jid=$1 AND chat_receiver=$2 AND deleted_at IS NULL
 	`
 	getMessageByJIDQuery = `
 		SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, type, error, broadcast_list_jid FROM message
-		WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3
+		WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3 AND deleted_at IS NULL
 	`
 	getMessageByMXIDQuery = `
 		SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, type, error, broadcast_list_jid FROM message
-		WHERE mxid=$1
+		WHERE mxid=$1 AND deleted_at IS NULL
 	`
 	getLastMessageInChatQuery = `
 		SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, type, error, broadcast_list_jid FROM message
-		WHERE chat_jid=$1 AND chat_receiver=$2 AND timestamp<=$3 AND sent=true ORDER BY timestamp DESC LIMIT 1
+		WHERE chat_jid=$1 AND chat_receiver=$2 AND timestamp<=$3 AND sent=true AND deleted_at IS NULL ORDER BY timestamp DESC LIMIT 1
 	`
 	getFirstMessageInChatQuery = `
 		SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, type, error, broadcast_list_jid FROM message
-		WHERE chat_jid=$1 AND chat_receiver=$2 AND sent=true ORDER BY timestamp ASC LIMIT 1
+		WHERE chat_jid=$1 AND chat_receiver=$2 AND sent=true AND deleted_at IS NULL ORDER BY timestamp ASC LIMIT 1
+	`
+	getFirstMessageFromSenderQuery = `
+		SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, type, error, broadcast_list_jid FROM message
+		WHERE chat_jid=$1 AND chat_receiver=$2 AND (sender=$3 OR sender LIKE $4) AND timestamp>$5 AND type='message' AND error='' AND deleted_at IS NULL
+		ORDER BY timestamp ASC LIMIT 1
+	`
+	purgeDeletedMessageQuery = `
+		DELETE FROM message WHERE ((chat_jid=$1 AND chat_receiver=$2 AND jid=$3) OR mxid=$4) AND deleted_at IS NOT NULL
+	`
+	getSplitPartsQuery = `
+		SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, type, error, broadcast_list_jid FROM message
+		WHERE chat_jid=$1 AND chat_receiver=$2 AND mxid LIKE $3 ESCAPE '\' AND deleted_at IS NULL ORDER BY timestamp ASC
 	`
 	getMessagesBetweenQuery = `
 		SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, type, error, broadcast_list_jid FROM message
-		WHERE chat_jid=$1 AND chat_receiver=$2 AND timestamp>$3 AND timestamp<=$4 AND sent=true AND error='' ORDER BY timestamp ASC
+		WHERE chat_jid=$1 AND chat_receiver=$2 AND timestamp>$3 AND timestamp<=$4 AND sent=true AND error='' AND deleted_at IS NULL ORDER BY timestamp ASC
 	`
 )
 
@@ -88,6 +101,28 @@ func (mq *MessageQuery) GetByMXID(mxid id.EventID) *Message {
 	return mq.maybeScan(mq.db.QueryRow(getMessageByMXIDQuery, mxid))
 }
 
+const splitPartMXIDFormat = "net.maunium.whatsapp.fake::%s::part"
+
+// SplitPartMXID returns the fake event ID used for additional WhatsApp messages that a long Matrix message was split into.
+func SplitPartMXID(mxid id.EventID, part int) id.EventID {
+	return id.EventID(fmt.Sprintf(splitPartMXIDFormat+"%d", mxid, part))
+}
+
+// GetSplitParts returns the additional WhatsApp messages that the given Matrix message was split into.
+func (mq *MessageQuery) GetSplitParts(chat PortalKey, mxid id.EventID) (messages []*Message) {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	pattern := escaper.Replace(fmt.Sprintf(splitPartMXIDFormat, mxid)) + "%"
+	rows, err := mq.db.Query(getSplitPartsQuery, chat.JID, chat.Receiver, pattern)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		messages = append(messages, mq.New().Scan(rows))
+	}
+	return
+}
+
 func (mq *MessageQuery) GetLastInChat(chat PortalKey) *Message {
 	return mq.GetLastInChatBefore(chat, time.Now().Add(60*time.Second))
 }
@@ -105,6 +140,11 @@ func (mq *MessageQuery) GetFirstInChat(chat PortalKey) *Message {
 	return mq.maybeScan(mq.db.QueryRow(getFirstMessageInChatQuery, chat.JID, chat.Receiver))
 }
 
+func (mq *MessageQuery) GetFirstFromSenderSince(chat PortalKey, sender types.JID, minTimestamp time.Time) *Message {
+	sender = sender.ToNonAD()
+	return mq.maybeScan(mq.db.QueryRow(getFirstMessageFromSenderQuery, chat.JID, chat.Receiver, sender, sender.User+":%@"+sender.Server, minTimestamp.Unix()))
+}
+
 func (mq *MessageQuery) GetMessagesBetween(chat PortalKey, minTimestamp, maxTimestamp time.Time) (messages []*Message) {
 	rows, err := mq.db.Query(getMessagesBetweenQuery, chat.JID, chat.Receiver, minTimestamp.Unix(), maxTimestamp.Unix())
 	if err != nil || rows == nil {
@@ -138,6 +178,7 @@ const (
 	MsgFake     MessageType = "fake"
 	MsgNormal   MessageType = "message"
 	MsgReaction MessageType = "reaction"
+	MsgEdit     MessageType = "edit"
 )
 
 type Message struct {
@@ -193,11 +234,19 @@ func (msg *Message) Insert(txn dbutil.Transaction) {
 	args := []interface{}{
 		msg.Chat.JID, msg.Chat.Receiver, msg.JID, msg.MXID, sender, msg.Timestamp.Unix(), msg.Sent, msg.Type, msg.Error, msg.BroadcastListJID,
 	}
+	// A soft-deleted row with the same ID can't be restored anymore once the ID is reused
+	purgeArgs := []interface{}{msg.Chat.JID, msg.Chat.Receiver, msg.JID, msg.MXID}
 	var err error
 	if txn != nil {
-		_, err = txn.Exec(query, args...)
+		_, err = txn.Exec(purgeDeletedMessageQuery, purgeArgs...)
+		if err == nil {
+			_, err = txn.Exec(query, args...)
+		}
 	} else {
-		_, err = msg.db.Exec(query, args...)
+		_, err = msg.db.Exec(purgeDeletedMessageQuery, purgeArgs...)
+		if err == nil {
+			_, err = msg.db.Exec(query, args...)
+		}
 	}
 	if err != nil {
 		msg.log.Warnfln("Failed to insert %s@%s: %v", msg.Chat, msg.JID, err)
@@ -231,8 +280,43 @@ func (msg *Message) UpdateMXID(txn dbutil.Transaction, mxid id.EventID, newType
 }
 
 func (msg *Message) Delete() {
-	_, err := msg.db.Exec("DELETE FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3", msg.Chat.JID, msg.Chat.Receiver, msg.JID)
+	var err error
+	if msg.db.SoftDelete {
+		_, err = msg.db.Exec("UPDATE message SET deleted_at=$1 WHERE chat_jid=$2 AND chat_receiver=$3 AND jid=$4", time.Now().Unix(), msg.Chat.JID, msg.Chat.Receiver, msg.JID)
+	} else {
+		_, err = msg.db.Exec("DELETE FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3", msg.Chat.JID, msg.Chat.Receiver, msg.JID)
+	}
 	if err != nil {
 		msg.log.Warnfln("Failed to delete %s@%s: %v", msg.Chat, msg.JID, err)
 	}
 }
+
+// ChangeSender replaces the sender of all messages and reactions sent by the given user (from any device)
+// in the portals that belong to the given receiver, which is used when the bridge user changes their own phone number.
+func (mq *MessageQuery) ChangeSender(receiver, oldSender, newSender types.JID) {
+	receiver, oldSender, newSender = receiver.ToNonAD(), oldSender.ToNonAD(), newSender.ToNonAD()
+	devicePattern := oldSender.User + ":%@" + oldSender.Server
+	_, err := mq.db.Exec("UPDATE message SET sender=$1 WHERE chat_receiver=$2 AND (sender=$3 OR sender LIKE $4)", newSender, receiver, oldSender, devicePattern)
+	if err != nil {
+		mq.log.Warnfln("Failed to change sender of messages from %s to %s: %v", oldSender, newSender, err)
+	}
+	_, err = mq.db.Exec("UPDATE reaction SET sender=$1 WHERE chat_receiver=$2 AND (sender=$3 OR sender LIKE $4)", newSender, receiver, oldSender, devicePattern)
+	if err != nil {
+		mq.log.Warnfln("Failed to change sender of reactions from %s to %s: %v", oldSender, newSender, err)
+	}
+}
+
+// HasSentInChat checks if the given user has sent any messages in the given chat from any of their devices.
+// Soft-deleted messages are ignored, so chats whose messages were purged count as new chats again.
+func (mq *MessageQuery) HasSentInChat(chat PortalKey, sender types.JID) bool {
+	sender = sender.ToNonAD()
+	var exists bool
+	err := mq.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND (sender=$3 OR sender LIKE $4) AND deleted_at IS NULL)",
+		chat.JID, chat.Receiver, sender, sender.User+":%@"+sender.Server,
+	).Scan(&exists)
+	if err != nil {
+		mq.log.Warnfln("Failed to check if %s has sent messages in %s: %v", sender, chat, err)
+	}
+	return exists
+}
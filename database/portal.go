@@ -65,26 +65,31 @@ func (pq *PortalQuery) New() *Portal {
 	}
 }
 
-const portalColumns = "jid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set, encrypted, last_sync, first_event_id, next_batch_id, relay_user_id, expiration_time"
+const portalColumns = "jid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set, encrypted, last_sync, first_event_id, next_batch_id, relay_user_id, expiration_time, notice_language"
 
 func (pq *PortalQuery) GetAll() []*Portal {
-	return pq.getAll(fmt.Sprintf("SELECT %s FROM portal", portalColumns))
+	return pq.getAll(fmt.Sprintf("SELECT %s FROM portal WHERE deleted_at IS NULL", portalColumns))
 }
 
 func (pq *PortalQuery) GetByJID(key PortalKey) *Portal {
-	return pq.get(fmt.Sprintf("SELECT %s FROM portal WHERE jid=$1 AND receiver=$2", portalColumns), key.JID, key.Receiver)
+	return pq.get(fmt.Sprintf("SELECT %s FROM portal WHERE jid=$1 AND receiver=$2 AND deleted_at IS NULL", portalColumns), key.JID, key.Receiver)
+}
+
+// GetDeleted returns a soft-deleted portal that hasn't been purged yet.
+func (pq *PortalQuery) GetDeleted(key PortalKey) *Portal {
+	return pq.get(fmt.Sprintf("SELECT %s FROM portal WHERE jid=$1 AND receiver=$2 AND deleted_at IS NOT NULL", portalColumns), key.JID, key.Receiver)
 }
 
 func (pq *PortalQuery) GetByMXID(mxid id.RoomID) *Portal {
-	return pq.get(fmt.Sprintf("SELECT %s FROM portal WHERE mxid=$1", portalColumns), mxid)
+	return pq.get(fmt.Sprintf("SELECT %s FROM portal WHERE mxid=$1 AND deleted_at IS NULL", portalColumns), mxid)
 }
 
 func (pq *PortalQuery) GetAllByJID(jid types.JID) []*Portal {
-	return pq.getAll(fmt.Sprintf("SELECT %s FROM portal WHERE jid=$1", portalColumns), jid.ToNonAD())
+	return pq.getAll(fmt.Sprintf("SELECT %s FROM portal WHERE jid=$1 AND deleted_at IS NULL", portalColumns), jid.ToNonAD())
 }
 
 func (pq *PortalQuery) FindPrivateChats(receiver types.JID) []*Portal {
-	return pq.getAll(fmt.Sprintf("SELECT %s FROM portal WHERE receiver=$1 AND jid LIKE '%%@s.whatsapp.net'", portalColumns), receiver.ToNonAD())
+	return pq.getAll(fmt.Sprintf("SELECT %s FROM portal WHERE receiver=$1 AND jid LIKE '%%@s.whatsapp.net' AND deleted_at IS NULL", portalColumns), receiver.ToNonAD())
 }
 
 func (pq *PortalQuery) FindPrivateChatsNotInSpace(receiver types.JID) (keys []PortalKey) {
@@ -92,7 +97,7 @@ func (pq *PortalQuery) FindPrivateChatsNotInSpace(receiver types.JID) (keys []Po
 	rows, err := pq.db.Query(`
 		SELECT jid FROM portal
 		    LEFT JOIN user_portal ON portal.jid=user_portal.portal_jid AND portal.receiver=user_portal.portal_receiver
-		WHERE mxid<>'' AND receiver=$1 AND (in_space=false OR in_space IS NULL)
+		WHERE mxid<>'' AND receiver=$1 AND (in_space=false OR in_space IS NULL) AND deleted_at IS NULL
 	`, receiver)
 	if err != nil || rows == nil {
 		return
@@ -151,12 +156,13 @@ type Portal struct {
 	RelayUserID id.UserID
 
 	ExpirationTime uint32
+	NoticeLanguage string
 }
 
 func (portal *Portal) Scan(row dbutil.Scannable) *Portal {
 	var mxid, avatarURL, firstEventID, nextBatchID, relayUserID sql.NullString
 	var lastSyncTs int64
-	err := row.Scan(&portal.Key.JID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.NameSet, &portal.Topic, &portal.TopicSet, &portal.Avatar, &avatarURL, &portal.AvatarSet, &portal.Encrypted, &lastSyncTs, &firstEventID, &nextBatchID, &relayUserID, &portal.ExpirationTime)
+	err := row.Scan(&portal.Key.JID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.NameSet, &portal.Topic, &portal.TopicSet, &portal.Avatar, &avatarURL, &portal.AvatarSet, &portal.Encrypted, &lastSyncTs, &firstEventID, &nextBatchID, &relayUserID, &portal.ExpirationTime, &portal.NoticeLanguage)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			portal.log.Errorln("Database scan failed:", err)
@@ -196,14 +202,19 @@ func (portal *Portal) lastSyncTs() int64 {
 }
 
 func (portal *Portal) Insert() {
-	_, err := portal.db.Exec(`
+	// Creating a new portal for the same chat means the soft-deleted one can't be restored anymore
+	_, err := portal.db.Exec("DELETE FROM portal WHERE jid=$1 AND receiver=$2 AND deleted_at IS NOT NULL", portal.Key.JID, portal.Key.Receiver)
+	if err != nil {
+		portal.log.Warnfln("Failed to purge deleted %s before inserting: %v", portal.Key, err)
+	}
+	_, err = portal.db.Exec(`
 		INSERT INTO portal (jid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
-		                    encrypted, last_sync, first_event_id, next_batch_id, relay_user_id, expiration_time)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		                    encrypted, last_sync, first_event_id, next_batch_id, relay_user_id, expiration_time, notice_language)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 	`,
 		portal.Key.JID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.NameSet, portal.Topic, portal.TopicSet,
 		portal.Avatar, portal.AvatarURL.String(), portal.AvatarSet, portal.Encrypted, portal.lastSyncTs(),
-		portal.FirstEventID.String(), portal.NextBatchID.String(), portal.relayUserPtr(), portal.ExpirationTime)
+		portal.FirstEventID.String(), portal.NextBatchID.String(), portal.relayUserPtr(), portal.ExpirationTime, portal.NoticeLanguage)
 	if err != nil {
 		portal.log.Warnfln("Failed to insert %s: %v", portal.Key, err)
 	}
@@ -213,13 +224,14 @@ func (portal *Portal) Update(txn dbutil.Transaction) {
 	query := `
 		UPDATE portal
 		SET mxid=$1, name=$2, name_set=$3, topic=$4, topic_set=$5, avatar=$6, avatar_url=$7, avatar_set=$8,
-		    encrypted=$9, last_sync=$10, first_event_id=$11, next_batch_id=$12, relay_user_id=$13, expiration_time=$14
-		WHERE jid=$15 AND receiver=$16
+		    encrypted=$9, last_sync=$10, first_event_id=$11, next_batch_id=$12, relay_user_id=$13, expiration_time=$14,
+		    notice_language=$15
+		WHERE jid=$16 AND receiver=$17
 	`
 	args := []interface{}{
 		portal.mxidPtr(), portal.Name, portal.NameSet, portal.Topic, portal.TopicSet, portal.Avatar, portal.AvatarURL.String(),
 		portal.AvatarSet, portal.Encrypted, portal.lastSyncTs(), portal.FirstEventID.String(), portal.NextBatchID.String(),
-		portal.relayUserPtr(), portal.ExpirationTime, portal.Key.JID, portal.Key.Receiver,
+		portal.relayUserPtr(), portal.ExpirationTime, portal.NoticeLanguage, portal.Key.JID, portal.Key.Receiver,
 	}
 	var err error
 	if txn != nil {
@@ -233,8 +245,111 @@ func (portal *Portal) Update(txn dbutil.Transaction) {
 }
 
 func (portal *Portal) Delete() {
-	_, err := portal.db.Exec("DELETE FROM portal WHERE jid=$1 AND receiver=$2", portal.Key.JID, portal.Key.Receiver)
+	var err error
+	if portal.db.SoftDelete {
+		now := time.Now().Unix()
+		_, err = portal.db.Exec("UPDATE portal SET deleted_at=$1 WHERE jid=$2 AND receiver=$3", now, portal.Key.JID, portal.Key.Receiver)
+		if err == nil {
+			_, err = portal.db.Exec("UPDATE message SET deleted_at=$1 WHERE chat_jid=$2 AND chat_receiver=$3 AND deleted_at IS NULL", now, portal.Key.JID, portal.Key.Receiver)
+		}
+	} else {
+		_, err = portal.db.Exec("DELETE FROM portal WHERE jid=$1 AND receiver=$2", portal.Key.JID, portal.Key.Receiver)
+	}
 	if err != nil {
 		portal.log.Warnfln("Failed to delete %s: %v", portal.Key, err)
 	}
 }
+
+// portalKeyTables lists the tables that refer to a portal key without ON UPDATE CASCADE,
+// in the form of table name, JID column and receiver column.
+var portalKeyTables = [][3]string{
+	{"message", "chat_jid", "chat_receiver"},
+	{"user_portal", "portal_jid", "portal_receiver"},
+	{"backfill_queue", "portal_jid", "portal_receiver"},
+	{"backfill_state", "portal_jid", "portal_receiver"},
+	{"media_backfill_requests", "portal_jid", "portal_receiver"},
+	{"history_sync_conversation", "portal_jid", "portal_receiver"},
+}
+
+// ChangeKey moves the portal, its messages and other related rows to a new key, e.g. when the other user
+// of a private chat changed their phone number. Any existing portal row with the new key is replaced.
+func (portal *Portal) ChangeKey(newKey PortalKey) (err error) {
+	txn, err := portal.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+	oldKey := portal.Key
+	_, err = txn.Exec("DELETE FROM portal WHERE jid=$1 AND receiver=$2", newKey.JID, newKey.Receiver)
+	if err != nil {
+		return fmt.Errorf("failed to delete existing portal with new key: %w", err)
+	}
+	// The room ID is moved to the new row only after the old one is deleted, as it must be unique
+	_, err = txn.Exec(`
+		INSERT INTO portal (jid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
+		                    encrypted, last_sync, first_event_id, next_batch_id, relay_user_id, expiration_time, notice_language)
+		SELECT $3, $4, NULL, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
+		       encrypted, last_sync, first_event_id, next_batch_id, relay_user_id, expiration_time, notice_language
+		FROM portal WHERE jid=$1 AND receiver=$2
+	`, oldKey.JID, oldKey.Receiver, newKey.JID, newKey.Receiver)
+	if err != nil {
+		return fmt.Errorf("failed to copy portal: %w", err)
+	}
+	for _, table := range portalKeyTables {
+		_, err = txn.Exec(
+			fmt.Sprintf("UPDATE %[1]s SET %[2]s=$1, %[3]s=$2 WHERE %[2]s=$3 AND %[3]s=$4", table[0], table[1], table[2]),
+			newKey.JID, newKey.Receiver, oldKey.JID, oldKey.Receiver)
+		if err != nil {
+			return fmt.Errorf("failed to move rows in %s: %w", table[0], err)
+		}
+	}
+	_, err = txn.Exec("DELETE FROM portal WHERE jid=$1 AND receiver=$2", oldKey.JID, oldKey.Receiver)
+	if err != nil {
+		return fmt.Errorf("failed to delete old portal: %w", err)
+	}
+	_, err = txn.Exec("UPDATE portal SET mxid=$1 WHERE jid=$2 AND receiver=$3", portal.mxidPtr(), newKey.JID, newKey.Receiver)
+	if err != nil {
+		return fmt.Errorf("failed to move room ID: %w", err)
+	}
+	if err = txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	portal.Key = newKey
+	return nil
+}
+
+// Undelete restores a soft-deleted portal and the messages that were deleted along with it. The Matrix room
+// was cleaned up when the portal was deleted, so the room ID is cleared and a new room has to be created for the portal.
+func (portal *Portal) Undelete() (err error) {
+	txn, err := portal.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+	// Messages that were deleted separately before the portal was deleted stay deleted
+	_, err = txn.Exec(`
+		UPDATE message SET deleted_at=NULL
+		WHERE chat_jid=$1 AND chat_receiver=$2
+		  AND deleted_at=(SELECT deleted_at FROM portal WHERE jid=$1 AND receiver=$2)
+	`, portal.Key.JID, portal.Key.Receiver)
+	if err != nil {
+		return fmt.Errorf("failed to restore messages: %w", err)
+	}
+	_, err = txn.Exec("UPDATE portal SET deleted_at=NULL, mxid=NULL WHERE jid=$1 AND receiver=$2", portal.Key.JID, portal.Key.Receiver)
+	if err != nil {
+		return fmt.Errorf("failed to restore portal: %w", err)
+	}
+	if err = txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	portal.MXID = ""
+	return nil
+}
@@ -0,0 +1,109 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// ReuploadedMediaQuery stores the mxc URIs of WhatsApp media that has been uploaded to the homeserver,
+// keyed by the SHA-256 hash of the file, so the same file is only uploaded once.
+// Files for encrypted rooms are stored separately along with their encryption keys.
+type ReuploadedMediaQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (rmq *ReuploadedMediaQuery) New() *ReuploadedMedia {
+	return &ReuploadedMedia{
+		db:  rmq.db,
+		log: rmq.log,
+	}
+}
+
+const (
+	getReuploadedMediaQuery = `
+		SELECT sha256, encrypted, mxc, file, mime_type, size FROM reuploaded_media WHERE sha256=$1 AND encrypted=$2
+	`
+	upsertReuploadedMediaQuery = `
+		INSERT INTO reuploaded_media (sha256, encrypted, mxc, file, mime_type, size) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (sha256, encrypted) DO UPDATE
+			SET mxc=excluded.mxc, file=excluded.file, mime_type=excluded.mime_type, size=excluded.size
+	`
+)
+
+func (rmq *ReuploadedMediaQuery) Get(sha256 []byte, encrypted bool) *ReuploadedMedia {
+	return rmq.New().Scan(rmq.db.QueryRow(getReuploadedMediaQuery, sha256, encrypted))
+}
+
+type ReuploadedMedia struct {
+	db  *Database
+	log log.Logger
+
+	SHA256    []byte
+	Encrypted bool
+	MXC       id.ContentURIString
+	// File is the encryption info of the file, which is only set for files uploaded to encrypted rooms.
+	File     *event.EncryptedFileInfo
+	MimeType string
+	Size     int64
+}
+
+func (rm *ReuploadedMedia) Scan(row dbutil.Scannable) *ReuploadedMedia {
+	var file sql.NullString
+	err := row.Scan(&rm.SHA256, &rm.Encrypted, &rm.MXC, &file, &rm.MimeType, &rm.Size)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			rm.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	if file.Valid {
+		rm.File = &event.EncryptedFileInfo{}
+		err = json.Unmarshal([]byte(file.String), rm.File)
+		if err != nil {
+			rm.log.Warnfln("Failed to parse encryption info of reuploaded media %s: %v", rm.MXC, err)
+			return nil
+		}
+	}
+	return rm
+}
+
+func (rm *ReuploadedMedia) Upsert() {
+	var file *string
+	if rm.File != nil {
+		data, err := json.Marshal(rm.File)
+		if err != nil {
+			rm.log.Warnfln("Failed to serialize encryption info of reuploaded media %s: %v", rm.MXC, err)
+			return
+		}
+		str := string(data)
+		file = &str
+	}
+	_, err := rm.db.Exec(upsertReuploadedMediaQuery, rm.SHA256, rm.Encrypted, rm.MXC, file, rm.MimeType, rm.Size)
+	if err != nil {
+		rm.log.Warnfln("Failed to store reuploaded media %s: %v", rm.MXC, err)
+	}
+}
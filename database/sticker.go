@@ -0,0 +1,119 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type StickerQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (sq *StickerQuery) New() *Sticker {
+	return &Sticker{
+		db:  sq.db,
+		log: sq.log,
+	}
+}
+
+const (
+	getStickersByShortcodeQuery = `
+		SELECT user_mxid, shortcode, pack, body, mxc, data, animated FROM sticker WHERE user_mxid=$1 AND shortcode=$2 ORDER BY pack
+	`
+	getAllStickersQuery = `
+		SELECT user_mxid, shortcode, pack, body, mxc, data, animated FROM sticker WHERE user_mxid=$1 ORDER BY pack, shortcode
+	`
+	upsertStickerQuery = `
+		INSERT INTO sticker (user_mxid, shortcode, pack, body, mxc, data, animated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_mxid, pack, shortcode) DO UPDATE
+			SET body=excluded.body, mxc=excluded.mxc, data=excluded.data, animated=excluded.animated
+	`
+	deleteStickerPackQuery = `
+		DELETE FROM sticker WHERE user_mxid=$1 AND pack=$2
+	`
+)
+
+// GetByShortcode returns the stickers with the given shortcode in all of the user's packs.
+func (sq *StickerQuery) GetByShortcode(userID id.UserID, shortcode string) []*Sticker {
+	return sq.getAll(getStickersByShortcodeQuery, userID, shortcode)
+}
+
+func (sq *StickerQuery) GetAll(userID id.UserID) []*Sticker {
+	return sq.getAll(getAllStickersQuery, userID)
+}
+
+func (sq *StickerQuery) getAll(query string, args ...interface{}) (stickers []*Sticker) {
+	rows, err := sq.db.Query(query, args...)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		stickers = append(stickers, sq.New().Scan(rows))
+	}
+	return
+}
+
+func (sq *StickerQuery) DeletePack(userID id.UserID, pack string) {
+	_, err := sq.db.Exec(deleteStickerPackQuery, userID, pack)
+	if err != nil {
+		sq.log.Warnfln("Failed to delete sticker pack %s of %s: %v", pack, userID, err)
+	}
+}
+
+// Sticker is a WhatsApp-compatible WebP sticker imported from a Matrix or Telegram sticker pack.
+type Sticker struct {
+	db  *Database
+	log log.Logger
+
+	UserMXID  id.UserID
+	Shortcode string
+	Pack      string
+	Body      string
+	MXC       id.ContentURI
+	Data      []byte
+	Animated  bool
+}
+
+func (sticker *Sticker) Scan(row dbutil.Scannable) *Sticker {
+	var mxc string
+	err := row.Scan(&sticker.UserMXID, &sticker.Shortcode, &sticker.Pack, &sticker.Body, &mxc, &sticker.Data, &sticker.Animated)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			sticker.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	sticker.MXC, _ = id.ParseContentURI(mxc)
+	return sticker
+}
+
+func (sticker *Sticker) Upsert() {
+	_, err := sticker.db.Exec(upsertStickerQuery, sticker.UserMXID, sticker.Shortcode, sticker.Pack, sticker.Body, sticker.MXC.String(), sticker.Data, sticker.Animated)
+	if err != nil {
+		sticker.log.Warnfln("Failed to upsert sticker %s of %s: %v", sticker.Shortcode, sticker.UserMXID, err)
+	}
+}
@@ -1,4 +1,4 @@
--- v0 -> v52: Latest revision
+-- v0 -> v71: Latest revision
 
 CREATE TABLE "user" (
     mxid     TEXT PRIMARY KEY,
@@ -12,7 +12,56 @@ CREATE TABLE "user" (
     phone_last_seen   BIGINT,
     phone_last_pinged BIGINT,
 
-    timezone TEXT
+    timezone TEXT,
+
+    auto_create_dm_portals BOOLEAN,
+
+    previous_username TEXT,
+    first_activity_ts BIGINT,
+    device_name       TEXT
+);
+
+CREATE TABLE user_settings (
+    user_mxid            TEXT PRIMARY KEY,
+    enable_presence      BOOLEAN,
+    enable_receipts      BOOLEAN,
+    relay_opt_in         BOOLEAN,
+    request_full_history BOOLEAN,
+
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE user_contact_sync (
+    user_mxid TEXT PRIMARY KEY,
+    version   BIGINT NOT NULL,
+    hash      bytea NOT NULL,
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE user_contact_sync_progress (
+    user_mxid TEXT,
+    jid       TEXT,
+    PRIMARY KEY (user_mxid, jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE user_blocked_contact (
+    user_mxid TEXT,
+    jid       TEXT,
+    PRIMARY KEY (user_mxid, jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE sticker (
+    user_mxid TEXT,
+    pack      TEXT,
+    shortcode TEXT,
+    body      TEXT NOT NULL,
+    mxc       TEXT NOT NULL,
+    data      bytea NOT NULL,
+    animated  BOOLEAN NOT NULL DEFAULT false,
+    PRIMARY KEY (user_mxid, pack, shortcode),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
 );
 
 CREATE TABLE portal (
@@ -33,6 +82,8 @@ CREATE TABLE portal (
     next_batch_id   TEXT,
     relay_user_id   TEXT,
     expiration_time BIGINT NOT NULL DEFAULT 0 CHECK (expiration_time >= 0 AND expiration_time < 4294967296),
+    notice_language TEXT NOT NULL DEFAULT '',
+    deleted_at      BIGINT,
 
     PRIMARY KEY (jid, receiver)
 );
@@ -55,7 +106,9 @@ CREATE TABLE puppet (
     enable_receipts BOOLEAN NOT NULL DEFAULT true,
 
     first_activity_ts BIGINT,
-    last_activity_ts BIGINT
+    last_activity_ts BIGINT,
+
+    defunct BOOLEAN NOT NULL DEFAULT false
 );
 
 -- only: postgres
@@ -73,6 +126,7 @@ CREATE TABLE message (
     type          TEXT,
 
     broadcast_list_jid TEXT,
+    deleted_at         BIGINT,
 
     PRIMARY KEY (chat_jid, chat_receiver, jid),
     FOREIGN KEY (chat_jid, chat_receiver) REFERENCES portal(jid, receiver) ON DELETE CASCADE
@@ -92,11 +146,27 @@ CREATE TABLE reaction (
         ON DELETE CASCADE ON UPDATE CASCADE
 );
 
+CREATE TABLE interactive_message (
+    chat_jid      TEXT,
+    chat_receiver TEXT,
+    jid           TEXT,
+    kind          TEXT NOT NULL,
+    options       TEXT NOT NULL,
+
+    PRIMARY KEY (chat_jid, chat_receiver, jid),
+    FOREIGN KEY (chat_jid, chat_receiver, jid) REFERENCES message(chat_jid, chat_receiver, jid)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
 CREATE TABLE disappearing_message (
     room_id   TEXT,
     event_id  TEXT,
     expire_in BIGINT NOT NULL,
     expire_at BIGINT,
+
+    kept            BOOLEAN NOT NULL DEFAULT false,
+    keep_annotation TEXT,
+
     PRIMARY KEY (room_id, event_id)
 );
 
@@ -157,6 +227,17 @@ CREATE TABLE media_backfill_requests (
     FOREIGN KEY (portal_jid, portal_receiver) REFERENCES portal(jid, receiver) ON UPDATE CASCADE ON DELETE CASCADE
 );
 
+CREATE TABLE deferred_media (
+    user_mxid       TEXT   NOT NULL,
+    portal_jid      TEXT   NOT NULL,
+    portal_receiver TEXT   NOT NULL,
+    message_id      TEXT   NOT NULL,
+    timestamp       BIGINT NOT NULL,
+    PRIMARY KEY (portal_jid, portal_receiver, message_id),
+    FOREIGN KEY (user_mxid)                   REFERENCES "user"(mxid)          ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (portal_jid, portal_receiver) REFERENCES portal(jid, receiver) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
 CREATE TABLE history_sync_conversation (
     user_mxid       TEXT,
     conversation_id TEXT,
@@ -172,6 +253,7 @@ CREATE TABLE history_sync_conversation (
     ephemeral_Expiration         INTEGER,
     marked_as_unread             BOOLEAN,
     unread_count                 INTEGER,
+    participant_count            INTEGER NOT NULL DEFAULT 0,
 
     PRIMARY KEY (user_mxid, conversation_id),
     FOREIGN KEY (user_mxid)                   REFERENCES "user"(mxid)          ON UPDATE CASCADE ON DELETE CASCADE,
@@ -190,3 +272,32 @@ CREATE TABLE history_sync_message (
     FOREIGN KEY (user_mxid)                  REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
     FOREIGN KEY (user_mxid, conversation_id) REFERENCES history_sync_conversation(user_mxid, conversation_id) ON DELETE CASCADE
 );
+
+CREATE TABLE history_sync_pending (
+    user_mxid   TEXT,
+    received_at BIGINT,
+    data        bytea   NOT NULL,
+    processed   INTEGER NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (user_mxid, received_at),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE direct_media (
+    media_id  TEXT PRIMARY KEY,
+    user_mxid TEXT  NOT NULL,
+    message   bytea NOT NULL,
+
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE reuploaded_media (
+    sha256    bytea   NOT NULL,
+    encrypted BOOLEAN NOT NULL,
+    mxc       TEXT    NOT NULL,
+    file      TEXT,
+    mime_type TEXT    NOT NULL,
+    size      BIGINT  NOT NULL,
+
+    PRIMARY KEY (sha256, encrypted)
+);
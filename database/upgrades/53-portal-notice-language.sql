@@ -0,0 +1,3 @@
+-- v53: Add per-portal language for system notices
+
+ALTER TABLE portal ADD COLUMN notice_language TEXT NOT NULL DEFAULT '';
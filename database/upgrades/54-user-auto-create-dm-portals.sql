@@ -0,0 +1,3 @@
+-- v54: Add per-user setting for automatically creating private chat portals
+
+ALTER TABLE "user" ADD COLUMN auto_create_dm_portals BOOLEAN;
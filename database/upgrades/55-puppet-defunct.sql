@@ -0,0 +1,3 @@
+-- v55: Add flag for puppets whose WhatsApp account has been deleted
+
+ALTER TABLE puppet ADD COLUMN defunct BOOLEAN NOT NULL DEFAULT false;
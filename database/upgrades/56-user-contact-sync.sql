@@ -0,0 +1,8 @@
+-- v56: Store the contact app state version that puppets were last synced at
+
+CREATE TABLE user_contact_sync (
+    user_mxid TEXT PRIMARY KEY,
+    version   BIGINT NOT NULL,
+    hash      bytea NOT NULL,
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,13 @@
+-- v57: Add table for imported sticker packs
+
+CREATE TABLE sticker (
+    user_mxid TEXT,
+    pack      TEXT,
+    shortcode TEXT,
+    body      TEXT NOT NULL,
+    mxc       TEXT NOT NULL,
+    data      bytea NOT NULL,
+    animated  BOOLEAN NOT NULL DEFAULT false,
+    PRIMARY KEY (user_mxid, pack, shortcode),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+-- v58: Add soft delete timestamps for portals and messages
+
+ALTER TABLE portal ADD COLUMN deleted_at BIGINT;
+ALTER TABLE message ADD COLUMN deleted_at BIGINT;
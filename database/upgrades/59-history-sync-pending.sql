@@ -0,0 +1,11 @@
+-- v59: Store received history sync payloads until they've been fully processed
+
+CREATE TABLE history_sync_pending (
+    user_mxid   TEXT,
+    received_at BIGINT,
+    data        bytea   NOT NULL,
+    processed   INTEGER NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (user_mxid, received_at),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
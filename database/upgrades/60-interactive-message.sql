@@ -0,0 +1,13 @@
+-- v60: Store options of bridged business messages for mapping replies
+
+CREATE TABLE interactive_message (
+    chat_jid      TEXT,
+    chat_receiver TEXT,
+    jid           TEXT,
+    kind          TEXT NOT NULL,
+    options       TEXT NOT NULL,
+
+    PRIMARY KEY (chat_jid, chat_receiver, jid),
+    FOREIGN KEY (chat_jid, chat_receiver, jid) REFERENCES message(chat_jid, chat_receiver, jid)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
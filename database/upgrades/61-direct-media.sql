@@ -0,0 +1,9 @@
+-- v61: Add table for WhatsApp media served directly by the bridge
+
+CREATE TABLE direct_media (
+    media_id  TEXT PRIMARY KEY,
+    user_mxid TEXT  NOT NULL,
+    message   bytea NOT NULL,
+
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,8 @@
+-- v62: Store progress of full contact resyncs so they can be resumed after a restart
+
+CREATE TABLE user_contact_sync_progress (
+    user_mxid TEXT,
+    jid       TEXT,
+    PRIMARY KEY (user_mxid, jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
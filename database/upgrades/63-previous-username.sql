@@ -0,0 +1,3 @@
+-- v63: Remember the previous phone number of logged out users to support migrating after a number change
+
+ALTER TABLE "user" ADD COLUMN previous_username TEXT;
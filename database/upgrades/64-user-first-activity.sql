@@ -0,0 +1,3 @@
+-- v64: Store when users linked their current WhatsApp session for warmup limits
+
+ALTER TABLE "user" ADD COLUMN first_activity_ts BIGINT;
@@ -0,0 +1,12 @@
+-- v65: Remember reuploaded WhatsApp media by the hash of the downloaded file to avoid uploading the same file multiple times
+
+CREATE TABLE reuploaded_media (
+    sha256    bytea   NOT NULL,
+    encrypted BOOLEAN NOT NULL,
+    mxc       TEXT    NOT NULL,
+    file      TEXT,
+    mime_type TEXT    NOT NULL,
+    size      BIGINT  NOT NULL,
+
+    PRIMARY KEY (sha256, encrypted)
+);
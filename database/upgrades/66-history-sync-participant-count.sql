@@ -0,0 +1,3 @@
+-- v66: Store participant counts of history sync conversations for backfill prioritization
+
+ALTER TABLE history_sync_conversation ADD COLUMN participant_count INTEGER NOT NULL DEFAULT 0;
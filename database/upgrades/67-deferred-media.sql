@@ -0,0 +1,12 @@
+-- v67: Add queue for media downloads deferred during backfill
+
+CREATE TABLE deferred_media (
+    user_mxid       TEXT   NOT NULL,
+    portal_jid      TEXT   NOT NULL,
+    portal_receiver TEXT   NOT NULL,
+    message_id      TEXT   NOT NULL,
+    timestamp       BIGINT NOT NULL,
+    PRIMARY KEY (portal_jid, portal_receiver, message_id),
+    FOREIGN KEY (user_mxid)                   REFERENCES "user"(mxid)          ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (portal_jid, portal_receiver) REFERENCES portal(jid, receiver) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- v68: Store custom linked device names of users
+
+ALTER TABLE "user" ADD COLUMN device_name TEXT;
@@ -0,0 +1,11 @@
+-- v69: Add table for per-user settings
+
+CREATE TABLE user_settings (
+    user_mxid            TEXT PRIMARY KEY,
+    enable_presence      BOOLEAN,
+    enable_receipts      BOOLEAN,
+    relay_opt_in         BOOLEAN,
+    request_full_history BOOLEAN,
+
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
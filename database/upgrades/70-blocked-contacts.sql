@@ -0,0 +1,8 @@
+-- v70: Add table for the last known WhatsApp block list of users
+
+CREATE TABLE user_blocked_contact (
+    user_mxid TEXT,
+    jid       TEXT,
+    PRIMARY KEY (user_mxid, jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
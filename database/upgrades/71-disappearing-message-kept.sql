@@ -0,0 +1,4 @@
+-- v71: Store disappearing messages that were kept in the chat on WhatsApp
+
+ALTER TABLE disappearing_message ADD COLUMN kept BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE disappearing_message ADD COLUMN keep_annotation TEXT;
@@ -18,6 +18,9 @@ package database
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,7 +48,7 @@ func (uq *UserQuery) New() *User {
 }
 
 func (uq *UserQuery) GetAll() (users []*User) {
-	rows, err := uq.db.Query(`SELECT mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone FROM "user"`)
+	rows, err := uq.db.Query(`SELECT mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone, auto_create_dm_portals FROM "user"`)
 	if err != nil || rows == nil {
 		return nil
 	}
@@ -57,7 +60,7 @@ func (uq *UserQuery) GetAll() (users []*User) {
 }
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	row := uq.db.QueryRow(`SELECT mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone FROM "user" WHERE mxid=$1`, userID)
+	row := uq.db.QueryRow(`SELECT mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone, auto_create_dm_portals FROM "user" WHERE mxid=$1`, userID)
 	if row == nil {
 		return nil
 	}
@@ -65,7 +68,7 @@ func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
 }
 
 func (uq *UserQuery) GetByUsername(username string) *User {
-	row := uq.db.QueryRow(`SELECT mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone FROM "user" WHERE username=$1`, username)
+	row := uq.db.QueryRow(`SELECT mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone, auto_create_dm_portals FROM "user" WHERE username=$1`, username)
 	if row == nil {
 		return nil
 	}
@@ -84,6 +87,9 @@ type User struct {
 	PhoneLastPinged time.Time
 	Timezone        string
 
+	// AutoCreateDMPortals overrides the bridge-wide auto_create_dm_portals setting if set.
+	AutoCreateDMPortals *bool
+
 	lastReadCache     map[PortalKey]time.Time
 	lastReadCacheLock sync.Mutex
 	inSpaceCache      map[PortalKey]bool
@@ -94,7 +100,8 @@ func (user *User) Scan(row dbutil.Scannable) *User {
 	var username, timezone sql.NullString
 	var device, agent sql.NullByte
 	var phoneLastSeen, phoneLastPinged sql.NullInt64
-	err := row.Scan(&user.MXID, &username, &agent, &device, &user.ManagementRoom, &user.SpaceRoom, &phoneLastSeen, &phoneLastPinged, &timezone)
+	var autoCreateDMPortals sql.NullBool
+	err := row.Scan(&user.MXID, &username, &agent, &device, &user.ManagementRoom, &user.SpaceRoom, &phoneLastSeen, &phoneLastPinged, &timezone, &autoCreateDMPortals)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			user.log.Errorln("Database scan failed:", err)
@@ -111,6 +118,9 @@ func (user *User) Scan(row dbutil.Scannable) *User {
 	if phoneLastPinged.Valid {
 		user.PhoneLastPinged = time.Unix(phoneLastPinged.Int64, 0)
 	}
+	if autoCreateDMPortals.Valid {
+		user.AutoCreateDMPortals = &autoCreateDMPortals.Bool
+	}
 	return user
 }
 
@@ -152,23 +162,260 @@ func (user *User) phoneLastPingedPtr() *int64 {
 }
 
 func (user *User) Insert() {
-	_, err := user.db.Exec(`INSERT INTO "user" (mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-		user.MXID, user.usernamePtr(), user.agentPtr(), user.devicePtr(), user.ManagementRoom, user.SpaceRoom, user.phoneLastSeenPtr(), user.phoneLastPingedPtr(), user.Timezone)
+	_, err := user.db.Exec(`INSERT INTO "user" (mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone, auto_create_dm_portals) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		user.MXID, user.usernamePtr(), user.agentPtr(), user.devicePtr(), user.ManagementRoom, user.SpaceRoom, user.phoneLastSeenPtr(), user.phoneLastPingedPtr(), user.Timezone, user.AutoCreateDMPortals)
 	if err != nil {
 		user.log.Warnfln("Failed to insert %s: %v", user.MXID, err)
 	}
 }
 
 func (user *User) Update() {
-	_, err := user.db.Exec(`UPDATE "user" SET username=$1, agent=$2, device=$3, management_room=$4, space_room=$5, phone_last_seen=$6, phone_last_pinged=$7, timezone=$8 WHERE mxid=$9`,
-		user.usernamePtr(), user.agentPtr(), user.devicePtr(), user.ManagementRoom, user.SpaceRoom, user.phoneLastSeenPtr(), user.phoneLastPingedPtr(), user.Timezone, user.MXID)
+	_, err := user.db.Exec(`UPDATE "user" SET username=$1, agent=$2, device=$3, management_room=$4, space_room=$5, phone_last_seen=$6, phone_last_pinged=$7, timezone=$8, auto_create_dm_portals=$9 WHERE mxid=$10`,
+		user.usernamePtr(), user.agentPtr(), user.devicePtr(), user.ManagementRoom, user.SpaceRoom, user.phoneLastSeenPtr(), user.phoneLastPingedPtr(), user.Timezone, user.AutoCreateDMPortals, user.MXID)
 	if err != nil {
 		user.log.Warnfln("Failed to update %s: %v", user.MXID, err)
 	}
 }
 
+// GetContactSyncState returns the contact app state version and hash that the user's puppets were last fully synced at.
+// A zero version is returned if the contacts have never been synced.
+func (user *User) GetContactSyncState() (version uint64, hash []byte) {
+	err := user.db.QueryRow("SELECT version, hash FROM user_contact_sync WHERE user_mxid=$1", user.MXID).Scan(&version, &hash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		user.log.Warnfln("Failed to get contact sync state of %s: %v", user.MXID, err)
+	}
+	return
+}
+
+func (user *User) SetContactSyncState(version uint64, hash []byte) {
+	_, err := user.db.Exec(`
+		INSERT INTO user_contact_sync (user_mxid, version, hash) VALUES ($1, $2, $3)
+		ON CONFLICT (user_mxid) DO UPDATE SET version=excluded.version, hash=excluded.hash
+	`, user.MXID, version, hash)
+	if err != nil {
+		user.log.Warnfln("Failed to store contact sync state of %s: %v", user.MXID, err)
+	}
+}
+
+// Delete removes the user and everything that references it, like portal memberships and backfill state.
+func (user *User) Delete() {
+	_, err := user.db.Exec(`DELETE FROM "user" WHERE mxid=$1`, user.MXID)
+	if err != nil {
+		user.log.Warnfln("Failed to delete %s: %v", user.MXID, err)
+	}
+}
+
+// GetPreviousUsername returns the phone number that the user was logged in with before the last logout,
+// or an empty string if it isn't known or the user has already logged back in with the same number.
+func (user *User) GetPreviousUsername() string {
+	var username sql.NullString
+	err := user.db.QueryRow(`SELECT previous_username FROM "user" WHERE mxid=$1`, user.MXID).Scan(&username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		user.log.Warnfln("Failed to get previous username of %s: %v", user.MXID, err)
+	}
+	return username.String
+}
+
+func (user *User) SetPreviousUsername(username string) {
+	var value *string
+	if len(username) > 0 {
+		value = &username
+	}
+	_, err := user.db.Exec(`UPDATE "user" SET previous_username=$1 WHERE mxid=$2`, value, user.MXID)
+	if err != nil {
+		user.log.Warnfln("Failed to set previous username of %s: %v", user.MXID, err)
+	}
+}
+
+// GetFirstActivity returns when the user linked their current WhatsApp session,
+// or a zero time if it isn't known (e.g. the session was linked before it was tracked).
+func (user *User) GetFirstActivity() time.Time {
+	var ts sql.NullInt64
+	err := user.db.QueryRow(`SELECT first_activity_ts FROM "user" WHERE mxid=$1`, user.MXID).Scan(&ts)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		user.log.Warnfln("Failed to get first activity time of %s: %v", user.MXID, err)
+	}
+	if !ts.Valid || ts.Int64 == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ts.Int64)
+}
+
+func (user *User) SetFirstActivity(ts time.Time) {
+	var value *int64
+	if !ts.IsZero() {
+		milli := ts.UnixMilli()
+		value = &milli
+	}
+	_, err := user.db.Exec(`UPDATE "user" SET first_activity_ts=$1 WHERE mxid=$2`, value, user.MXID)
+	if err != nil {
+		user.log.Warnfln("Failed to set first activity time of %s: %v", user.MXID, err)
+	}
+}
+
+// GetDeviceName returns the custom name that the user wants their linked device to have,
+// or an empty string if the default name from the config should be used.
+func (user *User) GetDeviceName() string {
+	var name sql.NullString
+	err := user.db.QueryRow(`SELECT device_name FROM "user" WHERE mxid=$1`, user.MXID).Scan(&name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		user.log.Warnfln("Failed to get device name of %s: %v", user.MXID, err)
+	}
+	return name.String
+}
+
+func (user *User) SetDeviceName(name string) {
+	var value *string
+	if len(name) > 0 {
+		value = &name
+	}
+	_, err := user.db.Exec(`UPDATE "user" SET device_name=$1 WHERE mxid=$2`, value, user.MXID)
+	if err != nil {
+		user.log.Warnfln("Failed to set device name of %s: %v", user.MXID, err)
+	}
+}
+
+// GetContactSyncProgress returns the contacts that have already been synced in an unfinished full contact resync.
+func (user *User) GetContactSyncProgress() map[types.JID]struct{} {
+	rows, err := user.db.Query("SELECT jid FROM user_contact_sync_progress WHERE user_mxid=$1", user.MXID)
+	if err != nil {
+		user.log.Warnfln("Failed to get contact sync progress of %s: %v", user.MXID, err)
+		return nil
+	}
+	defer rows.Close()
+	done := make(map[types.JID]struct{})
+	for rows.Next() {
+		var jid types.JID
+		if err = rows.Scan(&jid); err != nil {
+			user.log.Warnfln("Failed to scan contact sync progress row of %s: %v", user.MXID, err)
+			continue
+		}
+		done[jid] = struct{}{}
+	}
+	return done
+}
+
+func (user *User) MarkContactSynced(jid types.JID) {
+	_, err := user.db.Exec(`
+		INSERT INTO user_contact_sync_progress (user_mxid, jid) VALUES ($1, $2)
+		ON CONFLICT (user_mxid, jid) DO NOTHING
+	`, user.MXID, jid)
+	if err != nil {
+		user.log.Warnfln("Failed to mark contact %s as synced for %s: %v", jid, user.MXID, err)
+	}
+}
+
+func (user *User) ClearContactSyncProgress() {
+	_, err := user.db.Exec("DELETE FROM user_contact_sync_progress WHERE user_mxid=$1", user.MXID)
+	if err != nil {
+		user.log.Warnfln("Failed to clear contact sync progress of %s: %v", user.MXID, err)
+	}
+}
+
+func (user *User) GetBlockedContacts() map[types.JID]struct{} {
+	rows, err := user.db.Query("SELECT jid FROM user_blocked_contact WHERE user_mxid=$1", user.MXID)
+	if err != nil {
+		user.log.Warnfln("Failed to get blocked contacts of %s: %v", user.MXID, err)
+		return nil
+	}
+	defer rows.Close()
+	blocked := make(map[types.JID]struct{})
+	for rows.Next() {
+		var jid types.JID
+		if err = rows.Scan(&jid); err != nil {
+			user.log.Warnfln("Failed to scan blocked contact row of %s: %v", user.MXID, err)
+			continue
+		}
+		blocked[jid] = struct{}{}
+	}
+	return blocked
+}
+
+func (user *User) SetContactBlocked(jid types.JID, blocked bool) (err error) {
+	if blocked {
+		_, err = user.db.Exec(`
+			INSERT INTO user_blocked_contact (user_mxid, jid) VALUES ($1, $2)
+			ON CONFLICT (user_mxid, jid) DO NOTHING
+		`, user.MXID, jid)
+	} else {
+		_, err = user.db.Exec("DELETE FROM user_blocked_contact WHERE user_mxid=$1 AND jid=$2", user.MXID, jid)
+	}
+	return
+}
+
+// ReplaceBlockedContacts replaces the stored block list of the user with the given one.
+func (user *User) ReplaceBlockedContacts(blocked map[types.JID]struct{}) (err error) {
+	txn, err := user.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+	_, err = txn.Exec("DELETE FROM user_blocked_contact WHERE user_mxid=$1", user.MXID)
+	if err != nil {
+		return fmt.Errorf("failed to clear old block list: %w", err)
+	}
+	for jid := range blocked {
+		_, err = txn.Exec("INSERT INTO user_blocked_contact (user_mxid, jid) VALUES ($1, $2)", user.MXID, jid)
+		if err != nil {
+			return fmt.Errorf("failed to insert %s: %w", jid, err)
+		}
+	}
+	return txn.Commit()
+}
+
 func (user *User) GetLastAppStateKeyID() ([]byte, error) {
 	var keyID []byte
 	err := user.db.QueryRow("SELECT key_id FROM whatsmeow_app_state_sync_keys ORDER BY timestamp DESC LIMIT 1").Scan(&keyID)
 	return keyID, err
 }
+
+type ContactSearchResult struct {
+	JID          types.JID
+	FirstName    string
+	FullName     string
+	PushName     string
+	BusinessName string
+}
+
+// likeEscaper escapes the LIKE wildcards in user input, so that they're matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+const searchContactsQuery = `
+	SELECT their_jid, COALESCE(first_name, ''), COALESCE(full_name, ''), COALESCE(push_name, ''), COALESCE(business_name, '')
+	FROM whatsmeow_contacts
+	WHERE our_jid=$1 AND (
+		LOWER(full_name) LIKE $2 ESCAPE '\' OR LOWER(push_name) LIKE $2 ESCAPE '\' OR
+		LOWER(business_name) LIKE $2 ESCAPE '\' OR their_jid LIKE $2 ESCAPE '\'
+	)
+	ORDER BY LOWER(COALESCE(full_name, push_name, their_jid))
+	LIMIT $3
+`
+
+// SearchContacts finds the user's WhatsApp contacts whose name or phone number contains the query.
+func (user *User) SearchContacts(query string, limit int) ([]ContactSearchResult, error) {
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(query)) + "%"
+	rows, err := user.db.Query(searchContactsQuery, user.JID.ToNonAD().String(), pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []ContactSearchResult
+	for rows.Next() {
+		var result ContactSearchResult
+		var jid string
+		err = rows.Scan(&jid, &result.FirstName, &result.FullName, &result.PushName, &result.BusinessName)
+		if err != nil {
+			return results, err
+		}
+		result.JID, err = types.ParseJID(jid)
+		if err != nil {
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,106 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// UserSettingsQuery stores the preferences that users can change for themselves.
+// Unset values fall back to the bridge config.
+type UserSettingsQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (usq *UserSettingsQuery) New(userID id.UserID) *UserSettings {
+	return &UserSettings{
+		db:       usq.db,
+		log:      usq.log,
+		UserMXID: userID,
+	}
+}
+
+const (
+	getUserSettingsQuery = `
+		SELECT user_mxid, enable_presence, enable_receipts, relay_opt_in, request_full_history FROM user_settings WHERE user_mxid=$1
+	`
+	upsertUserSettingsQuery = `
+		INSERT INTO user_settings (user_mxid, enable_presence, enable_receipts, relay_opt_in, request_full_history)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_mxid) DO UPDATE
+			SET enable_presence=excluded.enable_presence, enable_receipts=excluded.enable_receipts,
+			    relay_opt_in=excluded.relay_opt_in, request_full_history=excluded.request_full_history
+	`
+)
+
+// Get returns the settings of the given user, or empty settings if the user hasn't changed anything.
+func (usq *UserSettingsQuery) Get(userID id.UserID) *UserSettings {
+	settings := usq.New(userID).Scan(usq.db.QueryRow(getUserSettingsQuery, userID))
+	if settings == nil {
+		settings = usq.New(userID)
+	}
+	return settings
+}
+
+type UserSettings struct {
+	db  *Database
+	log log.Logger
+
+	UserMXID id.UserID
+
+	EnablePresence     *bool
+	EnableReceipts     *bool
+	RelayOptIn         *bool
+	RequestFullHistory *bool
+}
+
+func nullBoolPtr(val sql.NullBool) *bool {
+	if !val.Valid {
+		return nil
+	}
+	return &val.Bool
+}
+
+func (us *UserSettings) Scan(row dbutil.Scannable) *UserSettings {
+	var enablePresence, enableReceipts, relayOptIn, requestFullHistory sql.NullBool
+	err := row.Scan(&us.UserMXID, &enablePresence, &enableReceipts, &relayOptIn, &requestFullHistory)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			us.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	us.EnablePresence = nullBoolPtr(enablePresence)
+	us.EnableReceipts = nullBoolPtr(enableReceipts)
+	us.RelayOptIn = nullBoolPtr(relayOptIn)
+	us.RequestFullHistory = nullBoolPtr(requestFullHistory)
+	return us
+}
+
+func (us *UserSettings) Upsert() {
+	_, err := us.db.Exec(upsertUserSettingsQuery, us.UserMXID, us.EnablePresence, us.EnableReceipts, us.RelayOptIn, us.RequestFullHistory)
+	if err != nil {
+		us.log.Warnfln("Failed to save settings of %s: %v", us.UserMXID, err)
+	}
+}
@@ -0,0 +1,81 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const maxDebugLogDuration = time.Hour
+
+var errDebugLogsAlreadyEnabled = errors.New("debug logs are already enabled for this user")
+
+// userLogger wraps the logger of a user to write its debug lines to the bridge log while the debug-logs command
+// is active for the user, even if the bridge log level would normally hide them. The WhatsApp client logger
+// is included because it is a sub-logger of the user logger.
+type userLogger struct {
+	log.Logger
+	user *User
+}
+
+func newUserLogger(parent log.Logger, user *User) *userLogger {
+	return &userLogger{Logger: parent, user: user}
+}
+
+func (ul *userLogger) Sub(module string) log.Logger {
+	return &userLogger{Logger: ul.Logger.Sub(module), user: ul.user}
+}
+
+func (ul *userLogger) Debugln(parts ...interface{}) {
+	if ul.user.debugLogsEnabled() {
+		ul.Logger.Infoln(append([]interface{}{"[DEBUG]"}, parts...)...)
+	} else {
+		ul.Logger.Debugln(parts...)
+	}
+}
+
+func (ul *userLogger) Debugfln(message string, args ...interface{}) {
+	if ul.user.debugLogsEnabled() {
+		ul.Logger.Infofln("[DEBUG] "+message, args...)
+	} else {
+		ul.Logger.Debugfln(message, args...)
+	}
+}
+
+func (user *User) debugLogsEnabled() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&user.debugLogsUntil)
+}
+
+// EnableDebugLogs writes the debug logs of the user's session, including the WhatsApp client,
+// to the bridge log for the given duration.
+func (user *User) EnableDebugLogs(duration time.Duration) error {
+	current := atomic.LoadInt64(&user.debugLogsUntil)
+	if time.Now().UnixNano() < current {
+		return errDebugLogsAlreadyEnabled
+	} else if !atomic.CompareAndSwapInt64(&user.debugLogsUntil, current, time.Now().Add(duration).UnixNano()) {
+		return errDebugLogsAlreadyEnabled
+	}
+	user.log.Infofln("Writing debug logs of this user to the bridge log for %s", duration)
+	time.AfterFunc(duration, func() {
+		user.log.Infoln("Finished writing debug logs of this user")
+	})
+	return nil
+}
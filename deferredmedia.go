@@ -0,0 +1,151 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+
+	"maunium.net/go/mautrix/appservice"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// deferredMediaIdleInterval is how often the deferred media queue is checked when it's empty
+// or the user isn't connected.
+const deferredMediaIdleInterval = 1 * time.Minute
+
+func (portal *Portal) queueDeferredMedia(source *User, infos []*wrappedInfo) {
+	queued := 0
+	for _, info := range infos {
+		if info == nil || !info.MediaDeferred {
+			continue
+		}
+		job := portal.bridge.DB.DeferredMedia.New()
+		job.UserID = source.MXID
+		job.PortalKey = portal.Key
+		job.MessageID = info.ID
+		job.Timestamp = info.Timestamp
+		job.Insert()
+		queued++
+	}
+	if queued > 0 {
+		portal.log.Debugfln("Queued %d backfilled media messages for deferred download", queued)
+	}
+}
+
+// deferredMediaLoop downloads media of backfilled messages one at a time. The jobs are handed over
+// to the portal's message loop, so they can't race with live messages or media retries in the same chat.
+func (user *User) deferredMediaLoop() {
+	delay := time.Duration(user.bridge.Config.Bridge.HistorySync.DeferredMedia.Delay) * time.Second
+	for {
+		if !user.IsLoggedIn() {
+			if !user.waitOrStop(deferredMediaIdleInterval) {
+				return
+			}
+			continue
+		}
+		job := user.bridge.DB.DeferredMedia.GetNext(user.MXID)
+		if job == nil {
+			if !user.waitOrStop(deferredMediaIdleInterval) {
+				return
+			}
+			continue
+		}
+		user.bridge.ResourceMonitor.Throttle("deferred media download")
+		portal := user.bridge.GetPortalByJID(job.PortalKey)
+		done := make(chan struct{})
+		portal.mediaRetries <- PortalMediaRetry{source: user, deferred: job, done: done}
+		<-done
+		if delay > 0 && !user.waitOrStop(delay) {
+			return
+		}
+	}
+}
+
+func (portal *Portal) handleDeferredMedia(job *database.DeferredMedia, source *User) {
+	defer job.Delete()
+	msg := portal.bridge.DB.Message.GetByJID(portal.Key, job.MessageID)
+	if msg == nil || msg.IsFakeMXID() {
+		portal.log.Debugfln("Dropping deferred media download for unknown message %s", job.MessageID)
+		return
+	}
+	meta, err := portal.fetchMediaRetryEvent(msg)
+	if err != nil {
+		portal.log.Warnfln("Can't download deferred media for %s: %v", msg.JID, err)
+		return
+	} else if len(meta.Media.DirectPath) == 0 {
+		portal.log.Warnfln("Can't download deferred media for %s: no direct path in placeholder metadata", msg.JID)
+		return
+	}
+
+	var intent *appservice.IntentAPI
+	if puppet := portal.bridge.GetPuppetByJID(msg.Sender); puppet != nil {
+		intent = puppet.IntentFor(portal)
+	} else {
+		intent = portal.MainIntent()
+	}
+
+	media := meta.Media
+	data, err := source.Client.DownloadMediaWithPath(media.DirectPath, media.EncSHA256, media.SHA256, media.Key, media.Length, media.Type, "")
+	if errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) {
+		portal.log.Debugfln("Deferred media for %s has expired: %v", msg.JID, err)
+		// The placeholder still has the media keys, so it can be handled like any other old media message.
+		msg.UpdateMXID(nil, msg.MXID, msg.Type, database.MsgErrMediaNotFound)
+		if portal.bridge.Config.Bridge.HistorySync.MediaRequests.AutoRequestMedia {
+			portal.sendMediaNoticeEdit(intent, msg, "Old media. Requesting media from your phone, it will appear here once your phone re-uploads it.")
+			_, err = portal.requestMediaRetry(source, msg.MXID, media.Key)
+			if err != nil {
+				portal.log.Warnfln("Failed to request expired deferred media %s from phone: %v", msg.JID, err)
+			}
+		} else {
+			portal.sendMediaNoticeEdit(intent, msg, "Old media. React with the ♻ (recycle) emoji to request this media from your phone.")
+		}
+		return
+	} else if errors.Is(err, whatsmeow.ErrFileLengthMismatch) || errors.Is(err, whatsmeow.ErrInvalidMediaSHA256) {
+		// Unlike live messages, there's no sender waiting for the media here, so don't upload data that doesn't match
+		portal.log.Warnfln("Mismatching media checksums in deferred media %s: %v", msg.JID, err)
+		portal.forgetFailedMedia(msg.JID)
+		portal.sendMediaNoticeEdit(intent, msg, "Failed to bridge media: the downloaded file didn't match its checksum")
+		return
+	} else if err != nil {
+		portal.log.Warnfln("Failed to download deferred media for %s: %v", msg.JID, err)
+		portal.sendMediaNoticeEdit(intent, msg, fmt.Sprintf("Failed to bridge media: %v", err))
+		return
+	}
+
+	converted := &ConvertedMessage{
+		Intent:  intent,
+		Type:    meta.Type,
+		Content: meta.Content,
+		Extra:   meta.ExtraContent,
+	}
+	portal.generateIncomingThumbnail(intent, data, converted)
+	portal.fillMissingAudioInfo(data, converted)
+	meta.ExtraContent = converted.Extra
+	data = portal.convertIncomingMedia(data, meta.Content)
+	err = portal.uploadMedia(intent, data, meta.Content)
+	if err != nil {
+		portal.log.Warnfln("Failed to upload deferred media for %s: %v", msg.JID, err)
+		portal.sendMediaNoticeEdit(intent, msg, fmt.Sprintf("Failed to bridge media: failed to upload media: %v", err))
+		return
+	}
+	portal.sendMediaReplacement(intent, msg, meta, "deferred download")
+}
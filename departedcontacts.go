@@ -0,0 +1,129 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const departedContactCheckBatchSize = 100
+
+// CheckDepartedContacts checks whether the other users in the user's private chat portals still have
+// a WhatsApp account, and marks the puppets of the ones that don't as defunct.
+func (user *User) CheckDepartedContacts() error {
+	var numbers []string
+	for _, portal := range user.bridge.DB.Portal.FindPrivateChats(user.JID.ToNonAD()) {
+		if len(portal.MXID) == 0 || portal.Key.JID.User == user.JID.User {
+			continue
+		}
+		puppet := user.bridge.GetPuppetByJID(portal.Key.JID)
+		if puppet != nil && !puppet.Defunct {
+			numbers = append(numbers, "+"+portal.Key.JID.User)
+		}
+	}
+	user.log.Debugfln("Checking %d private chat contacts for deleted accounts", len(numbers))
+	for start := 0; start < len(numbers); start += departedContactCheckBatchSize {
+		end := start + departedContactCheckBatchSize
+		if end > len(numbers) {
+			end = len(numbers)
+		}
+		err := user.checkDepartedNumbers(numbers[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckDepartedContact checks whether the given user still has a WhatsApp account. It's called when
+// sending a message to a private chat fails, as that's usually the first sign of a deleted account.
+func (user *User) CheckDepartedContact(jid types.JID) {
+	puppet := user.bridge.GetPuppetByJID(jid)
+	if puppet == nil || puppet.Defunct {
+		return
+	}
+	err := user.checkDepartedNumbers([]string{"+" + jid.User})
+	if err != nil {
+		user.log.Warnfln("Failed to check if %s still has a WhatsApp account: %v", jid, err)
+	}
+}
+
+func (user *User) checkDepartedNumbers(numbers []string) error {
+	if !user.IsLoggedIn() {
+		return fmt.Errorf("not logged in")
+	}
+	resp, err := user.Client.IsOnWhatsApp(numbers)
+	if err != nil {
+		return fmt.Errorf("failed to check if contacts are on WhatsApp: %w", err)
+	}
+	for _, item := range resp {
+		if item.IsIn || item.JID.IsEmpty() {
+			continue
+		}
+		puppet := user.bridge.GetPuppetByJID(item.JID)
+		if puppet != nil {
+			puppet.MarkDefunct(user)
+		}
+	}
+	return nil
+}
+
+// MarkDefunct marks the puppet as belonging to a deleted WhatsApp account, which excludes it from future
+// contact syncs. The given user is notified in their private chat portal with the puppet, which is optionally
+// archived too.
+func (puppet *Puppet) MarkDefunct(source *User) {
+	if puppet.Defunct {
+		return
+	}
+	puppet.log.Infofln("WhatsApp account no longer exists (checked through %s), marking puppet as defunct", source.MXID)
+	puppet.Defunct = true
+	puppet.Update()
+
+	portal := source.GetPortalByJID(puppet.JID)
+	if portal == nil || len(portal.MXID) == 0 {
+		return
+	}
+	name := puppet.Displayname
+	if len(name) == 0 {
+		name = "+" + puppet.JID.User
+	}
+	_, err := portal.sendMainIntentMessage(&event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    portal.formatNotice(noticeContactDeparted, name),
+	})
+	if err != nil {
+		portal.log.Warnfln("Failed to send notice about deleted account: %v", err)
+	}
+	if puppet.bridge.Config.Bridge.DepartedContacts.ArchiveRooms {
+		source.updateChatTag(nil, portal, puppet.bridge.Config.Bridge.ArchiveTag, true)
+	}
+}
+
+// ClearDefunct removes the defunct flag after a message is received from the puppet,
+// which means the phone number has been registered on WhatsApp again.
+func (puppet *Puppet) ClearDefunct() {
+	if !puppet.Defunct {
+		return
+	}
+	puppet.log.Infoln("Received message from defunct puppet, clearing defunct flag")
+	puppet.Defunct = false
+	puppet.Update()
+}
@@ -0,0 +1,308 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// wrapDirectMediaMessage stores a media message in a Message wrapper so that it can be serialized.
+func wrapDirectMediaMessage(msg MediaMessage) *waProto.Message {
+	switch typed := msg.(type) {
+	case *waProto.ImageMessage:
+		return &waProto.Message{ImageMessage: typed}
+	case *waProto.VideoMessage:
+		return &waProto.Message{VideoMessage: typed}
+	case *waProto.AudioMessage:
+		return &waProto.Message{AudioMessage: typed}
+	case *waProto.DocumentMessage:
+		return &waProto.Message{DocumentMessage: typed}
+	case *waProto.StickerMessage:
+		return &waProto.Message{StickerMessage: typed}
+	default:
+		return nil
+	}
+}
+
+func unwrapDirectMediaMessage(msg *waProto.Message) MediaMessage {
+	switch {
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage
+	case msg.VideoMessage != nil:
+		return msg.VideoMessage
+	case msg.AudioMessage != nil:
+		return msg.AudioMessage
+	case msg.DocumentMessage != nil:
+		return msg.DocumentMessage
+	case msg.StickerMessage != nil:
+		return msg.StickerMessage
+	default:
+		return nil
+	}
+}
+
+// makeDirectMediaURI stores the download info of a WhatsApp media message and returns an mxc URI on the bridge's
+// own media server name, so the file is only downloaded from WhatsApp when someone actually fetches it.
+func (portal *Portal) makeDirectMediaURI(source *User, msg MediaMessage) (id.ContentURIString, bool) {
+	cfg := portal.bridge.Config.Bridge.DirectMedia
+	if !cfg.Enabled || portal.Encrypted {
+		return "", false
+	}
+	mediaID, ok := portal.storeDirectMedia(source, msg)
+	if !ok {
+		return "", false
+	}
+	return id.ContentURI{Homeserver: cfg.ServerName, FileID: mediaID}.CUString(), true
+}
+
+// makeDirectMediaLink returns a plain HTTPS download link for a WhatsApp media message, which is used for files
+// that are too large to reupload to Matrix. An empty string is returned if direct media isn't enabled.
+func (portal *Portal) makeDirectMediaLink(source *User, msg MediaMessage, fileName string) string {
+	cfg := portal.bridge.Config.Bridge.DirectMedia
+	if !cfg.Enabled {
+		return ""
+	}
+	mediaID, ok := portal.storeDirectMedia(source, msg)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("https://%[1]s/_matrix/media/v3/download/%[1]s/%[2]s/%[3]s", cfg.ServerName, mediaID, url.PathEscape(fileName))
+}
+
+func (portal *Portal) storeDirectMedia(source *User, msg MediaMessage) (string, bool) {
+	wrapped := wrapDirectMediaMessage(msg)
+	if wrapped == nil || len(msg.GetFileEncSha256()) == 0 {
+		return "", false
+	}
+	dm := portal.bridge.DB.DirectMedia.New()
+	// The encrypted file hash is unique per upload, so the same file forwarded to many chats gets the same ID
+	dm.MediaID = base64.RawURLEncoding.EncodeToString(msg.GetFileEncSha256())
+	dm.UserMXID = source.MXID
+	dm.Message = wrapped
+	if err := dm.Upsert(); err != nil {
+		portal.log.Warnfln("Failed to store direct media info: %v", err)
+		return "", false
+	}
+	return dm.MediaID, true
+}
+
+// directMediaNeedsData returns true if the media can't be bridged with a direct media URI, because converting it
+// or filling in its metadata requires the file contents.
+func (portal *Portal) directMediaNeedsData(converted *ConvertedMessage) bool {
+	content := converted.Content
+	switch content.MsgType {
+	case event.MsgAudio:
+		if portal.bridge.Config.Bridge.MediaConversion.IncomingVoiceFormat != "" && strings.HasPrefix(content.Info.MimeType, "audio/ogg") {
+			return true
+		}
+		needsDuration, needsWaveform := portal.getMissingAudioInfo(converted)
+		return needsDuration || needsWaveform
+	case event.MsgVideo:
+		return portal.bridge.Config.Bridge.GenerateMediaThumbnails && len(content.Info.ThumbnailURL) == 0 && content.Info.ThumbnailFile == nil
+	case event.MsgImage:
+		return portal.bridge.Config.Bridge.GenerateMediaThumbnails && !hasBlurhash(converted.Extra)
+	default:
+		return false
+	}
+}
+
+// DirectMediaAPI serves WhatsApp media that was bridged with direct media mxc URIs. Homeservers fetch the files
+// over the federation media API, so the server name in the URIs must point at the bridge's appservice listener.
+type DirectMediaAPI struct {
+	bridge *WABridge
+	keys   *FederationKeyCache
+}
+
+func (dma *DirectMediaAPI) Init() {
+	keyServer := dma.bridge.Config.Bridge.DirectMedia.KeyServer
+	if len(keyServer) == 0 {
+		keyServer = dma.bridge.Config.Homeserver.Address
+	}
+	dma.keys = NewFederationKeyCache(keyServer)
+	router := dma.bridge.AS.Router
+	router.HandleFunc("/.well-known/matrix/server", dma.GetWellKnown).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/federation/v1/version", dma.GetVersion).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/federation/v1/media/download/{mediaID}", dma.FederationDownload).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/federation/v1/media/thumbnail/{mediaID}", dma.FederationDownload).Methods(http.MethodGet)
+	for _, version := range []string{"r0", "v3"} {
+		prefix := fmt.Sprintf("/_matrix/media/%s", version)
+		router.HandleFunc(prefix+"/download/{serverName}/{mediaID}", dma.LegacyDownload).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"/download/{serverName}/{mediaID}/{fileName}", dma.LegacyDownload).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"/thumbnail/{serverName}/{mediaID}", dma.LegacyDownload).Methods(http.MethodGet)
+	}
+}
+
+func (dma *DirectMediaAPI) GetWellKnown(w http.ResponseWriter, _ *http.Request) {
+	server := dma.bridge.Config.Bridge.DirectMedia.WellKnownResponse
+	if len(server) == 0 {
+		server = fmt.Sprintf("%s:443", dma.bridge.Config.Bridge.DirectMedia.ServerName)
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{"m.server": server})
+}
+
+func (dma *DirectMediaAPI) GetVersion(w http.ResponseWriter, _ *http.Request) {
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"server": map[string]string{
+			"name":    dma.bridge.Name,
+			"version": dma.bridge.Version,
+		},
+	})
+}
+
+var errDirectMediaNotFound = errors.New("media not found")
+
+// download downloads the media from WhatsApp. whatsmeow needs the whole file in memory to decrypt it,
+// so the size is reserved from the media memory limiter. The returned function releases the reservation
+// and must be called after the response has been written.
+func (dma *DirectMediaAPI) download(ctx context.Context, mediaID string) ([]byte, string, func(), error) {
+	dm := dma.bridge.DB.DirectMedia.Get(mediaID)
+	if dm == nil {
+		return nil, "", nil, errDirectMediaNotFound
+	}
+	msg := unwrapDirectMediaMessage(dm.Message)
+	user := dma.bridge.GetUserByMXIDIfExists(dm.UserMXID)
+	if msg == nil || user == nil || !user.IsLoggedIn() {
+		return nil, "", nil, errDirectMediaNotFound
+	}
+	ctx, cancel := context.WithTimeout(ctx, mediaMemoryWaitTimeout)
+	releaseMemory, err := dma.bridge.MediaMemory.Acquire(ctx, int64(msg.GetFileLength())*2)
+	cancel()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	data, err := user.Client.Download(msg)
+	if errors.Is(err, whatsmeow.ErrFileLengthMismatch) || errors.Is(err, whatsmeow.ErrInvalidMediaSHA256) {
+		// WhatsApp seems to ignore mismatching checksums too
+		err = nil
+	} else if errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) {
+		err = errDirectMediaNotFound
+	}
+	if err != nil {
+		releaseMemory()
+		return nil, "", nil, err
+	}
+	return data, msg.GetMimetype(), releaseMemory, nil
+}
+
+func (dma *DirectMediaAPI) writeDownloadError(w http.ResponseWriter, mediaID string, err error) {
+	if errors.Is(err, errDirectMediaNotFound) {
+		jsonResponse(w, http.StatusNotFound, matrixError("M_NOT_FOUND", "Media not found"))
+	} else {
+		dma.bridge.Log.Warnfln("Failed to download direct media %s: %v", mediaID, err)
+		jsonResponse(w, http.StatusBadGateway, matrixError("M_UNKNOWN", "Failed to download media from WhatsApp"))
+	}
+}
+
+func matrixError(errcode, message string) map[string]string {
+	return map[string]string{"errcode": errcode, "error": message}
+}
+
+// inlineMediaTypes are the mime types that are safe to display inline in browsers.
+// Everything else is served as an attachment.
+var inlineMediaTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"video/mp4":  true,
+	"video/webm": true,
+	"audio/mp4":  true,
+	"audio/ogg":  true,
+	"audio/mpeg": true,
+	"audio/aac":  true,
+}
+
+// LegacyDownload handles the unauthenticated media download endpoints, which older homeservers use over federation.
+func (dma *DirectMediaAPI) LegacyDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if vars["serverName"] != dma.bridge.Config.Bridge.DirectMedia.ServerName {
+		jsonResponse(w, http.StatusNotFound, matrixError("M_NOT_FOUND", "Unknown server name"))
+		return
+	}
+	data, mimeType, releaseMemory, err := dma.download(r.Context(), vars["mediaID"])
+	if err != nil {
+		dma.writeDownloadError(w, vars["mediaID"], err)
+		return
+	}
+	defer releaseMemory()
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	// The mime type comes from the WhatsApp sender, so make sure the file can't run scripts on the bridge's origin
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; script-src 'none'; style-src 'unsafe-inline'; media-src 'self'; object-src 'self';")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	disposition := "attachment"
+	if baseType, _, err := mime.ParseMediaType(mimeType); err == nil && inlineMediaTypes[baseType] {
+		disposition = "inline"
+	}
+	var params map[string]string
+	if fileName := vars["fileName"]; len(fileName) > 0 {
+		params = map[string]string{"filename": fileName}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// FederationDownload handles the authenticated federation media endpoints, which respond with
+// a multipart body containing a metadata JSON object and the file.
+// Requests must be signed by the homeserver fetching the media.
+func (dma *DirectMediaAPI) FederationDownload(w http.ResponseWriter, r *http.Request) {
+	origin, err := dma.keys.VerifyRequest(r, dma.bridge.Config.Bridge.DirectMedia.ServerName)
+	if err != nil {
+		dma.bridge.Log.Debugfln("Rejecting direct media request from %q: %v", origin, err)
+		jsonResponse(w, http.StatusUnauthorized, matrixError("M_UNAUTHORIZED", "Failed to verify request signature"))
+		return
+	}
+	mediaID := mux.Vars(r)["mediaID"]
+	data, mimeType, releaseMemory, err := dma.download(r.Context(), mediaID)
+	if err != nil {
+		dma.writeDownloadError(w, mediaID, err)
+		return
+	}
+	defer releaseMemory()
+	mpw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mpw.Boundary())
+	w.WriteHeader(http.StatusOK)
+	metaPart, err := mpw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err == nil {
+		_, _ = metaPart.Write([]byte("{}"))
+	}
+	filePart, err := mpw.CreatePart(textproto.MIMEHeader{"Content-Type": {mimeType}})
+	if err == nil {
+		_, _ = filePart.Write(data)
+	}
+	_ = mpw.Close()
+}
@@ -20,14 +20,41 @@ import (
 	"fmt"
 	"time"
 
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"maunium.net/go/mautrix-whatsapp/database"
 )
 
+var DisappearingTimerEvent = event.Type{Type: "com.beeper.disappearing_timer", Class: event.StateEventType}
+
+func (portal *Portal) canDisappear() bool {
+	if !portal.bridge.Config.Bridge.DisappearingMessagesRedact {
+		return false
+	}
+	return portal.bridge.Config.Bridge.DisappearingMessagesInGroups || !portal.IsGroupChat()
+}
+
+func (portal *Portal) UpdateDisappearingTimerState() {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, DisappearingTimerEvent, "", map[string]interface{}{
+		"timer":  int64(portal.ExpirationTime) * 1000,
+		"redact": portal.ExpirationTime > 0 && portal.canDisappear(),
+	})
+	if err != nil {
+		portal.log.Warnln("Failed to update disappearing timer state:", err)
+	}
+}
+
 func (portal *Portal) MarkDisappearing(eventID id.EventID, expiresIn uint32, startNow bool) {
-	if expiresIn == 0 || (!portal.bridge.Config.Bridge.DisappearingMessagesInGroups && portal.IsGroupChat()) {
+	if expiresIn == 0 || !portal.canDisappear() {
 		return
 	}
 
@@ -38,8 +65,24 @@ func (portal *Portal) MarkDisappearing(eventID id.EventID, expiresIn uint32, sta
 	}
 }
 
+func (portal *Portal) markViewOnce(eventID id.EventID) {
+	delay := time.Duration(portal.bridge.Config.Bridge.ViewOnce.RedactDelay) * time.Second
+	msg := portal.bridge.DB.DisappearingMessage.NewWithValues(portal.MXID, eventID, delay, false)
+	msg.Insert()
+}
+
+// markConvertedDisappearing schedules the Matrix event of a converted message to be redacted, either
+// after the first read receipt (view-once media) or based on the disappearing message timer.
+func (portal *Portal) markConvertedDisappearing(eventID id.EventID, converted *ConvertedMessage) {
+	if converted.ViewOnce && portal.bridge.Config.Bridge.ViewOnce.RedactAfterRead {
+		portal.markViewOnce(eventID)
+	} else {
+		portal.MarkDisappearing(eventID, converted.ExpiresIn, false)
+	}
+}
+
 func (portal *Portal) ScheduleDisappearing() {
-	if !portal.bridge.Config.Bridge.DisappearingMessagesInGroups && portal.IsGroupChat() {
+	if !portal.canDisappear() && !portal.bridge.Config.Bridge.ViewOnce.RedactAfterRead {
 		return
 	}
 	nowPlusHour := time.Now().Add(1 * time.Hour)
@@ -65,6 +108,14 @@ func (portal *Portal) sleepAndDelete(msg *database.DisappearingMessage) {
 	sleepTime := msg.ExpireAt.Sub(time.Now())
 	portal.log.Debugfln("Sleeping for %s to make %s disappear", sleepTime, msg.EventID)
 	time.Sleep(sleepTime)
+	// The message may have been kept in the chat (or rescheduled) while sleeping
+	msg = portal.bridge.DB.DisappearingMessage.Get(msg.RoomID, msg.EventID)
+	if msg == nil || msg.Kept {
+		return
+	} else if msg.ExpireAt.After(time.Now()) {
+		go portal.sleepAndDelete(msg)
+		return
+	}
 	_, err := portal.MainIntent().RedactEvent(msg.RoomID, msg.EventID, mautrix.ReqRedact{
 		Reason: "Message expired",
 		TxnID:  fmt.Sprintf("mxwa_disappear_%s", msg.EventID),
@@ -76,3 +127,62 @@ func (portal *Portal) sleepAndDelete(msg *database.DisappearingMessage) {
 	}
 	msg.Delete()
 }
+
+const keepInChatAnnotationKey = "📌"
+
+// HandleKeepInChat handles a WhatsApp message that keeps a disappearing message in the chat or un-keeps it.
+// Kept messages aren't redacted when they expire, and get an annotation from the participant who kept them.
+// Un-kept messages disappear immediately if their original expiry time has already passed.
+func (portal *Portal) HandleKeepInChat(intent *appservice.IntentAPI, info *types.MessageInfo, keepInChat *waProto.KeepInChatMessage) {
+	keep := keepInChat.GetKeepType() == waProto.KeepType_KEEP_FOR_ALL
+	if !keep && keepInChat.GetKeepType() != waProto.KeepType_UNDO_KEEP_FOR_ALL {
+		portal.log.Debugfln("Ignoring keep in chat message %s with unknown type %d", info.ID, keepInChat.GetKeepType())
+		return
+	}
+	target := portal.bridge.DB.Message.GetByJID(portal.Key, keepInChat.GetKey().GetId())
+	if target == nil || target.IsFakeMXID() {
+		portal.log.Debugfln("Ignoring keep in chat message %s: target message %s not found", info.ID, keepInChat.GetKey().GetId())
+		return
+	}
+	msg := portal.bridge.DB.DisappearingMessage.Get(portal.MXID, target.MXID)
+	if msg == nil || msg.Kept == keep {
+		return
+	}
+	if keep {
+		content := event.ReactionEventContent{RelatesTo: event.RelatesTo{
+			Type:    event.RelAnnotation,
+			EventID: target.MXID,
+			Key:     keepInChatAnnotationKey,
+		}}
+		var annotation id.EventID
+		resp, err := intent.SendMessageEvent(portal.MXID, event.EventReaction, &content)
+		if err != nil {
+			portal.log.Warnfln("Failed to annotate kept message %s: %v", target.MXID, err)
+		} else {
+			annotation = resp.EventID
+		}
+		msg.SetKept(true, annotation, time.Time{})
+		portal.log.Debugfln("%s kept %s in the chat", info.Sender, target.MXID)
+		return
+	}
+	portal.redactKeepAnnotation(msg)
+	var expireAt time.Time
+	if msg.ExpireAt.IsZero() {
+		expireAt = time.Now().Add(msg.ExpireIn)
+	}
+	msg.SetKept(false, "", expireAt)
+	portal.log.Debugfln("%s un-kept %s, it expires at %s", info.Sender, target.MXID, msg.ExpireAt)
+	if msg.ExpireAt.Before(time.Now().Add(1 * time.Hour)) {
+		go portal.sleepAndDelete(msg)
+	}
+}
+
+func (portal *Portal) redactKeepAnnotation(msg *database.DisappearingMessage) {
+	if len(msg.KeepAnnotation) == 0 {
+		return
+	}
+	_, err := portal.MainIntent().RedactEvent(msg.RoomID, msg.KeepAnnotation)
+	if err != nil {
+		portal.log.Warnfln("Failed to redact keep annotation %s of %s: %v", msg.KeepAnnotation, msg.EventID, err)
+	}
+}
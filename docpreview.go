@@ -0,0 +1,95 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// documentPreviewMaxSize is the size of the box that rendered document previews are scaled to fit in.
+// WhatsApp shows document previews as a wide card, so they're much larger than normal thumbnails.
+const documentPreviewMaxSize = 480
+
+var errPopplerNotFound = errors.New("poppler-utils (pdftoppm and pdfinfo) is not installed")
+
+var pdfInfoPagesRegex = regexp.MustCompile(`(?m)^Pages:\s+(\d+)$`)
+
+func isPDFDocument(info *event.FileInfo, fileName string) bool {
+	return info.MimeType == "application/pdf" || strings.HasSuffix(strings.ToLower(fileName), ".pdf")
+}
+
+func formatPageCount(pages uint32) string {
+	if pages == 1 {
+		return "1 page"
+	}
+	return fmt.Sprintf("%d pages", pages)
+}
+
+// DocumentPreview is a rendered first page of a document, used as the preview image in WhatsApp document cards.
+type DocumentPreview struct {
+	Image     []byte
+	Width     int
+	Height    int
+	PageCount uint32
+}
+
+// renderPDFPreview renders the first page of a PDF as a JPEG and counts the pages in it using poppler-utils.
+func (tp *TranscodePool) renderPDFPreview(ctx context.Context, data []byte) (*DocumentPreview, error) {
+	if _, err := exec.LookPath("pdftoppm"); err != nil {
+		return nil, errPopplerNotFound
+	} else if _, err = exec.LookPath("pdfinfo"); err != nil {
+		return nil, errPopplerNotFound
+	}
+	info, err := tp.run(ctx, "pdfinfo", data, "", func(inputPath, _ string) []string {
+		return []string{inputPath}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var preview DocumentPreview
+	if match := pdfInfoPagesRegex.FindSubmatch(info); match != nil {
+		pages, _ := strconv.ParseUint(string(match[1]), 10, 32)
+		preview.PageCount = uint32(pages)
+	}
+	// pdftoppm appends the extension to the output file prefix itself
+	preview.Image, err = tp.run(ctx, "pdftoppm", data, "preview.jpg", func(inputPath, outputPath string) []string {
+		return []string{
+			"-f", "1", "-l", "1", "-singlefile", "-jpeg", "-jpegopt", "quality=80",
+			"-scale-to", strconv.Itoa(documentPreviewMaxSize),
+			inputPath, strings.TrimSuffix(outputPath, ".jpg"),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(preview.Image))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode rendered preview: %w", err)
+	}
+	preview.Width, preview.Height = cfg.Width, cfg.Height
+	return &preview, nil
+}
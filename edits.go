@@ -0,0 +1,185 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// WhatsAppEditWindow is how long after sending a message WhatsApp allows editing it.
+const WhatsAppEditWindow = 15 * time.Minute
+
+// The protobuf schema of the WhatsApp library version the bridge uses predates message edits,
+// so the edit fields are read from and written to the unknown fields of the messages directly.
+const (
+	protocolMessageEdit = waProto.ProtocolMessage_Type(14)
+
+	protocolMessageEditedMessageField protowire.Number = 14
+	protocolMessageTimestampMSField   protowire.Number = 15
+	messageEditedMessageField         protowire.Number = 58
+)
+
+// getUnknownField returns the raw value of the given field from the unknown fields of a protobuf message.
+func getUnknownField(msg protoreflect.ProtoMessage, field protowire.Number, fieldType protowire.Type) []byte {
+	unknown := msg.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return nil
+		}
+		unknown = unknown[n:]
+		n = protowire.ConsumeFieldValue(num, typ, unknown)
+		if n < 0 {
+			return nil
+		} else if num == field && typ == fieldType {
+			return unknown[:n]
+		}
+		unknown = unknown[n:]
+	}
+	return nil
+}
+
+func getUnknownMessageField(msg protoreflect.ProtoMessage, field protowire.Number, into proto.Message) bool {
+	value := getUnknownField(msg, field, protowire.BytesType)
+	if value == nil {
+		return false
+	}
+	data, n := protowire.ConsumeBytes(value)
+	return n >= 0 && proto.Unmarshal(data, into) == nil
+}
+
+// unwrapEditedMessage returns the protocol message wrapped in the editedMessage field, or the message itself if it isn't an edit.
+func unwrapEditedMessage(msg *waProto.Message) *waProto.Message {
+	var wrapper waProto.FutureProofMessage
+	if msg == nil || !getUnknownMessageField(msg, messageEditedMessageField, &wrapper) || wrapper.GetMessage() == nil {
+		return msg
+	}
+	return wrapper.GetMessage()
+}
+
+func isEditMessage(msg *waProto.Message) bool {
+	return getUnknownField(msg, messageEditedMessageField, protowire.BytesType) != nil
+}
+
+func getEditedMessage(protoMsg *waProto.ProtocolMessage) *waProto.Message {
+	var edited waProto.Message
+	if !getUnknownMessageField(protoMsg, protocolMessageEditedMessageField, &edited) {
+		return nil
+	}
+	return &edited
+}
+
+func buildEditMessage(chat types.JID, target *database.Message, edited *waProto.Message) (*waProto.Message, error) {
+	editedData, err := proto.Marshal(edited)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal edited message: %w", err)
+	}
+	editType := protocolMessageEdit
+	protoMsg := &waProto.ProtocolMessage{
+		Key: &waProto.MessageKey{
+			FromMe:    proto.Bool(true),
+			Id:        proto.String(target.JID),
+			RemoteJid: proto.String(chat.String()),
+		},
+		Type: &editType,
+	}
+	unknown := protowire.AppendTag(nil, protocolMessageEditedMessageField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, editedData)
+	unknown = protowire.AppendTag(unknown, protocolMessageTimestampMSField, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, uint64(time.Now().UnixMilli()))
+	protoMsg.ProtoReflect().SetUnknown(unknown)
+
+	wrapperData, err := proto.Marshal(&waProto.FutureProofMessage{
+		Message: &waProto.Message{ProtocolMessage: protoMsg},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal edit wrapper: %w", err)
+	}
+	var msg waProto.Message
+	unknown = protowire.AppendTag(nil, messageEditedMessageField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, wrapperData)
+	msg.ProtoReflect().SetUnknown(unknown)
+	return &msg, nil
+}
+
+// getMatrixEditTarget finds the WhatsApp message a Matrix edit replaces and checks that the sender is allowed to edit it.
+func (portal *Portal) getMatrixEditTarget(sender *User, evt *event.Event, targetID id.EventID, isRelayed bool) (*database.Message, error) {
+	target := portal.bridge.DB.Message.GetByMXID(targetID)
+	if target == nil || target.Type != database.MsgNormal {
+		return nil, errTargetNotFound
+	} else if target.IsFakeJID() {
+		return nil, errTargetIsFake
+	} else if target.Sender.User != sender.JID.User {
+		return nil, errEditSentBySomeoneElse
+	} else if isRelayed && !portal.isOriginalMatrixSender(target, evt.Sender) {
+		return nil, errEditSentBySomeoneElse
+	} else if time.Since(target.Timestamp) > WhatsAppEditWindow {
+		return nil, errEditWindowExpired
+	}
+	return target, nil
+}
+
+func (portal *Portal) HandleMessageEdit(intent *appservice.IntentAPI, source *User, info *types.MessageInfo, protoMsg *waProto.ProtocolMessage, existingMsg *database.Message) {
+	if existingMsg != nil {
+		_, _ = portal.MainIntent().RedactEvent(portal.MXID, existingMsg.MXID, mautrix.ReqRedact{
+			Reason: "The undecryptable message was actually an edit",
+		})
+	}
+
+	targetJID := protoMsg.GetKey().GetId()
+	target := portal.bridge.DB.Message.GetByJID(portal.Key, targetJID)
+	if target == nil || target.Type != database.MsgNormal || target.IsFakeMXID() {
+		portal.log.Debugfln("Dropping edit %s from %s to unknown message %s", info.ID, info.Sender, targetJID)
+		return
+	} else if target.Sender.User != info.Sender.User {
+		portal.log.Warnfln("Dropping edit %s from %s to message %s sent by %s", info.ID, info.Sender, targetJID, target.Sender)
+		return
+	}
+	edited := getEditedMessage(protoMsg)
+	if edited.GetConversation() == "" && edited.GetExtendedTextMessage().GetText() == "" {
+		// Captions are the only other editable part of messages, but editing them would require re-sending the media
+		portal.log.Debugfln("Dropping edit %s to %s: only text edits are supported", info.ID, targetJID)
+		return
+	}
+	converted := portal.convertMessage(intent, source, info, edited, false)
+	if converted == nil {
+		return
+	}
+	converted.Content.SetEdit(target.MXID)
+	resp, err := portal.sendMessage(converted.Intent, converted.Type, converted.Content, converted.Extra, info.Timestamp.UnixMilli())
+	if err != nil {
+		portal.log.Errorfln("Failed to bridge edit %s of %s to Matrix: %v", info.ID, targetJID, err)
+		return
+	}
+	portal.MarkDisappearing(resp.EventID, converted.ExpiresIn, false)
+	portal.finishHandling(existingMsg, info, resp.EventID, database.MsgEdit, database.MsgNoError)
+}
@@ -0,0 +1,106 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package emoji contains the emoji normalization rules used when bridging reactions and text,
+// so that the same emoji always compares equal regardless of which side it came from.
+package emoji
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/util/variationselector"
+)
+
+const (
+	// TextPresentation (VS15) requests the text form of an emoji.
+	TextPresentation = '\uFE0E'
+	// EmojiPresentation (VS16) requests the emoji form of a character that defaults to text.
+	EmojiPresentation = '\uFE0F'
+	// ZeroWidthJoiner combines multiple emojis into a single glyph, e.g. families and flags.
+	ZeroWidthJoiner = '\u200D'
+)
+
+// IsSkinTone checks if the rune is one of the Fitzpatrick skin tone modifiers.
+func IsSkinTone(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+func isVariationSelector(r rune) bool {
+	return r == TextPresentation || r == EmojiPresentation
+}
+
+// StripVariationSelectors removes all VS15 and VS16 selectors while keeping skin tones and ZWJ sequences intact.
+func StripVariationSelectors(s string) string {
+	if !strings.ContainsAny(s, "\uFE0E\uFE0F") {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if isVariationSelector(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// StripSkinTones removes skin tone modifiers, e.g. for checking if two reactions use the same base emoji.
+func StripSkinTones(s string) string {
+	return strings.Map(func(r rune) rune {
+		if IsSkinTone(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// removeSelectorsBeforeModifiers drops variation selectors that directly precede a skin tone modifier.
+// A modifier sequence like 👍🏽 must not contain a selector, but naively adding one to every
+// emoji that has a text default produces 👍️🏽, which clients treat as a different reaction.
+func removeSelectorsBeforeModifiers(s string) string {
+	runes := []rune(s)
+	output := runes[:0]
+	for i, r := range runes {
+		if isVariationSelector(r) && i+1 < len(runes) && IsSkinTone(runes[i+1]) {
+			continue
+		}
+		output = append(output, r)
+	}
+	return string(output)
+}
+
+// Normalize returns the canonical form of an emoji used for comparisons.
+func Normalize(s string) string {
+	return StripVariationSelectors(strings.TrimSpace(s))
+}
+
+// Equal checks if two emojis are the same, ignoring variation selectors.
+func Equal(a, b string) bool {
+	return Normalize(a) == Normalize(b)
+}
+
+// EqualIgnoringSkinTone checks if two emojis are the same, ignoring variation selectors and skin tones.
+func EqualIgnoringSkinTone(a, b string) bool {
+	return StripSkinTones(Normalize(a)) == StripSkinTones(Normalize(b))
+}
+
+// ForWhatsApp converts an emoji into the form WhatsApp uses for reactions, which has no variation selectors.
+func ForWhatsApp(s string) string {
+	return Normalize(s)
+}
+
+// ForMatrix converts an emoji into the fully-qualified form that Matrix clients send as reaction keys.
+func ForMatrix(s string) string {
+	return removeSelectorsBeforeModifiers(variationselector.Add(Normalize(s)))
+}
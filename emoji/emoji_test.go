@@ -0,0 +1,140 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package emoji
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain emoji", "\U0001F44D", "\U0001F44D"},
+		{"emoji presentation selector", "\u2764\uFE0F", "\u2764"},
+		{"text presentation selector", "\u2764\uFE0E", "\u2764"},
+		{"surrounding whitespace", " \u2764\uFE0F\n", "\u2764"},
+		{"skin tone kept", "\U0001F44D\U0001F3FD", "\U0001F44D\U0001F3FD"},
+		{"selector before skin tone", "\U0001F44D\uFE0F\U0001F3FD", "\U0001F44D\U0001F3FD"},
+		{"zwj sequence kept", "\U0001F3F3\uFE0F\u200D\U0001F308", "\U0001F3F3\u200D\U0001F308"},
+		{"not an emoji", "+1", "+1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Normalize(test.input); got != test.want {
+				t.Errorf("Normalize(%+q) = %+q, want %+q", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStripSkinTones(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"no skin tone", "\U0001F44D", "\U0001F44D"},
+		{"light skin tone", "\U0001F44D\U0001F3FB", "\U0001F44D"},
+		{"dark skin tone", "\U0001F44D\U0001F3FF", "\U0001F44D"},
+		{"zwj sequence with skin tones", "\U0001F9D1\U0001F3FD\u200D\U0001F91D\u200D\U0001F9D1\U0001F3FB", "\U0001F9D1\u200D\U0001F91D\u200D\U0001F9D1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := StripSkinTones(test.input); got != test.want {
+				t.Errorf("StripSkinTones(%+q) = %+q, want %+q", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		name              string
+		a, b              string
+		equal             bool
+		equalIgnoringTone bool
+	}{
+		{"identical", "\U0001F44D", "\U0001F44D", true, true},
+		{"selector difference", "\u2764", "\u2764\uFE0F", true, true},
+		{"selector before skin tone", "\U0001F44D\uFE0F\U0001F3FD", "\U0001F44D\U0001F3FD", true, true},
+		{"different skin tone", "\U0001F44D\U0001F3FD", "\U0001F44D\U0001F3FB", false, true},
+		{"skin tone and no skin tone", "\U0001F44D\U0001F3FD", "\U0001F44D", false, true},
+		{"different emoji", "\U0001F44D", "\U0001F44E", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Equal(test.a, test.b); got != test.equal {
+				t.Errorf("Equal(%+q, %+q) = %t, want %t", test.a, test.b, got, test.equal)
+			}
+			if got := EqualIgnoringSkinTone(test.a, test.b); got != test.equalIgnoringTone {
+				t.Errorf("EqualIgnoringSkinTone(%+q, %+q) = %t, want %t", test.a, test.b, got, test.equalIgnoringTone)
+			}
+		})
+	}
+}
+
+func TestForWhatsApp(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"heart with selector", "\u2764\uFE0F", "\u2764"},
+		{"skin tone", "\U0001F44D\U0001F3FD", "\U0001F44D\U0001F3FD"},
+		{"selector before skin tone", "\U0001F44D\uFE0F\U0001F3FD", "\U0001F44D\U0001F3FD"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ForWhatsApp(test.input); got != test.want {
+				t.Errorf("ForWhatsApp(%+q) = %+q, want %+q", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestForMatrix(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"heart gets selector", "\u2764", "\u2764\uFE0F"},
+		{"heart keeps single selector", "\u2764\uFE0F", "\u2764\uFE0F"},
+		{"skin tone without selector", "\U0001F44D\U0001F3FD", "\U0001F44D\U0001F3FD"},
+		{"text default with skin tone", "\u261D\U0001F3FD", "\u261D\U0001F3FD"},
+		{"selector before skin tone", "\u261D\uFE0F\U0001F3FD", "\u261D\U0001F3FD"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ForMatrix(test.input); got != test.want {
+				t.Errorf("ForMatrix(%+q) = %+q, want %+q", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	inputs := []string{"\u2764", "\U0001F44D\U0001F3FD", "\u261D\U0001F3FD", "\U0001F3F3\uFE0F\u200D\U0001F308"}
+	for _, input := range inputs {
+		if !Equal(ForMatrix(input), ForWhatsApp(input)) {
+			t.Errorf("ForMatrix(%+q) = %+q and ForWhatsApp(%+q) = %+q don't compare equal", input, ForMatrix(input), input, ForWhatsApp(input))
+		}
+	}
+}
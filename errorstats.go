@@ -0,0 +1,249 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"go.mau.fi/whatsmeow"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// maxErrorBodySize is the maximum number of bytes read from failed Matrix API responses to find the error code.
+const maxErrorBodySize = 64 * 1024
+
+type errorClassStats struct {
+	Count     int
+	LastSeen  time.Time
+	LastError string
+}
+
+// errorStats keeps in-memory counters of Matrix API and WhatsApp send failures for the errors command.
+// Unlike the Prometheus counters, they're collected even if the metrics listener is disabled.
+type errorStats struct {
+	lock     sync.Mutex
+	since    time.Time
+	matrix   map[string]*errorClassStats
+	whatsapp map[string]*errorClassStats
+}
+
+func newErrorStats() errorStats {
+	return errorStats{
+		since:    time.Now(),
+		matrix:   make(map[string]*errorClassStats),
+		whatsapp: make(map[string]*errorClassStats),
+	}
+}
+
+func (es *errorStats) track(target map[string]*errorClassStats, class, message string) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	stats, ok := target[class]
+	if !ok {
+		stats = &errorClassStats{}
+		target[class] = stats
+	}
+	stats.Count++
+	stats.LastSeen = time.Now()
+	stats.LastError = message
+}
+
+func matrixErrorClass(status int, errcode string) string {
+	if status == 0 {
+		return "network error"
+	} else if errcode == "" {
+		return fmt.Sprintf("HTTP %d", status)
+	}
+	return fmt.Sprintf("HTTP %d %s", status, errcode)
+}
+
+// TrackMatrixAPIError counts a failed Matrix client API request. A zero status means no response was received.
+func (mh *MetricsHandler) TrackMatrixAPIError(method, path string, status int, errcode string) {
+	mh.errorStats.track(mh.errorStats.matrix, matrixErrorClass(status, errcode), fmt.Sprintf("%s %s", method, path))
+	if !mh.running {
+		return
+	}
+	mh.matrixAPIErrors.With(prometheus.Labels{
+		"status":  strconv.Itoa(status),
+		"errcode": errcode,
+	}).Inc()
+}
+
+// TrackWhatsAppSendError counts a Matrix event that couldn't be bridged to WhatsApp.
+func (mh *MetricsHandler) TrackWhatsAppSendError(err error) {
+	errorType := classifyWhatsAppSendError(err)
+	if errorType == "" {
+		return
+	}
+	mh.errorStats.track(mh.errorStats.whatsapp, errorType, err.Error())
+	if !mh.running {
+		return
+	}
+	mh.whatsappSendErrors.With(prometheus.Labels{"error_type": errorType}).Inc()
+}
+
+// classifyWhatsAppSendError returns the error type label for a failed Matrix->WhatsApp event,
+// or an empty string if the error doesn't mean the event failed.
+func classifyWhatsAppSendError(err error) string {
+	switch {
+	case errors.Is(err, errMessageTakingLong):
+		return ""
+	case errors.Is(err, errMessageDisconnected),
+		errors.Is(err, errMessageRetryDisconnected),
+		errors.Is(err, whatsmeow.ErrNotConnected),
+		errors.Is(err, errUserNotConnected):
+		return "disconnected"
+	case errors.Is(err, errUserNotLoggedIn),
+		errors.Is(err, errDifferentUser):
+		return "not_logged_in"
+	case errors.Is(err, errMediaDownloadFailed),
+		errors.Is(err, errMediaDecryptFailed):
+		return "matrix_media_download"
+	case errors.Is(err, errMediaConvertFailed):
+		return "media_convert"
+	case errors.Is(err, errMediaWhatsAppUploadFailed):
+		return "media_upload"
+	case errors.Is(err, errTimeoutBeforeHandling),
+		errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, errWarmupLimit):
+		return "warmup_limit"
+	}
+	reason, _, _, _, _ := errorToStatusReason(err)
+	switch reason {
+	case event.MessageStatusUnsupported:
+		return "unsupported"
+	case event.MessageStatusNoPermission:
+		return "no_permission"
+	default:
+		return "other"
+	}
+}
+
+// matrixErrorTrackingTransport wraps the HTTP transport of Matrix clients to count failed requests.
+type matrixErrorTrackingTransport struct {
+	base    http.RoundTripper
+	metrics *MetricsHandler
+}
+
+func (t *matrixErrorTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			t.metrics.TrackMatrixAPIError(req.Method, req.URL.Path, 0, "")
+		}
+		return resp, err
+	} else if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	data, readErr := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	var respErr struct {
+		ErrCode string `json:"errcode"`
+	}
+	if readErr == nil {
+		_ = json.Unmarshal(data, &respErr)
+	}
+	t.metrics.TrackMatrixAPIError(req.Method, req.URL.Path, resp.StatusCode, respErr.ErrCode)
+	return resp, nil
+}
+
+// InitErrorTracking makes the appservice HTTP client count failed requests for the metrics and errors command.
+func (br *WABridge) InitErrorTracking() {
+	base := br.AS.HTTPClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	br.AS.HTTPClient.Transport = &matrixErrorTrackingTransport{base: base, metrics: br.Metrics}
+}
+
+func formatErrorClasses(classes map[string]*errorClassStats) string {
+	if len(classes) == 0 {
+		return "* None\n"
+	}
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return classes[names[i]].Count > classes[names[j]].Count
+	})
+	var buf strings.Builder
+	for _, name := range names {
+		stats := classes[name]
+		lastSeen := "just now"
+		if since := time.Since(stats.LastSeen); since >= time.Second {
+			lastSeen = formatDuration(since) + " ago"
+		}
+		_, _ = fmt.Fprintf(&buf, "* **%s**: %d (last %s: `%s`)\n", name, stats.Count, lastSeen, stats.LastError)
+	}
+	return buf.String()
+}
+
+type ErrorClassInfo struct {
+	Class     string `json:"class"`
+	Count     int    `json:"count"`
+	LastSeen  int64  `json:"last_seen"`
+	LastError string `json:"last_error"`
+}
+
+func errorClassList(classes map[string]*errorClassStats) []ErrorClassInfo {
+	list := make([]ErrorClassInfo, 0, len(classes))
+	for name, stats := range classes {
+		list = append(list, ErrorClassInfo{
+			Class:     name,
+			Count:     stats.Count,
+			LastSeen:  stats.LastSeen.UnixMilli(),
+			LastError: stats.LastError,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen > list[j].LastSeen
+	})
+	return list
+}
+
+// ErrorClasses returns the errors counted since the bridge was started, most recently seen first.
+func (mh *MetricsHandler) ErrorClasses() (since time.Time, matrix, whatsapp []ErrorClassInfo) {
+	mh.errorStats.lock.Lock()
+	defer mh.errorStats.lock.Unlock()
+	return mh.errorStats.since, errorClassList(mh.errorStats.matrix), errorClassList(mh.errorStats.whatsapp)
+}
+
+// ErrorSummary returns a Markdown summary of the errors counted since the bridge was started.
+func (mh *MetricsHandler) ErrorSummary() string {
+	mh.errorStats.lock.Lock()
+	defer mh.errorStats.lock.Unlock()
+	return fmt.Sprintf("Errors since the bridge was started %s ago:\n\n#### Homeserver API\n%s\n#### WhatsApp sending\n%s",
+		formatDuration(time.Since(mh.errorStats.since)),
+		formatErrorClasses(mh.errorStats.matrix), formatErrorClasses(mh.errorStats.whatsapp))
+}
@@ -0,0 +1,264 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// federationKeyCacheTime is the maximum time that signing keys of other servers are cached for.
+// Keys are also refetched if a request is signed with a key that isn't in the cache, but at most
+// once per federationKeyRefetchInterval per server, so that requests with made up key IDs
+// can't be used to make the bridge send requests to the key server.
+const (
+	federationKeyCacheTime       = 1 * time.Hour
+	federationKeyRefetchInterval = 1 * time.Minute
+)
+
+var (
+	errMissingXMatrixAuth    = errors.New("missing X-Matrix authorization header")
+	errInvalidXMatrixAuth    = errors.New("malformed X-Matrix authorization header")
+	errWrongXMatrixDest      = errors.New("request is meant for a different server")
+	errUnknownFederationKey  = errors.New("unknown signing key")
+	errInvalidFederationSig  = errors.New("invalid request signature")
+	errFederationKeyNotFound = errors.New("key server didn't return keys for the origin server")
+)
+
+type xMatrixAuth struct {
+	Origin      string
+	Destination string
+	KeyID       string
+	Signature   []byte
+}
+
+func parseXMatrixAuth(header string) (*xMatrixAuth, error) {
+	const prefix = "X-Matrix "
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errMissingXMatrixAuth
+	}
+	var auth xMatrixAuth
+	for _, param := range strings.Split(header[len(prefix):], ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return nil, errInvalidXMatrixAuth
+		}
+		value = strings.Trim(value, `"`)
+		switch key {
+		case "origin":
+			auth.Origin = value
+		case "destination":
+			auth.Destination = value
+		case "key":
+			auth.KeyID = value
+		case "sig":
+			var err error
+			auth.Signature, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, errInvalidXMatrixAuth
+			}
+		}
+	}
+	if len(auth.Origin) == 0 || len(auth.KeyID) == 0 || len(auth.Signature) == 0 {
+		return nil, errInvalidXMatrixAuth
+	}
+	return &auth, nil
+}
+
+type federationServerKeys struct {
+	keys      map[string]ed25519.PublicKey
+	expires   time.Time
+	fetchedAt time.Time
+	fetchErr  error
+}
+
+// FederationKeyCache fetches the signing keys of other homeservers through a key server (notary),
+// so that the bridge doesn't need to implement server discovery to verify federation requests.
+type FederationKeyCache struct {
+	keyServer string
+	client    *http.Client
+	servers   map[string]*federationServerKeys
+	fetching  map[string]chan struct{}
+	lock      sync.Mutex
+}
+
+func NewFederationKeyCache(keyServer string) *FederationKeyCache {
+	return &FederationKeyCache{
+		keyServer: strings.TrimSuffix(keyServer, "/"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+		servers:   make(map[string]*federationServerKeys),
+		fetching:  make(map[string]chan struct{}),
+	}
+}
+
+type respQueryServerKeys struct {
+	ServerKeys []struct {
+		ServerName string `json:"server_name"`
+		VerifyKeys map[string]struct {
+			Key string `json:"key"`
+		} `json:"verify_keys"`
+		ValidUntilTS int64 `json:"valid_until_ts"`
+	} `json:"server_keys"`
+}
+
+func (fkc *FederationKeyCache) fetch(serverName string) (*federationServerKeys, error) {
+	reqURL := fmt.Sprintf("%s/_matrix/key/v2/query/%s", fkc.keyServer, url.PathEscape(serverName))
+	resp, err := fkc.client.Get(reqURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query keys of %s: %w", serverName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query keys of %s: unexpected status %d", serverName, resp.StatusCode)
+	}
+	var data respQueryServerKeys
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse keys of %s: %w", serverName, err)
+	}
+	result := &federationServerKeys{
+		keys:    make(map[string]ed25519.PublicKey),
+		expires: time.Now().Add(federationKeyCacheTime),
+	}
+	for _, serverKeys := range data.ServerKeys {
+		if serverKeys.ServerName != serverName {
+			continue
+		}
+		if validUntil := time.UnixMilli(serverKeys.ValidUntilTS); validUntil.Before(result.expires) {
+			result.expires = validUntil
+		}
+		for keyID, key := range serverKeys.VerifyKeys {
+			decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(key.Key, "="))
+			if err == nil && len(decoded) == ed25519.PublicKeySize {
+				result.keys[keyID] = decoded
+			}
+		}
+	}
+	if len(result.keys) == 0 {
+		return nil, errFederationKeyNotFound
+	}
+	return result, nil
+}
+
+// getCachedKey returns the cached key of the given server with the given ID. The boolean is false
+// if the keys of the server should be fetched instead. Must be called with the lock held.
+func (fkc *FederationKeyCache) getCachedKey(serverName, keyID string) (ed25519.PublicKey, bool, error) {
+	cached, ok := fkc.servers[serverName]
+	if !ok {
+		return nil, false, nil
+	}
+	key, found := cached.keys[keyID]
+	if found && time.Now().Before(cached.expires) {
+		return key, true, nil
+	} else if time.Since(cached.fetchedAt) < federationKeyRefetchInterval {
+		if cached.fetchErr != nil {
+			return nil, true, cached.fetchErr
+		}
+		return nil, true, errUnknownFederationKey
+	}
+	return nil, false, nil
+}
+
+// refetch fetches the keys of the given server and stores them in the cache. Failures are cached too,
+// and previously fetched keys are kept until they expire.
+func (fkc *FederationKeyCache) refetch(serverName string) {
+	fetched, err := fkc.fetch(serverName)
+	fkc.lock.Lock()
+	defer fkc.lock.Unlock()
+	if err != nil {
+		fetched = &federationServerKeys{fetchErr: err}
+		if prev, ok := fkc.servers[serverName]; ok {
+			fetched.keys, fetched.expires = prev.keys, prev.expires
+		}
+	}
+	fetched.fetchedAt = time.Now()
+	for name, cached := range fkc.servers {
+		if time.Since(cached.fetchedAt) > federationKeyRefetchInterval && time.Now().After(cached.expires) {
+			delete(fkc.servers, name)
+		}
+	}
+	fkc.servers[serverName] = fetched
+	close(fkc.fetching[serverName])
+	delete(fkc.fetching, serverName)
+}
+
+// GetKey returns the public key of the given server with the given ID. Only one fetch per server is made
+// at a time, and the lock isn't held while fetching, so slow servers don't block requests from others.
+func (fkc *FederationKeyCache) GetKey(serverName, keyID string) (ed25519.PublicKey, error) {
+	fkc.lock.Lock()
+	if key, ok, err := fkc.getCachedKey(serverName, keyID); ok {
+		fkc.lock.Unlock()
+		return key, err
+	}
+	done, inFlight := fkc.fetching[serverName]
+	if !inFlight {
+		done = make(chan struct{})
+		fkc.fetching[serverName] = done
+	}
+	fkc.lock.Unlock()
+	if inFlight {
+		<-done
+	} else {
+		fkc.refetch(serverName)
+	}
+	fkc.lock.Lock()
+	defer fkc.lock.Unlock()
+	key, ok, err := fkc.getCachedKey(serverName, keyID)
+	if !ok {
+		return nil, errUnknownFederationKey
+	}
+	return key, err
+}
+
+// VerifyRequest checks the X-Matrix signature of a federation request without a body.
+// The name of the server that sent the request is returned.
+func (fkc *FederationKeyCache) VerifyRequest(r *http.Request, ownServerName string) (string, error) {
+	auth, err := parseXMatrixAuth(r.Header.Get("Authorization"))
+	if err != nil {
+		return "", err
+	} else if len(auth.Destination) > 0 && auth.Destination != ownServerName {
+		return auth.Origin, errWrongXMatrixDest
+	}
+	key, err := fkc.GetKey(auth.Origin, auth.KeyID)
+	if err != nil {
+		return auth.Origin, err
+	}
+	signed := map[string]string{
+		"method":      r.Method,
+		"uri":         r.URL.RequestURI(),
+		"origin":      auth.Origin,
+		"destination": ownServerName,
+	}
+	var buf strings.Builder
+	encoder := json.NewEncoder(&buf)
+	// Canonical JSON doesn't escape HTML characters, and map keys are already sorted by the encoder
+	encoder.SetEscapeHTML(false)
+	if err = encoder.Encode(signed); err != nil {
+		return auth.Origin, err
+	}
+	if !ed25519.Verify(key, []byte(strings.TrimSuffix(buf.String(), "\n")), auth.Signature) {
+		return auth.Origin, errInvalidFederationSig
+	}
+	return auth.Origin, nil
+}
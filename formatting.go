@@ -55,16 +55,14 @@ func NewFormatter(bridge *WABridge) *Formatter {
 			Newline:      "\n",
 
 			PillConverter: func(displayname, mxid, eventID string, ctx format.Context) string {
-				if mxid[0] == '@' {
-					puppet := bridge.GetPuppetByMXID(id.UserID(mxid))
-					if puppet != nil {
-						jids, ok := ctx[mentionedJIDsContextKey].([]string)
-						if !ok {
-							ctx[mentionedJIDsContextKey] = []string{puppet.JID.String()}
-						} else {
-							ctx[mentionedJIDsContextKey] = append(jids, puppet.JID.String())
+				if len(mxid) > 0 && mxid[0] == '@' {
+					if jid := bridge.getMentionJID(id.UserID(mxid)); !jid.IsEmpty() {
+						jids, _ := ctx[mentionedJIDsContextKey].([]string)
+						jidStr := jid.String()
+						if !containsString(jids, jidStr) {
+							ctx[mentionedJIDsContextKey] = append(jids, jidStr)
 						}
-						return "@" + puppet.JID.User
+						return "@" + jid.User
 					}
 				}
 				return mxid
@@ -94,6 +92,28 @@ func NewFormatter(bridge *WABridge) *Formatter {
 	return formatter
 }
 
+// getMentionJID finds the WhatsApp user that a Matrix user ID refers to. Besides WhatsApp ghosts, this includes
+// Matrix users logged into the bridge and double puppets, so mentioning them on Matrix also notifies them on WhatsApp.
+func (br *WABridge) getMentionJID(mxid id.UserID) types.JID {
+	if puppet := br.GetPuppetByMXID(mxid); puppet != nil {
+		return puppet.JID
+	} else if puppet = br.GetPuppetByCustomMXID(mxid); puppet != nil {
+		return puppet.JID
+	} else if user := br.GetUserByMXIDIfExists(mxid); user != nil && !user.JID.IsEmpty() {
+		return user.JID.ToNonAD()
+	}
+	return types.EmptyJID
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
 func (formatter *Formatter) getMatrixInfoByJID(roomID id.RoomID, jid types.JID) (mxid id.UserID, displayname string) {
 	if puppet := formatter.bridge.GetPuppetByJID(jid); puppet != nil {
 		mxid = puppet.MXID
@@ -132,7 +152,12 @@ func (formatter *Formatter) ParseWhatsApp(roomID id.RoomID, content *event.Messa
 		}
 		mxid, displayname := formatter.getMatrixInfoByJID(roomID, jid)
 		number := "@" + jid.User
-		output = strings.ReplaceAll(output, number, fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, mxid, displayname))
+		if len(mxid) == 0 {
+			continue
+		} else if len(displayname) == 0 {
+			displayname = "+" + jid.User
+		}
+		output = strings.ReplaceAll(output, number, fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, mxid, html.EscapeString(displayname)))
 		content.Body = strings.ReplaceAll(content.Body, number, displayname)
 	}
 	if output != content.Body || forceHTML {
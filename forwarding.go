@@ -0,0 +1,113 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	forwardedContentKey        = "fi.mau.whatsapp.forwarded"
+	forwardingScoreContentKey  = "fi.mau.whatsapp.forwarding_score"
+	frequentlyForwardedContent = "fi.mau.whatsapp.frequently_forwarded"
+
+	// WhatsApp shows "Forwarded many times" once a message has been forwarded this many times.
+	frequentlyForwardedScore = 5
+)
+
+type messageWithContextInfo interface {
+	GetContextInfo() *waProto.ContextInfo
+}
+
+// getMessageContextInfo finds the context info of any message type that has one.
+func getMessageContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	parts := []messageWithContextInfo{
+		msg.GetExtendedTextMessage(), msg.GetImageMessage(), msg.GetVideoMessage(), msg.GetAudioMessage(),
+		msg.GetDocumentMessage(), msg.GetStickerMessage(), msg.GetContactMessage(), msg.GetContactsArrayMessage(),
+		msg.GetLocationMessage(), msg.GetLiveLocationMessage(), msg.GetGroupInviteMessage(),
+	}
+	for _, part := range parts {
+		if ctxInfo := part.GetContextInfo(); ctxInfo != nil {
+			return ctxInfo
+		}
+	}
+	return nil
+}
+
+func addForwardedPrefix(content *event.MessageEventContent, prefix string) {
+	if content.Format == event.FormatHTML {
+		content.FormattedBody = fmt.Sprintf("<em>%s</em><br/>%s", html.EscapeString(prefix), content.FormattedBody)
+	}
+	content.Body = fmt.Sprintf("%s\n%s", prefix, content.Body)
+}
+
+// addForwardedInfo marks a converted message as forwarded if WhatsApp flagged it as such.
+func (portal *Portal) addForwardedInfo(converted *ConvertedMessage, ctxInfo *waProto.ContextInfo) {
+	if !ctxInfo.GetIsForwarded() {
+		return
+	}
+	score := ctxInfo.GetForwardingScore()
+	frequently := score >= frequentlyForwardedScore
+	if converted.Extra == nil {
+		converted.Extra = make(map[string]interface{})
+	}
+	converted.Extra[forwardedContentKey] = true
+	converted.Extra[forwardingScoreContentKey] = score
+	if frequently {
+		converted.Extra[frequentlyForwardedContent] = true
+	}
+	if !portal.bridge.Config.Bridge.ForwardedPrefix {
+		return
+	}
+	prefix := "↪️ " + portal.formatNotice(noticeForwarded)
+	if frequently {
+		prefix = "⏩ " + portal.formatNotice(noticeForwardedMany)
+	}
+	switch {
+	case converted.Caption != nil:
+		addForwardedPrefix(converted.Caption, prefix)
+	case converted.Content.MsgType == event.MsgText, converted.Content.MsgType == event.MsgNotice,
+		converted.Content.MsgType == event.MsgEmote:
+		addForwardedPrefix(converted.Content, prefix)
+	case portal.bridge.Config.Bridge.CaptionInMessage && converted.Type == event.EventMessage &&
+		(converted.Content.MsgType == event.MsgImage || converted.Content.MsgType == event.MsgVideo ||
+			converted.Content.MsgType == event.MsgAudio || converted.Content.MsgType == event.MsgFile):
+		// Media without a caption has no text to prefix, so use the prefix as the caption.
+		// It's merged into the media event with the rest of the caption.
+		converted.Caption = &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    prefix,
+		}
+	}
+}
+
+// setForwardedFlag marks an outgoing WhatsApp message as forwarded if the Matrix event was copied
+// from a message that was bridged from a forwarded WhatsApp message.
+func setForwardedFlag(ctxInfo *waProto.ContextInfo, evt *event.Event) {
+	if forwarded, _ := evt.Content.Raw[forwardedContentKey].(bool); !forwarded {
+		return
+	}
+	score, _ := evt.Content.Raw[forwardingScoreContentKey].(float64)
+	ctxInfo.IsForwarded = proto.Bool(true)
+	ctxInfo.ForwardingScore = proto.Uint32(uint32(score) + 1)
+}
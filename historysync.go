@@ -19,7 +19,9 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	waProto "go.mau.fi/whatsmeow/binary/proto"
@@ -43,7 +45,8 @@ type wrappedInfo struct {
 	Type  database.MessageType
 	Error database.MessageErrorType
 
-	MediaKey []byte
+	MediaKey      []byte
+	MediaDeferred bool
 
 	ExpirationStart uint64
 	ExpiresIn       uint32
@@ -59,6 +62,7 @@ func (user *User) handleHistorySyncsLoop() {
 		BackfillQuery:   user.bridge.DB.Backfill,
 		reCheckChannels: []chan bool{},
 		log:             user.log.Sub("BackfillQueue"),
+		progressStart:   time.Now(),
 	}
 
 	forwardAndImmediate := []database.BackfillType{database.BackfillImmediate, database.BackfillForward}
@@ -78,11 +82,57 @@ func (user *User) handleHistorySyncsLoop() {
 		go user.dailyMediaRequestLoop()
 	}
 
+	if user.bridge.Config.Bridge.HistorySync.DeferredMedia.Enabled {
+		go user.deferredMediaLoop()
+	}
+
+	if user.bridge.Config.Bridge.HistorySync.ProgressInterval > 0 {
+		go user.backfillProgressLoop()
+	}
+
+	// Resume payloads that were received but not fully stored before the last shutdown.
+	// Payloads received after connecting are stored before they're queued, so they may be
+	// in both the database and the channel. Remember which ones were already handled here.
+	resumed := make(map[int64]struct{})
+	for _, pending := range user.bridge.DB.HistorySync.GetPending(user.MXID) {
+		user.log.Infofln("Resuming history sync received at %s from conversation #%d", time.Unix(0, pending.ReceivedAt), pending.Processed)
+		user.handleHistorySync(user.BackfillQueue, pending)
+		resumed[pending.ReceivedAt] = struct{}{}
+	}
+
 	// Always save the history syncs for the user. If they want to enable
 	// backfilling in the future, we will have it in the database.
-	for evt := range user.historySyncs {
-		user.handleHistorySync(user.BackfillQueue, evt.Data)
+	for {
+		var pending *database.PendingHistorySync
+		select {
+		case pending = <-user.historySyncs:
+		case <-user.loopCtx.Done():
+			return
+		}
+		if _, alreadyHandled := resumed[pending.ReceivedAt]; alreadyHandled {
+			user.log.Debugfln("Skipping history sync received at %s, it was already resumed from the database", time.Unix(0, pending.ReceivedAt))
+			delete(resumed, pending.ReceivedAt)
+			continue
+		}
+		user.handleHistorySync(user.BackfillQueue, pending)
+	}
+}
+
+func isStoredHistorySync(evt *waProto.HistorySync) bool {
+	return evt != nil && evt.SyncType != nil && evt.GetSyncType() != waProto.HistorySync_INITIAL_STATUS_V3 && evt.GetSyncType() != waProto.HistorySync_PUSH_NAME
+}
+
+// enqueueHistorySync persists a received history sync payload before queueing it for processing.
+// The queue is bounded, so this blocks the event handler when the bridge can't keep up.
+func (user *User) enqueueHistorySync(evt *waProto.HistorySync) {
+	if !isStoredHistorySync(evt) {
+		return
+	}
+	pending, err := user.bridge.DB.HistorySync.NewPending(user.MXID, evt)
+	if err != nil {
+		user.log.Warnln("Failed to persist history sync payload, it won't be resumed if the bridge is interrupted:", err)
 	}
+	user.historySyncs <- pending
 }
 
 func (user *User) dailyMediaRequestLoop() {
@@ -104,7 +154,9 @@ func (user *User) dailyMediaRequestLoop() {
 
 	// Wait to start the loop
 	user.log.Infof("Waiting until %s to do media retry requests", requestStartTime)
-	time.Sleep(time.Until(requestStartTime))
+	if !user.waitOrStop(time.Until(requestStartTime)) {
+		return
+	}
 
 	for {
 		mediaBackfillRequests := user.bridge.DB.MediaBackfillRequest.GetMediaBackfillRequestsForUser(user.MXID)
@@ -127,7 +179,9 @@ func (user *User) dailyMediaRequestLoop() {
 		}
 
 		// Wait for 24 hours before making requests again
-		time.Sleep(24 * time.Hour)
+		if !user.waitOrStop(24 * time.Hour) {
+			return
+		}
 	}
 }
 
@@ -208,6 +262,12 @@ func (user *User) backfillInChunks(req *database.Backfill, conv *database.Histor
 	// Update the backfill status here after the room has been created.
 	portal.updateBackfillStatus(backfillState)
 
+	if conv.EphemeralExpiration != nil && portal.IsPrivateChat() && portal.ExpirationTime != *conv.EphemeralExpiration {
+		portal.ExpirationTime = *conv.EphemeralExpiration
+		portal.Update(nil)
+		portal.UpdateDisappearingTimerState()
+	}
+
 	if sendDisappearedNotice {
 		user.log.Debugfln("Sending notice to %s that there are disappeared messages ending at %v", portal.Key.JID, conv.LastMessageTimestamp)
 		resp, err := portal.sendMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
@@ -246,6 +306,7 @@ func (user *User) backfillInChunks(req *database.Backfill, conv *database.Histor
 
 		if len(msgs) > 0 {
 			time.Sleep(time.Duration(req.BatchDelay) * time.Second)
+			user.bridge.ResourceMonitor.Throttle("history sync backfill batch")
 			user.log.Debugfln("Backfilling %d messages in %s (queue ID: %d)", len(msgs), portal.Key.JID, req.QueueID)
 			resp := portal.backfill(user, msgs, req.BackfillType == database.BackfillForward, isLatestEvents, forwardPrevID)
 			if resp != nil && (resp.BaseInsertionEventID != "" || !isLatestEvents) {
@@ -309,64 +370,23 @@ func (user *User) shouldCreatePortalForHistorySync(conv *database.HistorySyncCon
 	}
 }
 
-func (user *User) handleHistorySync(backfillQueue *BackfillQueue, evt *waProto.HistorySync) {
-	if evt == nil || evt.SyncType == nil || evt.GetSyncType() == waProto.HistorySync_INITIAL_STATUS_V3 || evt.GetSyncType() == waProto.HistorySync_PUSH_NAME {
+func (user *User) handleHistorySync(backfillQueue *BackfillQueue, pending *database.PendingHistorySync) {
+	evt := pending.Data
+	// The payload is only removed once everything has been stored and the backfills have been queued
+	defer pending.Delete()
+	if !isStoredHistorySync(evt) {
 		return
 	}
 	description := fmt.Sprintf("type %s, %d conversations, chunk order %d, progress: %d", evt.GetSyncType(), len(evt.GetConversations()), evt.GetChunkOrder(), evt.GetProgress())
 	user.log.Infoln("Storing history sync with", description)
 
-	for _, conv := range evt.GetConversations() {
-		jid, err := types.ParseJID(conv.GetId())
-		if err != nil {
-			user.log.Warnfln("Failed to parse chat JID '%s' in history sync: %v", conv.GetId(), err)
-			continue
-		} else if jid.Server == types.BroadcastServer {
-			user.log.Debugfln("Skipping broadcast list %s in history sync", jid)
+	for i, conv := range evt.GetConversations() {
+		if i < pending.Processed {
 			continue
 		}
-		portal := user.GetPortalByJID(jid)
-
-		historySyncConversation := user.bridge.DB.HistorySync.NewConversationWithValues(
-			user.MXID,
-			conv.GetId(),
-			&portal.Key,
-			getConversationTimestamp(conv),
-			conv.GetMuteEndTime(),
-			conv.GetArchived(),
-			conv.GetPinned(),
-			conv.GetDisappearingMode().GetInitiator(),
-			conv.GetEndOfHistoryTransferType(),
-			conv.EphemeralExpiration,
-			conv.GetMarkedAsUnread(),
-			conv.GetUnreadCount())
-		historySyncConversation.Upsert()
-
-		for _, rawMsg := range conv.GetMessages() {
-			// Don't store messages that will just be skipped.
-			msgEvt, err := user.Client.ParseWebMessage(portal.Key.JID, rawMsg.GetMessage())
-			if err != nil {
-				user.log.Warnln("Dropping historical message due to info parse error:", err)
-				continue
-			}
-
-			msgType := getMessageType(msgEvt.Message)
-			if msgType == "unknown" || msgType == "ignore" || msgType == "unknown_protocol" {
-				continue
-			}
-
-			// Don't store unsupported messages.
-			if !containsSupportedMessage(msgEvt.Message) {
-				continue
-			}
-
-			message, err := user.bridge.DB.HistorySync.NewMessageWithValues(user.MXID, conv.GetId(), msgEvt.Info.ID, rawMsg)
-			if err != nil {
-				user.log.Warnfln("Failed to save message %s in %s. Error: %+v", msgEvt.Info.ID, conv.GetId(), err)
-				continue
-			}
-			message.Insert()
-		}
+		user.bridge.ResourceMonitor.Throttle("storing history sync conversation")
+		user.storeHistorySyncConversation(conv)
+		pending.MarkProcessed(i + 1)
 	}
 
 	// If this was the initial bootstrap, enqueue immediate backfills for the
@@ -378,6 +398,7 @@ func (user *User) handleHistorySync(backfillQueue *BackfillQueue, evt *waProto.H
 		}
 
 		nMostRecent := user.bridge.DB.HistorySync.GetNMostRecentConversations(user.MXID, user.bridge.Config.Bridge.HistorySync.MaxInitialConversations)
+		user.sortConversationsForBackfill(nMostRecent)
 		if len(nMostRecent) > 0 {
 			// Find the portals for all of the conversations.
 			portals := []*Portal{}
@@ -406,6 +427,72 @@ func (user *User) handleHistorySync(backfillQueue *BackfillQueue, evt *waProto.H
 	}
 }
 
+func (user *User) storeHistorySyncConversation(conv *waProto.Conversation) {
+	jid, err := types.ParseJID(conv.GetId())
+	if err != nil {
+		user.log.Warnfln("Failed to parse chat JID '%s' in history sync: %v", conv.GetId(), err)
+		return
+	} else if jid.Server == types.BroadcastServer {
+		user.log.Debugfln("Skipping broadcast list %s in history sync", jid)
+		return
+	}
+	if conv.GetNewJid() != "" {
+		// The contact changed their phone number, so the chat continues under the new JID
+		newJID, err := types.ParseJID(conv.GetNewJid())
+		if err != nil {
+			user.log.Warnfln("Failed to parse new JID '%s' of %s in history sync: %v", conv.GetNewJid(), jid, err)
+		} else if newJID != jid {
+			if oldPortal := user.bridge.DB.Portal.GetByJID(database.NewPortalKey(jid, user.JID)); oldPortal != nil && len(oldPortal.MXID) > 0 {
+				user.HandleContactNumberChange(jid, newJID, time.Now())
+			}
+			jid = newJID
+		}
+	}
+	portal := user.GetPortalByJID(jid)
+
+	historySyncConversation := user.bridge.DB.HistorySync.NewConversationWithValues(
+		user.MXID,
+		conv.GetId(),
+		&portal.Key,
+		getConversationTimestamp(conv),
+		conv.GetMuteEndTime(),
+		conv.GetArchived(),
+		conv.GetPinned(),
+		conv.GetDisappearingMode().GetInitiator(),
+		conv.GetEndOfHistoryTransferType(),
+		conv.EphemeralExpiration,
+		conv.GetMarkedAsUnread(),
+		conv.GetUnreadCount())
+	historySyncConversation.ParticipantCount = len(conv.GetParticipant())
+	historySyncConversation.Upsert()
+
+	for _, rawMsg := range conv.GetMessages() {
+		// Don't store messages that will just be skipped.
+		msgEvt, err := user.Client.ParseWebMessage(portal.Key.JID, rawMsg.GetMessage())
+		if err != nil {
+			user.log.Warnln("Dropping historical message due to info parse error:", err)
+			continue
+		}
+
+		msgType := getMessageType(msgEvt.Message)
+		if msgType == "unknown" || msgType == "ignore" || msgType == "unknown_protocol" {
+			continue
+		}
+
+		// Don't store unsupported messages.
+		if !containsSupportedMessage(msgEvt.Message) {
+			continue
+		}
+
+		message, err := user.bridge.DB.HistorySync.NewMessageWithValues(user.MXID, conv.GetId(), msgEvt.Info.ID, rawMsg)
+		if err != nil {
+			user.log.Warnfln("Failed to save message %s in %s. Error: %+v", msgEvt.Info.ID, conv.GetId(), err)
+			continue
+		}
+		message.Insert()
+	}
+}
+
 func getConversationTimestamp(conv *waProto.Conversation) uint64 {
 	convTs := conv.GetConversationTimestamp()
 	if convTs == 0 && len(conv.GetMessages()) > 0 {
@@ -414,6 +501,29 @@ func getConversationTimestamp(conv *waProto.Conversation) uint64 {
 	return convTs
 }
 
+// backfillTier returns the priority tier of a conversation. Lower tiers are backfilled first.
+func (user *User) backfillTier(conv *database.HistorySyncConversation) int {
+	cfg := user.bridge.Config.Bridge.HistorySync.Priority
+	isGroup := conv.PortalKey.JID.Server == types.GroupServer
+	switch {
+	case isGroup && cfg.LargeGroupSize > 0 && conv.ParticipantCount >= cfg.LargeGroupSize:
+		return 2
+	case isGroup && cfg.DMsFirst:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sortConversationsForBackfill sorts conversations into priority tiers, keeping the most recent first within each tier.
+// The enqueue functions use the index in the list as the priority, so the order is stored in the backfill queue
+// and survives restarts.
+func (user *User) sortConversationsForBackfill(convs []*database.HistorySyncConversation) {
+	sort.SliceStable(convs, func(i, j int) bool {
+		return user.backfillTier(convs[i]) < user.backfillTier(convs[j])
+	})
+}
+
 func (user *User) EnqueueImmedateBackfills(portals []*Portal) {
 	for priority, portal := range portals {
 		maxMessages := user.bridge.Config.Bridge.HistorySync.Immediate.MaxEvents
@@ -450,6 +560,42 @@ func (user *User) EnqueueForwardBackfills(portals []*Portal) {
 	}
 }
 
+var (
+	errBackfillDisabled = errors.New("backfill is not enabled for this bridge")
+	errBackfillNotReady = errors.New("the backfill queue hasn't been started yet, try again after connecting to WhatsApp")
+	errNoOlderHistory   = errors.New("no older messages are stored from the history sync, and this version of the bridge can't request more history from the phone")
+)
+
+// RequestPortalBackfill queues a backfill of up to count messages older than the earliest bridged message in the portal,
+// using the messages stored from history syncs. If count is negative, all stored older messages are backfilled.
+func (user *User) RequestPortalBackfill(portal *Portal, count, batchSize, batchDelay int) error {
+	if !user.bridge.Config.Bridge.HistorySync.Backfill {
+		return errBackfillDisabled
+	} else if user.BackfillQueue == nil {
+		return errBackfillNotReady
+	}
+	conv := user.bridge.DB.HistorySync.GetConversation(user.MXID, &portal.Key)
+	if conv == nil {
+		return errNoOlderHistory
+	}
+	var timeEnd *time.Time
+	if firstMessage := user.bridge.DB.Message.GetFirstInChat(portal.Key); firstMessage != nil {
+		end := firstMessage.Timestamp.Add(-1 * time.Second)
+		timeEnd = &end
+	}
+	if len(user.bridge.DB.HistorySync.GetMessagesBetween(user.MXID, conv.ConversationID, nil, timeEnd, 1)) == 0 {
+		return errNoOlderHistory
+	}
+	if count > 0 && batchSize > count {
+		batchSize = count
+	}
+	user.log.Debugfln("Queuing on-demand backfill of %d messages in %s (batch size: %d, delay: %d)", count, portal.Key.JID, batchSize, batchDelay)
+	backfill := user.bridge.DB.Backfill.NewWithValues(user.MXID, database.BackfillImmediate, 0, &portal.Key, nil, batchSize, count, batchDelay)
+	backfill.Insert()
+	user.BackfillQueue.ReCheck()
+	return nil
+}
+
 // endregion
 // region Portal backfilling
 
@@ -473,6 +619,9 @@ func (portal *Portal) backfill(source *User, messages []*waProto.WebMessageInfo,
 	var infos []*wrappedInfo
 
 	if !isForward {
+		if portal.FirstEventID == "" && portal.NextBatchID == "" {
+			portal.findFirstEventID()
+		}
 		if portal.FirstEventID != "" || portal.NextBatchID != "" {
 			req.PrevEventID = portal.FirstEventID
 			req.BatchID = portal.NextBatchID
@@ -520,6 +669,18 @@ func (portal *Portal) backfill(source *User, messages []*waProto.WebMessageInfo,
 		addedMembers[puppet.MXID] = struct{}{}
 	}
 
+	replayGroupChanges := portal.IsGroupChat() && portal.bridge.Config.Bridge.HistorySync.ReplayGroupChanges &&
+		portal.bridge.Config.Homeserver.Software == bridgeconfig.SoftwareHungry
+	newestIconChange := -1
+	if replayGroupChanges && isLatest {
+		for i, webMsg := range messages {
+			if webMsg.GetMessageStubType() == waProto.WebMessageInfo_GROUP_CHANGE_ICON {
+				newestIconChange = i
+				break
+			}
+		}
+	}
+
 	portal.log.Infofln("Processing history sync with %d messages (forward: %t, latest: %t, prev: %s, batch: %s)", len(messages), isForward, isLatest, req.PrevEventID, req.BatchID)
 	// The messages are ordered newest to oldest, so iterate them in reverse order.
 	for i := len(messages) - 1; i >= 0; i-- {
@@ -529,6 +690,22 @@ func (portal *Portal) backfill(source *User, messages []*waProto.WebMessageInfo,
 			continue
 		}
 
+		if replayGroupChanges && webMsg.GetMessageStubType() != 0 {
+			puppet := portal.getMessagePuppet(source, &msgEvt.Info)
+			if puppet == nil {
+				continue
+			}
+			stateEvt := portal.convertBackfillGroupChange(puppet.DefaultIntent(), webMsg, &msgEvt.Info, i == newestIconChange)
+			if stateEvt != nil {
+				if !portal.bridge.StateStore.IsInRoom(portal.MXID, puppet.MXID) {
+					addMember(puppet)
+				}
+				req.Events = append(req.Events, stateEvt)
+				infos = append(infos, nil)
+			}
+			continue
+		}
+
 		msgType := getMessageType(msgEvt.Message)
 		if msgType == "unknown" || msgType == "ignore" || msgType == "unknown_protocol" {
 			if msgType != "ignore" {
@@ -556,6 +733,7 @@ func (portal *Portal) backfill(source *User, messages []*waProto.WebMessageInfo,
 			intent = puppet.DefaultIntent()
 		}
 
+		applyViewOnceFlag(msgEvt)
 		converted := portal.convertMessage(intent, source, &msgEvt.Info, msgEvt.Message, true)
 		if converted == nil {
 			portal.log.Debugfln("Skipping unsupported message %s in backfill", msgEvt.Info.ID)
@@ -612,10 +790,74 @@ func (portal *Portal) backfill(source *User, messages []*waProto.WebMessageInfo,
 		if portal.bridge.Config.Bridge.HistorySync.MediaRequests.AutoRequestMedia {
 			go portal.requestMediaRetries(source, resp.EventIDs, infos)
 		}
+		if portal.bridge.Config.Bridge.HistorySync.DeferredMedia.Enabled {
+			portal.queueDeferredMedia(source, infos)
+		}
 		return resp
 	}
 }
 
+// findFirstEventID finds an anchor for backwards batch sending in portals where the creation dummy event
+// couldn't be sent. The earliest event sent by the portal's main intent after the room was created is used,
+// so that backfilled history ends up at the start of the room instead of being lost.
+func (portal *Portal) findFirstEventID() {
+	intent := portal.MainIntent()
+	resp, err := intent.Messages(portal.MXID, "", "", 'f', nil, 20)
+	if err != nil {
+		portal.log.Warnln("Failed to fetch earliest events to find backfill anchor:", err)
+		return
+	}
+	for _, evt := range resp.Chunk {
+		// Events from /messages aren't parsed, so compare the type strings and raw content
+		isOwnJoin := evt.Type.Type == event.StateMember.Type && evt.GetStateKey() == intent.UserID.String() &&
+			evt.Content.Raw["membership"] == string(event.MembershipJoin)
+		if evt.Sender == intent.UserID && (evt.Type.Type == PortalCreationDummyEvent.Type || isOwnJoin) {
+			portal.log.Debugfln("Using %s (%s) as backfill anchor as first event ID wasn't known", evt.ID, evt.Type.Type)
+			portal.FirstEventID = evt.ID
+			portal.Update(nil)
+			return
+		}
+	}
+	portal.log.Warnfln("Didn't find a suitable backfill anchor in the first %d events", len(resp.Chunk))
+}
+
+// convertBackfillGroupChange converts a group metadata change stub from a history sync into a state event,
+// so that the backfilled room shows how the group evolved instead of only its current metadata.
+func (portal *Portal) convertBackfillGroupChange(intent *appservice.IntentAPI, webMsg *waProto.WebMessageInfo, info *types.MessageInfo, isNewestIcon bool) *event.Event {
+	var evtType event.Type
+	var content interface{}
+	params := webMsg.GetMessageStubParameters()
+	switch webMsg.GetMessageStubType() {
+	case waProto.WebMessageInfo_GROUP_CHANGE_SUBJECT:
+		if len(params) == 0 {
+			return nil
+		}
+		evtType, content = event.StateRoomName, &event.RoomNameEventContent{Name: params[0]}
+	case waProto.WebMessageInfo_GROUP_CHANGE_DESCRIPTION:
+		if len(params) == 0 {
+			return nil
+		}
+		evtType, content = event.StateTopic, &event.TopicEventContent{Topic: params[0]}
+	case waProto.WebMessageInfo_GROUP_CHANGE_ICON:
+		// Old group photos can't be downloaded, so only the newest change can use the current avatar
+		if !isNewestIcon || portal.AvatarURL.IsEmpty() {
+			return nil
+		}
+		evtType, content = event.StateRoomAvatar, &event.RoomAvatarEventContent{URL: portal.AvatarURL.CUString()}
+	default:
+		return nil
+	}
+	stateKey := ""
+	return &event.Event{
+		ID:        portal.deterministicEventID(info.Sender, info.ID),
+		Sender:    intent.UserID,
+		Type:      evtType,
+		StateKey:  &stateKey,
+		Timestamp: info.Timestamp.UnixMilli(),
+		Content:   event.Content{Parsed: content},
+	}
+}
+
 func (portal *Portal) requestMediaRetries(source *User, eventIDs []id.EventID, infos []*wrappedInfo) {
 	for i, info := range infos {
 		if info != nil && info.Error == database.MsgErrMediaNotFound && info.MediaKey != nil {
@@ -649,10 +891,10 @@ func (portal *Portal) appendBatchEvents(converted *ConvertedMessage, info *types
 			return err
 		}
 		*eventsArray = append(*eventsArray, mainEvt, captionEvt)
-		*infoArray = append(*infoArray, &wrappedInfo{info, database.MsgNormal, converted.Error, converted.MediaKey, expirationStart, converted.ExpiresIn}, nil)
+		*infoArray = append(*infoArray, &wrappedInfo{info, database.MsgNormal, converted.Error, converted.MediaKey, converted.MediaDeferred, expirationStart, converted.ExpiresIn}, nil)
 	} else {
 		*eventsArray = append(*eventsArray, mainEvt)
-		*infoArray = append(*infoArray, &wrappedInfo{info, database.MsgNormal, converted.Error, converted.MediaKey, expirationStart, converted.ExpiresIn})
+		*infoArray = append(*infoArray, &wrappedInfo{info, database.MsgNormal, converted.Error, converted.MediaKey, converted.MediaDeferred, expirationStart, converted.ExpiresIn})
 	}
 	if converted.MultiEvent != nil {
 		for _, subEvtContent := range converted.MultiEvent {
@@ -0,0 +1,188 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/util"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+const interactiveReplyHint = "Reply to this message with the number or text of an option to respond"
+
+// formatInteractiveMessage renders the text of a business message with its options (as markdown) and footer.
+// The text and footer use WhatsApp formatting, so the options are rendered separately and inserted afterwards.
+func (portal *Portal) formatInteractiveMessage(content *event.MessageEventContent, text, optionsMarkdown, footer string) {
+	placeholder := util.RandomString(64)
+	body := text
+	if len(optionsMarkdown) > 0 {
+		if len(body) > 0 {
+			body = fmt.Sprintf("%s\n\n%s", body, placeholder)
+		} else {
+			body = placeholder
+		}
+	}
+	if len(footer) > 0 {
+		body = fmt.Sprintf("%s\n\n%s", body, footer)
+	}
+	content.Body = body
+	portal.bridge.Formatter.ParseWhatsApp(portal.MXID, content, nil, false, true)
+	if len(optionsMarkdown) > 0 {
+		rendered := format.RenderMarkdown(optionsMarkdown, true, false)
+		content.Body = strings.Replace(content.Body, placeholder, rendered.Body, 1)
+		content.FormattedBody = strings.Replace(content.FormattedBody, placeholder, rendered.FormattedBody, 1)
+	}
+}
+
+func (portal *Portal) convertButtonsMessage(intent *appservice.IntentAPI, source *User, info *types.MessageInfo, msg *waProto.ButtonsMessage) *ConvertedMessage {
+	converted := &ConvertedMessage{
+		Intent: intent,
+		Type:   event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType: event.MsgText,
+		},
+		ReplyTo:   GetReply(msg.GetContextInfo()),
+		ExpiresIn: msg.GetContextInfo().GetExpiration(),
+	}
+	text := msg.GetContentText()
+	var convertedHeader *ConvertedMessage
+	switch header := msg.GetHeader().(type) {
+	case *waProto.ButtonsMessage_Text:
+		if len(header.Text) > 0 {
+			text = fmt.Sprintf("*%s*\n\n%s", header.Text, text)
+		}
+	case *waProto.ButtonsMessage_DocumentMessage:
+		convertedHeader = portal.convertMediaMessage(intent, source, info, header.DocumentMessage, "file attachment", false)
+	case *waProto.ButtonsMessage_ImageMessage:
+		convertedHeader = portal.convertMediaMessage(intent, source, info, header.ImageMessage, "photo", false)
+	case *waProto.ButtonsMessage_VideoMessage:
+		convertedHeader = portal.convertMediaMessage(intent, source, info, header.VideoMessage, "video attachment", false)
+	case *waProto.ButtonsMessage_LocationMessage:
+		text = fmt.Sprintf("Unsupported location message\n\n%s", text)
+	}
+
+	interactive := &database.InteractiveMessage{Kind: database.InteractiveButtons}
+	var optionsMarkdown strings.Builder
+	for i, button := range msg.GetButtons() {
+		displayText := button.GetButtonText().GetDisplayText()
+		if len(displayText) == 0 {
+			continue
+		}
+		number := len(interactive.Options) + 1
+		_, _ = fmt.Fprintf(&optionsMarkdown, "%d. %s\n", number, displayText)
+		interactive.Options = append(interactive.Options, database.InteractiveOption{
+			Number: number,
+			ID:     button.GetButtonId(),
+			Text:   displayText,
+			Index:  i,
+		})
+	}
+	if len(interactive.Options) > 0 {
+		optionsMarkdown.WriteString("\n" + interactiveReplyHint)
+		converted.Interactive = interactive
+	}
+	if len(text) == 0 && len(interactive.Options) == 0 && convertedHeader == nil {
+		text = "Unsupported business message"
+	}
+	portal.formatInteractiveMessage(converted.Content, text, optionsMarkdown.String(), msg.GetFooterText())
+	if convertedHeader != nil {
+		converted.MediaKey = convertedHeader.MediaKey
+		converted.Extra = convertedHeader.Extra
+		converted.Caption = converted.Content
+		converted.Content = convertedHeader.Content
+		converted.Error = convertedHeader.Error
+	}
+	return converted
+}
+
+func (portal *Portal) convertButtonsResponseMessage(intent *appservice.IntentAPI, msg *waProto.ButtonsResponseMessage) *ConvertedMessage {
+	body := msg.GetSelectedDisplayText()
+	if len(body) == 0 {
+		body = "Unsupported button reply message"
+	}
+	return &ConvertedMessage{
+		Intent: intent,
+		Type:   event.EventMessage,
+		Content: &event.MessageEventContent{
+			Body:    body,
+			MsgType: event.MsgText,
+		},
+		Extra: map[string]interface{}{
+			"fi.mau.whatsapp.buttons_reply": map[string]interface{}{
+				"id": msg.GetSelectedButtonId(),
+			},
+		},
+		ReplyTo:   GetReply(msg.GetContextInfo()),
+		ExpiresIn: msg.GetContextInfo().GetExpiration(),
+	}
+}
+
+func (portal *Portal) storeInteractiveMessage(interactive *database.InteractiveMessage, msgID types.MessageID) {
+	stored := portal.bridge.DB.InteractiveMessage.New()
+	stored.Chat = portal.Key
+	stored.JID = msgID
+	stored.Kind = interactive.Kind
+	stored.Options = interactive.Options
+	stored.Upsert()
+}
+
+// convertInteractiveReply converts a Matrix reply that selects an option of a business message
+// into the response message WhatsApp would send when tapping the option.
+func convertInteractiveReply(interactive *database.InteractiveMessage, option *database.InteractiveOption, ctxInfo *waProto.ContextInfo) *waProto.Message {
+	switch interactive.Kind {
+	case database.InteractiveButtons:
+		return &waProto.Message{ButtonsResponseMessage: &waProto.ButtonsResponseMessage{
+			SelectedButtonId: proto.String(option.ID),
+			Response:         &waProto.ButtonsResponseMessage_SelectedDisplayText{SelectedDisplayText: option.Text},
+			Type:             waProto.ButtonsResponseMessage_DISPLAY_TEXT.Enum(),
+			ContextInfo:      ctxInfo,
+		}}
+	case database.InteractiveTemplate:
+		return &waProto.Message{TemplateButtonReplyMessage: &waProto.TemplateButtonReplyMessage{
+			SelectedId:          proto.String(option.ID),
+			SelectedDisplayText: proto.String(option.Text),
+			SelectedIndex:       proto.Uint32(uint32(option.Index)),
+			ContextInfo:         ctxInfo,
+		}}
+	case database.InteractiveList:
+		msg := &waProto.ListResponseMessage{
+			Title:    proto.String(option.Text),
+			ListType: waProto.ListResponseMessage_SINGLE_SELECT.Enum(),
+			SingleSelectReply: &waProto.ListResponseMessage_SingleSelectReply{
+				SelectedRowId: proto.String(option.ID),
+			},
+			ContextInfo: ctxInfo,
+		}
+		if len(option.Description) > 0 {
+			msg.Description = proto.String(option.Description)
+		}
+		return &waProto.Message{ListResponseMessage: msg}
+	default:
+		return nil
+	}
+}
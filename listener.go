@@ -0,0 +1,167 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// parseAllowlist parses IP addresses, CIDR ranges and hostnames into a list of networks.
+// Hostnames are resolved once at startup.
+func parseAllowlist(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+		var ips []net.IP
+		if ip := net.ParseIP(entry); ip != nil {
+			ips = []net.IP{ip}
+		} else if resolved, err := net.LookupIP(entry); err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", entry, err)
+		} else {
+			ips = resolved
+		}
+		for _, ip := range ips {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return networks, nil
+}
+
+func ipAllowed(networks []*net.IPNet, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowlistMiddleware rejects requests to the appservice and provisioning API from IPs outside the configured allowlist.
+func (br *WABridge) AllowlistMiddleware(networks []*net.IPNet) func(http.Handler) http.Handler {
+	log := br.Log.Sub("Listener")
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ipAllowed(networks, r.RemoteAddr) {
+				log.Debugfln("Rejecting %s %s from %s: IP not in allowlist", r.Method, r.URL.Path, r.RemoteAddr)
+				jsonResponse(w, http.StatusForbidden, map[string]interface{}{
+					"error":   "IP address not allowed",
+					"errcode": "M_FORBIDDEN",
+				})
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// initACMEListener prepares an HTTPS listener for the appservice router with certificates from ACME (using the
+// HTTP-01 challenge on port 80). The autocert manager renews the certificate in the background, so the bridge
+// doesn't need to be restarted when it expires.
+//
+// The built-in appservice listener can't be given a custom TLS config, so it's moved to a random port on
+// localhost and the configured address is served by this listener instead.
+func (br *WABridge) initACMEListener() {
+	cfg := br.Config.Listener.ACME
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domain),
+		Email:      cfg.Email,
+	}
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			// The homeserver may connect by IP address without sending SNI
+			hello.ServerName = cfg.Domain
+		}
+		return manager.GetCertificate(hello)
+	}
+	br.acmeChallengeServer = &http.Server{Addr: cfg.ChallengeListen, Handler: manager.HTTPHandler(nil)}
+	br.acmeServer = &http.Server{Addr: br.AS.Host.Address(), Handler: br.AS.Router, TLSConfig: tlsConfig}
+	br.AS.Host.Hostname, br.AS.Host.Port = "127.0.0.1", 0
+	br.AS.Host.TLSCert, br.AS.Host.TLSKey = "", ""
+}
+
+// startACMEListener starts the listeners prepared by initACMEListener.
+func (br *WABridge) startACMEListener() {
+	go func() {
+		err := br.acmeChallengeServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			br.Log.Errorln("ACME challenge listener failed:", err)
+		}
+	}()
+	br.Log.Infoln("Listening with ACME certificates on", br.acmeServer.Addr)
+	err := br.acmeServer.ListenAndServeTLS("", "")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		br.Log.Fatalln("Error in ACME listener:", err)
+		os.Exit(21)
+	}
+}
+
+// stopACMEListener stops the listeners started by startACMEListener.
+func (br *WABridge) stopACMEListener() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = br.acmeServer.Shutdown(ctx)
+	_ = br.acmeChallengeServer.Shutdown(ctx)
+}
+
+// InitListener applies the TLS and IP allowlist settings to the appservice HTTP listener,
+// which is also used by the provisioning API.
+func (br *WABridge) InitListener() {
+	cfg := br.Config.Listener
+	if len(cfg.AllowedIPs) > 0 {
+		networks, err := parseAllowlist(cfg.AllowedIPs)
+		if err != nil {
+			br.Log.Fatalln("Failed to parse listener IP allowlist:", err)
+			os.Exit(20)
+		}
+		br.AS.Router.Use(br.AllowlistMiddleware(networks))
+	}
+	if cfg.ACME.Enabled {
+		br.initACMEListener()
+	} else if len(cfg.TLSCert) > 0 && len(cfg.TLSKey) > 0 {
+		br.AS.Host.TLSCert, br.AS.Host.TLSKey = cfg.TLSCert, cfg.TLSKey
+	}
+}
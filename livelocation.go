@@ -0,0 +1,212 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+var (
+	BeaconInfoEvent = event.Type{Type: "org.matrix.msc3672.beacon_info", Class: event.StateEventType}
+	BeaconEvent     = event.Type{Type: "org.matrix.msc3672.beacon", Class: event.MessageEventType}
+)
+
+// WhatsApp doesn't include the duration in live location messages, so use the longest duration the apps allow.
+const liveLocationTimeout = 8 * time.Hour
+
+type liveLocationShare struct {
+	intent      *appservice.IntentAPI
+	messageID   types.MessageID
+	infoEventID id.EventID
+	description string
+	started     time.Time
+
+	lastSequence int64
+	lastUpdate   time.Time
+}
+
+func (share *liveLocationShare) expired() bool {
+	return time.Since(share.started) > liveLocationTimeout
+}
+
+// isOutdated checks whether the given update is older than the last one that was bridged to the beacon.
+// Updates are ordered by sequence number if the message has one, and by timestamp otherwise.
+func (share *liveLocationShare) isOutdated(msg *waProto.LiveLocationMessage, ts time.Time) bool {
+	if msg.SequenceNumber != nil {
+		return msg.GetSequenceNumber() <= share.lastSequence
+	}
+	return ts.Before(share.lastUpdate)
+}
+
+func (share *liveLocationShare) infoContent(live bool) map[string]interface{} {
+	return map[string]interface{}{
+		"description":           share.description,
+		"live":                  live,
+		"timeout":               liveLocationTimeout.Milliseconds(),
+		"org.matrix.msc3488.ts": share.started.UnixMilli(),
+		"org.matrix.msc3488.asset": map[string]interface{}{
+			"type": "m.self",
+		},
+	}
+}
+
+// makeLocationExtra returns the extensible event (MSC3488) fields for a location. The timestamp is omitted if it's zero.
+func makeLocationExtra(lat, long float64, description string, ts time.Time, assetType string) map[string]interface{} {
+	location := map[string]interface{}{
+		"uri": fmt.Sprintf("geo:%.5f,%.5f", lat, long),
+	}
+	if len(description) > 0 {
+		location["description"] = description
+	}
+	extra := map[string]interface{}{
+		"org.matrix.msc3488.location": location,
+		"org.matrix.msc3488.asset": map[string]interface{}{
+			"type": assetType,
+		},
+	}
+	if !ts.IsZero() {
+		extra["org.matrix.msc3488.ts"] = ts.UnixMilli()
+	}
+	return extra
+}
+
+func (portal *Portal) sendBeaconLocation(share *liveLocationShare, msg *waProto.LiveLocationMessage, ts time.Time) error {
+	content := makeLocationExtra(msg.GetDegreesLatitude(), msg.GetDegreesLongitude(), "", ts, "m.self")
+	content["m.relates_to"] = map[string]interface{}{
+		"rel_type": "m.reference",
+		"event_id": share.infoEventID,
+	}
+	wrapped := &event.Content{Raw: content}
+	evtType, err := portal.encrypt(share.intent, wrapped, BeaconEvent)
+	if err != nil {
+		return err
+	}
+	_, err = share.intent.SendMassagedMessageEvent(portal.MXID, evtType, wrapped, ts.UnixMilli())
+	return err
+}
+
+// startLiveLocation bridges the first message of a WhatsApp live location share as an MSC3672 location beacon.
+// It returns false if the beacon couldn't be started, in which case the message should be bridged normally.
+func (portal *Portal) startLiveLocation(intent *appservice.IntentAPI, info *types.MessageInfo, msg *waProto.LiveLocationMessage) bool {
+	if !portal.bridge.Config.Bridge.LiveLocationBeacons {
+		return false
+	}
+	share := &liveLocationShare{
+		intent:      intent,
+		messageID:   info.ID,
+		description: msg.GetCaption(),
+		started:     info.Timestamp,
+
+		lastSequence: msg.GetSequenceNumber(),
+		lastUpdate:   info.Timestamp,
+	}
+	resp, err := intent.SendMassagedStateEvent(portal.MXID, BeaconInfoEvent, intent.UserID.String(), share.infoContent(true), info.Timestamp.UnixMilli())
+	if err != nil {
+		portal.log.Warnfln("Failed to start location beacon for %s, falling back to a notice: %v", info.ID, err)
+		return false
+	}
+	share.infoEventID = resp.EventID
+	portal.finishHandling(nil, info, resp.EventID, database.MsgNormal, database.MsgNoError)
+	err = portal.sendBeaconLocation(share, msg, info.Timestamp)
+	if err != nil {
+		portal.log.Warnfln("Failed to send initial location of beacon %s: %v", resp.EventID, err)
+	}
+	portal.liveLocationsLock.Lock()
+	portal.liveLocations[info.Sender.ToNonAD()] = share
+	portal.liveLocationsLock.Unlock()
+	return true
+}
+
+// handleLiveLocationUpdate sends a location update to the active beacon of the sender.
+// It returns false if the sender doesn't have an active beacon in the portal.
+func (portal *Portal) handleLiveLocationUpdate(info *types.MessageInfo, msg *waProto.LiveLocationMessage) bool {
+	if !portal.bridge.Config.Bridge.LiveLocationBeacons {
+		return false
+	}
+	sender := info.Sender.ToNonAD()
+	portal.liveLocationsLock.Lock()
+	share, ok := portal.liveLocations[sender]
+	if ok && share.expired() {
+		delete(portal.liveLocations, sender)
+		ok = false
+	}
+	outdated := ok && share.isOutdated(msg, info.Timestamp)
+	if ok && !outdated {
+		share.lastSequence = msg.GetSequenceNumber()
+		share.lastUpdate = info.Timestamp
+	}
+	portal.liveLocationsLock.Unlock()
+	if !ok {
+		return false
+	} else if outdated {
+		portal.log.Debugfln("Dropping out-of-order location update %s (sequence %d) for beacon %s", info.ID, msg.GetSequenceNumber(), share.infoEventID)
+		return true
+	}
+	err := portal.sendBeaconLocation(share, msg, info.Timestamp)
+	if err != nil {
+		portal.log.Warnfln("Failed to send location update %s to beacon %s: %v", info.ID, share.infoEventID, err)
+	} else {
+		portal.log.Debugfln("Sent location update %s to beacon %s", info.ID, share.infoEventID)
+	}
+	return true
+}
+
+// stopLiveLocation marks the beacon that was started by the given WhatsApp message as no longer live.
+func (portal *Portal) stopLiveLocation(messageID types.MessageID) {
+	portal.liveLocationsLock.Lock()
+	var share *liveLocationShare
+	for sender, item := range portal.liveLocations {
+		if item.messageID == messageID {
+			share = item
+			delete(portal.liveLocations, sender)
+			break
+		}
+	}
+	portal.liveLocationsLock.Unlock()
+	portal.endBeacon(share)
+}
+
+// stopLiveLocationOf marks the active beacon of the given sender as no longer live.
+func (portal *Portal) stopLiveLocationOf(sender types.JID) {
+	portal.liveLocationsLock.Lock()
+	share, ok := portal.liveLocations[sender.ToNonAD()]
+	if ok {
+		delete(portal.liveLocations, sender.ToNonAD())
+	}
+	portal.liveLocationsLock.Unlock()
+	portal.endBeacon(share)
+}
+
+func (portal *Portal) endBeacon(share *liveLocationShare) {
+	if share == nil {
+		return
+	}
+	_, err := share.intent.SendStateEvent(portal.MXID, BeaconInfoEvent, share.intent.UserID.String(), share.infoContent(false))
+	if err != nil {
+		portal.log.Warnfln("Failed to stop location beacon %s: %v", share.infoEventID, err)
+	}
+}
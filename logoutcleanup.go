@@ -0,0 +1,177 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+type LogoutCleanupMode string
+
+const (
+	LogoutCleanupKeep     LogoutCleanupMode = "keep"
+	LogoutCleanupLeave    LogoutCleanupMode = "leave"
+	LogoutCleanupReadOnly LogoutCleanupMode = "read-only"
+	LogoutCleanupDelete   LogoutCleanupMode = "delete"
+)
+
+func ParseLogoutCleanupMode(mode string) (LogoutCleanupMode, bool) {
+	switch LogoutCleanupMode(strings.ToLower(strings.TrimSpace(mode))) {
+	case LogoutCleanupKeep:
+		return LogoutCleanupKeep, true
+	case LogoutCleanupLeave:
+		return LogoutCleanupLeave, true
+	case LogoutCleanupReadOnly, "readonly":
+		return LogoutCleanupReadOnly, true
+	case LogoutCleanupDelete:
+		return LogoutCleanupDelete, true
+	default:
+		return "", false
+	}
+}
+
+// DefaultLogoutCleanupMode returns the configured logout cleanup mode, falling back to keeping the rooms
+// if the config value is missing or invalid.
+func (br *WABridge) DefaultLogoutCleanupMode() LogoutCleanupMode {
+	mode, ok := ParseLogoutCleanupMode(br.Config.Bridge.LogoutCleanup)
+	if !ok {
+		return LogoutCleanupKeep
+	}
+	return mode
+}
+
+type LogoutCleanupResult struct {
+	Cleaned int
+	Left    int
+}
+
+// getLogoutCleanupPortals collects the portals that should be cleaned up when the user logs out.
+// It must be called before the session is deleted, as private chat portals are found by the user's JID.
+func (user *User) getLogoutCleanupPortals() []*Portal {
+	var portals []*Portal
+	if !user.JID.IsEmpty() {
+		for _, portal := range user.bridge.dbPortalsToPortals(user.bridge.DB.Portal.FindPrivateChats(user.JID.ToNonAD())) {
+			if portal != nil && len(portal.MXID) > 0 {
+				portals = append(portals, portal)
+			}
+		}
+	}
+	for _, portal := range user.bridge.GetAllPortals() {
+		// Check the local state store first to avoid fetching the member list of every group on the bridge
+		if portal != nil && len(portal.MXID) > 0 && portal.IsGroupChat() && user.bridge.StateStore.IsInRoom(portal.MXID, user.MXID) {
+			portals = append(portals, portal)
+		}
+	}
+	return portals
+}
+
+// isSharedWithOthers checks whether the user is in the portal room and whether any other logged-in
+// Matrix user is in it too.
+func (portal *Portal) isSharedWithOthers(userID id.UserID) (isMember, shared bool, err error) {
+	members, err := portal.MainIntent().JoinedMembers(portal.MXID)
+	if err != nil {
+		return false, false, err
+	}
+	for member := range members.Joined {
+		if member == userID {
+			isMember = true
+			continue
+		}
+		_, isPuppet := portal.bridge.ParsePuppetMXID(member)
+		if isPuppet || member == portal.bridge.Bot.UserID {
+			continue
+		}
+		otherUser := portal.bridge.GetUserByMXID(member)
+		if otherUser != nil && otherUser.Session != nil {
+			shared = true
+		}
+	}
+	return
+}
+
+func (portal *Portal) kickLoggedOutUser(userID id.UserID) {
+	_, err := portal.MainIntent().KickUser(portal.MXID, &mautrix.ReqKickUser{
+		Reason: "Logged out of WhatsApp",
+		UserID: userID,
+	})
+	if err != nil {
+		portal.log.Warnfln("Failed to kick %s after logout: %v", userID, err)
+	}
+}
+
+// leaveAfterLogout kicks the user and makes the WhatsApp ghosts leave the room, but keeps the portal
+// and the bridge bot in the room, so that the room can be reused if the user logs in again.
+func (portal *Portal) leaveAfterLogout(userID id.UserID) {
+	members, err := portal.MainIntent().JoinedMembers(portal.MXID)
+	if err != nil {
+		portal.log.Errorln("Failed to get portal members for logout cleanup:", err)
+		return
+	}
+	for member := range members.Joined {
+		if member == portal.MainIntent().UserID {
+			continue
+		}
+		puppet := portal.bridge.GetPuppetByMXID(member)
+		if puppet != nil {
+			_, err = puppet.DefaultIntent().LeaveRoom(portal.MXID)
+			if err != nil {
+				portal.log.Warnln("Error leaving as puppet during logout cleanup:", err)
+			}
+		}
+	}
+	portal.kickLoggedOutUser(userID)
+}
+
+// CleanupPortalsAfterLogout applies the given cleanup mode to the given portals. Portals that other
+// logged-in users are in are left alone, except that the user is kicked from them in the leave and
+// delete modes.
+func (user *User) CleanupPortalsAfterLogout(portals []*Portal, mode LogoutCleanupMode) (result LogoutCleanupResult) {
+	if mode == LogoutCleanupKeep {
+		return
+	}
+	for _, portal := range portals {
+		isMember, shared, err := portal.isSharedWithOthers(user.MXID)
+		if err != nil {
+			portal.log.Warnfln("Failed to get members to clean up portal after %s logged out: %v", user.MXID, err)
+			continue
+		} else if !isMember && (portal.IsGroupChat() || shared) {
+			continue
+		}
+		if shared {
+			if mode == LogoutCleanupLeave || mode == LogoutCleanupDelete {
+				portal.kickLoggedOutUser(user.MXID)
+				result.Left++
+			}
+			continue
+		}
+		portal.log.Debugfln("Cleaning up portal after %s logged out (mode: %s)", user.MXID, mode)
+		switch mode {
+		case LogoutCleanupLeave:
+			portal.leaveAfterLogout(user.MXID)
+		case LogoutCleanupReadOnly:
+			portal.RestrictMessageSending(true)
+		case LogoutCleanupDelete:
+			portal.Delete()
+			portal.Cleanup(false)
+		}
+		result.Cleaned++
+	}
+	return
+}
@@ -65,11 +65,23 @@ type WABridge struct {
 	Provisioning *ProvisioningAPI
 	Formatter    *Formatter
 	Metrics      *MetricsHandler
-	WAContainer  *sqlstore.Container
-	WAVersion    string
+	Transcoder   *TranscodePool
+	MediaMemory  *MediaMemoryLimiter
+	// ResourceMonitor is nil if resource pressure detection is disabled
+	ResourceMonitor *ResourceMonitor
+	WAContainer     *sqlstore.Container
+	WAVersion       string
+
+	// acmeServer and acmeChallengeServer are only set if ACME is enabled for the listener
+	acmeServer          *http.Server
+	acmeChallengeServer *http.Server
 
 	PuppetActivity *PuppetActivity
 
+	startupSyncDone     chan struct{}
+	startupSyncDeferred map[*User]struct{}
+	startupSyncLock     sync.Mutex
+
 	usersByMXID         map[id.UserID]*User
 	usersByUsername     map[string]*User
 	usersLock           sync.Mutex
@@ -83,6 +95,10 @@ type WABridge struct {
 	puppets             map[types.JID]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
+
+	// devicePropsLock protects the global whatsmeow device props,
+	// which logins temporarily change to override the full history sync setting and the device name.
+	devicePropsLock sync.Mutex
 }
 
 func (br *WABridge) Init() {
@@ -91,6 +107,7 @@ func (br *WABridge) Init() {
 
 	// TODO this is a weird place for this
 	br.EventProcessor.On(event.EphemeralEventPresence, br.HandlePresence)
+	br.EventProcessor.On(EventSendSticker, br.MatrixHandler.HandleMessage)
 
 	Segment.log = br.Log.Sub("Segment")
 	Segment.key = br.Config.SegmentKey
@@ -99,9 +116,12 @@ func (br *WABridge) Init() {
 	}
 
 	br.DB = database.New(br.Bridge.DB, br.Log.Sub("Database"))
+	br.DB.SoftDelete = br.Config.Bridge.SoftDelete.Enabled
 	br.WAContainer = sqlstore.NewWithDB(br.DB.RawDB, br.DB.Dialect.String(), &waLogger{br.Log.Sub("Database").Sub("WhatsApp")})
 	br.WAContainer.DatabaseErrorHandler = br.DB.HandleSignalStoreError
 
+	br.InitListener()
+
 	ss := br.Config.Bridge.Provisioning.SharedSecret
 	if len(ss) > 0 && ss != "disable" {
 		br.Provisioning = &ProvisioningAPI{bridge: br}
@@ -110,10 +130,16 @@ func (br *WABridge) Init() {
 	br.Formatter = NewFormatter(br)
 	br.Metrics = NewMetricsHandler(br.Config.Metrics.Listen, br.Log.Sub("Metrics"), br.DB, br.PuppetActivity)
 	br.MatrixHandler.TrackEventDuration = br.Metrics.TrackMatrixEvent
+	br.InitErrorTracking()
+	if br.Config.Bridge.ResourcePressure.Enabled {
+		br.ResourceMonitor = NewResourceMonitor(br)
+	}
+	br.Transcoder = NewTranscodePool(br)
+	br.MediaMemory = NewMediaMemoryLimiter(br.Config.Bridge.MediaMemoryLimit)
 
 	store.BaseClientPayload.UserAgent.OsVersion = proto.String(br.WAVersion)
 	store.BaseClientPayload.UserAgent.OsBuildNumber = proto.String(br.WAVersion)
-	store.DeviceProps.Os = proto.String(br.Config.WhatsApp.OSName)
+	store.DeviceProps.Os = proto.String(br.Config.FormatDeviceName(""))
 	store.DeviceProps.RequireFullSync = proto.Bool(br.Config.Bridge.HistorySync.RequestFullSync)
 	versionParts := strings.Split(br.WAVersion, ".")
 	if len(versionParts) > 2 {
@@ -140,12 +166,29 @@ func (br *WABridge) Start() {
 		br.Log.Debugln("Initializing provisioning API")
 		br.Provisioning.Init()
 	}
+	if br.acmeServer != nil {
+		go br.startACMEListener()
+	}
+	if br.Config.Bridge.DirectMedia.Enabled {
+		br.Log.Debugln("Initializing direct media API")
+		(&DirectMediaAPI{bridge: br}).Init()
+	}
 	go br.CheckWhatsAppUpdate()
 	go br.StartUsers()
 	br.UpdateActivePuppetCount()
 	if br.Config.Metrics.Enabled {
 		go br.Metrics.Start()
 	}
+	if br.ResourceMonitor != nil {
+		go br.ResourceMonitor.Loop()
+	}
+
+	if br.Config.Bridge.DeadPortalCleanup.Enabled {
+		go br.DeadPortalCleanupLoop()
+	}
+	if br.Config.Bridge.SoftDelete.Enabled {
+		go br.PurgeDeletedLoop()
+	}
 
 	go br.Loop()
 }
@@ -193,11 +236,16 @@ func (br *WABridge) WarnUsersAboutDisconnection() {
 func (br *WABridge) StartUsers() {
 	br.Log.Debugln("Starting users")
 	foundAnySessions := false
+	var connectWait sync.WaitGroup
 	for _, user := range br.GetAllUsers() {
 		if !user.JID.IsEmpty() {
 			foundAnySessions = true
 		}
-		go user.Connect()
+		connectWait.Add(1)
+		go func(user *User) {
+			defer connectWait.Done()
+			user.Connect()
+		}(user)
 	}
 	if !foundAnySessions {
 		br.SendGlobalBridgeState(status.BridgeState{StateEvent: status.StateUnconfigured}.Fill(nil))
@@ -212,10 +260,18 @@ func (br *WABridge) StartUsers() {
 			}
 		}(loopuppet)
 	}
+	go func() {
+		connectWait.Wait()
+		br.RunStartupSync()
+	}()
 }
 
 func (br *WABridge) Stop() {
 	br.Metrics.Stop()
+	if br.acmeServer != nil {
+		br.stopACMEListener()
+	}
+	br.Transcoder.Cleanup()
 	for _, user := range br.usersByUsername {
 		if user.Client == nil {
 			continue
@@ -262,6 +318,8 @@ func main() {
 		portalsByJID:        make(map[database.PortalKey]*Portal),
 		puppets:             make(map[types.JID]*Puppet),
 		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
+		startupSyncDone:     make(chan struct{}),
+		startupSyncDeferred: make(map[*User]struct{}),
 		PuppetActivity: &PuppetActivity{
 			currentUserCount: 0,
 			isBlocked:        false,
@@ -68,6 +68,12 @@ func (br *WABridge) createPrivatePortalFromInvite(roomID id.RoomID, inviter *Use
 	} else {
 		portal.Name = ""
 	}
+	if portal.IsSelfChat() {
+		portal.Name = SelfChatName
+		portal.Topic = SelfChatTopic
+		_, _ = portal.MainIntent().SetRoomName(portal.MXID, portal.Name)
+		_, _ = portal.MainIntent().SetRoomTopic(portal.MXID, portal.Topic)
+	}
 	portal.log.Infofln("Created private chat portal in %s after invite from %s", roomID, inviter.MXID)
 	intent := puppet.DefaultIntent()
 
@@ -0,0 +1,64 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"maunium.net/go/mautrix/event"
+)
+
+// reuseUploadedMedia fills in a WhatsApp media message with a copy of the same file that was already uploaded
+// to the homeserver, so it doesn't have to be uploaded again. The hash must be the SHA-256 of the downloaded
+// and decrypted file: the hashes in the WhatsApp message are set by the sender and can't be trusted.
+func (portal *Portal) reuseUploadedMedia(dataHash []byte, converted *ConvertedMessage) bool {
+	content := converted.Content
+	if !portal.bridge.Config.Bridge.MediaDeduplication {
+		return false
+	}
+	reuploaded := portal.bridge.DB.ReuploadedMedia.Get(dataHash, portal.Encrypted)
+	if reuploaded == nil {
+		return false
+	}
+	if reuploaded.File != nil {
+		reuploaded.File.URL = reuploaded.MXC
+		content.File = reuploaded.File
+	} else {
+		content.URL = reuploaded.MXC
+	}
+	content.Info.MimeType = reuploaded.MimeType
+	content.Info.Size = int(reuploaded.Size)
+	portal.log.Debugfln("Reusing previously uploaded %s for media with hash %x", reuploaded.MXC, dataHash)
+	return true
+}
+
+// storeUploadedMedia remembers the upload of a WhatsApp media file so that it can be reused by reuseUploadedMedia.
+func (portal *Portal) storeUploadedMedia(dataHash []byte, content *event.MessageEventContent) {
+	if !portal.bridge.Config.Bridge.MediaDeduplication {
+		return
+	}
+	reuploaded := portal.bridge.DB.ReuploadedMedia.New()
+	reuploaded.SHA256 = dataHash
+	reuploaded.Encrypted = content.File != nil
+	if content.File != nil {
+		reuploaded.MXC = content.File.URL
+		reuploaded.File = content.File
+	} else {
+		reuploaded.MXC = content.URL
+	}
+	reuploaded.MimeType = content.Info.MimeType
+	reuploaded.Size = int64(content.Info.Size)
+	reuploaded.Upsert()
+}
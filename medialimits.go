@@ -0,0 +1,110 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func formatFileSize(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KiB", float64(size)/1024)
+	case size < 1024*1024*1024:
+		return fmt.Sprintf("%.1f MiB", float64(size)/1024/1024)
+	default:
+		return fmt.Sprintf("%.2f GiB", float64(size)/1024/1024/1024)
+	}
+}
+
+// incomingMediaSizeLimit returns the maximum size of media bridged from WhatsApp in bytes, or 0 if there's no limit.
+func (br *WABridge) incomingMediaSizeLimit() int64 {
+	return int64(br.Config.Bridge.MediaSizeLimits.Incoming) * 1024 * 1024
+}
+
+// outgoingMediaSizeLimit returns the maximum size of media bridged to WhatsApp in bytes.
+func (br *WABridge) outgoingMediaSizeLimit() int64 {
+	limit := int64(br.Config.Bridge.MediaSizeLimits.Outgoing) * 1024 * 1024
+	if limit <= 0 || limit > WhatsAppMaxFileSize {
+		return WhatsAppMaxFileSize
+	}
+	return limit
+}
+
+// makeMediaTooLargeMessage replaces a WhatsApp media message that is too large to reupload to Matrix with a notice
+// containing the file name and size, plus a download link if direct media is enabled.
+func (portal *Portal) makeMediaTooLargeMessage(source *User, info *types.MessageInfo, msg MediaMessage, converted *ConvertedMessage, reason string) *ConvertedMessage {
+	portal.log.Debugfln("Not reuploading media in %s: %s", info.ID, reason)
+	fileName := converted.Content.Body
+	body := fmt.Sprintf("%s (%s) is too large to bridge.", fileName, formatFileSize(int64(msg.GetFileLength())))
+	if link := portal.makeDirectMediaLink(source, msg, fileName); len(link) > 0 {
+		body += fmt.Sprintf(" Download it from %s", link)
+	}
+	converted.Type = event.EventMessage
+	converted.Content = &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    body,
+	}
+	return converted
+}
+
+// replaceTooLargeMatrixMedia turns a Matrix media message that is larger than the outgoing size limit into a text
+// message with the file name, size and a homeserver download link, so the WhatsApp side still gets the file.
+// Encrypted files can't be downloaded without the key, so they're only mentioned by name.
+func (portal *Portal) replaceTooLargeMatrixMedia(content *event.MessageEventContent) {
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+	default:
+		return
+	}
+	size := int64(content.GetInfo().Size)
+	if size <= portal.bridge.outgoingMediaSizeLimit() {
+		return
+	}
+	fileName := content.FileName
+	var caption string
+	if len(fileName) == 0 {
+		fileName = content.Body
+	} else if content.Body != fileName {
+		caption = content.Body
+	}
+	text := fmt.Sprintf("%s (%s) is too large to send on WhatsApp", fileName, formatFileSize(size))
+	if mxc, err := content.URL.Parse(); content.File == nil && err == nil && !mxc.IsEmpty() {
+		baseURL := portal.bridge.Config.Bridge.MediaSizeLimits.PublicURL
+		if len(baseURL) == 0 {
+			baseURL = portal.bridge.Config.Homeserver.Address
+		}
+		text += fmt.Sprintf(": %s/_matrix/media/v3/download/%s/%s/%s", strings.TrimSuffix(baseURL, "/"), mxc.Homeserver, mxc.FileID, url.PathEscape(fileName))
+	}
+	if len(caption) > 0 {
+		text = caption + "\n\n" + text
+	}
+	portal.log.Debugfln("Replacing %s media with a download link: %s is over the size limit", content.MsgType, formatFileSize(size))
+	*content = event.MessageEventContent{
+		MsgType:   event.MsgText,
+		Body:      text,
+		RelatesTo: content.RelatesTo,
+	}
+}
@@ -0,0 +1,146 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+
+	"golang.org/x/image/draw"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// generatedThumbnailMaxSize is the maximum width and height of video thumbnails generated for Matrix.
+	generatedThumbnailMaxSize = 800
+	// blurhashSourceMaxSize is the size images are scaled down to before computing their blurhash.
+	blurhashSourceMaxSize = 64
+)
+
+// addBlurhash stores the blurhash of the given image in the info object of the extra content of a Matrix event,
+// unless the event already has one.
+func addBlurhash(extraContent map[string]interface{}, img image.Image) {
+	info, ok := extraContent["info"].(map[string]interface{})
+	if !ok {
+		info = map[string]interface{}{}
+		extraContent["info"] = info
+	} else if _, hasBlurhash := info[BlurhashInfoKey]; hasBlurhash {
+		return
+	}
+	if blurhash := encodeBlurhash(scaleDownImage(img, blurhashSourceMaxSize)); len(blurhash) > 0 {
+		info[BlurhashInfoKey] = blurhash
+	}
+}
+
+func hasBlurhash(extraContent map[string]interface{}) bool {
+	info, ok := extraContent["info"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = info[BlurhashInfoKey]
+	return ok
+}
+
+// scaleDownImage scales the given image to fit in a maxSize x maxSize box, keeping the aspect ratio.
+// Images that are already small enough are returned as-is.
+func scaleDownImage(img image.Image, maxSize int) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= maxSize && height <= maxSize {
+		return img
+	} else if width > height {
+		width, height = maxSize, height*maxSize/width
+	} else {
+		width, height = width*maxSize/height, maxSize
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Rect, img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// generateIncomingThumbnail adds a thumbnail and blurhash to videos and images bridged from WhatsApp when the
+// message didn't include a usable one. Video thumbnails are made from the first frame of the video,
+// as the thumbnails embedded in WhatsApp messages are too low-resolution to display in Matrix clients.
+// This must be called before the media is uploaded, as uploading may encrypt the data in place.
+func (portal *Portal) generateIncomingThumbnail(intent *appservice.IntentAPI, data []byte, converted *ConvertedMessage) {
+	if !portal.bridge.Config.Bridge.GenerateMediaThumbnails {
+		return
+	}
+	content := converted.Content
+	var img image.Image
+	var err error
+	switch content.MsgType {
+	case event.MsgVideo:
+		if len(content.Info.ThumbnailURL) > 0 || content.Info.ThumbnailFile != nil {
+			return
+		}
+		var frame []byte
+		frame, err = portal.bridge.Transcoder.extractVideoFrame(context.Background(), data, generatedThumbnailMaxSize)
+		if err != nil {
+			portal.log.Warnfln("Failed to extract thumbnail frame from video: %v", err)
+			return
+		}
+		img, _, err = image.Decode(bytes.NewReader(frame))
+		if err != nil {
+			portal.log.Warnfln("Failed to decode extracted video frame: %v", err)
+			return
+		}
+		portal.uploadGeneratedThumbnail(intent, frame, img.Bounds(), content)
+	case event.MsgImage:
+		if hasBlurhash(converted.Extra) {
+			return
+		}
+		img, _, err = image.Decode(bytes.NewReader(data))
+		if err != nil {
+			portal.log.Debugfln("Failed to decode image for blurhash: %v", err)
+			return
+		}
+	default:
+		return
+	}
+	addBlurhash(converted.Extra, img)
+}
+
+func (portal *Portal) uploadGeneratedThumbnail(intent *appservice.IntentAPI, thumbnail []byte, bounds image.Rectangle, content *event.MessageEventContent) {
+	thumbnailSize := len(thumbnail)
+	uploadMime, file := portal.encryptFileInPlace(thumbnail, "image/jpeg")
+	uploaded, err := intent.UploadBytes(thumbnail, uploadMime)
+	if err != nil {
+		portal.log.Warnfln("Failed to upload generated thumbnail: %v", err)
+		return
+	}
+	if file != nil {
+		file.URL = uploaded.ContentURI.CUString()
+		content.Info.ThumbnailFile = file
+	} else {
+		content.Info.ThumbnailURL = uploaded.ContentURI.CUString()
+	}
+	content.Info.ThumbnailInfo = &event.FileInfo{
+		Size:     thumbnailSize,
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		MimeType: "image/jpeg",
+	}
+}
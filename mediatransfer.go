@@ -0,0 +1,147 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// mediaProgressLogThreshold is the minimum size of transfers that get progress logs.
+	mediaProgressLogThreshold = 16 * 1024 * 1024
+	mediaProgressLogInterval  = 10 * time.Second
+	mediaMemoryWaitTimeout    = 10 * time.Minute
+	// maxMediaPreallocation caps how much of the sender-provided file size is allocated before reading,
+	// larger files grow the buffer as they're read.
+	maxMediaPreallocation = 32 * 1024 * 1024
+	// WhatsAppMaxFileSize is the largest file WhatsApp accepts.
+	WhatsAppMaxFileSize = 2 * 1024 * 1024 * 1024
+)
+
+// MediaMemoryLimiter bounds the total size of media files that are held in memory at the same time.
+// whatsmeow needs whole files in memory to encrypt and decrypt them, so transfers reserve their size
+// before downloading and wait if too many large files are already being bridged.
+type MediaMemoryLimiter struct {
+	limit   int64
+	used    int64
+	lock    sync.Mutex
+	changed chan struct{}
+}
+
+func NewMediaMemoryLimiter(limitMB int) *MediaMemoryLimiter {
+	return &MediaMemoryLimiter{
+		limit:   int64(limitMB) * 1024 * 1024,
+		changed: make(chan struct{}),
+	}
+}
+
+// Acquire reserves the given number of bytes, waiting until enough memory is free. Sizes over the limit
+// reserve the whole limit, so a single large file can still be transferred when nothing else is running.
+// The returned function must be called to release the reservation.
+func (ml *MediaMemoryLimiter) Acquire(ctx context.Context, size int64) (func(), error) {
+	if ml.limit <= 0 {
+		return noop, nil
+	} else if size > ml.limit || size < 0 {
+		size = ml.limit
+	}
+	for {
+		ml.lock.Lock()
+		if ml.used+size <= ml.limit {
+			ml.used += size
+			ml.lock.Unlock()
+			return func() { ml.release(size) }, nil
+		}
+		changed := ml.changed
+		ml.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for memory to transfer media: %w", ctx.Err())
+		}
+	}
+}
+
+func (ml *MediaMemoryLimiter) release(size int64) {
+	ml.lock.Lock()
+	ml.used -= size
+	close(ml.changed)
+	ml.changed = make(chan struct{})
+	ml.lock.Unlock()
+}
+
+// progressReader logs the progress of large media transfers.
+type progressReader struct {
+	reader  io.Reader
+	log     log.Logger
+	action  string
+	total   int64
+	read    int64
+	lastLog time.Time
+}
+
+func newProgressReader(reader io.Reader, total int64, logger log.Logger, action string) io.Reader {
+	if total < mediaProgressLogThreshold {
+		return reader
+	}
+	return &progressReader{reader: reader, log: logger, action: action, total: total, lastLog: time.Now()}
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.reader.Read(p)
+	pr.read += int64(n)
+	if time.Since(pr.lastLog) >= mediaProgressLogInterval {
+		pr.lastLog = time.Now()
+		pr.log.Debugfln("%s: %d/%d MiB (%d%%)", pr.action, pr.read/1024/1024, pr.total/1024/1024, pr.read*100/pr.total)
+	}
+	return
+}
+
+// downloadMatrixMediaLimited reads a file from the homeserver into memory. The expected size is only a hint
+// for the initial buffer, as it comes from the sender. Files larger than maxSize are rejected without
+// reading the rest of the response.
+func (portal *Portal) downloadMatrixMediaLimited(ctx context.Context, mxc id.ContentURI, expectedSize, maxSize int64) ([]byte, error) {
+	resp, err := portal.MainIntent().DownloadContext(ctx, mxc)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	if expectedSize <= 0 || expectedSize > maxSize {
+		expectedSize = 0
+	}
+	preallocate := expectedSize
+	if preallocate > maxMediaPreallocation {
+		preallocate = maxMediaPreallocation
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, preallocate+bytes.MinRead))
+	reader := newProgressReader(resp, expectedSize, portal.log, fmt.Sprintf("Downloading %s", mxc))
+	_, err = buf.ReadFrom(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	} else if int64(buf.Len()) > maxSize {
+		return nil, fmt.Errorf("file is larger than the maximum of %d MiB", maxSize/1024/1024)
+	}
+	return buf.Bytes(), nil
+}
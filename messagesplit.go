@@ -0,0 +1,114 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// WhatsAppMaxTextLength is the maximum number of characters WhatsApp accepts in a single text message.
+const WhatsAppMaxTextLength = 65536
+
+func lastIndexRune(runes []rune, r rune) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitText splits text into chunks of at most maxLength characters,
+// preferring to split at line breaks and then at spaces.
+func splitText(text string, maxLength int) (chunks []string) {
+	runes := []rune(text)
+	for len(runes) > maxLength {
+		cut := maxLength
+		if idx := lastIndexRune(runes[:maxLength], '\n'); idx > maxLength/2 {
+			cut = idx + 1
+		} else if idx = lastIndexRune(runes[:maxLength], ' '); idx > maxLength/2 {
+			cut = idx + 1
+		}
+		chunks = append(chunks, strings.TrimRight(string(runes[:cut]), " \n"))
+		runes = runes[cut:]
+	}
+	return append(chunks, string(runes))
+}
+
+// splitLongTextMessage splits text messages that are too long for WhatsApp into multiple messages.
+// The first message keeps the reply, mentions and link preview of the original message.
+func splitLongTextMessage(msg *waProto.Message) []*waProto.Message {
+	var text string
+	var ctxInfo *waProto.ContextInfo
+	if msg.Conversation != nil {
+		text = msg.GetConversation()
+	} else if msg.ExtendedTextMessage != nil {
+		text = msg.GetExtendedTextMessage().GetText()
+		ctxInfo = msg.GetExtendedTextMessage().GetContextInfo()
+	} else {
+		return []*waProto.Message{msg}
+	}
+	chunks := splitText(text, WhatsAppMaxTextLength)
+	if len(chunks) == 1 {
+		return []*waProto.Message{msg}
+	}
+	parts := make([]*waProto.Message, len(chunks))
+	if msg.Conversation != nil {
+		msg.Conversation = proto.String(chunks[0])
+	} else {
+		msg.ExtendedTextMessage.Text = proto.String(chunks[0])
+	}
+	parts[0] = msg
+	for i := 1; i < len(chunks); i++ {
+		if ctxInfo.GetExpiration() != 0 {
+			parts[i] = &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{
+				Text:        proto.String(chunks[i]),
+				ContextInfo: &waProto.ContextInfo{Expiration: ctxInfo.Expiration},
+			}}
+		} else {
+			parts[i] = &waProto.Message{Conversation: proto.String(chunks[i])}
+		}
+	}
+	return parts
+}
+
+// sendSplitParts sends the remaining parts of a split Matrix message. The parts are stored with fake event IDs
+// derived from the original event, so that redacting the Matrix message deletes all of them.
+func (portal *Portal) sendSplitParts(ctx context.Context, sender *User, targetChat types.JID, evtID id.EventID, parts []*waProto.Message) {
+	for i, part := range parts {
+		partNumber := i + 2
+		info := portal.generateMessageInfo(sender)
+		dbMsg := portal.markHandled(nil, nil, info, database.SplitPartMXID(evtID, partNumber), false, true, database.MsgNormal, database.MsgNoError)
+		portal.log.Debugfln("Sending part %d of event %s to WhatsApp as %s", partNumber, evtID, info.ID)
+		resp, err := sender.Client.SendMessage(ctx, targetChat, info.ID, part)
+		if err != nil {
+			portal.log.Errorfln("Failed to send part %d of %s to WhatsApp: %v", partNumber, evtID, err)
+			return
+		}
+		dbMsg.MarkSent(resp.Timestamp)
+	}
+}
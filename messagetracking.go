@@ -52,9 +52,23 @@ var (
 	errTargetIsFake                = errors.New("target is a fake event")
 	errReactionSentBySomeoneElse   = errors.New("target reaction was sent by someone else")
 	errDMSentByOtherUser           = errors.New("target message was sent by the other user in a DM")
+	errRedactionSentBySomeoneElse  = errors.New("target message was relayed for someone else")
+	errRevokeWindowExpired         = errors.New("the message is too old to be deleted for everyone on WhatsApp")
+	errEditSentBySomeoneElse       = errors.New("target message was sent by someone else")
+	errEditWindowExpired           = errors.New("the message is too old to be edited on WhatsApp")
+	errEditUnsupportedType         = errors.New("only text messages can be edited on WhatsApp")
+	errEditRedactionNotSupported   = errors.New("edits can't be deleted separately on WhatsApp")
 
 	errBroadcastReactionNotSupported = errors.New("reacting to status messages is not currently supported")
 	errBroadcastSendDisabled         = errors.New("sending status messages is disabled")
+	errBroadcastReplyRequired        = errors.New("messages in broadcast lists must be replies to the person they should be sent to")
+	errRelayNotConfirmed             = errors.New("sending to the large group was not confirmed in time")
+	errAnnounceOnlyGroup             = errors.New("only admins can send messages to this group")
+	errWarmupLimit                   = errors.New("newly linked WhatsApp account warmup limit reached")
+	errMessageQueuedOffline          = errors.New("you are not connected to WhatsApp, the message will be sent after reconnecting")
+	errMessageDroppedFromQueue       = errors.New("the message was removed from the offline queue")
+	errMessageQueueExpired           = errors.New("the message was in the offline queue for too long")
+	errRelayOptedOut                 = errors.New("you are not logged in and have opted out of relaying your messages")
 
 	errMessageDisconnected      = &whatsmeow.DisconnectedError{Action: "message send"}
 	errMessageRetryDisconnected = &whatsmeow.DisconnectedError{Action: "message send (retry)"}
@@ -72,11 +86,14 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		errors.Is(err, whatsmeow.ErrUnknownServer),
 		errors.Is(err, whatsmeow.ErrRecipientADJID),
 		errors.Is(err, errBroadcastReactionNotSupported),
-		errors.Is(err, errBroadcastSendDisabled):
+		errors.Is(err, errBroadcastSendDisabled),
+		errors.Is(err, errBroadcastReplyRequired):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, ""
 	case errors.Is(err, errMNoticeDisabled):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, false, ""
-	case errors.Is(err, errMediaUnsupportedType):
+	case errors.Is(err, errMediaUnsupportedType),
+		errors.Is(err, errEditUnsupportedType),
+		errors.Is(err, errEditRedactionNotSupported):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, err.Error()
 	case errors.Is(err, errTimeoutBeforeHandling):
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, true, true, "the message was too old when it reached the bridge, so it was not handled"
@@ -84,13 +101,32 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, false, true, "handling the message took too long and was cancelled"
 	case errors.Is(err, errMessageTakingLong):
 		return event.MessageStatusTooOld, event.MessageStatusPending, false, true, err.Error()
+	case errors.Is(err, errMessageQueuedOffline):
+		return event.MessageStatusGenericError, event.MessageStatusPending, false, true, err.Error()
+	case errors.Is(err, errMessageDroppedFromQueue):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errMessageQueueExpired):
+		return event.MessageStatusTooOld, event.MessageStatusRetriable, true, true, err.Error()
 	case errors.Is(err, errTargetNotFound),
 		errors.Is(err, errTargetIsFake),
 		errors.Is(err, errReactionDatabaseNotFound),
 		errors.Is(err, errReactionTargetNotFound),
 		errors.Is(err, errReactionSentBySomeoneElse),
-		errors.Is(err, errDMSentByOtherUser):
+		errors.Is(err, errDMSentByOtherUser),
+		errors.Is(err, errRedactionSentBySomeoneElse),
+		errors.Is(err, errEditSentBySomeoneElse):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, ""
+	case errors.Is(err, errRevokeWindowExpired),
+		errors.Is(err, errEditWindowExpired):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errRelayNotConfirmed),
+		errors.Is(err, errRelayOptedOut),
+		errors.Is(err, errContactBlocked):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errWarmupLimit):
+		return event.MessageStatusGenericError, event.MessageStatusRetriable, true, true, err.Error()
+	case errors.Is(err, errAnnounceOnlyGroup):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, err.Error()
 	case errors.Is(err, whatsmeow.ErrNotConnected),
 		errors.Is(err, errUserNotConnected):
 		return event.MessageStatusGenericError, event.MessageStatusRetriable, true, true, ""
@@ -185,6 +221,8 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 		msgType = "reaction"
 	case event.EventRedaction:
 		msgType = "redaction"
+	case EventSendSticker:
+		msgType = "sticker shortcode"
 	default:
 		msgType = "unknown event"
 	}
@@ -202,6 +240,9 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 			level = log.LevelDebug
 		}
 		portal.log.Logfln(level, "%s %s %s from %s: %v", part, msgType, evtDescription, evt.Sender, err)
+		if part != "Ignoring" {
+			portal.bridge.Metrics.TrackWhatsAppSendError(err)
+		}
 		reason, statusCode, isCertain, sendNotice, _ := errorToStatusReason(err)
 		checkpointStatus := status.ReasonToCheckpointStatus(reason, statusCode)
 		portal.bridge.SendMessageCheckpoint(evt, status.MsgStepRemote, err, checkpointStatus, ms.getRetryNum())
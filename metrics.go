@@ -53,6 +53,8 @@ type MetricsHandler struct {
 	countCollection         prometheus.Histogram
 	disconnections          *prometheus.CounterVec
 	incomingRetryReceipts   *prometheus.CounterVec
+	matrixAPIErrors         *prometheus.CounterVec
+	whatsappSendErrors      *prometheus.CounterVec
 	puppetCount             prometheus.Gauge
 	activePuppetCount       prometheus.Gauge
 	bridgeBlocked           prometheus.Gauge
@@ -63,6 +65,9 @@ type MetricsHandler struct {
 	encryptedPrivateCount   prometheus.Gauge
 	unencryptedGroupCount   prometheus.Gauge
 	unencryptedPrivateCount prometheus.Gauge
+	resourceConstrained     prometheus.Gauge
+	memoryUsage             prometheus.Gauge
+	loadPerCPU              prometheus.Gauge
 
 	connected          prometheus.Gauge
 	connectedState     map[string]bool
@@ -70,6 +75,8 @@ type MetricsHandler struct {
 	loggedIn           prometheus.Gauge
 	loggedInState      map[string]bool
 	loggedInStateLock  sync.Mutex
+
+	errorStats errorStats
 }
 
 func NewMetricsHandler(address string, log log.Logger, db *database.Database, puppetActivity *PuppetActivity) *MetricsHandler {
@@ -108,6 +115,14 @@ func NewMetricsHandler(address string, log log.Logger, db *database.Database, pu
 			Name: "whatsapp_incoming_retry_receipts",
 			Help: "Number of times a remote WhatsApp user has requested a retry from the bridge. retry_count = 5 is usually the last attempt (and very likely means a failed message)",
 		}, []string{"retry_count", "message_found"}),
+		matrixAPIErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "matrix_api_errors",
+			Help: "Number of failed Matrix client API requests by HTTP status and Matrix error code. status = 0 means the request failed without a response",
+		}, []string{"status", "errcode"}),
+		whatsappSendErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "whatsapp_send_errors",
+			Help: "Number of Matrix events that failed to be bridged to WhatsApp by error type",
+		}, []string{"error_type"}),
 		puppetCount: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "whatsapp_puppets_total",
 			Help: "Number of WhatsApp users bridged into Matrix",
@@ -134,6 +149,19 @@ func NewMetricsHandler(address string, log log.Logger, db *database.Database, pu
 		unencryptedGroupCount:   portalCount.With(prometheus.Labels{"type": "group", "encrypted": "false"}),
 		unencryptedPrivateCount: portalCount.With(prometheus.Labels{"type": "private", "encrypted": "false"}),
 
+		resourceConstrained: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "bridge_resource_constrained",
+			Help: "Is the bridge currently deferring background work because of high memory usage or CPU load",
+		}),
+		memoryUsage: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "bridge_system_memory_usage_percent",
+			Help: "Percentage of system memory in use, as seen by the resource pressure monitor",
+		}),
+		loadPerCPU: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "bridge_system_load_per_cpu",
+			Help: "One minute load average divided by the number of CPUs, as seen by the resource pressure monitor",
+		}),
+
 		loggedIn: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "bridge_logged_in",
 			Help: "Users logged into the bridge",
@@ -144,6 +172,7 @@ func NewMetricsHandler(address string, log log.Logger, db *database.Database, pu
 			Help: "Bridge users connected to WhatsApp",
 		}),
 		connectedState: make(map[string]bool),
+		errorStats:     newErrorStats(),
 	}
 }
 
@@ -194,6 +223,19 @@ func (mh *MetricsHandler) TrackRetryReceipt(count int, found bool) {
 	}).Inc()
 }
 
+func (mh *MetricsHandler) TrackResourcePressure(constrained bool, memoryPercent, loadPerCPU float64) {
+	if !mh.running {
+		return
+	}
+	if constrained {
+		mh.resourceConstrained.Set(1)
+	} else {
+		mh.resourceConstrained.Set(0)
+	}
+	mh.memoryUsage.Set(memoryPercent)
+	mh.loadPerCPU.Set(loadPerCPU)
+}
+
 func (mh *MetricsHandler) TrackLoginState(jid types.JID, loggedIn bool) {
 	if !mh.running {
 		return
@@ -254,7 +296,7 @@ func (mh *MetricsHandler) updateStats() {
 	}
 
 	var messageCount int
-	err = mh.db.QueryRowContext(mh.ctx, "SELECT COUNT(*) FROM message").Scan(&messageCount)
+	err = mh.db.QueryRowContext(mh.ctx, "SELECT COUNT(*) FROM message WHERE deleted_at IS NULL").Scan(&messageCount)
 	if err != nil {
 		mh.log.Warnln("Failed to scan number of messages:", err)
 	} else {
@@ -268,7 +310,7 @@ func (mh *MetricsHandler) updateStats() {
 				COUNT(CASE WHEN jid LIKE '%@s.whatsapp.net' AND encrypted THEN 1 END) AS encrypted_private_portals,
 				COUNT(CASE WHEN jid LIKE '%@g.us' AND NOT encrypted THEN 1 END) AS unencrypted_group_portals,
 				COUNT(CASE WHEN jid LIKE '%@s.whatsapp.net' AND NOT encrypted THEN 1 END) AS unencrypted_private_portals
-			FROM portal WHERE mxid<>''
+			FROM portal WHERE mxid<>'' AND deleted_at IS NULL
 		`).Scan(&encryptedGroupCount, &encryptedPrivateCount, &unencryptedGroupCount, &unencryptedPrivateCount)
 	if err != nil {
 		mh.log.Warnln("Failed to scan number of portals:", err)
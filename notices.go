@@ -0,0 +1,191 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type noticeKey string
+
+const (
+	noticeDisappearingOff        noticeKey = "disappearing_off"
+	noticeDisappearingSet        noticeKey = "disappearing_set"
+	noticeDisappearingNoRedact   noticeKey = "disappearing_no_redact"
+	noticeDisappearingNoGroups   noticeKey = "disappearing_no_groups"
+	noticeIncomingCall           noticeKey = "incoming_call"
+	noticeIncomingCallType       noticeKey = "incoming_call_type"
+	noticeSecurityCodeChanged    noticeKey = "security_code_changed"
+	noticeSecurityCodeChangedDev noticeKey = "security_code_changed_device"
+	noticeLiveLocationStarted    noticeKey = "live_location_started"
+	noticeViewOnceNotBridged     noticeKey = "view_once_not_bridged"
+	noticeAnnounceOn             noticeKey = "announce_on"
+	noticeAnnounceOff            noticeKey = "announce_off"
+	noticeContactDeparted        noticeKey = "contact_departed"
+	noticeForwarded              noticeKey = "forwarded"
+	noticeForwardedMany          noticeKey = "forwarded_many"
+	noticeNumberChanged          noticeKey = "number_changed"
+	noticeNumberChangedGroup     noticeKey = "number_changed_group"
+)
+
+const defaultNoticeLanguage = "en"
+
+// noticeTranslations contains the texts of system notices that are sent into portals.
+// The English texts are used as a fallback for any key missing in other languages.
+var noticeTranslations = map[string]map[noticeKey]string{
+	"en": {
+		noticeDisappearingOff:        "Turned off disappearing messages",
+		noticeDisappearingSet:        "Set the disappearing message timer to %s",
+		noticeDisappearingNoRedact:   "However, this bridge is not configured to disappear messages on Matrix.",
+		noticeDisappearingNoGroups:   "However, this bridge is not configured to disappear messages in group chats.",
+		noticeIncomingCall:           "Incoming call",
+		noticeIncomingCallType:       "Incoming %s call",
+		noticeSecurityCodeChanged:    "Your security code with %s changed.",
+		noticeSecurityCodeChangedDev: "Your security code with %s (device #%d) changed.",
+		noticeLiveLocationStarted:    "Started sharing live location",
+		noticeViewOnceNotBridged:     "View-once media (not bridged)",
+		noticeAnnounceOn:             "Changed the group settings so only admins can send messages",
+		noticeAnnounceOff:            "Changed the group settings so all participants can send messages",
+		noticeContactDeparted:        "%s no longer has a WhatsApp account. Messages sent here won't be delivered.",
+		noticeForwarded:              "Forwarded",
+		noticeForwardedMany:          "Forwarded many times",
+		noticeNumberChanged:          "Changed their phone number from %s to %s",
+		noticeNumberChangedGroup:     "Changed their phone number to %s. New messages from them will come from the new number.",
+	},
+	"de": {
+		noticeDisappearingOff:        "Selbstlöschende Nachrichten deaktiviert",
+		noticeDisappearingSet:        "Timer für selbstlöschende Nachrichten auf %s gesetzt",
+		noticeDisappearingNoRedact:   "Diese Bridge ist jedoch nicht so konfiguriert, dass Nachrichten auf Matrix gelöscht werden.",
+		noticeDisappearingNoGroups:   "Diese Bridge ist jedoch nicht so konfiguriert, dass Nachrichten in Gruppenchats gelöscht werden.",
+		noticeIncomingCall:           "Eingehender Anruf",
+		noticeIncomingCallType:       "Eingehender %s-Anruf",
+		noticeSecurityCodeChanged:    "Deine Sicherheitsnummer mit %s hat sich geändert.",
+		noticeSecurityCodeChangedDev: "Deine Sicherheitsnummer mit %s (Gerät #%d) hat sich geändert.",
+		noticeLiveLocationStarted:    "Teilt jetzt den Live-Standort",
+		noticeViewOnceNotBridged:     "Einmal-Ansicht-Medium (nicht übertragen)",
+		noticeAnnounceOn:             "Hat die Gruppeneinstellungen geändert, sodass nur Admins Nachrichten senden können",
+		noticeAnnounceOff:            "Hat die Gruppeneinstellungen geändert, sodass alle Teilnehmer Nachrichten senden können",
+		noticeContactDeparted:        "%s hat kein WhatsApp-Konto mehr. Hier gesendete Nachrichten werden nicht zugestellt.",
+		noticeForwarded:              "Weitergeleitet",
+		noticeForwardedMany:          "Häufig weitergeleitet",
+		noticeNumberChanged:          "Hat die Telefonnummer von %s zu %s geändert",
+		noticeNumberChangedGroup:     "Hat die Telefonnummer zu %s geändert. Neue Nachrichten kommen von der neuen Nummer.",
+	},
+	"es": {
+		noticeDisappearingOff:        "Se desactivaron los mensajes temporales",
+		noticeDisappearingSet:        "Se estableció la duración de los mensajes temporales en %s",
+		noticeDisappearingNoRedact:   "Sin embargo, este puente no está configurado para eliminar mensajes en Matrix.",
+		noticeDisappearingNoGroups:   "Sin embargo, este puente no está configurado para eliminar mensajes en chats de grupo.",
+		noticeIncomingCall:           "Llamada entrante",
+		noticeIncomingCallType:       "Llamada de %s entrante",
+		noticeSecurityCodeChanged:    "Tu código de seguridad con %s cambió.",
+		noticeSecurityCodeChangedDev: "Tu código de seguridad con %s (dispositivo #%d) cambió.",
+		noticeLiveLocationStarted:    "Empezó a compartir su ubicación en tiempo real",
+		noticeViewOnceNotBridged:     "Archivo de visualización única (no transferido)",
+		noticeAnnounceOn:             "Cambió la configuración del grupo para que solo los administradores puedan enviar mensajes",
+		noticeAnnounceOff:            "Cambió la configuración del grupo para que todos los participantes puedan enviar mensajes",
+		noticeContactDeparted:        "%s ya no tiene una cuenta de WhatsApp. Los mensajes enviados aquí no se entregarán.",
+		noticeForwarded:              "Reenviado",
+		noticeForwardedMany:          "Reenviado muchas veces",
+		noticeNumberChanged:          "Cambió su número de teléfono de %s a %s",
+		noticeNumberChangedGroup:     "Cambió su número de teléfono a %s. Sus nuevos mensajes llegarán desde el nuevo número.",
+	},
+	"fr": {
+		noticeDisappearingOff:        "Messages éphémères désactivés",
+		noticeDisappearingSet:        "Durée des messages éphémères réglée sur %s",
+		noticeDisappearingNoRedact:   "Cependant, ce pont n'est pas configuré pour supprimer les messages sur Matrix.",
+		noticeDisappearingNoGroups:   "Cependant, ce pont n'est pas configuré pour supprimer les messages dans les groupes.",
+		noticeIncomingCall:           "Appel entrant",
+		noticeIncomingCallType:       "Appel %s entrant",
+		noticeSecurityCodeChanged:    "Votre code de sécurité avec %s a changé.",
+		noticeSecurityCodeChangedDev: "Votre code de sécurité avec %s (appareil n°%d) a changé.",
+		noticeLiveLocationStarted:    "A commencé à partager sa position en direct",
+		noticeViewOnceNotBridged:     "Média à vue unique (non transféré)",
+		noticeAnnounceOn:             "A modifié les paramètres du groupe pour que seuls les administrateurs puissent envoyer des messages",
+		noticeAnnounceOff:            "A modifié les paramètres du groupe pour que tous les participants puissent envoyer des messages",
+		noticeContactDeparted:        "%s n'a plus de compte WhatsApp. Les messages envoyés ici ne seront pas distribués.",
+		noticeForwarded:              "Transféré",
+		noticeForwardedMany:          "Transféré plusieurs fois",
+		noticeNumberChanged:          "A changé de numéro de téléphone de %s à %s",
+		noticeNumberChangedGroup:     "A changé de numéro de téléphone pour %s. Ses nouveaux messages viendront du nouveau numéro.",
+	},
+	"pt": {
+		noticeDisappearingOff:        "Mensagens temporárias desativadas",
+		noticeDisappearingSet:        "A duração das mensagens temporárias foi definida para %s",
+		noticeDisappearingNoRedact:   "No entanto, esta ponte não está configurada para apagar mensagens no Matrix.",
+		noticeDisappearingNoGroups:   "No entanto, esta ponte não está configurada para apagar mensagens em grupos.",
+		noticeIncomingCall:           "Chamada recebida",
+		noticeIncomingCallType:       "Chamada de %s recebida",
+		noticeSecurityCodeChanged:    "Seu código de segurança com %s mudou.",
+		noticeSecurityCodeChangedDev: "Seu código de segurança com %s (dispositivo nº %d) mudou.",
+		noticeLiveLocationStarted:    "Começou a compartilhar a localização em tempo real",
+		noticeViewOnceNotBridged:     "Mídia de visualização única (não transferida)",
+		noticeAnnounceOn:             "Alterou as configurações do grupo para que apenas administradores possam enviar mensagens",
+		noticeAnnounceOff:            "Alterou as configurações do grupo para que todos os participantes possam enviar mensagens",
+		noticeContactDeparted:        "%s não tem mais uma conta do WhatsApp. As mensagens enviadas aqui não serão entregues.",
+		noticeForwarded:              "Encaminhada",
+		noticeForwardedMany:          "Encaminhada com frequência",
+		noticeNumberChanged:          "Mudou o número de telefone de %s para %s",
+		noticeNumberChangedGroup:     "Mudou o número de telefone para %s. As novas mensagens virão do novo número.",
+	},
+}
+
+func normalizeNoticeLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if idx := strings.IndexAny(lang, "-_"); idx > 0 {
+		lang = lang[:idx]
+	}
+	return lang
+}
+
+func isSupportedNoticeLanguage(lang string) bool {
+	_, ok := noticeTranslations[normalizeNoticeLanguage(lang)]
+	return ok
+}
+
+func supportedNoticeLanguages() []string {
+	langs := make([]string, 0, len(noticeTranslations))
+	for lang := range noticeTranslations {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// getNoticeLanguage returns the language that should be used for system notices in the portal.
+// The portal-specific language takes priority over the bridge-wide default.
+func (portal *Portal) getNoticeLanguage() string {
+	if portal.NoticeLanguage != "" && isSupportedNoticeLanguage(portal.NoticeLanguage) {
+		return normalizeNoticeLanguage(portal.NoticeLanguage)
+	} else if isSupportedNoticeLanguage(portal.bridge.Config.Bridge.DefaultNoticeLanguage) {
+		return normalizeNoticeLanguage(portal.bridge.Config.Bridge.DefaultNoticeLanguage)
+	}
+	return defaultNoticeLanguage
+}
+
+func (portal *Portal) formatNotice(key noticeKey, args ...interface{}) string {
+	text, ok := noticeTranslations[portal.getNoticeLanguage()][key]
+	if !ok {
+		text = noticeTranslations[defaultNoticeLanguage][key]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
@@ -0,0 +1,263 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// changePortalKey moves a portal to a new key in the database and in the portal cache.
+func (br *WABridge) changePortalKey(portal *Portal, newKey database.PortalKey) error {
+	br.portalsLock.Lock()
+	oldKey := portal.Key
+	err := portal.ChangeKey(newKey)
+	if err != nil {
+		br.portalsLock.Unlock()
+		return err
+	}
+	delete(br.portalsByJID, oldKey)
+	br.portalsByJID[newKey] = portal
+	portal.log = br.Log.Sub(fmt.Sprintf("Portal/%s", newKey))
+	br.portalsLock.Unlock()
+	// Logging the change sends a state event, so it's done after unlocking to not block portal lookups
+	portal.LogPortalChange("jid", oldKey.JID.String(), newKey.JID.String())
+	return nil
+}
+
+// HandleContactNumberChange handles a contact changing their phone number. The private chat portal is moved
+// to the new number, so the existing room and message history keep working, and a notice is sent to the
+// group portals that the user shares with the contact.
+//
+// The change must come from WhatsApp, as it also affects portals and puppets shared with other users.
+func (user *User) HandleContactNumberChange(oldJID, newJID types.JID, ts time.Time) {
+	oldPuppet, newPuppet, msgID := user.prepareContactNumberChange(oldJID, newJID)
+	if oldPuppet == nil {
+		return
+	}
+	oldJID, newJID = oldPuppet.JID, newPuppet.JID
+
+	user.migratePrivateChatPortal(oldPuppet, newPuppet, ts, msgID)
+
+	for _, portal := range user.bridge.GetAllPortals() {
+		if !portal.IsGroupChat() || len(portal.MXID) == 0 ||
+			!user.bridge.StateStore.IsInRoom(portal.MXID, user.MXID) ||
+			!user.bridge.StateStore.IsInRoom(portal.MXID, oldPuppet.MXID) {
+			continue
+		}
+		portal.messages <- PortalMessage{
+			fake: &fakeMessage{
+				Sender: oldJID,
+				Text:   portal.formatNotice(noticeNumberChangedGroup, "+"+newJID.User),
+				ID:     msgID,
+				Time:   ts,
+			},
+			source: user,
+		}
+	}
+
+	if !oldPuppet.Defunct {
+		oldPuppet.Defunct = true
+		oldPuppet.Update()
+	}
+}
+
+// MoveContactPrivateChat moves the user's private chat portal with a contact to the contact's new number.
+// Unlike HandleContactNumberChange, nothing shared with other users is changed, as the new number was
+// given by the user rather than confirmed by WhatsApp.
+func (user *User) MoveContactPrivateChat(oldJID, newJID types.JID, ts time.Time) {
+	oldPuppet, newPuppet, msgID := user.prepareContactNumberChange(oldJID, newJID)
+	if oldPuppet == nil {
+		return
+	}
+	user.migratePrivateChatPortal(oldPuppet, newPuppet, ts, msgID)
+}
+
+func (user *User) prepareContactNumberChange(oldJID, newJID types.JID) (oldPuppet, newPuppet *Puppet, msgID string) {
+	oldJID, newJID = oldJID.ToNonAD(), newJID.ToNonAD()
+	if oldJID == newJID || oldJID.Server != types.DefaultUserServer || newJID.Server != types.DefaultUserServer {
+		return nil, nil, ""
+	}
+	user.log.Infofln("Contact %s changed their number to %s", oldJID, newJID)
+	oldPuppet = user.bridge.GetPuppetByJID(oldJID)
+	newPuppet = user.bridge.GetPuppetByJID(newJID)
+	if oldPuppet == nil || newPuppet == nil {
+		return nil, nil, ""
+	}
+	newPuppet.SyncContact(user, true, false, "number change")
+	msgID = fmt.Sprintf("numberchange-%s-%s", oldJID.User, newJID.User)
+	return
+}
+
+func (user *User) migratePrivateChatPortal(oldPuppet, newPuppet *Puppet, ts time.Time, msgID string) {
+	portal := user.GetPortalByJID(oldPuppet.JID)
+	if portal == nil || len(portal.MXID) == 0 {
+		return
+	}
+	newKey := database.NewPortalKey(newPuppet.JID, user.JID)
+	if existing := user.bridge.GetPortalByJID(newKey); existing != nil && len(existing.MXID) > 0 {
+		portal.log.Infofln("Not moving private chat to %s: there's already a portal room for the new number (%s)", newPuppet.JID, existing.MXID)
+		existing.messages <- PortalMessage{
+			fake: &fakeMessage{
+				Sender: newPuppet.JID,
+				Text:   existing.formatNotice(noticeNumberChanged, "+"+oldPuppet.JID.User, "+"+newPuppet.JID.User),
+				ID:     msgID,
+				Time:   ts,
+			},
+			source: user,
+		}
+		return
+	}
+
+	oldKey := portal.Key
+	portal.roomCreateLock.Lock()
+	err := user.bridge.changePortalKey(portal, newKey)
+	portal.roomCreateLock.Unlock()
+	if err != nil {
+		// Changing the key is done in a single transaction, so the portal still has the old key
+		portal.log.Errorfln("Failed to move private chat to new number %s: %v", newPuppet.JID, err)
+		return
+	}
+	portal.log.Infofln("Moved private chat from %s to new number %s", oldPuppet.JID, newPuppet.JID)
+
+	oldIntent, newIntent := oldPuppet.DefaultIntent(), newPuppet.DefaultIntent()
+	levels, err := oldIntent.PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Warnln("Failed to get power levels to give them to the new number:", err)
+	} else if levels.GetUserLevel(newIntent.UserID) < levels.GetUserLevel(oldIntent.UserID) {
+		levels.SetUserLevel(newIntent.UserID, levels.GetUserLevel(oldIntent.UserID))
+		_, err = oldIntent.SetPowerLevels(portal.MXID, levels)
+		if err != nil {
+			portal.log.Warnln("Failed to give power levels to the new number:", err)
+		}
+	}
+	_, err = oldIntent.InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: newIntent.UserID})
+	if err != nil {
+		portal.log.Warnfln("Failed to invite %s to the room: %v", newIntent.UserID, err)
+	}
+	err = newIntent.EnsureJoined(portal.MXID)
+	if err != nil {
+		portal.log.Errorfln("Failed to join %s to the room, moving the private chat back to %s: %v", newIntent.UserID, oldPuppet.JID, err)
+		portal.roomCreateLock.Lock()
+		err = user.bridge.changePortalKey(portal, oldKey)
+		portal.roomCreateLock.Unlock()
+		if err != nil {
+			portal.log.Errorfln("Failed to move private chat back to %s: %v", oldPuppet.JID, err)
+		}
+		return
+	}
+	_, _ = oldIntent.LeaveRoom(portal.MXID)
+
+	portal.UpdateBridgeInfo()
+	if user.bridge.Config.Bridge.PrivateChatPortalMeta && len(newPuppet.Displayname) > 0 {
+		portal.UpdateName(newPuppet.Displayname, types.EmptyJID, true)
+	}
+	portal.messages <- PortalMessage{
+		fake: &fakeMessage{
+			Sender: newPuppet.JID,
+			Text:   portal.formatNotice(noticeNumberChanged, "+"+oldPuppet.JID.User, "+"+newPuppet.JID.User),
+			ID:     msgID,
+			Time:   ts,
+		},
+		source: user,
+	}
+}
+
+var errNoPreviousNumber = errors.New("no previous phone number is known")
+
+// checkOwnNumberChange tells the user how to migrate their chats if they logged in with a different phone number
+// than before. The chats aren't migrated automatically, as the new number might be a different account entirely.
+func (user *User) checkOwnNumberChange() {
+	prev := user.GetPreviousUsername()
+	if len(prev) == 0 {
+		return
+	} else if prev == user.JID.User {
+		user.SetPreviousUsername("")
+		return
+	}
+	user.log.Infofln("Logged in as %s, but was previously logged in as %s", user.JID.User, prev)
+	user.sendMarkdownBridgeAlert("You're now logged in as +%s, but you were previously logged in as +%s. "+
+		"If you changed your phone number, use the `migrate-own-number` command to move your existing private chats to the new number.",
+		user.JID.User, prev)
+}
+
+// MigrateOwnNumber moves the user's private chat portals, sent messages and double puppeting from the phone number
+// they were previously logged in with to the current one. Chats that already have a room for the new number are skipped.
+func (user *User) MigrateOwnNumber() (moved, skipped int, err error) {
+	prev := user.GetPreviousUsername()
+	if len(prev) == 0 {
+		return 0, 0, errNoPreviousNumber
+	}
+	oldJID := types.NewJID(prev, types.DefaultUserServer)
+	newJID := user.JID.ToNonAD()
+	user.log.Infofln("Migrating chats from previous number %s to %s", oldJID, newJID)
+	for _, portal := range user.bridge.dbPortalsToPortals(user.bridge.DB.Portal.FindPrivateChats(oldJID)) {
+		chatJID := portal.Key.JID
+		if chatJID.User == oldJID.User {
+			// Self-chats are keyed by the user's own number on both sides
+			chatJID = newJID
+		}
+		newKey := database.NewPortalKey(chatJID, newJID)
+		if existing := user.bridge.DB.Portal.GetByJID(newKey); existing != nil && len(existing.MXID) > 0 {
+			portal.log.Debugfln("Not moving to %s: there's already a portal room for the new number (%s)", newKey, existing.MXID)
+			skipped++
+			continue
+		}
+		portal.roomCreateLock.Lock()
+		err = user.bridge.changePortalKey(portal, newKey)
+		portal.roomCreateLock.Unlock()
+		if err != nil {
+			return moved, skipped, fmt.Errorf("failed to move %s: %w", portal.Key, err)
+		}
+		portal.UpdateBridgeInfo()
+		moved++
+	}
+	// Only the private chats were moved to the new number, group portals are shared with other users
+	user.bridge.DB.Message.ChangeSender(newJID, oldJID, newJID)
+
+	oldPuppet := user.bridge.GetPuppetByJID(oldJID)
+	newPuppet := user.bridge.GetPuppetByJID(newJID)
+	if oldPuppet.CustomMXID == user.MXID && len(newPuppet.CustomMXID) == 0 {
+		accessToken := oldPuppet.AccessToken
+		if oldPuppet.customIntent != nil {
+			oldPuppet.stopSyncing()
+		}
+		user.bridge.puppetsLock.Lock()
+		delete(user.bridge.puppetsByCustomMXID, oldPuppet.CustomMXID)
+		user.bridge.puppetsLock.Unlock()
+		oldPuppet.clearCustomMXID()
+		oldPuppet.Update()
+		err = newPuppet.SwitchCustomMXID(accessToken, user.MXID)
+		if err != nil {
+			user.log.Warnfln("Failed to move double puppeting to %s: %v", newJID, err)
+		}
+	}
+	if !oldPuppet.Defunct {
+		oldPuppet.Defunct = true
+		oldPuppet.Update()
+	}
+	user.SetPreviousUsername("")
+	user.log.Infofln("Moved %d private chats to %s, skipped %d", moved, newJID, skipped)
+	return moved, skipped, nil
+}
@@ -0,0 +1,116 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// queuedMessage is a Matrix message that was sent while the user wasn't connected to WhatsApp.
+type queuedMessage struct {
+	ID       int
+	Portal   *Portal
+	Event    *event.Event
+	QueuedAt time.Time
+}
+
+// offlineQueueState holds the outgoing messages of a user that are waiting for the WhatsApp connection
+// to come back. The queue is only kept in memory, so it's lost when the bridge is restarted.
+type offlineQueueState struct {
+	lock   sync.Mutex
+	nextID int
+	items  []*queuedMessage
+}
+
+// queueOfflineMessage adds a message to the offline queue. It returns false if the queue is disabled or full,
+// in which case the message should fail normally.
+func (user *User) queueOfflineMessage(portal *Portal, evt *event.Event) bool {
+	cfg := user.bridge.Config.Bridge.OfflineQueue
+	if !cfg.Enabled {
+		return false
+	}
+	user.offlineQueue.lock.Lock()
+	defer user.offlineQueue.lock.Unlock()
+	if cfg.MaxSize > 0 && len(user.offlineQueue.items) >= cfg.MaxSize {
+		user.log.Warnfln("Not queuing %s as offline queue is full (%d messages)", evt.ID, len(user.offlineQueue.items))
+		return false
+	}
+	user.offlineQueue.nextID++
+	user.offlineQueue.items = append(user.offlineQueue.items, &queuedMessage{
+		ID:       user.offlineQueue.nextID,
+		Portal:   portal,
+		Event:    evt,
+		QueuedAt: time.Now(),
+	})
+	user.log.Debugfln("Queued %s in %s to be sent after reconnecting (#%d)", evt.ID, portal.MXID, user.offlineQueue.nextID)
+	return true
+}
+
+// OfflineQueue returns a copy of the messages currently in the offline queue, oldest first.
+func (user *User) OfflineQueue() []*queuedMessage {
+	user.offlineQueue.lock.Lock()
+	defer user.offlineQueue.lock.Unlock()
+	items := make([]*queuedMessage, len(user.offlineQueue.items))
+	copy(items, user.offlineQueue.items)
+	return items
+}
+
+// DropQueuedMessage removes a message from the offline queue and marks it as failed.
+func (user *User) DropQueuedMessage(queueID int) *queuedMessage {
+	user.offlineQueue.lock.Lock()
+	defer user.offlineQueue.lock.Unlock()
+	for i, item := range user.offlineQueue.items {
+		if item.ID == queueID {
+			user.offlineQueue.items = append(user.offlineQueue.items[:i], user.offlineQueue.items[i+1:]...)
+			go item.Portal.sendMessageMetrics(item.Event, errMessageDroppedFromQueue, "Dropped queued", nil)
+			return item
+		}
+	}
+	return nil
+}
+
+// FlushOfflineQueue sends all queued messages to their portals, which handle them like new messages.
+// Messages that have been in the queue for longer than the configured maximum age are failed instead.
+// It returns the number of messages that were sent to portals.
+func (user *User) FlushOfflineQueue() int {
+	user.offlineQueue.lock.Lock()
+	items := user.offlineQueue.items
+	user.offlineQueue.items = nil
+	user.offlineQueue.lock.Unlock()
+	maxAge := time.Duration(user.bridge.Config.Bridge.OfflineQueue.MaxAge) * time.Second
+	flushed := 0
+	for _, item := range items {
+		if maxAge > 0 && time.Since(item.QueuedAt) > maxAge {
+			go item.Portal.sendMessageMetrics(item.Event, errMessageQueueExpired, "Expired queued", nil)
+			continue
+		}
+		item.Portal.matrixMessages <- PortalMatrixMessage{
+			evt:           item.Event,
+			user:          user,
+			receivedAt:    time.Now(),
+			offlineQueued: time.Since(item.QueuedAt),
+		}
+		flushed++
+	}
+	if len(items) > 0 {
+		user.log.Infofln("Flushed %d of %d messages from offline queue", flushed, len(items))
+	}
+	return flushed
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -53,15 +54,15 @@ import (
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util"
 	"maunium.net/go/mautrix/util/dbutil"
-	"maunium.net/go/mautrix/util/ffmpeg"
-	"maunium.net/go/mautrix/util/variationselector"
 
 	"go.mau.fi/whatsmeow"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
 
+	"maunium.net/go/mautrix-whatsapp/config"
 	"maunium.net/go/mautrix-whatsapp/database"
+	"maunium.net/go/mautrix-whatsapp/emoji"
 )
 
 const StatusBroadcastTopic = "WhatsApp status updates from your contacts"
@@ -69,12 +70,15 @@ const StatusBroadcastName = "WhatsApp Status Broadcast"
 const BroadcastTopic = "WhatsApp broadcast list"
 const UnnamedBroadcastName = "Unnamed broadcast list"
 const PrivateChatTopic = "WhatsApp private chat"
+const SelfChatName = "Message yourself"
+const SelfChatTopic = "Notes you send to yourself on WhatsApp"
 
 // The delay between the current time and msg time before we consider the message too stale to be
 // part of a users activity
 const MaximumMsgLagActivity = 5 * 60
 
 var ErrStatusBroadcastDisabled = errors.New("status bridging is disabled")
+var ErrBroadcastListDisabled = errors.New("broadcast list bridging is disabled")
 
 func (br *WABridge) GetPortalByMXID(mxid id.RoomID) *Portal {
 	br.portalsLock.Lock()
@@ -101,6 +105,31 @@ func (portal *Portal) IsEncrypted() bool {
 func (portal *Portal) MarkEncrypted() {
 	portal.Encrypted = true
 	portal.Update(nil)
+	portal.LogPortalChange("encrypted", false, true)
+}
+
+var PortalChangelogEvent = event.Type{Type: "fi.mau.whatsapp.portal_change", Class: event.StateEventType}
+
+// LogPortalChange sends a state event describing a change to a portal property, so that external tools
+// can follow bridge state without polling the database. Each change gets its own state key, which means
+// the room state works as an append-only changelog.
+func (portal *Portal) LogPortalChange(field string, oldValue, newValue interface{}) {
+	if !portal.bridge.Config.Bridge.PortalChangelogEvents || len(portal.MXID) == 0 {
+		return
+	}
+	ts := time.Now().UnixMilli()
+	stateKey := fmt.Sprintf("%d:%s", ts, field)
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, PortalChangelogEvent, stateKey, map[string]interface{}{
+		"field":     field,
+		"old_value": oldValue,
+		"new_value": newValue,
+		"timestamp": ts,
+		"jid":       portal.Key.JID.String(),
+		"receiver":  portal.Key.Receiver.String(),
+	})
+	if err != nil {
+		portal.log.Warnfln("Failed to send portal change event for %s: %v", field, err)
+	}
 }
 
 func (portal *Portal) ReceiveMatrixEvent(user bridge.User, evt *event.Event) {
@@ -183,7 +212,10 @@ func (br *WABridge) newBlankPortal(key database.PortalKey) *Portal {
 		matrixMessages: make(chan PortalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
 		mediaRetries:   make(chan PortalMediaRetry, br.Config.Bridge.PortalMessageBuffer),
 
-		mediaErrorCache: make(map[types.MessageID]*FailedMediaMeta),
+		mediaErrorCache: make(map[types.MessageID]*failedMediaCacheEntry),
+		liveLocations:   make(map[types.JID]*liveLocationShare),
+
+		relayConfirmations: make(map[id.EventID]*pendingRelayConfirmation),
 	}
 	go portal.handleMessageLoop()
 	return portal
@@ -224,11 +256,22 @@ type PortalMatrixMessage struct {
 	evt        *event.Event
 	user       *User
 	receivedAt time.Time
+
+	// captionMergeFlush marks items that send media which was held back waiting for a caption.
+	captionMergeFlush bool
+	// offlineQueued is how long the message waited in the user's offline queue,
+	// which doesn't count towards the handling timeout.
+	offlineQueued time.Duration
 }
 
 type PortalMediaRetry struct {
 	evt    *events.MediaRetry
 	source *User
+
+	// deferred is set instead of evt for jobs from the deferred media queue.
+	// done is closed after the job has been handled.
+	deferred *database.DeferredMedia
+	done     chan struct{}
 }
 
 type recentlyHandledWrapper struct {
@@ -260,9 +303,25 @@ type Portal struct {
 	matrixMessages chan PortalMatrixMessage
 	mediaRetries   chan PortalMediaRetry
 
-	mediaErrorCache map[types.MessageID]*FailedMediaMeta
+	mediaErrorCache     map[types.MessageID]*failedMediaCacheEntry
+	mediaErrorCacheLock sync.Mutex
+
+	liveLocations     map[types.JID]*liveLocationShare
+	liveLocationsLock sync.Mutex
+
+	relayConfirmations     map[id.EventID]*pendingRelayConfirmation
+	relayConfirmationsLock sync.Mutex
+	cachedGroupSize        int
+	cachedGroupSizeAt      time.Time
+	cachedGroupSizeLock    sync.Mutex
+
+	captionMerge     *pendingCaptionMerge
+	captionMergeLock sync.Mutex
 
 	relayUser *User
+	// relayBotFallback is set while the relay bot account can't be used, so the fallback is only logged once.
+	relayBotFallback bool
+	relayUserLock    sync.Mutex
 }
 
 func (portal *Portal) handleMessageLoopItem(msg PortalMessage) {
@@ -272,6 +331,11 @@ func (portal *Portal) handleMessageLoopItem(msg PortalMessage) {
 			return
 		}
 		portal.log.Debugln("Creating Matrix room from incoming message")
+		if portal.IsBroadcastList() && !portal.IsStatusBroadcastList() && msg.evt != nil && !msg.evt.Info.IsFromMe {
+			puppet := portal.bridge.GetPuppetByJID(msg.evt.Info.Sender)
+			puppet.SyncContact(msg.source, true, false, "creating broadcast list portal")
+			portal.Name = fmt.Sprintf("Broadcast from %s", puppet.Displayname)
+		}
 		err := portal.CreateMatrixRoom(msg.source, nil, false, true)
 		if err != nil {
 			portal.log.Errorln("Failed to create portal room:", err)
@@ -296,12 +360,16 @@ func (portal *Portal) handleMessageLoopItem(msg PortalMessage) {
 }
 
 func (portal *Portal) handleMatrixMessageLoopItem(msg PortalMatrixMessage) {
+	if msg.captionMergeFlush {
+		portal.flushCaptionMerge(msg.evt.ID)
+		return
+	}
 	evtTS := time.UnixMilli(msg.evt.Timestamp)
 	timings := messageTimings{
 		initReceive:  msg.evt.Mautrix.ReceivedAt.Sub(evtTS),
 		decrypt:      msg.evt.Mautrix.DecryptionDuration,
 		portalQueue:  time.Since(msg.receivedAt),
-		totalReceive: time.Since(evtTS),
+		totalReceive: time.Since(evtTS) - msg.offlineQueued,
 	}
 	implicitRRStart := time.Now()
 	portal.handleMatrixReadReceipt(msg.user, "", evtTS, false)
@@ -313,6 +381,8 @@ func (portal *Portal) handleMatrixMessageLoopItem(msg PortalMatrixMessage) {
 		portal.HandleMatrixRedaction(msg.user, msg.evt)
 	case event.EventReaction:
 		portal.HandleMatrixReaction(msg.user, msg.evt)
+	case EventSendSticker:
+		portal.HandleMatrixStickerShortcode(msg.user, msg.evt)
 	default:
 		portal.log.Warnln("Unsupported event type %+v in portal message channel", msg.evt.Type)
 	}
@@ -347,6 +417,13 @@ func (portal *Portal) handleReceipt(receipt *events.Receipt, source *User) {
 	intent := portal.bridge.GetPuppetByJID(receipt.Sender).IntentFor(portal)
 	for _, msg := range markAsRead {
 		err := intent.SetReadMarkers(portal.MXID, source.makeReadMarkerContent(msg.MXID, intent.IsCustomPuppet))
+		if errors.Is(err, mautrix.MUnknownToken) && intent.IsCustomPuppet {
+			puppet := portal.bridge.GetPuppetByJID(receipt.Sender)
+			if !puppet.handleInvalidToken(intent.AccessToken, err, "marking messages as read") {
+				return
+			}
+			err = intent.SetReadMarkers(portal.MXID, source.makeReadMarkerContent(msg.MXID, intent.IsCustomPuppet))
+		}
 		if err != nil {
 			portal.log.Warnfln("Failed to mark message %s as read by %s: %v", msg.MXID, intent.UserID, err)
 		} else {
@@ -363,7 +440,12 @@ func (portal *Portal) handleMessageLoop() {
 		case msg := <-portal.matrixMessages:
 			portal.handleMatrixMessageLoopItem(msg)
 		case retry := <-portal.mediaRetries:
-			portal.handleMediaRetry(retry.evt, retry.source)
+			if retry.deferred != nil {
+				portal.handleDeferredMedia(retry.deferred, retry.source)
+				close(retry.done)
+			} else {
+				portal.handleMediaRetry(retry.evt, retry.source)
+			}
 		}
 	}
 }
@@ -377,7 +459,8 @@ func containsSupportedMessage(waMsg *waProto.Message) bool {
 		waMsg.DocumentMessage != nil || waMsg.ContactMessage != nil || waMsg.LocationMessage != nil ||
 		waMsg.LiveLocationMessage != nil || waMsg.GroupInviteMessage != nil || waMsg.ContactsArrayMessage != nil ||
 		waMsg.HighlyStructuredMessage != nil || waMsg.TemplateMessage != nil || waMsg.TemplateButtonReplyMessage != nil ||
-		waMsg.ListMessage != nil || waMsg.ListResponseMessage != nil
+		waMsg.ListMessage != nil || waMsg.ListResponseMessage != nil || waMsg.ButtonsMessage != nil ||
+		waMsg.ButtonsResponseMessage != nil
 }
 
 func getMessageType(waMsg *waProto.Message) string {
@@ -408,6 +491,8 @@ func getMessageType(waMsg *waProto.Message) string {
 		return "group invite"
 	case waMsg.ReactionMessage != nil:
 		return "reaction"
+	case waMsg.KeepInChatMessage != nil:
+		return "keep in chat"
 	case waMsg.ProtocolMessage != nil:
 		switch waMsg.GetProtocolMessage().GetType() {
 		case waProto.ProtocolMessage_REVOKE:
@@ -417,6 +502,11 @@ func getMessageType(waMsg *waProto.Message) string {
 			return "revoke"
 		case waProto.ProtocolMessage_EPHEMERAL_SETTING:
 			return "disappearing timer change"
+		case protocolMessageEdit:
+			if getEditedMessage(waMsg.GetProtocolMessage()) == nil {
+				return "ignore"
+			}
+			return "edit"
 		case waProto.ProtocolMessage_APP_STATE_SYNC_KEY_SHARE, waProto.ProtocolMessage_HISTORY_SYNC_NOTIFICATION, waProto.ProtocolMessage_INITIAL_SECURITY_NOTIFICATION_SETTING_SYNC:
 			return "ignore"
 		default:
@@ -497,7 +587,7 @@ func formatDuration(d time.Duration) string {
 		parts = append(parts, pluralUnit(hours, "hour"))
 	}
 	if minutes > 0 {
-		parts = append(parts, pluralUnit(seconds, "minute"))
+		parts = append(parts, pluralUnit(minutes, "minute"))
 	}
 	if seconds > 0 {
 		parts = append(parts, pluralUnit(seconds, "second"))
@@ -506,6 +596,14 @@ func formatDuration(d time.Duration) string {
 }
 
 func (portal *Portal) convertMessage(intent *appservice.IntentAPI, source *User, info *types.MessageInfo, waMsg *waProto.Message, isBackfill bool) *ConvertedMessage {
+	converted := portal.convertMessageContent(intent, source, info, waMsg, isBackfill)
+	if converted != nil {
+		portal.addForwardedInfo(converted, getMessageContextInfo(waMsg))
+	}
+	return converted
+}
+
+func (portal *Portal) convertMessageContent(intent *appservice.IntentAPI, source *User, info *types.MessageInfo, waMsg *waProto.Message, isBackfill bool) *ConvertedMessage {
 	switch {
 	case waMsg.Conversation != nil || waMsg.ExtendedTextMessage != nil:
 		return portal.convertTextMessage(intent, source, waMsg)
@@ -519,6 +617,12 @@ func (portal *Portal) convertMessage(intent *appservice.IntentAPI, source *User,
 		return portal.convertListMessage(intent, source, waMsg.GetListMessage())
 	case waMsg.ListResponseMessage != nil:
 		return portal.convertListResponseMessage(intent, waMsg.GetListResponseMessage())
+	case waMsg.ButtonsMessage != nil:
+		return portal.convertButtonsMessage(intent, source, info, waMsg.GetButtonsMessage())
+	case waMsg.ButtonsResponseMessage != nil:
+		return portal.convertButtonsResponseMessage(intent, waMsg.GetButtonsResponseMessage())
+	case isViewOnceMedia(waMsg) && !portal.bridge.Config.Bridge.ViewOnce.Enabled:
+		return portal.convertDisabledViewOnceMessage(intent, waMsg)
 	case waMsg.ImageMessage != nil:
 		return portal.convertMediaMessage(intent, source, info, waMsg.GetImageMessage(), "photo", isBackfill)
 	case waMsg.StickerMessage != nil:
@@ -546,6 +650,7 @@ func (portal *Portal) convertMessage(intent *appservice.IntentAPI, source *User,
 	case waMsg.ProtocolMessage != nil && waMsg.ProtocolMessage.GetType() == waProto.ProtocolMessage_EPHEMERAL_SETTING:
 		portal.ExpirationTime = waMsg.ProtocolMessage.GetEphemeralExpiration()
 		portal.Update(nil)
+		portal.UpdateDisappearingTimerState()
 		return &ConvertedMessage{
 			Intent: intent,
 			Type:   event.EventMessage,
@@ -565,6 +670,7 @@ func (portal *Portal) UpdateGroupDisappearingMessages(sender *types.JID, timesta
 	}
 	portal.ExpirationTime = timer
 	portal.Update(nil)
+	portal.UpdateDisappearingTimerState()
 	intent := portal.MainIntent()
 	if sender != nil {
 		intent = portal.bridge.GetPuppetByJID(sender.ToNonAD()).IntentFor(portal)
@@ -582,11 +688,13 @@ func (portal *Portal) UpdateGroupDisappearingMessages(sender *types.JID, timesta
 
 func (portal *Portal) formatDisappearingMessageNotice() string {
 	if portal.ExpirationTime == 0 {
-		return "Turned off disappearing messages"
+		return portal.formatNotice(noticeDisappearingOff)
 	} else {
-		msg := fmt.Sprintf("Set the disappearing message timer to %s", formatDuration(time.Duration(portal.ExpirationTime)*time.Second))
-		if !portal.bridge.Config.Bridge.DisappearingMessagesInGroups && portal.IsGroupChat() {
-			msg += ". However, this bridge is not configured to disappear messages in group chats."
+		msg := portal.formatNotice(noticeDisappearingSet, formatDuration(time.Duration(portal.ExpirationTime)*time.Second))
+		if !portal.bridge.Config.Bridge.DisappearingMessagesRedact {
+			msg += ". " + portal.formatNotice(noticeDisappearingNoRedact)
+		} else if !portal.bridge.Config.Bridge.DisappearingMessagesInGroups && portal.IsGroupChat() {
+			msg += ". " + portal.formatNotice(noticeDisappearingNoGroups)
 		}
 		return msg
 	}
@@ -624,7 +732,7 @@ func (portal *Portal) handleUndecryptableMessage(source *User, evt *events.Undec
 	intent := portal.getMessageIntent(source, &evt.Info)
 	if intent == nil {
 		return
-	} else if !intent.IsCustomPuppet && portal.IsPrivateChat() && evt.Info.Sender.User == portal.Key.Receiver.User {
+	} else if !intent.IsCustomPuppet && portal.IsPrivateChat() && !portal.IsSelfChat() && evt.Info.Sender.User == portal.Key.Receiver.User {
 		portal.log.Debugfln("Not handling %s (undecryptable): user doesn't have double puppeting enabled", evt.Info.ID)
 		return
 	}
@@ -646,7 +754,7 @@ func (portal *Portal) handleFakeMessage(msg fakeMessage) {
 		return
 	}
 	intent := portal.bridge.GetPuppetByJID(msg.Sender).IntentFor(portal)
-	if !intent.IsCustomPuppet && portal.IsPrivateChat() && msg.Sender.User == portal.Key.Receiver.User {
+	if !intent.IsCustomPuppet && portal.IsPrivateChat() && !portal.IsSelfChat() && msg.Sender.User == portal.Key.Receiver.User {
 		portal.log.Debugfln("Not handling %s (fake): user doesn't have double puppeting enabled", msg.ID)
 		return
 	}
@@ -681,10 +789,17 @@ func (portal *Portal) handleMessage(source *User, evt *events.Message) {
 		return
 	}
 	msgID := evt.Info.ID
+	evt.Message = unwrapEditedMessage(evt.Message)
 	msgType := getMessageType(evt.Message)
 	if msgType == "ignore" {
 		return
-	} else if portal.isRecentlyHandled(msgID, database.MsgNoError) {
+	} else if evt.Message.LiveLocationMessage != nil && portal.handleLiveLocationUpdate(&evt.Info, evt.Message.GetLiveLocationMessage()) {
+		return
+	} else if loc := evt.Message.GetLocationMessage(); loc != nil && loc.IsLive != nil && !loc.GetIsLive() {
+		// A location with live explicitly set to false means the sender stopped sharing their live location
+		portal.stopLiveLocationOf(evt.Info.Sender)
+	}
+	if portal.isRecentlyHandled(msgID, database.MsgNoError) {
 		portal.log.Debugfln("Not handling %s (%s): message was recently handled", msgID, msgType)
 		return
 	}
@@ -704,10 +819,13 @@ func (portal *Portal) handleMessage(source *User, evt *events.Message) {
 	intent := portal.getMessageIntent(source, &evt.Info)
 	if intent == nil {
 		return
-	} else if !intent.IsCustomPuppet && portal.IsPrivateChat() && evt.Info.Sender.User == portal.Key.Receiver.User {
+	} else if !intent.IsCustomPuppet && portal.IsPrivateChat() && !portal.IsSelfChat() && evt.Info.Sender.User == portal.Key.Receiver.User {
 		portal.log.Debugfln("Not handling %s (%s): user doesn't have double puppeting enabled", msgID, msgType)
 		return
+	} else if existingMsg == nil && evt.Message.LiveLocationMessage != nil && portal.startLiveLocation(intent, &evt.Info, evt.Message.GetLiveLocationMessage()) {
+		return
 	}
+	applyViewOnceFlag(evt)
 	converted := portal.convertMessage(intent, source, &evt.Info, evt.Message, false)
 	if converted != nil {
 		if evt.Info.IsIncomingBroadcast() {
@@ -726,12 +844,17 @@ func (portal *Portal) handleMessage(source *User, evt *events.Message) {
 			converted.Content.SetEdit(existingMsg.MXID)
 		} else if converted.ReplyTo != nil {
 			portal.SetReply(converted.Content, converted.ReplyTo, false)
+		} else if portal.IsStatusBroadcastList() && portal.bridge.Config.Bridge.StatusBroadcastThreads {
+			portal.setStatusThread(converted.Content, &evt.Info)
+			if converted.Caption != nil {
+				converted.Caption.RelatesTo = converted.Content.RelatesTo
+			}
 		}
 		resp, err := portal.sendMessage(converted.Intent, converted.Type, converted.Content, converted.Extra, evt.Info.Timestamp.UnixMilli())
 		if err != nil {
 			portal.log.Errorfln("Failed to send %s to Matrix: %v", msgID, err)
 		} else {
-			portal.MarkDisappearing(resp.EventID, converted.ExpiresIn, false)
+			portal.markConvertedDisappearing(resp.EventID, converted)
 			eventID = resp.EventID
 			lastEventID = eventID
 		}
@@ -741,7 +864,7 @@ func (portal *Portal) handleMessage(source *User, evt *events.Message) {
 			if err != nil {
 				portal.log.Errorfln("Failed to send caption of %s to Matrix: %v", msgID, err)
 			} else {
-				portal.MarkDisappearing(resp.EventID, converted.ExpiresIn, false)
+				portal.markConvertedDisappearing(resp.EventID, converted)
 				lastEventID = resp.EventID
 			}
 		}
@@ -766,9 +889,19 @@ func (portal *Portal) handleMessage(source *User, evt *events.Message) {
 		}
 		if len(eventID) != 0 {
 			portal.finishHandling(existingMsg, &evt.Info, eventID, database.MsgNormal, converted.Error)
+			if converted.Interactive != nil {
+				portal.storeInteractiveMessage(converted.Interactive, evt.Info.ID)
+			}
+			if converted.Error == database.MsgErrMediaNotFound && converted.MediaKey != nil && portal.bridge.Config.Bridge.RequestExpiredMedia {
+				go portal.requestExpiredMedia(source, &evt.Info, converted.MediaKey)
+			}
 		}
 	} else if msgType == "reaction" {
 		portal.HandleMessageReaction(intent, source, &evt.Info, evt.Message.GetReactionMessage(), existingMsg)
+	} else if msgType == "keep in chat" {
+		portal.HandleKeepInChat(intent, &evt.Info, evt.Message.GetKeepInChatMessage())
+	} else if msgType == "edit" {
+		portal.HandleMessageEdit(intent, source, &evt.Info, evt.Message.GetProtocolMessage(), existingMsg)
 	} else if msgType == "revoke" {
 		portal.HandleMessageRevoke(source, &evt.Info, evt.Message.GetProtocolMessage().GetKey())
 		if existingMsg != nil {
@@ -796,6 +929,9 @@ func (portal *Portal) handleMessage(source *User, evt *events.Message) {
 		sender = nil
 	} else if !evt.Info.Sender.IsEmpty() {
 		sender = portal.bridge.GetPuppetByJID(evt.Info.Sender)
+		if sender != nil {
+			sender.ClearDefunct()
+		}
 	}
 
 	if sender != nil && tsMilli+MaximumMsgLagActivity > time.Now().Unix() {
@@ -869,7 +1005,36 @@ func (portal *Portal) getMessageIntent(user *User, info *types.MessageInfo) *app
 	if puppet == nil {
 		return nil
 	}
-	return puppet.IntentFor(portal)
+	intent := puppet.IntentFor(portal)
+	if portal.bridge.Config.Bridge.ReinviteKickedGhosts {
+		portal.ensureGhostJoined(intent)
+	}
+	return intent
+}
+
+// ensureGhostJoined re-invites and joins a ghost that isn't in the portal room anymore on Matrix
+// (e.g. because an admin kicked it), even though it's still sending messages on WhatsApp.
+func (portal *Portal) ensureGhostJoined(intent *appservice.IntentAPI) {
+	if len(portal.MXID) == 0 || intent.IsCustomPuppet || portal.IsPrivateChat() || intent.UserID == portal.MainIntent().UserID {
+		return
+	} else if portal.bridge.StateStore.IsInRoom(portal.MXID, intent.UserID) {
+		return
+	} else if portal.bridge.StateStore.IsMembership(portal.MXID, intent.UserID, event.MembershipBan) {
+		// Bans are deliberate, so don't try to undo them.
+		return
+	}
+	portal.log.Infofln("%s isn't in the room on Matrix, re-inviting it before bridging its message", intent.UserID)
+	_, err := portal.MainIntent().InviteUser(portal.MXID, &mautrix.ReqInviteUser{
+		UserID: intent.UserID,
+		Reason: "Rejoining user who is still a participant on WhatsApp",
+	})
+	if err != nil {
+		portal.log.Warnfln("Failed to re-invite %s: %v", intent.UserID, err)
+	}
+	err = intent.EnsureJoined(portal.MXID, appservice.EnsureJoinedParams{IgnoreCache: true})
+	if err != nil {
+		portal.log.Warnfln("Failed to rejoin %s to the room: %v", intent.UserID, err)
+	}
 }
 
 func (portal *Portal) finishHandling(existing *database.Message, message *types.MessageInfo, mxid id.EventID, msgType database.MessageType, errType database.MessageErrorType) {
@@ -1149,6 +1314,7 @@ func (portal *Portal) UpdateMetadata(user *User, groupInfo *types.GroupInfo) boo
 	if portal.ExpirationTime != groupInfo.DisappearingTimer {
 		update = true
 		portal.ExpirationTime = groupInfo.DisappearingTimer
+		portal.UpdateDisappearingTimerState()
 	}
 
 	portal.RestrictMessageSending(groupInfo.IsAnnounce)
@@ -1206,6 +1372,7 @@ func (portal *Portal) GetBasePowerLevels() *event.PowerLevelsEventContent {
 			event.StateTopic.Type:      anyone,
 			event.EventReaction.Type:   anyone,
 			event.EventRedaction.Type:  anyone,
+			BeaconInfoEvent.Type:       anyone,
 		},
 	}
 }
@@ -1214,6 +1381,7 @@ func (portal *Portal) applyPowerLevelFixes(levels *event.PowerLevelsEventContent
 	changed := false
 	changed = levels.EnsureEventLevel(event.EventReaction, 0) || changed
 	changed = levels.EnsureEventLevel(event.EventRedaction, 0) || changed
+	changed = levels.EnsureEventLevel(BeaconInfoEvent, 0) || changed
 	return changed
 }
 
@@ -1273,6 +1441,48 @@ func (portal *Portal) RestrictMessageSending(restrict bool) id.EventID {
 	}
 }
 
+// checkAnnouncePermission rejects messages that WhatsApp would reject because the group only allows admins
+// to send messages and the WhatsApp account the message would be sent from isn't an admin. The power levels
+// of ghosts mirror the WhatsApp admin status, so the ghost of the account is checked instead of the Matrix
+// sender, who may have a higher power level on Matrix or be sending through the relay.
+func (portal *Portal) checkAnnouncePermission(sender *User) error {
+	if !portal.IsGroupChat() || sender == nil || sender.JID.IsEmpty() {
+		return nil
+	}
+	levels := portal.bridge.StateStore.GetPowerLevels(portal.MXID)
+	if levels == nil || levels.EventsDefault < 50 {
+		return nil
+	}
+	puppet := portal.bridge.GetPuppetByJID(sender.JID)
+	if puppet != nil && levels.GetUserLevel(puppet.MXID) < levels.EventsDefault {
+		return errAnnounceOnlyGroup
+	}
+	return nil
+}
+
+// UpdateAnnounce updates the room power levels after the "only admins can send messages" setting
+// of the group is changed on WhatsApp, and notifies the room about the change.
+func (portal *Portal) UpdateAnnounce(sender *types.JID, timestamp time.Time, isAnnounce bool) {
+	if portal.RestrictMessageSending(isAnnounce) == "" {
+		return
+	}
+	intent := portal.MainIntent()
+	if sender != nil && !sender.IsEmpty() {
+		intent = portal.bridge.GetPuppetByJID(sender.ToNonAD()).IntentFor(portal)
+	}
+	body := portal.formatNotice(noticeAnnounceOff)
+	if isAnnounce {
+		body = portal.formatNotice(noticeAnnounceOn)
+	}
+	_, err := portal.sendMessage(intent, event.EventMessage, &event.MessageEventContent{
+		Body:    body,
+		MsgType: event.MsgNotice,
+	}, nil, timestamp.UnixMilli())
+	if err != nil {
+		portal.log.Warnfln("Failed to notify portal about announcement mode change: %v", err)
+	}
+}
+
 func (portal *Portal) RestrictMetadataChanges(restrict bool) id.EventID {
 	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
 	if err != nil {
@@ -1373,6 +1583,11 @@ func (portal *Portal) CreateMatrixRoom(user *User, groupInfo *types.GroupInfo, i
 			portal.Name = ""
 		}
 		portal.Topic = PrivateChatTopic
+		if portal.IsSelfChat() {
+			// The ghost of the user's own number would otherwise make the room look like a DM with themselves
+			portal.Name = SelfChatName
+			portal.Topic = SelfChatTopic
+		}
 	} else if portal.IsStatusBroadcastList() {
 		if !portal.bridge.Config.Bridge.EnableStatusBroadcast {
 			portal.log.Debugln("Status bridging is disabled in config, not creating room after all")
@@ -1381,22 +1596,14 @@ func (portal *Portal) CreateMatrixRoom(user *User, groupInfo *types.GroupInfo, i
 		portal.Name = StatusBroadcastName
 		portal.Topic = StatusBroadcastTopic
 	} else if portal.IsBroadcastList() {
-		//var err error
-		//broadcastMetadata, err = user.Conn.GetBroadcastMetadata(portal.Key.JID)
-		//if err == nil && broadcastMetadata.Status == 200 {
-		//	portal.Name = broadcastMetadata.Name
-		//} else {
-		//	user.Conn.Store.ContactsLock.RLock()
-		//	contact, _ := user.Conn.Store.Contacts[portal.Key.JID]
-		//	user.Conn.Store.ContactsLock.RUnlock()
-		//	portal.Name = contact.Name
-		//}
-		//if len(portal.Name) == 0 {
-		//	portal.Name = UnnamedBroadcastName
-		//}
-		//portal.Topic = BroadcastTopic
-		portal.log.Debugln("Broadcast list is not yet supported, not creating room after all")
-		return fmt.Errorf("broadcast list bridging is currently not supported")
+		if !portal.bridge.Config.Bridge.BroadcastListPortals {
+			portal.log.Debugln("Broadcast list bridging is disabled in config, not creating room after all")
+			return ErrBroadcastListDisabled
+		}
+		if len(portal.Name) == 0 {
+			portal.Name = UnnamedBroadcastName
+		}
+		portal.Topic = BroadcastTopic
 	} else {
 		if groupInfo == nil || !isFullInfo {
 			foundInfo, err := user.Client.GetGroupInfo(portal.Key.JID)
@@ -1424,10 +1631,22 @@ func (portal *Portal) CreateMatrixRoom(user *User, groupInfo *types.GroupInfo, i
 
 	bridgeInfoStateKey, bridgeInfo := portal.getBridgeInfo()
 
+	powerLevels := portal.GetBasePowerLevels()
+	if groupInfo != nil {
+		// Apply group restrictions in the initial state, so that the room doesn't start out allowing everyone to talk
+		if groupInfo.IsAnnounce {
+			powerLevels.EventsDefault = 50
+		}
+		if groupInfo.IsLocked {
+			powerLevels.EnsureEventLevel(event.StateRoomName, 50)
+			powerLevels.EnsureEventLevel(event.StateRoomAvatar, 50)
+			powerLevels.EnsureEventLevel(event.StateTopic, 50)
+		}
+	}
 	initialState := []*event.Event{{
 		Type: event.StatePowerLevels,
 		Content: event.Content{
-			Parsed: portal.GetBasePowerLevels(),
+			Parsed: powerLevels,
 		},
 	}, {
 		Type:     event.StateBridge,
@@ -1504,6 +1723,7 @@ func (portal *Portal) CreateMatrixRoom(user *User, groupInfo *types.GroupInfo, i
 		if groupInfo.IsEphemeral {
 			portal.ExpirationTime = groupInfo.DisappearingTimer
 			portal.Update(nil)
+			portal.UpdateDisappearingTimerState()
 		}
 		portal.SyncParticipants(user, groupInfo)
 		if groupInfo.IsAnnounce {
@@ -1566,6 +1786,11 @@ func (portal *Portal) IsPrivateChat() bool {
 	return portal.Key.JID.Server == types.DefaultUserServer
 }
 
+// IsSelfChat returns true if the portal is the "message yourself" chat, i.e. a private chat with the user's own number.
+func (portal *Portal) IsSelfChat() bool {
+	return portal.IsPrivateChat() && portal.Key.JID.User == portal.Key.Receiver.User
+}
+
 func (portal *Portal) IsGroupChat() bool {
 	return portal.Key.JID.Server == types.GroupServer
 }
@@ -1578,19 +1803,90 @@ func (portal *Portal) IsStatusBroadcastList() bool {
 	return portal.Key.JID == types.StatusBroadcastJID
 }
 
+const statusLifetime = 24 * time.Hour
+
+// setStatusThread puts a status update in a thread rooted at the first status update
+// that the same contact posted within the lifetime of a status.
+func (portal *Portal) setStatusThread(content *event.MessageEventContent, info *types.MessageInfo) {
+	root := portal.bridge.DB.Message.GetFirstFromSenderSince(portal.Key, info.Sender, info.Timestamp.Add(-statusLifetime))
+	if root == nil || root.JID == info.ID || len(root.MXID) == 0 || root.IsFakeMXID() {
+		return
+	}
+	content.RelatesTo = &event.RelatesTo{
+		Type:    event.RelThread,
+		EventID: root.MXID,
+	}
+}
+
+// getBroadcastReplyTarget returns the private chat that a Matrix message in a broadcast list portal should be sent to,
+// or an empty JID if the message isn't a reply. Replies to status updates and messages in incoming broadcast lists
+// are sent as private messages to the author of the replied-to message.
+func (portal *Portal) getBroadcastReplyTarget(sender *User, evt *event.Event) types.JID {
+	if !portal.IsBroadcastList() {
+		return types.EmptyJID
+	}
+	replyToID := evt.Content.AsMessage().GetReplyTo()
+	if len(replyToID) == 0 {
+		return types.EmptyJID
+	}
+	target := portal.bridge.DB.Message.GetByMXID(replyToID)
+	if target == nil || target.IsFakeJID() || target.Type != database.MsgNormal || target.Sender.User == sender.JID.User {
+		return types.EmptyJID
+	}
+	return target.Sender.ToNonAD()
+}
+
 func (portal *Portal) HasRelaybot() bool {
 	return portal.bridge.Config.Bridge.Relay.Enabled && len(portal.RelayUserID) > 0
 }
 
+// GetRelayUser returns the user whose WhatsApp account relayed messages should be sent from.
+// If the bridge is configured to use a dedicated relay bot account, that account is used as long as it's connected
+// and a participant of the group, with the portal's own relay user as a fallback.
 func (portal *Portal) GetRelayUser() *User {
 	if !portal.HasRelaybot() {
 		return nil
-	} else if portal.relayUser == nil {
+	}
+	relayCfg := portal.bridge.Config.Bridge.Relay
+	var botUser *User
+	var fallbackReason string
+	if relayCfg.Identity == config.RelayIdentityBot && len(relayCfg.BotAccount) > 0 {
+		botUser, fallbackReason = portal.checkRelayBotAccount(relayCfg.BotAccount)
+	}
+
+	portal.relayUserLock.Lock()
+	defer portal.relayUserLock.Unlock()
+	if botUser != nil {
+		portal.relayBotFallback = false
+		return botUser
+	} else if len(fallbackReason) > 0 && !portal.relayBotFallback {
+		portal.log.Warnfln("Relay bot account %s %s, falling back to %s", relayCfg.BotAccount, fallbackReason, portal.RelayUserID)
+		portal.relayBotFallback = true
+	}
+	if portal.relayUser == nil {
 		portal.relayUser = portal.bridge.GetUserByMXID(portal.RelayUserID)
 	}
 	return portal.relayUser
 }
 
+// checkRelayBotAccount returns the relay bot user if it can send to this portal, or the reason why it can't.
+func (portal *Portal) checkRelayBotAccount(botAccount id.UserID) (*User, string) {
+	botUser := portal.bridge.GetUserByMXIDIfExists(botAccount)
+	if botUser == nil || !botUser.IsLoggedIn() {
+		return nil, "is not connected"
+	} else if !portal.IsGroupChat() {
+		return botUser, ""
+	}
+	inGroup, err := botUser.isInCachedGroupList(portal.Key.JID)
+	if err != nil {
+		portal.log.Warnfln("Failed to check if relay bot account %s is in the group: %v", botAccount, err)
+		return nil, "couldn't be checked for group membership"
+	} else if !inGroup {
+		return nil, "is not a participant of the group"
+	}
+	return botUser, ""
+}
+
 func (portal *Portal) MainIntent() *appservice.IntentAPI {
 	if portal.IsPrivateChat() {
 		return portal.bridge.GetPuppetByJID(portal.Key.JID).DefaultIntent()
@@ -1605,7 +1901,12 @@ func (portal *Portal) SetReply(content *event.MessageEventContent, replyTo *Repl
 	message := portal.bridge.DB.Message.GetByJID(portal.Key, replyTo.MessageID)
 	if message == nil || message.IsFakeMXID() {
 		if isBackfill && portal.bridge.Config.Homeserver.Software == bridgeconfig.SoftwareHungry {
-			content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(portal.deterministicEventID(replyTo.Sender, replyTo.MessageID))
+			targetID := portal.deterministicEventID(replyTo.Sender, replyTo.MessageID)
+			if portal.bridge.Config.Bridge.RepliesAsThreads {
+				portal.setReplyThread(content, targetID, nil)
+			} else {
+				content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(targetID)
+			}
 			return true
 		}
 		return false
@@ -1613,7 +1914,11 @@ func (portal *Portal) SetReply(content *event.MessageEventContent, replyTo *Repl
 	evt, err := portal.MainIntent().GetEvent(portal.MXID, message.MXID)
 	if err != nil {
 		portal.log.Warnln("Failed to get reply target:", err)
-		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(message.MXID)
+		if portal.bridge.Config.Bridge.RepliesAsThreads {
+			portal.setReplyThread(content, message.MXID, nil)
+		} else {
+			content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(message.MXID)
+		}
 		return true
 	}
 	_ = evt.Content.ParseRaw(evt.Type)
@@ -1625,10 +1930,28 @@ func (portal *Portal) SetReply(content *event.MessageEventContent, replyTo *Repl
 			evt = decryptedEvt
 		}
 	}
-	content.SetReply(evt)
+	if portal.bridge.Config.Bridge.RepliesAsThreads {
+		portal.setReplyThread(content, evt.ID, evt)
+	} else {
+		content.SetReply(evt)
+	}
 	return true
 }
 
+// setReplyThread puts a WhatsApp reply into the thread of the replied-to message, or starts a new thread
+// rooted at the replied-to message if it isn't in a thread yet.
+func (portal *Portal) setReplyThread(content *event.MessageEventContent, replyToID id.EventID, replyTo *event.Event) {
+	threadRoot := replyToID
+	if replyTo != nil {
+		if rel := replyTo.Content.AsMessage().RelatesTo; rel != nil && rel.Type == event.RelThread && len(rel.EventID) > 0 {
+			threadRoot = rel.EventID
+		}
+	}
+	content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(replyToID)
+	content.RelatesTo.Type = event.RelThread
+	content.RelatesTo.EventID = threadRoot
+}
+
 func (portal *Portal) HandleMessageReaction(intent *appservice.IntentAPI, user *User, info *types.MessageInfo, reaction *waProto.ReactionMessage, existingMsg *database.Message) {
 	if existingMsg != nil {
 		_, _ = portal.MainIntent().RedactEvent(portal.MXID, existingMsg.MXID, mautrix.ReqRedact{
@@ -1661,7 +1984,7 @@ func (portal *Portal) HandleMessageReaction(intent *appservice.IntentAPI, user *
 		content.RelatesTo = event.RelatesTo{
 			Type:    event.RelAnnotation,
 			EventID: target.MXID,
-			Key:     variationselector.Add(reaction.GetText()),
+			Key:     emoji.ForMatrix(reaction.GetText()),
 		}
 		resp, err := intent.SendMassagedMessageEvent(portal.MXID, event.EventReaction, &content, info.Timestamp.UnixMilli())
 		if err != nil {
@@ -1679,15 +2002,16 @@ func (portal *Portal) HandleMessageRevoke(user *User, info *types.MessageInfo, k
 	if msg == nil || msg.IsFakeMXID() {
 		return false
 	}
+	portal.stopLiveLocation(msg.JID)
 	intent := portal.bridge.GetPuppetByJID(info.Sender).IntentFor(portal)
-	_, err := intent.RedactEvent(portal.MXID, msg.MXID)
+	reason := mautrix.ReqRedact{Reason: "Message was deleted for everyone on WhatsApp"}
+	_, err := intent.RedactEvent(portal.MXID, msg.MXID, reason)
+	if errors.Is(err, mautrix.MForbidden) {
+		// Deleted by a group admin or sent through the relay, so the sender's ghost may not have permission
+		_, err = portal.MainIntent().RedactEvent(portal.MXID, msg.MXID, reason)
+	}
 	if err != nil {
-		if errors.Is(err, mautrix.MForbidden) {
-			_, err = portal.MainIntent().RedactEvent(portal.MXID, msg.MXID)
-			if err != nil {
-				portal.log.Errorln("Failed to redact %s: %v", msg.JID, err)
-			}
-		}
+		portal.log.Errorfln("Failed to redact %s: %v", msg.JID, err)
 	} else {
 		msg.Delete()
 	}
@@ -1786,8 +2110,15 @@ type ConvertedMessage struct {
 
 	ReplyTo   *ReplyInfo
 	ExpiresIn uint32
+	ViewOnce  bool
 	Error     database.MessageErrorType
 	MediaKey  []byte
+	// MediaDeferred is set when the media of a backfilled message was replaced with a placeholder
+	// and should be downloaded later from the deferred media queue.
+	MediaDeferred bool
+
+	// Interactive contains the selectable options of business messages.
+	Interactive *database.InteractiveMessage
 }
 
 func (cm *ConvertedMessage) MergeCaption() {
@@ -1849,28 +2180,28 @@ func (portal *Portal) convertTemplateMessage(intent *appservice.IntentAPI, sourc
 		return converted
 	}
 	content := tpl.GetHydratedContentText()
-	if buttons := tpl.GetHydratedButtons(); len(buttons) > 0 {
-		addButtonText := false
-		descriptions := make([]string, len(buttons))
-		for i, rawButton := range buttons {
-			switch button := rawButton.GetHydratedButton().(type) {
-			case *waProto.HydratedTemplateButton_QuickReplyButton:
-				descriptions[i] = fmt.Sprintf("<%s>", button.QuickReplyButton.GetDisplayText())
-				addButtonText = true
-			case *waProto.HydratedTemplateButton_UrlButton:
-				descriptions[i] = fmt.Sprintf("[%s](%s)", button.UrlButton.GetDisplayText(), button.UrlButton.GetUrl())
-			case *waProto.HydratedTemplateButton_CallButton:
-				descriptions[i] = fmt.Sprintf("[%s](tel:%s)", button.CallButton.GetDisplayText(), button.CallButton.GetPhoneNumber())
-			}
-		}
-		description := strings.Join(descriptions, " - ")
-		if addButtonText {
-			description += "\nUse the WhatsApp app to click buttons"
+	interactive := &database.InteractiveMessage{Kind: database.InteractiveTemplate}
+	var optionsMarkdown strings.Builder
+	for i, rawButton := range tpl.GetHydratedButtons() {
+		number := i + 1
+		switch button := rawButton.GetHydratedButton().(type) {
+		case *waProto.HydratedTemplateButton_QuickReplyButton:
+			_, _ = fmt.Fprintf(&optionsMarkdown, "%d. %s\n", number, button.QuickReplyButton.GetDisplayText())
+			interactive.Options = append(interactive.Options, database.InteractiveOption{
+				Number: number,
+				ID:     button.QuickReplyButton.GetId(),
+				Text:   button.QuickReplyButton.GetDisplayText(),
+				Index:  int(rawButton.GetIndex()),
+			})
+		case *waProto.HydratedTemplateButton_UrlButton:
+			_, _ = fmt.Fprintf(&optionsMarkdown, "%d. [%s](%s)\n", number, button.UrlButton.GetDisplayText(), button.UrlButton.GetUrl())
+		case *waProto.HydratedTemplateButton_CallButton:
+			_, _ = fmt.Fprintf(&optionsMarkdown, "%d. [%s](tel:%s)\n", number, button.CallButton.GetDisplayText(), button.CallButton.GetPhoneNumber())
 		}
-		content = fmt.Sprintf("%s\n\n%s", content, description)
 	}
-	if footer := tpl.GetHydratedFooterText(); footer != "" {
-		content = fmt.Sprintf("%s\n\n%s", content, footer)
+	if len(interactive.Options) > 0 {
+		optionsMarkdown.WriteString("\n" + interactiveReplyHint)
+		converted.Interactive = interactive
 	}
 
 	var convertedTitle *ConvertedMessage
@@ -1887,8 +2218,7 @@ func (portal *Portal) convertTemplateMessage(intent *appservice.IntentAPI, sourc
 		content = fmt.Sprintf("%s\n\n%s", title.HydratedTitleText, content)
 	}
 
-	converted.Content.Body = content
-	portal.bridge.Formatter.ParseWhatsApp(portal.MXID, converted.Content, nil, true, false)
+	portal.formatInteractiveMessage(converted.Content, content, optionsMarkdown.String(), tpl.GetHydratedFooterText())
 	if convertedTitle != nil {
 		converted.MediaKey = convertedTitle.MediaKey
 		converted.Extra = convertedTitle.Extra
@@ -1941,34 +2271,35 @@ func (portal *Portal) convertListMessage(intent *appservice.IntentAPI, source *U
 			body = fmt.Sprintf("%s\n\n%s", msg.GetTitle(), body)
 		}
 	}
-	randomID := util.RandomString(64)
-	body = fmt.Sprintf("%s\n%s", body, randomID)
-	if msg.GetFooterText() != "" {
-		body = fmt.Sprintf("%s\n\n%s", body, msg.GetFooterText())
-	}
-	converted.Content.Body = body
-	portal.bridge.Formatter.ParseWhatsApp(portal.MXID, converted.Content, nil, false, true)
 
+	interactive := &database.InteractiveMessage{Kind: database.InteractiveList}
 	var optionsMarkdown strings.Builder
 	_, _ = fmt.Fprintf(&optionsMarkdown, "#### %s\n", msg.GetButtonText())
 	for _, section := range msg.GetSections() {
-		nesting := ""
 		if section.GetTitle() != "" {
-			_, _ = fmt.Fprintf(&optionsMarkdown, "* %s\n", section.GetTitle())
-			nesting = "  "
+			_, _ = fmt.Fprintf(&optionsMarkdown, "\n**%s**\n\n", section.GetTitle())
 		}
 		for _, row := range section.GetRows() {
+			number := len(interactive.Options) + 1
 			if row.GetDescription() != "" {
-				_, _ = fmt.Fprintf(&optionsMarkdown, "%s* %s: %s\n", nesting, row.GetTitle(), row.GetDescription())
+				_, _ = fmt.Fprintf(&optionsMarkdown, "%d. %s: %s\n", number, row.GetTitle(), row.GetDescription())
 			} else {
-				_, _ = fmt.Fprintf(&optionsMarkdown, "%s* %s\n", nesting, row.GetTitle())
+				_, _ = fmt.Fprintf(&optionsMarkdown, "%d. %s\n", number, row.GetTitle())
 			}
+			interactive.Options = append(interactive.Options, database.InteractiveOption{
+				Number:      number,
+				ID:          row.GetRowId(),
+				Text:        row.GetTitle(),
+				Description: row.GetDescription(),
+				Index:       number - 1,
+			})
 		}
 	}
-	optionsMarkdown.WriteString("\nUse the WhatsApp app to respond")
-	rendered := format.RenderMarkdown(optionsMarkdown.String(), true, false)
-	converted.Content.Body = strings.Replace(converted.Content.Body, randomID, rendered.Body, 1)
-	converted.Content.FormattedBody = strings.Replace(converted.Content.FormattedBody, randomID, rendered.FormattedBody, 1)
+	if len(interactive.Options) > 0 {
+		optionsMarkdown.WriteString("\n" + interactiveReplyHint)
+		converted.Interactive = interactive
+	}
+	portal.formatInteractiveMessage(converted.Content, body, optionsMarkdown.String(), msg.GetFooterText())
 	return converted
 }
 
@@ -2004,7 +2335,7 @@ func (portal *Portal) convertListResponseMessage(intent *appservice.IntentAPI, m
 
 func (portal *Portal) convertLiveLocationMessage(intent *appservice.IntentAPI, msg *waProto.LiveLocationMessage) *ConvertedMessage {
 	content := &event.MessageEventContent{
-		Body:    "Started sharing live location",
+		Body:    portal.formatNotice(noticeLiveLocationStarted),
 		MsgType: event.MsgNotice,
 	}
 	if len(msg.GetCaption()) > 0 {
@@ -2066,12 +2397,13 @@ func (portal *Portal) convertLocationMessage(intent *appservice.IntentAPI, msg *
 		Intent:    intent,
 		Type:      event.EventMessage,
 		Content:   content,
+		Extra:     makeLocationExtra(msg.GetDegreesLatitude(), msg.GetDegreesLongitude(), msg.GetName(), time.Time{}, "m.pin"),
 		ReplyTo:   GetReply(msg.GetContextInfo()),
 		ExpiresIn: msg.GetContextInfo().GetExpiration(),
 	}
 }
 
-const inviteMsg = `%s<hr/>This invitation to join "%s" expires at %s. Reply to this message with <code>!wa accept</code> to accept the invite.`
+const inviteMsg = `%s<hr/>%sThis invitation to join <strong>%s</strong> expires at %s. Reply to this message with <code>!wa accept-invite</code> or react with ✅ to join the group.`
 const inviteMetaField = "fi.mau.whatsapp.invite"
 const escapedInviteMetaField = `fi\.mau\.whatsapp\.invite`
 
@@ -2082,9 +2414,60 @@ type InviteMeta struct {
 	Inviter    types.JID `json:"inviter"`
 }
 
+// acceptGroupInvite joins the group of an invite message. The portal is created when WhatsApp
+// sends the joined group event.
+func (user *User) acceptGroupInvite(meta *InviteMeta) error {
+	if meta.Inviter.User == user.JID.User {
+		return errors.New("you can't accept your own invites")
+	}
+	return user.Client.JoinGroupWithInvite(meta.JID, meta.Inviter, meta.Code, meta.Expiration)
+}
+
+// handleInviteAcceptReaction accepts a group invite when the user reacts to the invite message with a check mark.
+// Returns true if the reacted message was an invite, in which case the reaction isn't bridged.
+func (portal *Portal) handleInviteAcceptReaction(sender *User, evt *event.Event, content *event.ReactionEventContent) bool {
+	if !portal.IsPrivateChat() || !sender.IsLoggedIn() || !emoji.Equal(content.RelatesTo.Key, "\u2705") {
+		return false
+	}
+	target, err := portal.MainIntent().GetEvent(portal.MXID, content.RelatesTo.EventID)
+	if err != nil {
+		portal.log.Warnfln("Failed to get event %s to check if %s is an invite acceptance: %v", content.RelatesTo.EventID, evt.ID, err)
+		return false
+	}
+	rawContent, err := tryDecryptEvent(portal.bridge.Crypto, target)
+	if err != nil {
+		return false
+	}
+	meta, _ := parseInviteMeta(rawContent)
+	if meta == nil {
+		return false
+	}
+	var notice string
+	if err = sender.acceptGroupInvite(meta); err != nil {
+		portal.log.Warnfln("Failed to accept invite to %s from reaction %s: %v", meta.JID, evt.ID, err)
+		notice = fmt.Sprintf("Failed to accept group invite: %v", err)
+	} else {
+		portal.log.Debugfln("%s accepted invite to %s with reaction %s", sender.MXID, meta.JID, evt.ID)
+		notice = "Successfully accepted the invite, the portal should be created momentarily"
+	}
+	_, _ = portal.MainIntent().RedactEvent(portal.MXID, evt.ID, mautrix.ReqRedact{Reason: "group invite accepted"})
+	_, _ = portal.sendMainIntentMessage(&event.MessageEventContent{MsgType: event.MsgNotice, Body: notice})
+	return true
+}
+
 func (portal *Portal) convertGroupInviteMessage(intent *appservice.IntentAPI, info *types.MessageInfo, msg *waProto.GroupInviteMessage) *ConvertedMessage {
 	expiry := time.Unix(msg.GetInviteExpiration(), 0)
-	htmlMessage := fmt.Sprintf(inviteMsg, html.EscapeString(msg.GetCaption()), msg.GetGroupName(), expiry)
+	var avatarHTML string
+	// Inline images can't be encrypted, so the group avatar is only shown in unencrypted rooms.
+	if thumbnail := msg.GetJpegThumbnail(); len(thumbnail) > 0 && !portal.Encrypted {
+		resp, err := intent.UploadBytes(thumbnail, "image/jpeg")
+		if err != nil {
+			portal.log.Warnfln("Failed to upload avatar of invite group %s: %v", msg.GetGroupJid(), err)
+		} else {
+			avatarHTML = fmt.Sprintf(`<img src="%s" alt="Group avatar" width="48" height="48"/><br/>`, resp.ContentURI.CUString())
+		}
+	}
+	htmlMessage := fmt.Sprintf(inviteMsg, html.EscapeString(msg.GetCaption()), avatarHTML, html.EscapeString(msg.GetGroupName()), expiry)
 	content := &event.MessageEventContent{
 		MsgType:       event.MsgText,
 		Body:          format.HTMLToText(htmlMessage),
@@ -2140,10 +2523,18 @@ func (portal *Portal) convertContactMessage(intent *appservice.IntentAPI, msg *w
 		content.URL = uploadResp.ContentURI.CUString()
 	}
 
+	body, formattedBody := portal.formatVCard(msg.GetDisplayName(), ParseVCard(msg.GetVcard()))
 	return &ConvertedMessage{
-		Intent:    intent,
-		Type:      event.EventMessage,
-		Content:   content,
+		Intent:  intent,
+		Type:    event.EventMessage,
+		Content: content,
+		Caption: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          body,
+			Format:        event.FormatHTML,
+			FormattedBody: formattedBody,
+		},
+		Extra:     map[string]interface{}{},
 		ReplyTo:   GetReply(msg.GetContextInfo()),
 		ExpiresIn: msg.GetContextInfo().GetExpiration(),
 	}
@@ -2154,11 +2545,11 @@ func (portal *Portal) convertContactsArrayMessage(intent *appservice.IntentAPI,
 	if len(name) == 0 {
 		name = fmt.Sprintf("%d contacts", len(msg.GetContacts()))
 	}
-	contacts := make([]*event.MessageEventContent, 0, len(msg.GetContacts()))
+	contacts := make([]*event.MessageEventContent, 0, len(msg.GetContacts())*2)
 	for _, contact := range msg.GetContacts() {
 		converted := portal.convertContactMessage(intent, contact)
 		if converted != nil {
-			contacts = append(contacts, converted.Content)
+			contacts = append(contacts, converted.Caption, converted.Content)
 		}
 	}
 	return &ConvertedMessage{
@@ -2280,6 +2671,8 @@ type FailedMediaKeys struct {
 	Type      whatsmeow.MediaType `json:"type"`
 	SHA256    []byte              `json:"sha256"`
 	EncSHA256 []byte              `json:"enc_sha256"`
+	// DirectPath is only stored for deferred media, which is downloaded using the original path.
+	DirectPath string `json:"direct_path,omitempty"`
 }
 
 type FailedMediaMeta struct {
@@ -2303,6 +2696,16 @@ func (portal *Portal) makeMediaBridgeFailureMessage(info *types.MessageInfo, bri
 	} else {
 		portal.log.Errorfln("Failed to bridge media for %s: %v", info.ID, bridgeErr)
 	}
+	body := userFriendlyError
+	if body == "" {
+		body = fmt.Sprintf("Failed to bridge media: %v", bridgeErr)
+	}
+	return portal.makeMediaPlaceholderMessage(info, converted, keys, body)
+}
+
+// makeMediaPlaceholderMessage replaces the converted media with a notice. If keys are given, the original
+// content is stored in the event so that the media can be bridged later with an edit.
+func (portal *Portal) makeMediaPlaceholderMessage(info *types.MessageInfo, converted *ConvertedMessage, keys *FailedMediaKeys, body string) *ConvertedMessage {
 	if keys != nil {
 		if portal.bridge.Config.Bridge.CaptionInMessage {
 			converted.MergeCaption()
@@ -2314,13 +2717,9 @@ func (portal *Portal) makeMediaBridgeFailureMessage(info *types.MessageInfo, bri
 			Media:        *keys,
 		}
 		converted.Extra[failedMediaField] = meta
-		portal.mediaErrorCache[info.ID] = meta
+		portal.cacheFailedMedia(info.ID, meta)
 	}
 	converted.Type = event.EventMessage
-	body := userFriendlyError
-	if body == "" {
-		body = fmt.Sprintf("Failed to bridge media: %v", bridgeErr)
-	}
 	converted.Content = &event.MessageEventContent{
 		MsgType: event.MsgNotice,
 		Body:    body,
@@ -2328,6 +2727,46 @@ func (portal *Portal) makeMediaBridgeFailureMessage(info *types.MessageInfo, bri
 	return converted
 }
 
+// mediaErrorCacheTTL is how long failed media metadata is kept in memory. Older entries are fetched
+// from the placeholder event in the room instead.
+const mediaErrorCacheTTL = 24 * time.Hour
+
+type failedMediaCacheEntry struct {
+	meta  *FailedMediaMeta
+	added time.Time
+}
+
+func (portal *Portal) cacheFailedMedia(msgID types.MessageID, meta *FailedMediaMeta) {
+	portal.mediaErrorCacheLock.Lock()
+	defer portal.mediaErrorCacheLock.Unlock()
+	now := time.Now()
+	for cachedID, entry := range portal.mediaErrorCache {
+		if now.Sub(entry.added) > mediaErrorCacheTTL {
+			delete(portal.mediaErrorCache, cachedID)
+		}
+	}
+	portal.mediaErrorCache[msgID] = &failedMediaCacheEntry{meta: meta, added: now}
+}
+
+func (portal *Portal) getCachedFailedMedia(msgID types.MessageID) *FailedMediaMeta {
+	portal.mediaErrorCacheLock.Lock()
+	defer portal.mediaErrorCacheLock.Unlock()
+	entry, ok := portal.mediaErrorCache[msgID]
+	if !ok {
+		return nil
+	} else if time.Since(entry.added) > mediaErrorCacheTTL {
+		delete(portal.mediaErrorCache, msgID)
+		return nil
+	}
+	return entry.meta
+}
+
+func (portal *Portal) forgetFailedMedia(msgID types.MessageID) {
+	portal.mediaErrorCacheLock.Lock()
+	delete(portal.mediaErrorCache, msgID)
+	portal.mediaErrorCacheLock.Unlock()
+}
+
 func (portal *Portal) encryptFileInPlace(data []byte, mimeType string) (string, *event.EncryptedFileInfo) {
 	if !portal.Encrypted {
 		return mimeType, nil
@@ -2374,8 +2813,65 @@ type MediaMessageWithDuration interface {
 	GetSeconds() uint32
 }
 
+type MediaMessageWithViewOnce interface {
+	MediaMessage
+	GetViewOnce() bool
+}
+
+// applyViewOnceFlag copies the IsViewOnce flag of unwrapped view-once messages to the media message itself,
+// as messages wrapped in ViewOnceMessageV2 don't always set the viewOnce field of the inner media.
+func applyViewOnceFlag(evt *events.Message) {
+	if !evt.IsViewOnce {
+		return
+	}
+	if evt.Message.ImageMessage != nil {
+		evt.Message.ImageMessage.ViewOnce = proto.Bool(true)
+	} else if evt.Message.VideoMessage != nil {
+		evt.Message.VideoMessage.ViewOnce = proto.Bool(true)
+	}
+}
+
+func isViewOnceMedia(waMsg *waProto.Message) bool {
+	return waMsg.GetImageMessage().GetViewOnce() || waMsg.GetVideoMessage().GetViewOnce()
+}
+
+func (portal *Portal) convertDisabledViewOnceMessage(intent *appservice.IntentAPI, waMsg *waProto.Message) *ConvertedMessage {
+	var ctxInfo *waProto.ContextInfo
+	if waMsg.ImageMessage != nil {
+		ctxInfo = waMsg.GetImageMessage().GetContextInfo()
+	} else {
+		ctxInfo = waMsg.GetVideoMessage().GetContextInfo()
+	}
+	return &ConvertedMessage{
+		Intent: intent,
+		Type:   event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    portal.formatNotice(noticeViewOnceNotBridged),
+		},
+		Extra:     map[string]interface{}{"fi.mau.whatsapp.view_once": true},
+		ReplyTo:   GetReply(ctxInfo),
+		ExpiresIn: ctxInfo.GetExpiration(),
+	}
+}
+
 const WhatsAppStickerSize = 190
 
+// WhatsAppStickerUploadSize is the size of the sticker images that WhatsApp clients expect.
+const WhatsAppStickerUploadSize = 512
+
+// scaleStickerSize scales sticker dimensions so that the longer side is WhatsAppStickerSize, keeping the aspect ratio.
+func scaleStickerSize(width, height int) (int, int) {
+	switch {
+	case width <= 0 || height <= 0:
+		return WhatsAppStickerSize, WhatsAppStickerSize
+	case width > height:
+		return WhatsAppStickerSize, height * WhatsAppStickerSize / width
+	default:
+		return width * WhatsAppStickerSize / height, WhatsAppStickerSize
+	}
+}
+
 func (portal *Portal) convertMediaMessageContent(intent *appservice.IntentAPI, msg MediaMessage) *ConvertedMessage {
 	content := &event.MessageEventContent{
 		Info: &event.FileInfo{
@@ -2416,6 +2912,7 @@ func (portal *Portal) convertMediaMessageContent(intent *appservice.IntentAPI, m
 	if ok && videoMessage.GetGifPlayback() {
 		isGIF = true
 		extraContent["info"] = map[string]interface{}{
+			"fi.mau.gif":           true,
 			"fi.mau.loop":          true,
 			"fi.mau.autoplay":      true,
 			"fi.mau.hide_controls": true,
@@ -2423,11 +2920,34 @@ func (portal *Portal) convertMediaMessageContent(intent *appservice.IntentAPI, m
 		}
 	}
 
+	// Document thumbnails are previews of the first page rather than a downscaled copy of the file,
+	// so they're always bridged regardless of the whatsapp_thumbnail option.
+	documentMessage, isDocument := msg.(*waProto.DocumentMessage)
+	if isDocument && documentMessage.GetPageCount() > 0 {
+		extraContent["fi.mau.whatsapp.page_count"] = documentMessage.GetPageCount()
+	}
+
 	messageWithThumbnail, ok := msg.(MediaMessageWithThumbnail)
-	if ok && messageWithThumbnail.GetJpegThumbnail() != nil && (portal.bridge.Config.Bridge.WhatsappThumbnail || isGIF) {
+	var thumbnailCfg image.Config
+	if ok && messageWithThumbnail.GetJpegThumbnail() != nil {
+		switch msg.(type) {
+		case *waProto.ImageMessage, *waProto.VideoMessage:
+			// The thumbnail is tiny, so decoding it fully to compute the blurhash is cheap,
+			// and the dimensions can be taken from the decoded image instead of a separate DecodeConfig pass.
+			thumbnailImg, _, err := image.Decode(bytes.NewReader(messageWithThumbnail.GetJpegThumbnail()))
+			if err != nil {
+				portal.log.Debugfln("Failed to decode thumbnail for blurhash: %v", err)
+			} else {
+				thumbnailCfg.Width, thumbnailCfg.Height = thumbnailImg.Bounds().Dx(), thumbnailImg.Bounds().Dy()
+				addBlurhash(extraContent, thumbnailImg)
+			}
+		default:
+			thumbnailCfg, _, _ = image.DecodeConfig(bytes.NewReader(messageWithThumbnail.GetJpegThumbnail()))
+		}
+	}
+	if ok && messageWithThumbnail.GetJpegThumbnail() != nil && (portal.bridge.Config.Bridge.WhatsappThumbnail || isGIF || isDocument) {
 		thumbnailData := messageWithThumbnail.GetJpegThumbnail()
 		thumbnailMime := http.DetectContentType(thumbnailData)
-		thumbnailCfg, _, _ := image.DecodeConfig(bytes.NewReader(thumbnailData))
 		thumbnailSize := len(thumbnailData)
 		thumbnailUploadMime, thumbnailFile := portal.encryptFileInPlace(thumbnailData, thumbnailMime)
 		uploadedThumbnail, err := intent.UploadBytes(thumbnailData, thumbnailUploadMime)
@@ -2455,15 +2975,9 @@ func (portal *Portal) convertMediaMessageContent(intent *appservice.IntentAPI, m
 		content.MsgType = event.MsgImage
 	case *waProto.StickerMessage:
 		eventType = event.EventSticker
-		if content.Info.Width > content.Info.Height {
-			content.Info.Height /= content.Info.Width / WhatsAppStickerSize
-			content.Info.Width = WhatsAppStickerSize
-		} else if content.Info.Width < content.Info.Height {
-			content.Info.Width /= content.Info.Height / WhatsAppStickerSize
-			content.Info.Height = WhatsAppStickerSize
-		} else {
-			content.Info.Width = WhatsAppStickerSize
-			content.Info.Height = WhatsAppStickerSize
+		content.Info.Width, content.Info.Height = scaleStickerSize(content.Info.Width, content.Info.Height)
+		if msg.(*waProto.StickerMessage).GetIsAnimated() {
+			extraContent["fi.mau.whatsapp.animated_sticker"] = true
 		}
 	case *waProto.VideoMessage:
 		content.MsgType = event.MsgVideo
@@ -2478,41 +2992,40 @@ func (portal *Portal) convertMediaMessageContent(intent *appservice.IntentAPI, m
 
 	audioMessage, ok := msg.(*waProto.AudioMessage)
 	if ok {
-		var waveform []int
-		if audioMessage.Waveform != nil {
-			waveform = make([]int, len(audioMessage.Waveform))
-			max := 0
-			for i, part := range audioMessage.Waveform {
-				waveform[i] = int(part)
-				if waveform[i] > max {
-					max = waveform[i]
-				}
-			}
-			multiplier := 0
-			if max > 0 {
-				multiplier = 1024 / max
-			}
-			if multiplier > 32 {
-				multiplier = 32
-			}
-			for i := range waveform {
-				waveform[i] *= multiplier
-			}
-		}
 		extraContent["org.matrix.msc1767.audio"] = map[string]interface{}{
 			"duration": int(audioMessage.GetSeconds()) * 1000,
-			"waveform": waveform,
+			"waveform": convertWaveformToMatrix(audioMessage.Waveform),
 		}
 		if audioMessage.GetPtt() {
 			extraContent["org.matrix.msc3245.voice"] = map[string]interface{}{}
 		}
 	}
 
+	viewOnceMessage, ok := msg.(MediaMessageWithViewOnce)
+	isViewOnce := ok && viewOnceMessage.GetViewOnce()
+	if isViewOnce {
+		extraContent["fi.mau.whatsapp.view_once"] = true
+		extraContent["page.codeberg.everypizza.msc4193.spoiler"] = true
+	}
+
 	messageWithCaption, ok := msg.(MediaMessageWithCaption)
 	var captionContent *event.MessageEventContent
-	if ok && len(messageWithCaption.GetCaption()) > 0 {
+	var caption string
+	if ok {
+		caption = messageWithCaption.GetCaption()
+	}
+	if isDocument && documentMessage.GetPageCount() > 0 {
+		// Use WhatsApp formatting so the page count is italicized by the formatter below
+		pageCount := fmt.Sprintf("_%s_", formatPageCount(documentMessage.GetPageCount()))
+		if len(caption) > 0 {
+			caption = fmt.Sprintf("%s\n\n%s", caption, pageCount)
+		} else {
+			caption = pageCount
+		}
+	}
+	if len(caption) > 0 {
 		captionContent = &event.MessageEventContent{
-			Body:    messageWithCaption.GetCaption(),
+			Body:    caption,
 			MsgType: event.MsgNotice,
 		}
 
@@ -2526,16 +3039,34 @@ func (portal *Portal) convertMediaMessageContent(intent *appservice.IntentAPI, m
 		Caption:   captionContent,
 		ReplyTo:   GetReply(msg.GetContextInfo()),
 		ExpiresIn: msg.GetContextInfo().GetExpiration(),
+		ViewOnce:  isViewOnce,
 		Extra:     extraContent,
 	}
 }
 
+// convertIncomingMedia converts media from WhatsApp into formats that Matrix clients can play, if enabled in the config.
+// The original data is returned if no conversion is needed or the conversion fails.
+func (portal *Portal) convertIncomingMedia(data []byte, content *event.MessageEventContent) []byte {
+	format := portal.bridge.Config.Bridge.MediaConversion.IncomingVoiceFormat
+	if format == "" || content.MsgType != event.MsgAudio || !strings.HasPrefix(content.Info.MimeType, "audio/ogg") {
+		return data
+	}
+	converted, mimeType, err := portal.bridge.Transcoder.convertIncomingVoice(context.Background(), data, format)
+	if err != nil {
+		portal.log.Warnfln("Failed to convert voice message to %s, bridging original file: %v", format, err)
+		return data
+	}
+	content.Info.MimeType = mimeType
+	return converted
+}
+
 func (portal *Portal) uploadMedia(intent *appservice.IntentAPI, data []byte, content *event.MessageEventContent) error {
 	uploadMimeType, file := portal.encryptFileInPlace(data, content.Info.MimeType)
 
 	req := mautrix.ReqUploadMedia{
-		ContentBytes: data,
-		ContentType:  uploadMimeType,
+		Content:       newProgressReader(bytes.NewReader(data), int64(len(data)), portal.log, "Uploading media to homeserver"),
+		ContentLength: int64(len(data)),
+		ContentType:   uploadMimeType,
 	}
 	var mxc id.ContentURI
 	if portal.bridge.Config.Homeserver.AsyncMedia {
@@ -2569,6 +3100,35 @@ func (portal *Portal) uploadMedia(intent *appservice.IntentAPI, data []byte, con
 
 func (portal *Portal) convertMediaMessage(intent *appservice.IntentAPI, source *User, info *types.MessageInfo, msg MediaMessage, typeName string, isBackfill bool) *ConvertedMessage {
 	converted := portal.convertMediaMessageContent(intent, msg)
+	if limit := portal.bridge.incomingMediaSizeLimit(); limit > 0 && int64(msg.GetFileLength()) > limit {
+		return portal.makeMediaTooLargeMessage(source, info, msg, converted, fmt.Sprintf("file is larger than the limit of %s", formatFileSize(limit)))
+	}
+	// Media that needs to be converted or analyzed is downloaded normally, as that can't be done on the fly
+	if !portal.directMediaNeedsData(converted) {
+		if mxc, ok := portal.makeDirectMediaURI(source, msg); ok {
+			converted.Content.URL = mxc
+			return converted
+		}
+	}
+	if isBackfill && portal.bridge.Config.Bridge.HistorySync.DeferredMedia.Enabled && len(msg.GetDirectPath()) > 0 {
+		converted.MediaDeferred = true
+		return portal.makeMediaPlaceholderMessage(info, converted, &FailedMediaKeys{
+			Key:        msg.GetMediaKey(),
+			Length:     int(msg.GetFileLength()),
+			Type:       whatsmeow.GetMediaType(msg),
+			SHA256:     msg.GetFileSha256(),
+			EncSHA256:  msg.GetFileEncSha256(),
+			DirectPath: msg.GetDirectPath(),
+		}, fmt.Sprintf("Loading %s...", typeName))
+	}
+	// The encrypted download, the decrypted copy and the re-encrypted upload may all be in memory at once.
+	ctx, cancel := context.WithTimeout(context.Background(), mediaMemoryWaitTimeout)
+	releaseMemory, err := portal.bridge.MediaMemory.Acquire(ctx, int64(msg.GetFileLength())*2)
+	cancel()
+	if err != nil {
+		return portal.makeMediaBridgeFailureMessage(info, err, converted, nil, "")
+	}
+	defer releaseMemory()
 	data, err := source.Client.Download(msg)
 	if errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) {
 		converted.Error = database.MsgErrMediaNotFound
@@ -2577,6 +3137,8 @@ func (portal *Portal) convertMediaMessage(intent *appservice.IntentAPI, source *
 		errorText := fmt.Sprintf("Old %s.", typeName)
 		if portal.bridge.Config.Bridge.HistorySync.MediaRequests.AutoRequestMedia && isBackfill {
 			errorText += " Media will be automatically requested from your phone later."
+		} else if portal.bridge.Config.Bridge.RequestExpiredMedia && !isBackfill {
+			errorText += " Requesting media from your phone, it will appear here once your phone re-uploads it."
 		} else {
 			errorText += " React with the \u267b (recycle) emoji to request this media from your phone."
 		}
@@ -2591,28 +3153,41 @@ func (portal *Portal) convertMediaMessage(intent *appservice.IntentAPI, source *
 	} else if errors.Is(err, whatsmeow.ErrNoURLPresent) {
 		portal.log.Debugfln("No URL present error for media message %s, ignoring...", info.ID)
 		return nil
-	} else if errors.Is(err, whatsmeow.ErrFileLengthMismatch) || errors.Is(err, whatsmeow.ErrInvalidMediaSHA256) {
+	}
+	checksumMismatch := errors.Is(err, whatsmeow.ErrFileLengthMismatch) || errors.Is(err, whatsmeow.ErrInvalidMediaSHA256)
+	if checksumMismatch {
 		portal.log.Warnfln("Mismatching media checksums in %s: %v. Ignoring because WhatsApp seems to ignore them too", info.ID, err)
 	} else if err != nil {
 		return portal.makeMediaBridgeFailureMessage(info, err, converted, nil, "")
 	}
 
+	dataHash := sha256.Sum256(data)
+	portal.generateIncomingThumbnail(intent, data, converted)
+	portal.fillMissingAudioInfo(data, converted)
+	if portal.reuseUploadedMedia(dataHash[:], converted) {
+		return converted
+	}
+	data = portal.convertIncomingMedia(data, converted.Content)
 	err = portal.uploadMedia(intent, data, converted.Content)
 	if err != nil {
 		if errors.Is(err, mautrix.MTooLarge) {
-			return portal.makeMediaBridgeFailureMessage(info, errors.New("homeserver rejected too large file"), converted, nil, "")
+			return portal.makeMediaTooLargeMessage(source, info, msg, converted, "homeserver rejected too large file")
 		} else if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.IsStatus(413) {
-			return portal.makeMediaBridgeFailureMessage(info, errors.New("proxy rejected too large file"), converted, nil, "")
+			return portal.makeMediaTooLargeMessage(source, info, msg, converted, "proxy rejected too large file")
 		} else {
 			return portal.makeMediaBridgeFailureMessage(info, fmt.Errorf("failed to upload media: %w", err), converted, nil, "")
 		}
 	}
+	if !checksumMismatch {
+		// Files that don't match the sender's checksums aren't reused, as they may not be what the sender intended
+		portal.storeUploadedMedia(dataHash[:], converted.Content)
+	}
 	return converted
 }
 
 func (portal *Portal) fetchMediaRetryEvent(msg *database.Message) (*FailedMediaMeta, error) {
-	errorMeta, ok := portal.mediaErrorCache[msg.JID]
-	if ok {
+	errorMeta := portal.getCachedFailedMedia(msg.JID)
+	if errorMeta != nil {
 		return errorMeta, nil
 	}
 	evt, err := portal.MainIntent().GetEvent(portal.MXID, msg.MXID)
@@ -2647,9 +3222,13 @@ func (portal *Portal) fetchMediaRetryEvent(msg *database.Message) (*FailedMediaM
 }
 
 func (portal *Portal) sendMediaRetryFailureEdit(intent *appservice.IntentAPI, msg *database.Message, err error) {
+	portal.sendMediaNoticeEdit(intent, msg, fmt.Sprintf("Failed to bridge media after re-requesting it from your phone: %v", err))
+}
+
+func (portal *Portal) sendMediaNoticeEdit(intent *appservice.IntentAPI, msg *database.Message, body string) {
 	content := event.MessageEventContent{
 		MsgType: event.MsgNotice,
-		Body:    fmt.Sprintf("Failed to bridge media after re-requesting it from your phone: %v", err),
+		Body:    body,
 	}
 	contentCopy := content
 	content.NewContent = &contentCopy
@@ -2659,11 +3238,10 @@ func (portal *Portal) sendMediaRetryFailureEdit(intent *appservice.IntentAPI, ms
 	}
 	resp, sendErr := portal.sendMessage(intent, event.EventMessage, &content, nil, time.Now().UnixMilli())
 	if sendErr != nil {
-		portal.log.Warnfln("Failed to edit %s after retry failure for %s: %v", msg.MXID, msg.JID, sendErr)
+		portal.log.Warnfln("Failed to edit %s with media notice for %s: %v", msg.MXID, msg.JID, sendErr)
 	} else {
-		portal.log.Debugfln("Successfully edited %s -> %s after retry failure for %s", msg.MXID, resp.EventID, msg.JID)
+		portal.log.Debugfln("Successfully edited %s -> %s with media notice for %s", msg.MXID, resp.EventID, msg.JID)
 	}
-
 }
 
 func (portal *Portal) handleMediaRetry(retry *events.MediaRetry, source *User) {
@@ -2719,12 +3297,18 @@ func (portal *Portal) handleMediaRetry(retry *events.MediaRetry, source *User) {
 		portal.sendMediaRetryFailureEdit(intent, msg, err)
 		return
 	}
+	data = portal.convertIncomingMedia(data, meta.Content)
 	err = portal.uploadMedia(intent, data, meta.Content)
 	if err != nil {
 		portal.log.Warnfln("Failed to re-upload media for %s after retry notification: %v", retry.MessageID, err)
 		portal.sendMediaRetryFailureEdit(intent, msg, fmt.Errorf("re-uploading media failed: %v", err))
 		return
 	}
+	portal.sendMediaReplacement(intent, msg, meta, "retry notification")
+}
+
+// sendMediaReplacement edits a media placeholder message into the successfully uploaded media in meta.
+func (portal *Portal) sendMediaReplacement(intent *appservice.IntentAPI, msg *database.Message, meta *FailedMediaMeta, reason string) bool {
 	replaceContent := &event.MessageEventContent{
 		MsgType:    meta.Content.MsgType,
 		Body:       "* " + meta.Content.Body,
@@ -2740,11 +3324,13 @@ func (portal *Portal) handleMediaRetry(retry *events.MediaRetry, source *User) {
 	}
 	resp, err := portal.sendMessage(intent, meta.Type, replaceContent, meta.ExtraContent, time.Now().UnixMilli())
 	if err != nil {
-		portal.log.Warnfln("Failed to edit %s after retry notification for %s: %v", msg.MXID, retry.MessageID, err)
-		return
+		portal.log.Warnfln("Failed to edit %s after %s for %s: %v", msg.MXID, reason, msg.JID, err)
+		return false
 	}
-	portal.log.Debugfln("Successfully edited %s -> %s after retry notification for %s", msg.MXID, resp.EventID, retry.MessageID)
+	portal.log.Debugfln("Successfully edited %s -> %s after %s for %s", msg.MXID, resp.EventID, reason, msg.JID)
 	msg.UpdateMXID(nil, resp.EventID, database.MsgNormal, database.MsgNoError)
+	portal.forgetFailedMedia(msg.JID)
+	return true
 }
 
 func (portal *Portal) requestMediaRetry(user *User, eventID id.EventID, mediaKey []byte) (bool, error) {
@@ -2786,6 +3372,20 @@ func (portal *Portal) requestMediaRetry(user *User, eventID id.EventID, mediaKey
 	return true, err
 }
 
+// requestExpiredMedia asks the sender's phone to re-upload the media of a new message that has already expired
+// on the WhatsApp servers. The placeholder is edited in handleMediaRetry once the retry notification arrives.
+func (portal *Portal) requestExpiredMedia(source *User, info *types.MessageInfo, mediaKey []byte) {
+	if source.Client == nil {
+		return
+	}
+	err := source.Client.SendMediaRetryReceipt(info, mediaKey)
+	if err != nil {
+		portal.log.Warnfln("Failed to send media retry request for expired media in %s: %v", info.ID, err)
+	} else {
+		portal.log.Debugfln("Sent media retry request for expired media in %s", info.ID)
+	}
+}
+
 const thumbnailMaxSize = 72
 const thumbnailMinSize = 24
 
@@ -2839,16 +3439,21 @@ func createThumbnail(source []byte, png bool) ([]byte, error) {
 	return data, err
 }
 
-func (portal *Portal) downloadThumbnail(ctx context.Context, original []byte, thumbnailURL id.ContentURIString, eventID id.EventID, png bool) ([]byte, error) {
-	if len(thumbnailURL) == 0 {
+func (portal *Portal) downloadThumbnail(ctx context.Context, original []byte, info *event.FileInfo, mediaType whatsmeow.MediaType, eventID id.EventID, png bool) ([]byte, error) {
+	if len(info.ThumbnailURL) == 0 && info.ThumbnailFile == nil {
 		// just fall back to making thumbnail of original
-	} else if mxc, err := thumbnailURL.Parse(); err != nil {
-		portal.log.Warnfln("Malformed thumbnail URL in %s: %v (falling back to generating thumbnail from source)", eventID, err)
-	} else if thumbnail, err := portal.MainIntent().DownloadBytesContext(ctx, mxc); err != nil {
+	} else if thumbnail, err := portal.downloadMatrixMedia(ctx, &event.MessageEventContent{URL: info.ThumbnailURL, File: info.ThumbnailFile}); err != nil {
 		portal.log.Warnfln("Failed to download thumbnail in %s: %v (falling back to generating thumbnail from source)", eventID, err)
 	} else {
 		return createThumbnail(thumbnail, png)
 	}
+	if mediaType == whatsmeow.MediaVideo {
+		frame, err := portal.bridge.Transcoder.extractVideoFrame(ctx, original, thumbnailMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		return createThumbnail(frame, png)
+	}
 	return createThumbnail(original, png)
 }
 
@@ -2881,7 +3486,7 @@ func (img *PaddedImage) At(x, y int) color.Color {
 	return img.Image.At(x+img.OffsetX, y+img.OffsetY)
 }
 
-func (portal *Portal) convertToWebP(img []byte) ([]byte, error) {
+func convertToWebP(img []byte) ([]byte, error) {
 	decodedImg, _, err := image.Decode(bytes.NewReader(img))
 	if err != nil {
 		return img, fmt.Errorf("failed to decode image: %w", err)
@@ -2904,6 +3509,11 @@ func (portal *Portal) convertToWebP(img []byte) ([]byte, error) {
 		}
 		decodedImg = paddedImg
 	}
+	if size := decodedImg.Bounds().Dx(); size != WhatsAppStickerUploadSize {
+		scaledImg := image.NewRGBA(image.Rect(0, 0, WhatsAppStickerUploadSize, WhatsAppStickerUploadSize))
+		draw.CatmullRom.Scale(scaledImg, scaledImg.Bounds(), decodedImg, decodedImg.Bounds(), draw.Src, nil)
+		decodedImg = scaledImg
+	}
 
 	var webpBuffer bytes.Buffer
 	if err = webp.Encode(&webpBuffer, decodedImg, nil); err != nil {
@@ -2913,21 +3523,8 @@ func (portal *Portal) convertToWebP(img []byte) ([]byte, error) {
 	return webpBuffer.Bytes(), nil
 }
 
-func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, relaybotFormatted bool, content *event.MessageEventContent, eventID id.EventID, mediaType whatsmeow.MediaType) (*MediaUpload, error) {
-	fileName := content.Body
-	var caption string
-	var mentionedJIDs []string
-	var hasHTMLCaption bool
-	isSticker := string(content.MsgType) == event.EventSticker.Type
-	if content.FileName != "" && content.Body != content.FileName {
-		fileName = content.FileName
-		caption = content.Body
-		hasHTMLCaption = content.Format == event.FormatHTML
-	}
-	if relaybotFormatted || hasHTMLCaption {
-		caption, mentionedJIDs = portal.bridge.Formatter.ParseMatrix(content.FormattedBody)
-	}
-
+// downloadMatrixMedia downloads and decrypts the file of a Matrix media message.
+func (portal *Portal) downloadMatrixMedia(ctx context.Context, content *event.MessageEventContent) ([]byte, error) {
 	var file *event.EncryptedFileInfo
 	rawMXC := content.URL
 	if content.File != nil {
@@ -2938,7 +3535,11 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 	if err != nil {
 		return nil, err
 	}
-	data, err := portal.MainIntent().DownloadBytesContext(ctx, mxc)
+	var expectedSize int64
+	if content.Info != nil {
+		expectedSize = int64(content.Info.Size)
+	}
+	data, err := portal.downloadMatrixMediaLimited(ctx, mxc, expectedSize, portal.bridge.outgoingMediaSizeLimit())
 	if err != nil {
 		return nil, util.NewDualError(errMediaDownloadFailed, err)
 	}
@@ -2948,29 +3549,65 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 			return nil, util.NewDualError(errMediaDecryptFailed, err)
 		}
 	}
+	return data, nil
+}
+
+func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, relaybotFormatted bool, content *event.MessageEventContent, evt *event.Event, mediaType whatsmeow.MediaType) (*MediaUpload, error) {
+	fileName := content.Body
+	var caption string
+	var mentionedJIDs []string
+	var hasHTMLCaption bool
+	isSticker := string(content.MsgType) == event.EventSticker.Type
+	if content.FileName != "" && content.Body != content.FileName {
+		fileName = content.FileName
+		caption = content.Body
+		hasHTMLCaption = content.Format == event.FormatHTML
+	}
+	if relaybotFormatted || hasHTMLCaption {
+		caption, mentionedJIDs = portal.bridge.Formatter.ParseMatrix(content.FormattedBody)
+	}
+
+	// The downloaded file and the encrypted copy made by whatsmeow are both in memory during the upload.
+	// The size in the event is set by the sender, so don't trust it beyond the limit that the download is capped at.
+	expectedSize := int64(content.GetInfo().Size)
+	if maxSize := portal.bridge.outgoingMediaSizeLimit(); expectedSize <= 0 || expectedSize > maxSize {
+		expectedSize = maxSize
+	}
+	releaseMemory, err := portal.bridge.MediaMemory.Acquire(ctx, expectedSize*2)
+	if err != nil {
+		return nil, util.NewDualError(errMediaDownloadFailed, err)
+	}
+	defer releaseMemory()
+	data, err := portal.downloadMatrixMedia(ctx, content)
+	if err != nil {
+		return nil, err
+	}
 	mimeType := content.GetInfo().MimeType
 	var convertErr error
+	var isAnimated bool
+	_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
 	// Allowed mime types from https://developers.facebook.com/docs/whatsapp/on-premises/reference/media
+	transcoder := portal.bridge.Transcoder
 	switch {
 	case isSticker:
 		if mimeType != "image/webp" || content.Info.Width != content.Info.Height {
-			data, convertErr = portal.convertToWebP(data)
+			data, isAnimated, convertErr = transcoder.convertStickerToWebP(ctx, data, mimeType)
 			content.Info.MimeType = "image/webp"
 		}
 	case mediaType == whatsmeow.MediaVideo:
-		switch mimeType {
-		case "video/mp4", "video/3gpp":
-			// Allowed
-		case "image/gif":
-			data, convertErr = ffmpeg.ConvertBytes(ctx, data, ".mp4", []string{"-f", "gif"}, []string{
-				"-pix_fmt", "yuv420p", "-c:v", "libx264", "-movflags", "+faststart",
-				"-filter:v", "crop='floor(in_w/2)*2:floor(in_h/2)*2'",
-			}, mimeType)
-			content.Info.MimeType = "video/mp4"
-		case "video/webm":
-			data, convertErr = ffmpeg.ConvertBytes(ctx, data, ".mp4", []string{"-f", "webm"}, []string{
-				"-pix_fmt", "yuv420p", "-c:v", "libx264",
-			}, mimeType)
+		switch {
+		case mimeType == "video/mp4", mimeType == "video/3gpp":
+			// The container is allowed, but not all WhatsApp clients can play codecs other than H.264
+			codec, err := transcoder.probeVideoCodec(ctx, data)
+			if err != nil {
+				portal.log.Debugfln("Failed to check video codec of %s, sending it as-is: %v", evt.ID, err)
+			} else if codec != "h264" {
+				portal.log.Debugfln("Converting %s video in %s to H.264", codec, evt.ID)
+				data, convertErr = transcoder.convertVideoToH264(ctx, data, mimeType)
+				content.Info.MimeType = "video/mp4"
+			}
+		case mimeType == "image/gif", strings.HasPrefix(mimeType, "video/"):
+			data, convertErr = transcoder.convertVideoToH264(ctx, data, mimeType)
 			content.Info.MimeType = "video/mp4"
 		default:
 			return nil, fmt.Errorf("%w %q in video message", errMediaUnsupportedType, mimeType)
@@ -2982,16 +3619,26 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 		case "image/webp":
 			data, convertErr = portal.convertWebPtoPNG(data)
 			content.Info.MimeType = "image/png"
+		case "image/heic", "image/heif", "image/avif":
+			data, convertErr = transcoder.convertImageToJPEG(ctx, data)
+			content.Info.MimeType = "image/jpeg"
 		default:
 			return nil, fmt.Errorf("%w %q in image message", errMediaUnsupportedType, mimeType)
 		}
+	case mediaType == whatsmeow.MediaAudio && isVoice && mimeType != "audio/ogg; codecs=opus":
+		// WhatsApp only shows Opus-in-OGG files as voice notes
+		data, convertErr = transcoder.convertVoiceToOpus(ctx, data)
+		content.Info.MimeType = "audio/ogg; codecs=opus"
 	case mediaType == whatsmeow.MediaAudio:
-		switch mimeType {
-		case "audio/aac", "audio/mp4", "audio/amr", "audio/mpeg", "audio/ogg; codecs=opus":
+		switch {
+		case mimeType == "audio/aac", mimeType == "audio/mp4", mimeType == "audio/amr", mimeType == "audio/mpeg", mimeType == "audio/ogg; codecs=opus":
 			// Allowed
-		case "audio/ogg":
+		case mimeType == "audio/ogg":
 			// Hopefully it's opus already
 			content.Info.MimeType = "audio/ogg; codecs=opus"
+		case strings.HasPrefix(mimeType, "audio/"):
+			data, convertErr = transcoder.convertAudioToOpus(ctx, data)
+			content.Info.MimeType = "audio/ogg; codecs=opus"
 		default:
 			return nil, fmt.Errorf("%w %q in audio message", errMediaUnsupportedType, mimeType)
 		}
@@ -3006,6 +3653,18 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 			portal.log.Warnfln("Failed to re-encode %s media: %v, continuing with original file", mimeType, convertErr)
 		}
 	}
+	var waveform []byte
+	var audioDuration int
+	if mediaType == whatsmeow.MediaAudio {
+		needsDuration := getUnstableAudioDuration(content, evt.Content.Raw) == 0
+		needsWaveform := isVoice && len(getUnstableWaveform(evt.Content.Raw)) == 0 && portal.bridge.Config.Bridge.AudioWaveforms
+		if needsDuration || needsWaveform {
+			waveform, audioDuration, err = transcoder.generateVoiceWaveform(ctx, data)
+			if err != nil {
+				portal.log.Warnfln("Failed to analyze audio in %s to find duration and waveform: %v", evt.ID, err)
+			}
+		}
+	}
 	uploadResp, err := sender.Client.Upload(ctx, data, mediaType)
 	if err != nil {
 		return nil, util.NewDualError(errMediaWhatsAppUploadFailed, err)
@@ -3014,10 +3673,21 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 	// Audio doesn't have thumbnails
 	var thumbnail []byte
 	if mediaType != whatsmeow.MediaAudio {
-		thumbnail, err = portal.downloadThumbnail(ctx, data, content.GetInfo().ThumbnailURL, eventID, isSticker)
+		thumbnail, err = portal.downloadThumbnail(ctx, data, content.GetInfo(), mediaType, evt.ID, isSticker)
 		// Ignore format errors for non-image files, we don't care about those thumbnails
 		if err != nil && (!errors.Is(err, image.ErrFormat) || mediaType == whatsmeow.MediaImage) {
-			portal.log.Warnfln("Failed to generate thumbnail for %s: %v", eventID, err)
+			portal.log.Warnfln("Failed to generate thumbnail for %s: %v", evt.ID, err)
+		}
+	}
+	var preview *DocumentPreview
+	if mediaType == whatsmeow.MediaDocument && isPDFDocument(content.GetInfo(), fileName) {
+		preview, err = transcoder.renderPDFPreview(ctx, data)
+		if errors.Is(err, errPopplerNotFound) {
+			portal.log.Debugfln("Not generating document preview for %s: %v", evt.ID, err)
+		} else if err != nil {
+			portal.log.Warnfln("Failed to generate document preview for %s: %v", evt.ID, err)
+		} else {
+			thumbnail = preview.Image
 		}
 	}
 
@@ -3028,6 +3698,10 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 		MentionedJIDs:  mentionedJIDs,
 		Thumbnail:      thumbnail,
 		FileLength:     len(data),
+		IsAnimated:     isAnimated,
+		Waveform:       waveform,
+		Duration:       audioDuration,
+		Preview:        preview,
 	}, nil
 }
 
@@ -3038,6 +3712,12 @@ type MediaUpload struct {
 	MentionedJIDs []string
 	Thumbnail     []byte
 	FileLength    int
+	IsAnimated    bool
+	// Waveform and Duration (in milliseconds) are only generated for audio messages that don't have them
+	Waveform []byte
+	Duration int
+	// Preview is only rendered for PDF documents
+	Preview *DocumentPreview
 }
 
 func (portal *Portal) addRelaybotFormat(sender *User, content *event.MessageEventContent) bool {
@@ -3087,6 +3767,22 @@ func parseGeoURI(uri string) (lat, long float64, err error) {
 	return
 }
 
+// isMatrixGIF checks if a Matrix image or video should be sent as a WhatsApp GIF, i.e. an autoplaying looped MP4.
+// Besides actual GIF files, this includes videos that other bridges and clients flag as GIFs.
+func isMatrixGIF(evt *event.Event, content *event.MessageEventContent) bool {
+	if content.GetInfo().MimeType == "image/gif" {
+		return true
+	}
+	info, ok := evt.Content.Raw["info"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	isGIF, _ := info["fi.mau.gif"].(bool)
+	autoplay, _ := info["fi.mau.autoplay"].(bool)
+	loop, _ := info["fi.mau.loop"].(bool)
+	return isGIF || (autoplay && loop)
+}
+
 func getUnstableWaveform(content map[string]interface{}) []byte {
 	audioInfo, ok := content["org.matrix.msc1767.audio"].(map[string]interface{})
 	if !ok {
@@ -3101,7 +3797,8 @@ func getUnstableWaveform(content map[string]interface{}) []byte {
 	for i, part := range waveform {
 		val, ok = part.(float64)
 		if ok {
-			output[i] = byte(val / 4)
+			// MSC1767 waveforms go up to 1024, WhatsApp ones only up to 100
+			output[i] = byte(math.Min(val, 1024) * voiceWaveformMax / 1024)
 		}
 	}
 	return output
@@ -3113,32 +3810,65 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		return nil, sender, fmt.Errorf("%w %T", errUnexpectedParsedContentType, evt.Content.Parsed)
 	}
 
+	var editTargetID id.EventID
+	if content.RelatesTo != nil && content.RelatesTo.Type == event.RelReplace {
+		editTargetID = content.RelatesTo.EventID
+		if content.NewContent != nil {
+			content = content.NewContent
+		}
+	}
+
 	var msg waProto.Message
 	var ctxInfo waProto.ContextInfo
+	var replyInteractive *database.InteractiveMessage
 	replyToID := content.GetReplyTo()
+	if len(replyToID) == 0 && portal.bridge.Config.Bridge.RepliesAsThreads && content.RelatesTo != nil && content.RelatesTo.Type == event.RelThread {
+		// Thread messages without an explicit reply are sent as quotes of the thread root
+		replyToID = content.RelatesTo.EventID
+	}
 	if len(replyToID) > 0 {
 		replyToMsg := portal.bridge.DB.Message.GetByMXID(replyToID)
 		if replyToMsg != nil && !replyToMsg.IsFakeJID() && replyToMsg.Type == database.MsgNormal {
 			ctxInfo.StanzaId = &replyToMsg.JID
 			ctxInfo.Participant = proto.String(replyToMsg.Sender.ToNonAD().String())
-			// Using blank content here seems to work fine on all official WhatsApp apps.
-			//
-			// We could probably invent a slightly more accurate version of the quoted message
-			// by fetching the Matrix event and converting it to the WhatsApp format, but that's
-			// a lot of work and this works fine.
-			ctxInfo.QuotedMessage = &waProto.Message{Conversation: proto.String("")}
+			ctxInfo.QuotedMessage = portal.makeQuotedMessage(ctx, replyToID)
+			if portal.IsBroadcastList() {
+				ctxInfo.RemoteJid = proto.String(portal.Key.JID.String())
+			}
+			replyInteractive = portal.bridge.DB.InteractiveMessage.GetByJID(portal.Key, replyToMsg.JID)
 		}
 	}
 	if portal.ExpirationTime != 0 {
 		ctxInfo.Expiration = proto.Uint32(portal.ExpirationTime)
 	}
+	if portal.bridge.Config.Bridge.MarkResentAsForwarded {
+		setForwardedFlag(&ctxInfo, evt)
+	}
+	if evt.Type != event.EventSticker {
+		portal.replaceTooLargeMatrixMedia(content)
+	}
 	relaybotFormatted := false
+	isRelayed := false
 	if !sender.IsLoggedIn() || (portal.IsPrivateChat() && sender.JID.User != portal.Key.Receiver.User) {
 		if !portal.HasRelaybot() {
 			return nil, sender, errUserNotLoggedIn
 		}
 		relaybotFormatted = portal.addRelaybotFormat(sender, content)
 		sender = portal.GetRelayUser()
+		isRelayed = true
+	}
+	if err := portal.checkAnnouncePermission(sender); err != nil {
+		return nil, sender, err
+	}
+	var editTarget *database.Message
+	if len(editTargetID) > 0 {
+		var err error
+		editTarget, err = portal.getMatrixEditTarget(sender, evt, editTargetID, isRelayed)
+		if err != nil {
+			return nil, sender, err
+		} else if content.MsgType != event.MsgText && content.MsgType != event.MsgEmote && content.MsgType != event.MsgNotice {
+			return nil, sender, errEditUnsupportedType
+		}
 	}
 	if evt.Type == event.EventSticker {
 		if relaybotFormatted {
@@ -3164,6 +3894,11 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		if content.MsgType == event.MsgEmote && !relaybotFormatted {
 			text = "/me " + text
 		}
+		if replyInteractive != nil && content.MsgType == event.MsgText && !relaybotFormatted {
+			if option := replyInteractive.Match(text); option != nil {
+				return convertInteractiveReply(replyInteractive, option, &ctxInfo), sender, nil
+			}
+		}
 		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{
 			Text:        &text,
 			ContextInfo: &ctxInfo,
@@ -3178,7 +3913,7 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			msg.Conversation = &text
 		}
 	case event.MsgImage:
-		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt.ID, whatsmeow.MediaImage)
+		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt, whatsmeow.MediaImage)
 		if media == nil {
 			return nil, sender, err
 		}
@@ -3195,7 +3930,7 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			FileLength:    proto.Uint64(uint64(media.FileLength)),
 		}
 	case event.MessageType(event.EventSticker.Type):
-		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt.ID, whatsmeow.MediaImage)
+		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt, whatsmeow.MediaImage)
 		if media == nil {
 			return nil, sender, err
 		}
@@ -3209,10 +3944,13 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			FileEncSha256: media.FileEncSHA256,
 			FileSha256:    media.FileSHA256,
 			FileLength:    proto.Uint64(uint64(media.FileLength)),
+			Width:         proto.Uint32(WhatsAppStickerUploadSize),
+			Height:        proto.Uint32(WhatsAppStickerUploadSize),
+			IsAnimated:    proto.Bool(media.IsAnimated),
 		}
 	case event.MsgVideo:
-		gifPlayback := content.GetInfo().MimeType == "image/gif"
-		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt.ID, whatsmeow.MediaVideo)
+		gifPlayback := isMatrixGIF(evt, content)
+		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt, whatsmeow.MediaVideo)
 		if media == nil {
 			return nil, sender, err
 		}
@@ -3232,11 +3970,14 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			FileLength:    proto.Uint64(uint64(media.FileLength)),
 		}
 	case event.MsgAudio:
-		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt.ID, whatsmeow.MediaAudio)
+		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt, whatsmeow.MediaAudio)
 		if media == nil {
 			return nil, sender, err
 		}
-		duration := uint32(content.GetInfo().Duration / 1000)
+		duration := uint32(getUnstableAudioDuration(content, evt.Content.Raw) / 1000)
+		if duration == 0 {
+			duration = uint32(media.Duration / 1000)
+		}
 		msg.AudioMessage = &waProto.AudioMessage{
 			ContextInfo:   &ctxInfo,
 			Url:           &media.URL,
@@ -3250,12 +3991,35 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		_, isMSC3245Voice := evt.Content.Raw["org.matrix.msc3245.voice"]
 		if isMSC3245Voice {
 			msg.AudioMessage.Waveform = getUnstableWaveform(evt.Content.Raw)
+			if len(msg.AudioMessage.Waveform) == 0 {
+				msg.AudioMessage.Waveform = media.Waveform
+			}
 			msg.AudioMessage.Ptt = proto.Bool(true)
 			// hacky hack to add the codecs param that whatsapp seems to require
 			msg.AudioMessage.Mimetype = proto.String(addCodecToMime(content.GetInfo().MimeType, "opus"))
 		}
 	case event.MsgFile:
-		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt.ID, whatsmeow.MediaDocument)
+		fileName := content.FileName
+		if len(fileName) == 0 {
+			fileName = content.Body
+		}
+		if isVCardFile(content.GetInfo().MimeType, fileName) {
+			data, err := portal.downloadMatrixMedia(ctx, content)
+			if err != nil {
+				return nil, sender, err
+			}
+			displayName := ParseVCard(string(data)).FullName
+			if len(displayName) == 0 {
+				displayName = strings.TrimSuffix(fileName, ".vcf")
+			}
+			msg.ContactMessage = &waProto.ContactMessage{
+				DisplayName: &displayName,
+				Vcard:       proto.String(string(data)),
+				ContextInfo: &ctxInfo,
+			}
+			break
+		}
+		media, err := portal.preprocessMatrixMedia(ctx, sender, relaybotFormatted, content, evt, whatsmeow.MediaDocument)
 		if media == nil {
 			return nil, sender, err
 		}
@@ -3272,6 +4036,13 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			FileSha256:    media.FileSHA256,
 			FileLength:    proto.Uint64(uint64(media.FileLength)),
 		}
+		if media.Preview != nil {
+			msg.DocumentMessage.ThumbnailWidth = proto.Uint32(uint32(media.Preview.Width))
+			msg.DocumentMessage.ThumbnailHeight = proto.Uint32(uint32(media.Preview.Height))
+			if media.Preview.PageCount > 0 {
+				msg.DocumentMessage.PageCount = proto.Uint32(media.Preview.PageCount)
+			}
+		}
 		if media.Caption != "" {
 			msg.DocumentWithCaptionMessage = &waProto.FutureProofMessage{
 				Message: &waProto.Message{
@@ -3281,7 +4052,11 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			msg.DocumentMessage = nil
 		}
 	case event.MsgLocation:
-		lat, long, err := parseGeoURI(content.GeoURI)
+		geoURI := content.GeoURI
+		if location, ok := evt.Content.Raw["org.matrix.msc3488.location"].(map[string]interface{}); ok && len(geoURI) == 0 {
+			geoURI, _ = location["uri"].(string)
+		}
+		lat, long, err := parseGeoURI(geoURI)
 		if err != nil {
 			return nil, sender, fmt.Errorf("%w: %v", errInvalidGeoURI, err)
 		}
@@ -3294,6 +4069,10 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 	default:
 		return nil, sender, fmt.Errorf("%w %q", errUnknownMsgType, content.MsgType)
 	}
+	if editTarget != nil {
+		editMsg, err := buildEditMessage(portal.Key.JID, editTarget, &msg)
+		return editMsg, sender, err
+	}
 	return &msg, sender, nil
 }
 
@@ -3311,18 +4090,36 @@ func (portal *Portal) generateMessageInfo(sender *User) *types.MessageInfo {
 }
 
 func (portal *Portal) HandleMatrixMessage(sender *User, evt *event.Event, timings messageTimings) {
+	if portal.holdForCaptionMerge(sender, evt, timings) {
+		return
+	}
+	portal.handleMatrixMessage(sender, evt, timings)
+}
+
+func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event, timings messageTimings) {
 	start := time.Now()
 	ms := metricSender{portal: portal, timings: &timings}
 	if portal.bridge.PuppetActivity.isBlocked {
 		portal.log.Warnln("Bridge is blocking messages")
 		return
 	}
-	if err := portal.canBridgeFrom(sender, true); err != nil {
+	broadcastReplyTarget := portal.getBroadcastReplyTarget(sender, evt)
+	if err := portal.canBridgeFrom(sender, true); errors.Is(err, errUserNotConnected) && sender.queueOfflineMessage(portal, evt) {
+		go ms.sendMessageMetrics(evt, errMessageQueuedOffline, "Queued", false)
+		return
+	} else if err != nil {
 		go ms.sendMessageMetrics(evt, err, "Ignoring", true)
 		return
-	} else if portal.Key.JID == types.StatusBroadcastJID && portal.bridge.Config.Bridge.DisableStatusBroadcastSend {
+	} else if portal.Key.JID == types.StatusBroadcastJID && portal.bridge.Config.Bridge.DisableStatusBroadcastSend && broadcastReplyTarget.IsEmpty() {
 		go ms.sendMessageMetrics(evt, errBroadcastSendDisabled, "Ignoring", true)
 		return
+	} else if portal.IsBroadcastList() && !portal.IsStatusBroadcastList() && broadcastReplyTarget.IsEmpty() {
+		// Guessing the recipient could send private messages to the wrong person
+		go ms.sendMessageMetrics(evt, errBroadcastReplyRequired, "Ignoring", true)
+		return
+	}
+	if portal.requestRelayConfirmation(sender, evt, timings) {
+		return
 	}
 
 	messageAge := timings.totalReceive
@@ -3381,26 +4178,50 @@ func (portal *Portal) HandleMatrixMessage(sender *User, evt *event.Event, timing
 	if msg == nil {
 		go ms.sendMessageMetrics(evt, err, "Error converting", true)
 		return
+	} else if err = sender.checkWarmupLimits(portal); err != nil {
+		go ms.sendMessageMetrics(evt, err, "Warmup limit", true)
+		return
 	}
+	parts := splitLongTextMessage(msg)
+	msg = parts[0]
 	portal.MarkDisappearing(origEvtID, portal.ExpirationTime, true)
 	info := portal.generateMessageInfo(sender)
 	if dbMsg == nil {
-		dbMsg = portal.markHandled(nil, nil, info, evt.ID, false, true, database.MsgNormal, database.MsgNoError)
+		msgType := database.MsgNormal
+		if isEditMessage(msg) {
+			msgType = database.MsgEdit
+		}
+		dbMsg = portal.markHandled(nil, nil, info, evt.ID, false, true, msgType, database.MsgNoError)
 	} else {
 		info.ID = dbMsg.JID
 	}
-	portal.log.Debugln("Sending event", evt.ID, "to WhatsApp", info.ID)
+	targetChat := portal.Key.JID
+	if !broadcastReplyTarget.IsEmpty() {
+		// Replies in broadcast lists are sent to the private chat with the author of the message
+		targetChat = broadcastReplyTarget
+		portal.log.Debugln("Sending event", evt.ID, "to WhatsApp", info.ID, "as a broadcast reply to", targetChat)
+	} else {
+		portal.log.Debugln("Sending event", evt.ID, "to WhatsApp", info.ID)
+	}
 	start = time.Now()
-	resp, err := sender.Client.SendMessage(ctx, portal.Key.JID, info.ID, msg)
+	resp, err := sender.Client.SendMessage(ctx, targetChat, info.ID, msg)
 	timings.totalSend = time.Since(start)
 	timings.whatsmeow = resp.DebugTimings
 	go ms.sendMessageMetrics(evt, err, "Error sending", true)
 	if err == nil {
 		dbMsg.MarkSent(resp.Timestamp)
+		if len(parts) > 1 {
+			portal.sendSplitParts(ctx, sender, targetChat, origEvtID, parts[1:])
+		}
+	} else if portal.IsPrivateChat() && portal.bridge.Config.Bridge.DepartedContacts.Enabled {
+		go sender.CheckDepartedContact(portal.Key.JID)
 	}
 }
 
 func (portal *Portal) HandleMatrixReaction(sender *User, evt *event.Event) {
+	if portal.handleRelayConfirmationReaction(sender, evt) {
+		return
+	}
 	if err := portal.canBridgeFrom(sender, false); err != nil {
 		go portal.sendMessageMetrics(evt, err, "Ignoring", nil)
 		return
@@ -3412,6 +4233,9 @@ func (portal *Portal) HandleMatrixReaction(sender *User, evt *event.Event) {
 	}
 
 	content, ok := evt.Content.Parsed.(*event.ReactionEventContent)
+	if ok && portal.handleInviteAcceptReaction(sender, evt, content) {
+		return
+	}
 	if ok && strings.Contains(content.RelatesTo.Key, "retry") || strings.HasPrefix(content.RelatesTo.Key, "\u267b") { // ♻️
 		if retryRequested, _ := portal.requestMediaRetry(sender, content.RelatesTo.EventID, nil); retryRequested {
 			_, _ = portal.MainIntent().RedactEvent(portal.MXID, evt.ID, mautrix.ReqRedact{
@@ -3438,7 +4262,13 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) error
 	}
 	info := portal.generateMessageInfo(sender)
 	dbMsg := portal.markHandled(nil, nil, info, evt.ID, false, true, database.MsgReaction, database.MsgNoError)
-	portal.upsertReaction(nil, target.JID, sender.JID, evt.ID, info.ID)
+	// WhatsApp only allows one reaction per user, so the previous reaction is redacted,
+	// preferably with the user's own double puppet so the redaction looks like it came from them.
+	var intent *appservice.IntentAPI
+	if customPuppet := portal.bridge.GetPuppetByCustomMXID(sender.MXID); customPuppet != nil && customPuppet.CustomIntent() != nil {
+		intent = customPuppet.CustomIntent()
+	}
+	portal.upsertReaction(intent, target.JID, sender.JID, evt.ID, info.ID)
 	portal.log.Debugln("Sending reaction", evt.ID, "to WhatsApp", info.ID)
 	resp, err := portal.sendReactionToWhatsApp(sender, info.ID, target, content.RelatesTo.Key, evt.Timestamp)
 	if err == nil {
@@ -3452,7 +4282,7 @@ func (portal *Portal) sendReactionToWhatsApp(sender *User, id types.MessageID, t
 	if !portal.IsPrivateChat() {
 		messageKeyParticipant = proto.String(target.Sender.ToNonAD().String())
 	}
-	key = variationselector.Remove(key)
+	key = emoji.ForWhatsApp(key)
 	return sender.Client.SendMessage(context.TODO(), portal.Key.JID, id, &waProto.Message{
 		ReactionMessage: &waProto.ReactionMessage{
 			Key: &waProto.MessageKey{
@@ -3492,6 +4322,9 @@ func (portal *Portal) upsertReaction(intent *appservice.IntentAPI, targetJID typ
 	dbReaction.Upsert()
 }
 
+// WhatsAppRevokeWindow is how long after sending WhatsApp allows deleting a message for everyone.
+const WhatsAppRevokeWindow = 60 * time.Hour
+
 func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
 	if err := portal.canBridgeFrom(sender, true); err != nil {
 		go portal.sendMessageMetrics(evt, err, "Ignoring", nil)
@@ -3500,7 +4333,8 @@ func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
 	portal.log.Debugfln("Received redaction %s from %s", evt.ID, evt.Sender)
 
 	senderLogIdentifier := sender.MXID
-	if !sender.HasSession() {
+	isRelayed := !sender.HasSession()
+	if isRelayed {
 		sender = portal.GetRelayUser()
 		senderLogIdentifier += " (through relaybot)"
 	}
@@ -3524,6 +4358,13 @@ func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
 			_, err := portal.sendReactionToWhatsApp(sender, "", reactionTarget, "", evt.Timestamp)
 			go portal.sendMessageMetrics(evt, err, "Error sending", nil)
 		}
+	} else if msg.Type == database.MsgEdit {
+		go portal.sendMessageMetrics(evt, errEditRedactionNotSupported, "Ignoring", nil)
+	} else if time.Since(msg.Timestamp) > WhatsAppRevokeWindow {
+		go portal.sendMessageMetrics(evt, errRevokeWindowExpired, "Ignoring", nil)
+	} else if isRelayed && !portal.isOriginalMatrixSender(msg, evt.Sender) {
+		// The relay account sent the message for everyone, so make sure relay users can only delete their own messages
+		go portal.sendMessageMetrics(evt, errRedactionSentBySomeoneElse, "Ignoring", nil)
 	} else {
 		key := &waProto.MessageKey{
 			FromMe:    proto.Bool(true),
@@ -3538,17 +4379,41 @@ func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
 			key.FromMe = proto.Bool(false)
 			key.Participant = proto.String(msg.Sender.ToNonAD().String())
 		}
-		portal.log.Debugfln("Sending redaction %s of %s/%s to WhatsApp", evt.ID, msg.MXID, msg.JID)
+		portal.log.Debugfln("Sending redaction %s of %s/%s from %s to WhatsApp", evt.ID, msg.MXID, msg.JID, senderLogIdentifier)
 		_, err := sender.Client.SendMessage(context.TODO(), portal.Key.JID, "", &waProto.Message{
 			ProtocolMessage: &waProto.ProtocolMessage{
 				Type: waProto.ProtocolMessage_REVOKE.Enum(),
 				Key:  key,
 			},
 		})
+		// Long messages may have been split into multiple WhatsApp messages, which are all deleted
+		for _, part := range portal.bridge.DB.Message.GetSplitParts(portal.Key, msg.MXID) {
+			if err != nil {
+				break
+			}
+			partKey := proto.Clone(key).(*waProto.MessageKey)
+			partKey.Id = proto.String(part.JID)
+			_, err = sender.Client.SendMessage(context.TODO(), portal.Key.JID, "", &waProto.Message{
+				ProtocolMessage: &waProto.ProtocolMessage{
+					Type: waProto.ProtocolMessage_REVOKE.Enum(),
+					Key:  partKey,
+				},
+			})
+		}
 		go portal.sendMessageMetrics(evt, err, "Error sending", nil)
 	}
 }
 
+// isOriginalMatrixSender checks if the given bridged message was originally sent by the given Matrix user.
+func (portal *Portal) isOriginalMatrixSender(msg *database.Message, userID id.UserID) bool {
+	evt, err := portal.MainIntent().GetEvent(portal.MXID, msg.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to get %s to check its sender: %v", msg.MXID, err)
+		return false
+	}
+	return evt.Sender == userID
+}
+
 func (portal *Portal) HandleMatrixReadReceipt(sender bridge.User, eventID id.EventID, receiptTimestamp time.Time) {
 	portal.handleMatrixReadReceipt(sender.(*User), eventID, receiptTimestamp, true)
 }
@@ -3668,6 +4533,9 @@ func (portal *Portal) HandleMatrixTyping(newTyping []id.UserID) {
 func (portal *Portal) canBridgeFrom(sender *User, allowRelay bool) error {
 	if !sender.IsLoggedIn() {
 		if allowRelay && portal.HasRelaybot() {
+			if !sender.AllowsRelay() {
+				return errRelayOptedOut
+			}
 			return nil
 		} else if sender.Session != nil {
 			return errUserNotConnected
@@ -3676,6 +4544,8 @@ func (portal *Portal) canBridgeFrom(sender *User, allowRelay bool) error {
 		}
 	} else if portal.IsPrivateChat() && sender.JID.User != portal.Key.Receiver.User && (!allowRelay || !portal.HasRelaybot()) {
 		return errDifferentUser
+	} else if portal.IsPrivateChat() && sender.IsContactBlocked(portal.Key.JID) {
+		return errContactBlocked
 	}
 	return nil
 }
@@ -3796,6 +4666,26 @@ func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brTarget bridge.G
 	//portal.log.Infofln("Add %s response: %s", puppet.JID, <-resp)
 }
 
+// setGroupPhotoFromRoom sets the WhatsApp group photo to the given Matrix avatar, which is used when
+// an existing Matrix room is turned into a new WhatsApp group.
+func (portal *Portal) setGroupPhotoFromRoom(sender *User, avatarURL id.ContentURI) {
+	portal.avatarLock.Lock()
+	defer portal.avatarLock.Unlock()
+	data, err := portal.MainIntent().DownloadBytes(avatarURL)
+	if err != nil {
+		portal.log.Errorfln("Failed to download room avatar %s: %v", avatarURL, err)
+		return
+	}
+	newID, err := sender.Client.SetGroupPhoto(portal.Key.JID, data)
+	if err != nil {
+		portal.log.Errorfln("Failed to set group avatar from room: %v", err)
+		return
+	}
+	portal.Avatar = newID
+	portal.AvatarURL = avatarURL
+	portal.AvatarSet = true
+}
+
 func (portal *Portal) HandleMatrixMeta(brSender bridge.User, evt *event.Event) {
 	sender := brSender.(*User)
 	if !sender.Whitelisted || !sender.IsLoggedIn() {
@@ -0,0 +1,162 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// DeadPortal is a group portal whose WhatsApp chat no longer exists for any of the bridge users in the room.
+type DeadPortal struct {
+	Portal *Portal
+	Reason string
+}
+
+// checkDeadPortal checks whether the given group portal is dead. An empty reason means that the portal is
+// still alive or that its state couldn't be determined (e.g. because none of its users are connected).
+func (br *WABridge) checkDeadPortal(portal *Portal) string {
+	users, err := portal.GetMatrixUsers()
+	if err != nil {
+		portal.log.Warnfln("Failed to get Matrix users to check if portal is dead: %v", err)
+		return ""
+	} else if len(users) == 0 {
+		return "no Matrix users left in the room"
+	}
+	removedAfter := time.Duration(br.Config.Bridge.DeadPortalCleanup.RemovedAfter) * 24 * time.Hour
+	var reason string
+	for _, userID := range users {
+		user := br.GetUserByMXIDIfExists(userID)
+		if user == nil || !user.IsLoggedIn() {
+			continue
+		}
+		// The group list cache is invalidated by group change events, so only groups that are missing
+		// from it need to be checked individually to find out why.
+		var inGroup bool
+		inGroup, err = user.isInCachedGroupList(portal.Key.JID)
+		if err != nil {
+			portal.log.Warnfln("Failed to get group list of %s to check if portal is dead: %v", user.MXID, err)
+			return ""
+		} else if inGroup {
+			return ""
+		}
+		_, err = user.Client.GetGroupInfo(portal.Key.JID)
+		if err == nil {
+			return ""
+		} else if errors.Is(err, whatsmeow.ErrGroupNotFound) {
+			reason = "WhatsApp group no longer exists"
+		} else if errors.Is(err, whatsmeow.ErrNotInGroup) {
+			lastMessage := br.DB.Message.GetLastInChat(portal.Key)
+			if lastMessage != nil && time.Since(lastMessage.Timestamp) < removedAfter {
+				return ""
+			} else if reason == "" {
+				reason = "removed from WhatsApp group"
+			}
+		} else {
+			portal.log.Warnfln("Failed to get group info as %s to check if portal is dead: %v", user.MXID, err)
+			return ""
+		}
+	}
+	return reason
+}
+
+func (user *User) isInCachedGroupList(jid types.JID) (bool, error) {
+	groups, err := user.getCachedGroupList()
+	if err != nil {
+		return false, err
+	}
+	for _, group := range groups {
+		if group.JID == jid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FindDeadPortals returns all group portals out of the given list that can be cleaned up.
+func (br *WABridge) FindDeadPortals(portals []*Portal) []DeadPortal {
+	var dead []DeadPortal
+	for _, portal := range portals {
+		if len(portal.MXID) == 0 || !portal.IsGroupChat() {
+			continue
+		}
+		if reason := br.checkDeadPortal(portal); reason != "" {
+			dead = append(dead, DeadPortal{Portal: portal, Reason: reason})
+		}
+	}
+	return dead
+}
+
+// CleanupDeadPortal deletes the given portal and kicks all ghosts from the room. If leave is true, real Matrix
+// users are also kicked, and users with double puppeting leave and forget the room.
+func (br *WABridge) CleanupDeadPortal(dead DeadPortal, leave bool) {
+	portal := dead.Portal
+	portal.log.Infofln("Cleaning up dead portal (%s)", dead.Reason)
+	if leave {
+		users, _ := portal.GetMatrixUsers()
+		for _, userID := range users {
+			customPuppet := br.GetPuppetByCustomMXID(userID)
+			if customPuppet != nil && customPuppet.CustomIntent() != nil {
+				_, _ = customPuppet.CustomIntent().LeaveRoom(portal.MXID)
+				_, _ = customPuppet.CustomIntent().ForgetRoom(portal.MXID)
+			}
+		}
+	}
+	portal.Delete()
+	portal.Cleanup(!leave)
+}
+
+func (br *WABridge) DeadPortalCleanupLoop() {
+	cfg := &br.Config.Bridge.DeadPortalCleanup
+	interval := time.Duration(cfg.Interval) * time.Hour
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	for {
+		time.Sleep(interval)
+		dead := br.FindDeadPortals(br.GetAllPortals())
+		if len(dead) == 0 {
+			continue
+		} else if cfg.DryRun {
+			for _, portal := range dead {
+				portal.Portal.log.Infofln("Portal is dead (%s), not cleaning up as dry run is enabled", portal.Reason)
+			}
+			continue
+		}
+		br.Log.Infofln("Cleaning up %d dead portals", len(dead))
+		for _, portal := range dead {
+			br.CleanupDeadPortal(portal, cfg.LeaveRooms)
+		}
+	}
+}
+
+// PurgeDeletedLoop permanently removes soft-deleted portals and messages once their grace period has passed.
+func (br *WABridge) PurgeDeletedLoop() {
+	gracePeriod := time.Duration(br.Config.Bridge.SoftDelete.GracePeriod) * 24 * time.Hour
+	for {
+		portals, messages, err := br.DB.PurgeDeleted(time.Now().Add(-gracePeriod))
+		if err != nil {
+			br.Log.Warnln("Failed to purge soft-deleted portals and messages:", err)
+		} else if portals > 0 || messages > 0 {
+			br.Log.Infofln("Purged %d soft-deleted portals and %d soft-deleted messages", portals, messages)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -19,6 +19,8 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,6 +32,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/skip2/go-qrcode"
 
 	"go.mau.fi/whatsmeow/appstate"
 	waBinary "go.mau.fi/whatsmeow/binary"
@@ -41,6 +44,9 @@ import (
 
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/config"
+	"maunium.net/go/mautrix-whatsapp/database"
 )
 
 type ProvisioningAPI struct {
@@ -54,25 +60,52 @@ func (prov *ProvisioningAPI) Init() {
 	prov.log.Debugln("Enabling provisioning API at", prov.bridge.Config.Bridge.Provisioning.Prefix)
 	r := prov.bridge.AS.Router.PathPrefix(prov.bridge.Config.Bridge.Provisioning.Prefix).Subrouter()
 	r.Use(prov.AuthMiddleware)
-	r.HandleFunc("/v1/ping", prov.Ping).Methods(http.MethodGet)
-	r.HandleFunc("/v1/login", prov.Login).Methods(http.MethodGet)
-	r.HandleFunc("/v1/logout", prov.Logout).Methods(http.MethodPost)
-	r.HandleFunc("/v1/delete_session", prov.DeleteSession).Methods(http.MethodPost)
-	r.HandleFunc("/v1/disconnect", prov.Disconnect).Methods(http.MethodPost)
-	r.HandleFunc("/v1/reconnect", prov.Reconnect).Methods(http.MethodPost)
-	r.HandleFunc("/v1/debug/appstate/{name}", prov.SyncAppState).Methods(http.MethodPost)
-	r.HandleFunc("/v1/debug/retry", prov.SendRetryReceipt).Methods(http.MethodPost)
-	r.HandleFunc("/v1/contacts", prov.ListContacts).Methods(http.MethodGet)
-	r.HandleFunc("/v1/groups", prov.ListGroups).Methods(http.MethodGet)
-	r.HandleFunc("/v1/resolve_identifier/{number}", prov.ResolveIdentifier).Methods(http.MethodGet)
-	r.HandleFunc("/v1/bulk_resolve_identifier", prov.BulkResolveIdentifier).Methods(http.MethodPost)
-	r.HandleFunc("/v1/pm/{number}", prov.StartPM).Methods(http.MethodPost)
-	r.HandleFunc("/v1/open/{groupID}", prov.OpenGroup).Methods(http.MethodPost)
+	r.HandleFunc("/v1/ping", prov.requireScope(config.ProvisioningScopeMetrics, prov.Ping)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/login", prov.requireScope(config.ProvisioningScopeLogin, prov.Login)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/events", prov.requireScope(config.ProvisioningScopeLogin, prov.Events)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/login/qr.png", prov.requireScope(config.ProvisioningScopeLogin, prov.LoginQRImage)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/logout", prov.requireScope(config.ProvisioningScopeLogin, prov.Logout)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/delete_session", prov.requireScope(config.ProvisioningScopeLogin, prov.DeleteSession)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/session/export", prov.requireScope(config.ProvisioningScopeAdmin, prov.ExportSession)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/session/export/confirm", prov.requireScope(config.ProvisioningScopeAdmin, prov.ConfirmSessionExport)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/session/import", prov.requireScope(config.ProvisioningScopeAdmin, prov.ImportSession)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/device_name", prov.requireScope(config.ProvisioningScopeLogin, prov.GetDeviceName)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/device_name", prov.requireScope(config.ProvisioningScopeLogin, prov.SetDeviceName)).Methods(http.MethodPut)
+	r.HandleFunc("/v1/settings", prov.requireScope(config.ProvisioningScopeLogin, prov.GetSettings)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/settings", prov.requireScope(config.ProvisioningScopeLogin, prov.PutSettings)).Methods(http.MethodPut)
+	r.HandleFunc("/v1/disconnect", prov.requireScope(config.ProvisioningScopeLogin, prov.Disconnect)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/reconnect", prov.requireScope(config.ProvisioningScopeLogin, prov.Reconnect)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/debug/appstate/{name}", prov.requireScope(config.ProvisioningScopeAdmin, prov.SyncAppState)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/debug/retry", prov.requireScope(config.ProvisioningScopeAdmin, prov.SendRetryReceipt)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/contacts", prov.requireScope(config.ProvisioningScopePortalsRead, prov.ListContacts)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/groups", prov.requireScope(config.ProvisioningScopePortalsRead, prov.ListGroups)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/resolve_identifier/{number}", prov.requireScope(config.ProvisioningScopePortalsRead, prov.ResolveIdentifier)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/resolve", prov.requireScope(config.ProvisioningScopePortalsRead, prov.Resolve)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/bulk_resolve_identifier", prov.requireScope(config.ProvisioningScopePortalsRead, prov.BulkResolveIdentifier)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/pm/{number}", prov.requireScope(config.ProvisioningScopePortalsWrite, prov.StartPM)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/open/{groupID}", prov.requireScope(config.ProvisioningScopePortalsWrite, prov.OpenGroup)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/groups/{groupID}/bridge", prov.requireScope(config.ProvisioningScopePortalsWrite, prov.BridgeGroup)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/backfill", prov.requireScope(config.ProvisioningScopePortalsRead, prov.BackfillStatus)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/backfill/{roomID}", prov.requireScope(config.ProvisioningScopePortalsWrite, prov.Backfill)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/command", prov.requireScope(config.ProvisioningScopeCommands, prov.RunCommand)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/admin/users", prov.requireScope(config.ProvisioningScopeAdmin, prov.AdminListUsers)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/admin/errors", prov.requireScope(config.ProvisioningScopeAdmin, prov.AdminErrors)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/admin/users/{userID}", prov.requireScope(config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.AdminGetUser))).Methods(http.MethodGet)
+	r.HandleFunc("/v1/admin/users/{userID}", prov.requireScope(config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.AdminDeleteUser))).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/admin/users/{userID}/logout", prov.requireScope(config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.Logout))).Methods(http.MethodPost)
+	r.HandleFunc("/v1/admin/users/{userID}/disconnect", prov.requireScope(config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.Disconnect))).Methods(http.MethodPost)
+	r.HandleFunc("/v1/admin/users/{userID}/reconnect", prov.requireScope(config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.Reconnect))).Methods(http.MethodPost)
+	if prov.bridge.Config.Bridge.Provisioning.AdminUI {
+		// The page is registered outside the subrouter, as browsers can't send the auth header when navigating
+		prov.bridge.AS.Router.HandleFunc(prov.bridge.Config.Bridge.Provisioning.Prefix+"/admin", prov.AdminUI).Methods(http.MethodGet)
+	}
 	prov.bridge.AS.Router.HandleFunc("/_matrix/app/com.beeper.asmux/ping", prov.BridgeStatePing).Methods(http.MethodPost)
 	prov.bridge.AS.Router.HandleFunc("/_matrix/app/com.beeper.bridge_state", prov.BridgeStatePing).Methods(http.MethodPost)
 
 	// Deprecated, just use /disconnect
-	r.HandleFunc("/v1/delete_connection", prov.Disconnect).Methods(http.MethodPost)
+	r.HandleFunc("/v1/delete_connection", prov.requireScope(config.ProvisioningScopeLogin, prov.Disconnect)).Methods(http.MethodPost)
+
+	prov.initV2()
 }
 
 type responseWrap struct {
@@ -98,7 +131,7 @@ func (rw *responseWrap) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		auth := r.Header.Get("Authorization")
-		if len(auth) == 0 && strings.HasSuffix(r.URL.Path, "/login") {
+		if len(auth) == 0 && (strings.HasSuffix(r.URL.Path, "/login") || strings.HasSuffix(r.URL.Path, "/events")) {
 			authParts := strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",")
 			for _, part := range authParts {
 				part = strings.TrimSpace(part)
@@ -110,7 +143,17 @@ func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
 		} else if strings.HasPrefix(auth, "Bearer ") {
 			auth = auth[len("Bearer "):]
 		}
-		if auth != prov.bridge.Config.Bridge.Provisioning.SharedSecret {
+		userID := r.URL.Query().Get("user_id")
+		var token *config.ProvisioningToken
+		if imageToken := r.URL.Query().Get("image_token"); len(auth) == 0 && len(imageToken) > 0 && strings.HasSuffix(r.URL.Path, "/login/qr.png") {
+			// Image tags can't set headers, so the QR image also accepts a token that is only valid for the in-flight login
+			if user := prov.bridge.GetUserByMXIDIfExists(id.UserID(userID)); user != nil && user.CheckLoginQRImageToken(imageToken) {
+				token = loginQRImageToken
+			}
+		} else {
+			token = prov.getToken(auth)
+		}
+		if token == nil {
 			prov.log.Infof("Authentication token does not match shared secret")
 			jsonResponse(w, http.StatusForbidden, map[string]interface{}{
 				"error":   "Authentication token does not match shared secret",
@@ -118,16 +161,53 @@ func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
 			})
 			return
 		}
-		userID := r.URL.Query().Get("user_id")
 		user := prov.bridge.GetUserByMXID(id.UserID(userID))
 		start := time.Now()
 		wWrap := &responseWrap{w, 200}
-		h.ServeHTTP(wWrap, r.WithContext(context.WithValue(r.Context(), "user", user)))
+		ctx := context.WithValue(r.Context(), "user", user)
+		ctx = context.WithValue(ctx, "token", token)
+		h.ServeHTTP(wWrap, r.WithContext(ctx))
 		duration := time.Now().Sub(start).Seconds()
 		prov.log.Infofln("%s %s from %s took %.2f seconds and returned status %d", r.Method, r.URL.Path, user.MXID, duration, wWrap.statusCode)
 	})
 }
 
+var sharedSecretToken = &config.ProvisioningToken{Scopes: []config.ProvisioningScope{config.ProvisioningScopeAdmin}}
+
+// loginQRImageToken is used for requests authenticated with the QR image token of a login,
+// which is only accepted for the QR image endpoint.
+var loginQRImageToken = &config.ProvisioningToken{Scopes: []config.ProvisioningScope{config.ProvisioningScopeLogin}}
+
+// getToken finds the provisioning token matching the given auth string.
+// The shared secret is treated as a token with the admin scope.
+func (prov *ProvisioningAPI) getToken(auth string) *config.ProvisioningToken {
+	if len(auth) == 0 {
+		return nil
+	} else if auth == prov.bridge.Config.Bridge.Provisioning.SharedSecret {
+		return sharedSecretToken
+	}
+	for i, token := range prov.bridge.Config.Bridge.Provisioning.Tokens {
+		if len(token.Token) > 0 && auth == token.Token {
+			return &prov.bridge.Config.Bridge.Provisioning.Tokens[i]
+		}
+	}
+	return nil
+}
+
+func (prov *ProvisioningAPI) requireScope(scope config.ProvisioningScope, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := r.Context().Value("token").(*config.ProvisioningToken)
+		if !ok || !token.HasScope(scope) {
+			jsonResponse(w, http.StatusForbidden, Error{
+				Error:   fmt.Sprintf("This token doesn't have the %s scope", scope),
+				ErrCode: "M_FORBIDDEN",
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
 type Error struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error"`
@@ -154,6 +234,73 @@ func (prov *ProvisioningAPI) DeleteSession(w http.ResponseWriter, r *http.Reques
 	user.removeFromJIDMap(status.BridgeState{StateEvent: status.StateLoggedOut})
 }
 
+func (prov *ProvisioningAPI) ExportSession(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	export, err := user.ExportSession()
+	if errors.Is(err, errNoSessionToExport) {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   err.Error(),
+			ErrCode: "no session",
+		})
+	} else if err != nil {
+		user.log.Errorln("Failed to export session:", err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to export session: %v", err),
+			ErrCode: "export failed",
+		})
+	} else {
+		jsonResponse(w, http.StatusOK, export)
+	}
+}
+
+func (prov *ProvisioningAPI) ConfirmSessionExport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	err := user.ConfirmSessionExport()
+	if errors.Is(err, errNoSessionExport) {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   err.Error(),
+			ErrCode: "no session export",
+		})
+	} else {
+		jsonResponse(w, http.StatusOK, Response{true, "Exported session removed from this bridge"})
+	}
+}
+
+func (prov *ProvisioningAPI) ImportSession(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	var export SessionExport
+	decoder := json.NewDecoder(r.Body)
+	// Keep numbers exact, the export contains 64-bit integers
+	decoder.UseNumber()
+	if err := decoder.Decode(&export); err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Malformed request body",
+			ErrCode: "bad json",
+		})
+		return
+	}
+	err := user.ImportSession(&export)
+	if errors.Is(err, errSessionAlreadyExists) || errors.Is(err, errSessionLoginInProgress) || errors.Is(err, errSessionAccountInUse) {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   err.Error(),
+			ErrCode: "already logged in",
+		})
+	} else if errors.Is(err, errSessionExportVersion) || errors.Is(err, errSessionExportInvalid) || errors.Is(err, errSessionExportMismatch) {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   err.Error(),
+			ErrCode: "invalid export",
+		})
+	} else if err != nil {
+		user.log.Errorln("Failed to import session:", err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to import session: %v", err),
+			ErrCode: "import failed",
+		})
+	} else {
+		jsonResponse(w, http.StatusOK, Response{true, "Session imported, connecting to WhatsApp"})
+	}
+}
+
 func (prov *ProvisioningAPI) Disconnect(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*User)
 	if user.Client == nil {
@@ -294,23 +441,54 @@ func (prov *ProvisioningAPI) ListContacts(w http.ResponseWriter, r *http.Request
 	} else {
 		augmentedContacts := map[types.JID]interface{}{}
 		for jid, contact := range contacts {
-			var avatarUrl id.ContentURI
-			if puppet := prov.bridge.GetPuppetByJID(jid); puppet != nil {
-				avatarUrl = puppet.AvatarURL
-			}
+			info := prov.getContactInfo(jid, contact)
 			augmentedContacts[jid] = map[string]interface{}{
-				"Found":        contact.Found,
-				"FirstName":    contact.FirstName,
-				"FullName":     contact.FullName,
-				"PushName":     contact.PushName,
-				"BusinessName": contact.BusinessName,
-				"AvatarURL":    avatarUrl,
+				"Found":        info.Found,
+				"FirstName":    info.FirstName,
+				"FullName":     info.FullName,
+				"PushName":     info.PushName,
+				"BusinessName": info.BusinessName,
+				"AvatarURL":    info.AvatarURL,
+				"MXID":         info.MXID,
+				"Displayname":  info.Displayname,
 			}
 		}
 		jsonResponse(w, http.StatusOK, augmentedContacts)
 	}
 }
 
+type ContactInfo struct {
+	JID          types.JID     `json:"jid"`
+	Found        bool          `json:"found"`
+	FirstName    string        `json:"first_name,omitempty"`
+	FullName     string        `json:"full_name,omitempty"`
+	PushName     string        `json:"push_name,omitempty"`
+	BusinessName string        `json:"business_name,omitempty"`
+	AvatarURL    id.ContentURI `json:"avatar_url"`
+	MXID         id.UserID     `json:"mxid"`
+	Displayname  string        `json:"displayname"`
+}
+
+func (prov *ProvisioningAPI) getContactInfo(jid types.JID, contact types.ContactInfo) ContactInfo {
+	info := ContactInfo{
+		JID:          jid,
+		Found:        contact.Found,
+		FirstName:    contact.FirstName,
+		FullName:     contact.FullName,
+		PushName:     contact.PushName,
+		BusinessName: contact.BusinessName,
+	}
+	if puppet := prov.bridge.GetPuppetByJID(jid); puppet != nil {
+		info.AvatarURL = puppet.AvatarURL
+		info.MXID = puppet.MXID
+		info.Displayname = puppet.Displayname
+	}
+	if len(info.Displayname) == 0 {
+		info.Displayname, _ = prov.bridge.Config.Bridge.FormatDisplayname(jid, contact)
+	}
+	return info
+}
+
 func (prov *ProvisioningAPI) ListGroups(w http.ResponseWriter, r *http.Request) {
 	if user := r.Context().Value("user").(*User); user.Session == nil {
 		jsonResponse(w, http.StatusBadRequest, Error{
@@ -324,8 +502,28 @@ func (prov *ProvisioningAPI) ListGroups(w http.ResponseWriter, r *http.Request)
 			ErrCode: "failed to get groups",
 		})
 	} else {
-		jsonResponse(w, http.StatusOK, groups)
+		output := make([]GroupBridgeInfo, 0, len(groups))
+		for _, group := range groups {
+			output = append(output, prov.getGroupBridgeInfo(group))
+		}
+		jsonResponse(w, http.StatusOK, output)
+	}
+}
+
+func (prov *ProvisioningAPI) getGroupBridgeInfo(group *types.GroupInfo) GroupBridgeInfo {
+	info := GroupBridgeInfo{GroupInfo: group}
+	if portal := prov.bridge.DB.Portal.GetByJID(database.NewPortalKey(group.JID, group.JID)); portal != nil {
+		info.RoomID = portal.MXID
+		info.Bridged = len(portal.MXID) > 0
 	}
+	return info
+}
+
+// GroupBridgeInfo is a WhatsApp group in the group list along with the portal room it's bridged to, if any.
+type GroupBridgeInfo struct {
+	*types.GroupInfo
+	RoomID  id.RoomID `json:"room_id,omitempty"`
+	Bridged bool      `json:"bridged"`
 }
 
 type OtherUserInfo struct {
@@ -354,6 +552,10 @@ func looksEmaily(str string) bool {
 
 func (prov *ProvisioningAPI) resolveIdentifier(w http.ResponseWriter, r *http.Request) (types.JID, *User) {
 	number, _ := mux.Vars(r)["number"]
+	return prov.resolveNumber(w, r, number)
+}
+
+func (prov *ProvisioningAPI) resolveNumber(w http.ResponseWriter, r *http.Request, number string) (types.JID, *User) {
 	if strings.HasSuffix(number, "@"+types.DefaultUserServer) {
 		jid, _ := types.ParseJID(number)
 		number = "+" + jid.User
@@ -398,8 +600,10 @@ func (prov *ProvisioningAPI) StartPM(w http.ResponseWriter, r *http.Request) {
 	portal, puppet, justCreated, err := user.StartPM(jid, "provisioning API PM")
 	if err != nil {
 		jsonResponse(w, http.StatusInternalServerError, Error{
-			Error: fmt.Sprintf("Failed to create portal: %v", err),
+			Error:   fmt.Sprintf("Failed to create portal: %v", err),
+			ErrCode: "failed to create portal",
 		})
+		return
 	}
 	status := http.StatusOK
 	if justCreated {
@@ -436,6 +640,51 @@ func (prov *ProvisioningAPI) ResolveIdentifier(w http.ResponseWriter, r *http.Re
 	})
 }
 
+type ReqResolve struct {
+	Phone string `json:"phone"`
+}
+
+type RespResolve struct {
+	JID         types.JID     `json:"jid"`
+	MXID        id.UserID     `json:"mxid"`
+	Displayname string        `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURI `json:"avatar_url,omitempty"`
+	RoomID      id.RoomID     `json:"room_id,omitempty"`
+	// MatrixTo links to the existing private chat portal, or to the ghost user if there's no portal yet.
+	MatrixTo string `json:"matrix_to"`
+}
+
+// Resolve checks if a phone number is on WhatsApp and returns the ghost user and the existing private chat
+// portal of the number. Unlike ResolveIdentifier, this never creates a portal.
+func (prov *ProvisioningAPI) Resolve(w http.ResponseWriter, r *http.Request) {
+	var req ReqResolve
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Phone) == 0 {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Malformed request body, expected an object with a phone field",
+			ErrCode: "bad json",
+		})
+		return
+	}
+	jid, user := prov.resolveNumber(w, r, req.Phone)
+	if jid.IsEmpty() || user == nil {
+		// resolveNumber already responded with an error
+		return
+	}
+	puppet := prov.bridge.GetPuppetByJID(jid)
+	resp := RespResolve{
+		JID:         puppet.JID,
+		MXID:        puppet.MXID,
+		Displayname: puppet.Displayname,
+		AvatarURL:   puppet.AvatarURL,
+		MatrixTo:    fmt.Sprintf("https://matrix.to/#/%s", puppet.MXID),
+	}
+	if portal := prov.bridge.DB.Portal.GetByJID(database.NewPortalKey(jid, user.JID)); portal != nil && len(portal.MXID) > 0 {
+		resp.RoomID = portal.MXID
+		resp.MatrixTo = fmt.Sprintf("https://matrix.to/#/%s", portal.MXID)
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
 type ReqBulkResolveIdentifier struct {
 	Numbers []string `json:"numbers"`
 }
@@ -464,6 +713,16 @@ func (prov *ProvisioningAPI) BulkResolveIdentifier(w http.ResponseWriter, r *htt
 }
 
 func (prov *ProvisioningAPI) OpenGroup(w http.ResponseWriter, r *http.Request) {
+	prov.openGroup(w, r, false)
+}
+
+// BridgeGroup creates the portal room for a group, or re-links the user to the existing one.
+// If the user can't be invited to the existing room anymore, a new room is created.
+func (prov *ProvisioningAPI) BridgeGroup(w http.ResponseWriter, r *http.Request) {
+	prov.openGroup(w, r, true)
+}
+
+func (prov *ProvisioningAPI) openGroup(w http.ResponseWriter, r *http.Request, relink bool) {
 	groupID, _ := mux.Vars(r)["groupID"]
 	if user := r.Context().Value("user").(*User); !user.IsLoggedIn() {
 		jsonResponse(w, http.StatusBadRequest, Error{
@@ -485,11 +744,20 @@ func (prov *ProvisioningAPI) OpenGroup(w http.ResponseWriter, r *http.Request) {
 		prov.log.Debugln("Importing", jid, "for", user.MXID)
 		portal := user.GetPortalByJID(info.JID)
 		status := http.StatusOK
+		if relink && len(portal.MXID) > 0 {
+			if !portal.ensureUserInvited(user) {
+				portal.log.Warnfln("ensureUserInvited(%s) returned false, creating new portal", user.MXID)
+				portal.MXID = ""
+			} else {
+				portal.UpdateMatrixRoom(user, info)
+			}
+		}
 		if len(portal.MXID) == 0 {
 			err = portal.CreateMatrixRoom(user, info, true, true)
 			if err != nil {
 				jsonResponse(w, http.StatusInternalServerError, Error{
-					Error: fmt.Sprintf("Failed to create portal: %v", err),
+					Error:   fmt.Sprintf("Failed to create portal: %v", err),
+					ErrCode: "failed to create portal",
 				})
 				return
 			}
@@ -503,6 +771,59 @@ func (prov *ProvisioningAPI) OpenGroup(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type ReqBackfill struct {
+	Count      int `json:"count"`
+	BatchSize  int `json:"batch_size"`
+	BatchDelay int `json:"batch_delay"`
+}
+
+// Backfill queues a backfill of older messages in a portal. The body is optional, a missing or zero count
+// means all stored older messages.
+func (prov *ProvisioningAPI) Backfill(w http.ResponseWriter, r *http.Request) {
+	roomID := id.RoomID(mux.Vars(r)["roomID"])
+	user := r.Context().Value("user").(*User)
+	req := ReqBackfill{BatchSize: 100, BatchDelay: 5}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Malformed request body",
+				ErrCode: "bad json",
+			})
+			return
+		}
+	}
+	if req.Count <= 0 {
+		req.Count = -1
+	}
+	if req.BatchSize <= 0 {
+		req.BatchSize = 100
+	}
+	portal := prov.bridge.GetPortalByMXID(roomID)
+	if portal == nil || !prov.bridge.StateStore.IsInRoom(roomID, user.MXID) {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Portal room not found or you're not in it",
+			ErrCode: "M_NOT_FOUND",
+		})
+	} else if err := user.RequestPortalBackfill(portal, req.Count, req.BatchSize, req.BatchDelay); errors.Is(err, errNoOlderHistory) {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   err.Error(),
+			ErrCode: "no older history",
+		})
+	} else if err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   err.Error(),
+			ErrCode: "backfill unavailable",
+		})
+	} else {
+		jsonResponse(w, http.StatusAccepted, Response{true, "Backfill queued"})
+	}
+}
+
+func (prov *ProvisioningAPI) BackfillStatus(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	jsonResponse(w, http.StatusOK, user.GetBackfillProgress())
+}
+
 func (prov *ProvisioningAPI) Ping(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*User)
 	wa := map[string]interface{}{
@@ -551,6 +872,22 @@ func (prov *ProvisioningAPI) Logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	force := strings.ToLower(r.URL.Query().Get("force")) != "false"
+	cleanupMode := user.bridge.DefaultLogoutCleanupMode()
+	if cleanupParam := r.URL.Query().Get("cleanup"); cleanupParam != "" {
+		var ok bool
+		cleanupMode, ok = ParseLogoutCleanupMode(cleanupParam)
+		if !ok {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Invalid cleanup mode, must be one of keep, leave, read-only or delete",
+				ErrCode: "invalid cleanup mode",
+			})
+			return
+		}
+	}
+	var cleanupPortals []*Portal
+	if cleanupMode != LogoutCleanupKeep {
+		cleanupPortals = user.getLogoutCleanupPortals()
+	}
 
 	if user.Client == nil {
 		if !force {
@@ -579,14 +916,98 @@ func (prov *ProvisioningAPI) Logout(w http.ResponseWriter, r *http.Request) {
 	user.bridge.Metrics.TrackConnectionState(user.JID, false)
 	user.removeFromJIDMap(status.BridgeState{StateEvent: status.StateLoggedOut})
 	user.DeleteSession()
+	if cleanupMode != LogoutCleanupKeep {
+		go user.CleanupPortalsAfterLogout(cleanupPortals, cleanupMode)
+	}
 	jsonResponse(w, http.StatusOK, Response{true, "Logged out successfully."})
 }
 
+type DeviceNameInfo struct {
+	Name   string `json:"name"`
+	Custom bool   `json:"custom"`
+}
+
+func (prov *ProvisioningAPI) GetDeviceName(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	jsonResponse(w, http.StatusOK, DeviceNameInfo{
+		Name:   user.DeviceName(),
+		Custom: len(user.GetDeviceName()) > 0,
+	})
+}
+
+func (prov *ProvisioningAPI) SetDeviceName(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	var req DeviceNameInfo
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Malformed request body",
+			ErrCode: "bad json",
+		})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if len(name) > maxDeviceNameLength {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("Device name can't be longer than %d characters", maxDeviceNameLength),
+			ErrCode: "device name too long",
+		})
+		return
+	}
+	user.SetDeviceName(name)
+	jsonResponse(w, http.StatusOK, DeviceNameInfo{
+		Name:   user.DeviceName(),
+		Custom: len(name) > 0,
+	})
+}
+
+func (prov *ProvisioningAPI) LoginQRImage(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	code, expiry := user.GetLoginQR()
+	if code == "" {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "No login in progress",
+			ErrCode: "no login in progress",
+		})
+		return
+	}
+	size := 256
+	if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+		var err error
+		size, err = strconv.Atoi(sizeStr)
+		if err != nil || size < 64 || size > 1024 {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Size must be an integer between 64 and 1024",
+				ErrCode: "invalid size",
+			})
+			return
+		}
+	}
+	png, err := qrcode.Encode(code, qrcode.Low, size)
+	if err != nil {
+		user.log.Errorln("Failed to encode QR code:", err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to encode QR code",
+			ErrCode: "qr encode error",
+		})
+		return
+	}
+	codeHash := sha256.Sum256([]byte(code))
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", expiry.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, hex.EncodeToString(codeHash[:8])))
+	w.Header().Set("X-QR-Expires-In", strconv.Itoa(int(time.Until(expiry).Seconds())))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(png)
+}
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
-	Subprotocols: []string{"net.maunium.whatsapp.login"},
+	Subprotocols: []string{"net.maunium.whatsapp.login", provEventWebsocketProtocol},
 }
 
 func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
@@ -626,7 +1047,11 @@ func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
 		user.Update()
 	}
 
-	qrChan, err := user.Login(ctx)
+	fullSync := user.WantsFullHistorySync()
+	if parsed, err := strconv.ParseBool(r.URL.Query().Get("full_history")); err == nil {
+		fullSync = parsed
+	}
+	qrChan, err := user.Login(ctx, fullSync)
 	if err != nil {
 		user.log.Errorln("Failed to log in from provisioning API:", err)
 		if errors.Is(err, ErrAlreadyLoggedIn) {
@@ -644,6 +1069,7 @@ func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	user.log.Debugln("Started login via provisioning API")
 	Segment.Track(user.MXID, "$login_start")
+	defer user.SetLoginQR("", 0)
 
 	for {
 		select {
@@ -700,9 +1126,11 @@ func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
 				})
 			case "code":
 				Segment.Track(user.MXID, "$qrcode_retrieved")
+				user.SetLoginQR(evt.Code, evt.Timeout)
 				_ = c.WriteJSON(map[string]interface{}{
-					"code":    evt.Code,
-					"timeout": int(evt.Timeout.Seconds()),
+					"code":        evt.Code,
+					"timeout":     int(evt.Timeout.Seconds()),
+					"image_token": user.GetLoginQRImageToken(),
 				})
 				continue
 			}
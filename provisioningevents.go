@@ -0,0 +1,199 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/status"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	ProvEventBridgeState      = "bridge_state"
+	ProvEventLoginQR          = "login_qr"
+	ProvEventLoginSuccess     = "login_success"
+	ProvEventBackfillProgress = "backfill_progress"
+)
+
+const (
+	provEventBufferSize        = 16
+	provEventStateInterval     = 1 * time.Second
+	provEventProgressInterval  = 15 * time.Second
+	provEventWebsocketProtocol = "net.maunium.whatsapp.events"
+)
+
+type ProvisioningEvent struct {
+	Type      string      `json:"type"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+type ProvLoginQREvent struct {
+	Code       string `json:"code"`
+	Timeout    int    `json:"timeout"`
+	ImageToken string `json:"image_token,omitempty"`
+}
+
+type ProvLoginSuccessEvent struct {
+	JID      types.JID `json:"jid"`
+	Phone    string    `json:"phone"`
+	Platform string    `json:"platform"`
+}
+
+// SubscribeProvisioningEvents registers a channel that receives the events published for the user.
+// The returned function must be called to unsubscribe when the channel isn't read anymore.
+func (user *User) SubscribeProvisioningEvents() (<-chan *ProvisioningEvent, func()) {
+	ch := make(chan *ProvisioningEvent, provEventBufferSize)
+	user.provEventSubsLock.Lock()
+	if user.provEventSubs == nil {
+		user.provEventSubs = make(map[chan *ProvisioningEvent]struct{})
+	}
+	user.provEventSubs[ch] = struct{}{}
+	user.provEventSubsLock.Unlock()
+	return ch, func() {
+		user.provEventSubsLock.Lock()
+		delete(user.provEventSubs, ch)
+		user.provEventSubsLock.Unlock()
+	}
+}
+
+// publishProvisioningEvent sends an event to all subscribers of the user. Subscribers that aren't
+// keeping up miss the event instead of blocking the caller.
+func (user *User) publishProvisioningEvent(evtType string, data interface{}) {
+	evt := &ProvisioningEvent{
+		Type:      evtType,
+		Timestamp: time.Now().UnixMilli(),
+		Data:      data,
+	}
+	user.provEventSubsLock.Lock()
+	defer user.provEventSubsLock.Unlock()
+	for ch := range user.provEventSubs {
+		select {
+		case ch <- evt:
+		default:
+			user.log.Debugfln("Dropping %s provisioning event for slow subscriber", evtType)
+		}
+	}
+}
+
+func bridgeStateChanged(a, b status.BridgeState) bool {
+	return a.StateEvent != b.StateEvent || a.Error != b.Error || a.Message != b.Message
+}
+
+// Events streams login QR codes, connection state changes and backfill progress of the user over a websocket,
+// so that clients don't need to poll the other endpoints. The current state is sent right after connecting.
+func (prov *ProvisioningAPI) Events(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		prov.log.Errorln("Failed to upgrade connection to websocket:", err)
+		return
+	}
+	defer func() {
+		err := c.Close()
+		if err != nil {
+			user.log.Debugln("Error closing websocket:", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Read everything so SetCloseHandler() works
+		for {
+			_, _, err := c.ReadMessage()
+			if err != nil {
+				cancel()
+				break
+			}
+		}
+	}()
+	c.SetCloseHandler(func(code int, text string) error {
+		user.log.Debugfln("Provisioning event websocket closed (%d)", code)
+		cancel()
+		return nil
+	})
+
+	events, unsubscribe := user.SubscribeProvisioningEvents()
+	defer unsubscribe()
+
+	send := func(evtType string, data interface{}) bool {
+		err := c.WriteJSON(&ProvisioningEvent{
+			Type:      evtType,
+			Timestamp: time.Now().UnixMilli(),
+			Data:      data,
+		})
+		if err != nil {
+			user.log.Debugln("Failed to write to provisioning event websocket:", err)
+			return false
+		}
+		return true
+	}
+
+	lastState := user.BridgeState.GetPrev()
+	if !send(ProvEventBridgeState, lastState) {
+		return
+	}
+	if code, expiry := user.GetLoginQR(); code != "" && !send(ProvEventLoginQR, ProvLoginQREvent{
+		Code:       code,
+		Timeout:    int(time.Until(expiry).Seconds()),
+		ImageToken: user.GetLoginQRImageToken(),
+	}) {
+		return
+	}
+	lastProgress := user.GetBackfillProgress()
+	if !send(ProvEventBackfillProgress, lastProgress) {
+		return
+	}
+
+	stateTicker := time.NewTicker(provEventStateInterval)
+	defer stateTicker.Stop()
+	progressTicker := time.NewTicker(provEventProgressInterval)
+	defer progressTicker.Stop()
+	for {
+		select {
+		case evt := <-events:
+			if err = c.WriteJSON(evt); err != nil {
+				user.log.Debugln("Failed to write to provisioning event websocket:", err)
+				return
+			}
+		case <-stateTicker.C:
+			// Bridge states are sent from many places, so polling the latest one is simpler than hooking each of them
+			if state := user.BridgeState.GetPrev(); bridgeStateChanged(state, lastState) {
+				lastState = state
+				if !send(ProvEventBridgeState, state) {
+					return
+				}
+			}
+		case <-progressTicker.C:
+			progress := user.GetBackfillProgress()
+			if progress.RemainingJobs != lastProgress.RemainingJobs || progress.DeferredMedia != lastProgress.DeferredMedia {
+				lastProgress = progress
+				if !send(ProvEventBackfillProgress, progress) {
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
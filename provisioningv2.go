@@ -0,0 +1,320 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix-whatsapp/config"
+)
+
+//go:embed provisioning-openapi.json
+var provisioningOpenAPI []byte
+
+const (
+	provV2DefaultLimit = 100
+	provV2MaxLimit     = 1000
+	provV2MaxRequestID = 64
+)
+
+type provV2Route struct {
+	method  string
+	path    string
+	scope   config.ProvisioningScope
+	handler http.HandlerFunc
+}
+
+func (prov *ProvisioningAPI) v2Routes() []provV2Route {
+	return []provV2Route{
+		{http.MethodGet, "/ping", config.ProvisioningScopeMetrics, prov.Ping},
+		{http.MethodGet, "/login", config.ProvisioningScopeLogin, prov.Login},
+		{http.MethodGet, "/events", config.ProvisioningScopeLogin, prov.Events},
+		{http.MethodGet, "/login/qr.png", config.ProvisioningScopeLogin, prov.LoginQRImage},
+		{http.MethodPost, "/logout", config.ProvisioningScopeLogin, prov.Logout},
+		{http.MethodPost, "/delete_session", config.ProvisioningScopeLogin, prov.DeleteSession},
+		{http.MethodPost, "/session/export", config.ProvisioningScopeAdmin, prov.ExportSession},
+		{http.MethodPost, "/session/export/confirm", config.ProvisioningScopeAdmin, prov.ConfirmSessionExport},
+		{http.MethodPost, "/session/import", config.ProvisioningScopeAdmin, prov.ImportSession},
+		{http.MethodGet, "/device_name", config.ProvisioningScopeLogin, prov.GetDeviceName},
+		{http.MethodPut, "/device_name", config.ProvisioningScopeLogin, prov.SetDeviceName},
+		{http.MethodGet, "/settings", config.ProvisioningScopeLogin, prov.GetSettings},
+		{http.MethodPut, "/settings", config.ProvisioningScopeLogin, prov.PutSettings},
+		{http.MethodPost, "/disconnect", config.ProvisioningScopeLogin, prov.Disconnect},
+		{http.MethodPost, "/reconnect", config.ProvisioningScopeLogin, prov.Reconnect},
+		{http.MethodGet, "/contacts", config.ProvisioningScopePortalsRead, prov.ListContactsV2},
+		{http.MethodGet, "/groups", config.ProvisioningScopePortalsRead, prov.ListGroupsV2},
+		{http.MethodPost, "/groups/{groupID}/bridge", config.ProvisioningScopePortalsWrite, prov.BridgeGroup},
+		{http.MethodGet, "/resolve_identifier/{number}", config.ProvisioningScopePortalsRead, prov.ResolveIdentifier},
+		{http.MethodPost, "/resolve", config.ProvisioningScopePortalsRead, prov.Resolve},
+		{http.MethodPost, "/bulk_resolve_identifier", config.ProvisioningScopePortalsRead, prov.BulkResolveIdentifier},
+		{http.MethodPost, "/pm/{number}", config.ProvisioningScopePortalsWrite, prov.StartPM},
+		{http.MethodGet, "/backfill", config.ProvisioningScopePortalsRead, prov.BackfillStatus},
+		{http.MethodPost, "/backfill/{roomID}", config.ProvisioningScopePortalsWrite, prov.Backfill},
+		{http.MethodPost, "/command", config.ProvisioningScopeCommands, prov.RunCommand},
+		{http.MethodGet, "/admin/users", config.ProvisioningScopeAdmin, prov.AdminListUsers},
+		{http.MethodGet, "/admin/errors", config.ProvisioningScopeAdmin, prov.AdminErrors},
+		{http.MethodGet, "/admin/users/{userID}", config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.AdminGetUser)},
+		{http.MethodDelete, "/admin/users/{userID}", config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.AdminDeleteUser)},
+		{http.MethodPost, "/admin/users/{userID}/logout", config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.Logout)},
+		{http.MethodPost, "/admin/users/{userID}/disconnect", config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.Disconnect)},
+		{http.MethodPost, "/admin/users/{userID}/reconnect", config.ProvisioningScopeAdmin, prov.adminTargetUser(prov.Reconnect)},
+		{http.MethodPost, "/debug/appstate/{name}", config.ProvisioningScopeAdmin, prov.SyncAppState},
+		{http.MethodPost, "/debug/retry", config.ProvisioningScopeAdmin, prov.SendRetryReceipt},
+	}
+}
+
+// initV2 registers the v2 provisioning API. Most endpoints share their handlers with v1, but all responses
+// get a request ID and errors are rewritten into the v2 error format by the v2 middleware.
+func (prov *ProvisioningAPI) initV2() {
+	prefix := prov.bridge.Config.Bridge.Provisioning.Prefix + "/v2"
+	// The schema is public, so it's registered outside the authenticated subrouter
+	prov.bridge.AS.Router.HandleFunc(prefix+"/openapi.json", prov.OpenAPI).Methods(http.MethodGet)
+	r := prov.bridge.AS.Router.PathPrefix(prefix).Subrouter()
+	r.Use(prov.V2Middleware, prov.AuthMiddleware)
+	for _, route := range prov.v2Routes() {
+		r.HandleFunc(route.path, prov.requireScope(route.scope, route.handler)).Methods(route.method)
+	}
+}
+
+func (prov *ProvisioningAPI) OpenAPI(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(provisioningOpenAPI)
+}
+
+type V2Error struct {
+	ErrCode   string `json:"errcode"`
+	Error     string `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+type V2Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Total      int         `json:"total"`
+}
+
+// v2ResponseWrap buffers error responses so that the v2 middleware can rewrite them,
+// while successful responses and websocket upgrades are passed through directly.
+type v2ResponseWrap struct {
+	http.ResponseWriter
+	statusCode int
+	errorBody  *bytes.Buffer
+}
+
+var _ http.Hijacker = (*v2ResponseWrap)(nil)
+
+func (rw *v2ResponseWrap) WriteHeader(statusCode int) {
+	rw.statusCode = statusCode
+	if statusCode >= 400 {
+		rw.errorBody = &bytes.Buffer{}
+		return
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *v2ResponseWrap) Write(data []byte) (int, error) {
+	if rw.errorBody != nil {
+		return rw.errorBody.Write(data)
+	}
+	return rw.ResponseWriter.Write(data)
+}
+
+func (rw *v2ResponseWrap) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	return hijacker.Hijack()
+}
+
+// normalizeErrCode turns the free-form v1 error codes like "no session" into NO_SESSION.
+func normalizeErrCode(errCode string) string {
+	if len(errCode) == 0 {
+		return "M_UNKNOWN"
+	}
+	return strings.ToUpper(strings.NewReplacer(" ", "_", "-", "_").Replace(errCode))
+}
+
+func getRequestID(r *http.Request) string {
+	requestID := r.Header.Get("X-Request-ID")
+	if len(requestID) > 0 && len(requestID) <= provV2MaxRequestID {
+		return requestID
+	}
+	randomBytes := make([]byte, 8)
+	_, _ = rand.Read(randomBytes)
+	return hex.EncodeToString(randomBytes)
+}
+
+func (prov *ProvisioningAPI) V2Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := getRequestID(r)
+		w.Header().Set("X-Request-ID", requestID)
+		wrap := &v2ResponseWrap{ResponseWriter: w, statusCode: http.StatusOK}
+		h.ServeHTTP(wrap, r)
+		if wrap.errorBody == nil {
+			return
+		}
+		var v1Err Error
+		_ = json.Unmarshal(wrap.errorBody.Bytes(), &v1Err)
+		if len(v1Err.Error) == 0 {
+			v1Err.Error = http.StatusText(wrap.statusCode)
+		}
+		prov.log.Debugfln("Request %s to %s failed with status %d: %s", requestID, r.URL.Path, wrap.statusCode, v1Err.Error)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(wrap.statusCode)
+		_ = json.NewEncoder(w).Encode(V2Error{
+			ErrCode:   normalizeErrCode(v1Err.ErrCode),
+			Error:     v1Err.Error,
+			RequestID: requestID,
+		})
+	})
+}
+
+// getPageParams parses the limit and cursor query parameters. The cursor is the offset of the next item,
+// which is stable as long as the underlying list doesn't change.
+func getPageParams(r *http.Request) (limit, offset int, ok bool) {
+	limit = provV2DefaultLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return 0, 0, false
+		} else if limit > provV2MaxLimit {
+			limit = provV2MaxLimit
+		}
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var err error
+		offset, err = strconv.Atoi(cursor)
+		if err != nil || offset < 0 {
+			return 0, 0, false
+		}
+	}
+	return limit, offset, true
+}
+
+func pageBounds(total, limit, offset int) (start, end int, nextCursor string) {
+	start = offset
+	if start > total {
+		start = total
+	}
+	end = start + limit
+	if end >= total {
+		end = total
+	} else {
+		nextCursor = strconv.Itoa(end)
+	}
+	return
+}
+
+func invalidPageParams(w http.ResponseWriter) {
+	jsonResponse(w, http.StatusBadRequest, Error{
+		Error:   "Invalid limit or cursor",
+		ErrCode: "invalid pagination",
+	})
+}
+
+// ListContactsV2 lists the user's WhatsApp contacts sorted by JID, one page at a time.
+// Unlike v1, ghosts are only looked up for the contacts on the requested page.
+func (prov *ProvisioningAPI) ListContactsV2(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	limit, offset, ok := getPageParams(r)
+	if !ok {
+		invalidPageParams(w)
+		return
+	} else if user.Session == nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "User is not logged into WhatsApp",
+			ErrCode: "no session",
+		})
+		return
+	}
+	contacts, err := user.Session.Contacts.GetAllContacts()
+	if err != nil {
+		prov.log.Errorfln("Failed to fetch %s's contacts: %v", user.MXID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Internal server error while fetching contact list",
+			ErrCode: "failed to get contacts",
+		})
+		return
+	}
+	jids := make([]types.JID, 0, len(contacts))
+	for jid := range contacts {
+		jids = append(jids, jid)
+	}
+	sort.Slice(jids, func(i, j int) bool {
+		return jids[i].String() < jids[j].String()
+	})
+	start, end, nextCursor := pageBounds(len(jids), limit, offset)
+	items := make([]ContactInfo, 0, end-start)
+	for _, jid := range jids[start:end] {
+		items = append(items, prov.getContactInfo(jid, contacts[jid]))
+	}
+	jsonResponse(w, http.StatusOK, V2Page{Items: items, NextCursor: nextCursor, Total: len(jids)})
+}
+
+// ListGroupsV2 lists the user's WhatsApp groups sorted by JID along with their bridging status, one page at a time.
+func (prov *ProvisioningAPI) ListGroupsV2(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	limit, offset, ok := getPageParams(r)
+	if !ok {
+		invalidPageParams(w)
+		return
+	} else if user.Session == nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "User is not logged into WhatsApp",
+			ErrCode: "no session",
+		})
+		return
+	}
+	groups, err := user.getCachedGroupList()
+	if err != nil {
+		prov.log.Errorfln("Failed to fetch %s's groups: %v", user.MXID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Internal server error while fetching group list",
+			ErrCode: "failed to get groups",
+		})
+		return
+	}
+	sorted := make([]*types.GroupInfo, len(groups))
+	copy(sorted, groups)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].JID.String() < sorted[j].JID.String()
+	})
+	start, end, nextCursor := pageBounds(len(sorted), limit, offset)
+	items := make([]GroupBridgeInfo, 0, end-start)
+	for _, group := range sorted[start:end] {
+		items = append(items, prov.getGroupBridgeInfo(group))
+	}
+	jsonResponse(w, http.StatusOK, V2Page{Items: items, NextCursor: nextCursor, Total: len(sorted)})
+}
@@ -204,6 +204,8 @@ type Puppet struct {
 	customUser   *User
 
 	syncLock sync.Mutex
+	// tokenLock prevents concurrent requests that fail with an invalid token from all trying to log in again.
+	tokenLock sync.Mutex
 }
 
 var _ bridge.GhostWithProfile = (*Puppet)(nil)
@@ -323,12 +325,16 @@ func (puppet *Puppet) updatePortalAvatar() {
 
 func (puppet *Puppet) updatePortalName() {
 	puppet.updatePortalMeta(func(portal *Portal) {
-		portal.UpdateName(puppet.Displayname, types.EmptyJID, true)
+		if !portal.IsSelfChat() {
+			portal.UpdateName(puppet.Displayname, types.EmptyJID, true)
+		}
 	})
 }
 
 func (puppet *Puppet) SyncContact(source *User, onlyIfNoName, shouldHavePushName bool, reason string) {
-	if onlyIfNoName && len(puppet.Displayname) > 0 && (!shouldHavePushName || puppet.NameQuality > config.NameQualityPhone) {
+	if puppet.Defunct {
+		return
+	} else if onlyIfNoName && len(puppet.Displayname) > 0 && (!shouldHavePushName || puppet.NameQuality > config.NameQualityPhone) {
 		source.EnqueuePuppetResync(puppet)
 		return
 	}
@@ -343,6 +349,10 @@ func (puppet *Puppet) SyncContact(source *User, onlyIfNoName, shouldHavePushName
 }
 
 func (puppet *Puppet) Sync(source *User, contact *types.ContactInfo, forceAvatarSync, forcePortalSync bool) {
+	if puppet.Defunct {
+		puppet.log.Debugfln("Not syncing info through %s: puppet is defunct", source.JID)
+		return
+	}
 	puppet.syncLock.Lock()
 	defer puppet.syncLock.Unlock()
 	err := puppet.DefaultIntent().EnsureRegistered()
@@ -0,0 +1,106 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Originals larger than this aren't downloaded just to generate a quote thumbnail.
+const maxQuoteThumbnailSourceSize = 10 * 1024 * 1024
+
+// makeQuotedMessage creates the quoted message for a reply to the given event. Replies to images and videos
+// include the media type and a thumbnail, so that WhatsApp renders the usual media quote. Other messages are
+// quoted with blank content, which works fine on all official WhatsApp apps.
+func (portal *Portal) makeQuotedMessage(ctx context.Context, replyToID id.EventID) *waProto.Message {
+	blank := &waProto.Message{Conversation: proto.String("")}
+	evt, err := portal.MainIntent().GetEvent(portal.MXID, replyToID)
+	if err != nil {
+		portal.log.Debugfln("Failed to get reply target %s to build quote: %v", replyToID, err)
+		return blank
+	}
+	rawContent, err := tryDecryptEvent(portal.bridge.Crypto, evt)
+	if err != nil {
+		portal.log.Debugfln("Failed to decrypt reply target %s to build quote: %v", replyToID, err)
+		return blank
+	}
+	var content event.MessageEventContent
+	if err = json.Unmarshal(rawContent, &content); err != nil || (content.MsgType != event.MsgImage && content.MsgType != event.MsgVideo) {
+		return blank
+	}
+
+	info := content.GetInfo()
+	var caption *string
+	if content.FileName != "" && content.Body != content.FileName {
+		caption = proto.String(content.Body)
+	}
+	thumbnail := portal.makeQuoteThumbnail(ctx, &content)
+	if content.MsgType == event.MsgImage {
+		msg := &waProto.ImageMessage{
+			Mimetype:      proto.String(info.MimeType),
+			Caption:       caption,
+			JpegThumbnail: thumbnail,
+		}
+		if info.Width > 0 && info.Height > 0 {
+			msg.Width = proto.Uint32(uint32(info.Width))
+			msg.Height = proto.Uint32(uint32(info.Height))
+		}
+		return &waProto.Message{ImageMessage: msg}
+	}
+	msg := &waProto.VideoMessage{
+		Mimetype:      proto.String(info.MimeType),
+		Caption:       caption,
+		JpegThumbnail: thumbnail,
+	}
+	if info.Duration > 0 {
+		msg.Seconds = proto.Uint32(uint32(info.Duration / 1000))
+	}
+	return &waProto.Message{VideoMessage: msg}
+}
+
+// makeQuoteThumbnail creates a JPEG thumbnail for a quoted media message from the Matrix thumbnail if there
+// is one. Small enough images are used directly if they don't have a thumbnail.
+func (portal *Portal) makeQuoteThumbnail(ctx context.Context, content *event.MessageEventContent) []byte {
+	info := content.GetInfo()
+	var source []byte
+	var err error
+	if info.ThumbnailFile != nil || len(info.ThumbnailURL) > 0 {
+		source, err = portal.downloadMatrixMedia(ctx, &event.MessageEventContent{URL: info.ThumbnailURL, File: info.ThumbnailFile})
+	} else if content.MsgType == event.MsgImage && info.Size > 0 && info.Size <= maxQuoteThumbnailSourceSize {
+		source, err = portal.downloadMatrixMedia(ctx, content)
+	} else {
+		return nil
+	}
+	if err != nil {
+		portal.log.Debugfln("Failed to download media for quote thumbnail: %v", err)
+		return nil
+	}
+	thumbnail, err := createThumbnail(source, false)
+	if err != nil {
+		portal.log.Debugfln("Failed to create quote thumbnail: %v", err)
+		return nil
+	}
+	return thumbnail
+}
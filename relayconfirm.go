@@ -0,0 +1,153 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/emoji"
+)
+
+const groupSizeCacheDuration = 10 * time.Minute
+
+type pendingRelayConfirmation struct {
+	sender  *User
+	evt     *event.Event
+	timings messageTimings
+	timer   *time.Timer
+}
+
+// getGroupSize returns the number of participants in the group, fetched with the relay user's account
+// and cached for a while so that every relayed message doesn't cause a group info request.
+func (portal *Portal) getGroupSize() int {
+	portal.cachedGroupSizeLock.Lock()
+	cachedSize, cachedAt := portal.cachedGroupSize, portal.cachedGroupSizeAt
+	portal.cachedGroupSizeLock.Unlock()
+	if time.Since(cachedAt) < groupSizeCacheDuration {
+		return cachedSize
+	}
+	relay := portal.GetRelayUser()
+	if relay == nil || !relay.IsLoggedIn() {
+		return 0
+	}
+	info, err := relay.Client.GetGroupInfo(portal.Key.JID)
+	if err != nil {
+		portal.log.Warnln("Failed to get group info to check group size:", err)
+		return cachedSize
+	}
+	portal.cachedGroupSizeLock.Lock()
+	portal.cachedGroupSize = len(info.Participants)
+	portal.cachedGroupSizeAt = time.Now()
+	portal.cachedGroupSizeLock.Unlock()
+	return len(info.Participants)
+}
+
+// requestRelayConfirmation checks if the given message would be relayed into a group larger than the configured
+// threshold. If it would, the message is held back and the sender is asked to confirm it with a reaction.
+// Returns true if the message was held back.
+func (portal *Portal) requestRelayConfirmation(sender *User, evt *event.Event, timings messageTimings) bool {
+	relayCfg := portal.bridge.Config.Bridge.Relay
+	if relayCfg.ConfirmThreshold <= 0 || !portal.IsGroupChat() || !portal.HasRelaybot() || sender.IsLoggedIn() {
+		return false
+	}
+	// Getting the size may need a network request, so it's done before locking
+	size := portal.getGroupSize()
+	portal.relayConfirmationsLock.Lock()
+	defer portal.relayConfirmationsLock.Unlock()
+	for noticeID, pending := range portal.relayConfirmations {
+		if pending.evt.ID == evt.ID && pending.timer == nil {
+			// The message was confirmed, let it through
+			delete(portal.relayConfirmations, noticeID)
+			return false
+		}
+	}
+	if size < relayCfg.ConfirmThreshold {
+		return false
+	}
+	timeout := time.Duration(relayCfg.ConfirmTimeout) * time.Second
+	notice := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body: fmt.Sprintf("This message will be sent to %d WhatsApp group members. React with ✅ within %s to send it.",
+			size, formatDuration(timeout)),
+	}
+	notice.SetReply(evt)
+	resp, err := portal.sendMainIntentMessage(notice)
+	if err != nil {
+		portal.log.Warnfln("Failed to send relay confirmation request for %s: %v", evt.ID, err)
+		return false
+	}
+	noticeID := resp.EventID
+	portal.relayConfirmations[noticeID] = &pendingRelayConfirmation{
+		sender:  sender,
+		evt:     evt,
+		timings: timings,
+		timer: time.AfterFunc(timeout, func() {
+			portal.expireRelayConfirmation(noticeID)
+		}),
+	}
+	portal.log.Debugfln("Holding back relayed message %s until %s confirms it", evt.ID, sender.MXID)
+	return true
+}
+
+func (portal *Portal) expireRelayConfirmation(noticeID id.EventID) {
+	portal.relayConfirmationsLock.Lock()
+	pending, ok := portal.relayConfirmations[noticeID]
+	if ok && pending.timer != nil {
+		delete(portal.relayConfirmations, noticeID)
+	}
+	portal.relayConfirmationsLock.Unlock()
+	if !ok || pending.timer == nil {
+		return
+	}
+	_, _ = portal.MainIntent().RedactEvent(portal.MXID, noticeID, mautrix.ReqRedact{Reason: "confirmation timed out"})
+	portal.sendMessageMetrics(pending.evt, errRelayNotConfirmed, "Not sending", nil)
+}
+
+func isConfirmationReaction(key string) bool {
+	return emoji.Equal(key, "\u2705") || emoji.Equal(key, "\u2714") || emoji.EqualIgnoringSkinTone(key, "\U0001F44D")
+}
+
+// handleRelayConfirmationReaction handles reactions to relay confirmation notices.
+// Returns true if the reaction was a confirmation and shouldn't be bridged.
+func (portal *Portal) handleRelayConfirmationReaction(sender *User, evt *event.Event) bool {
+	content, ok := evt.Content.Parsed.(*event.ReactionEventContent)
+	if !ok {
+		return false
+	}
+	noticeID := content.RelatesTo.EventID
+	portal.relayConfirmationsLock.Lock()
+	pending, ok := portal.relayConfirmations[noticeID]
+	if !ok || pending.timer == nil || pending.sender.MXID != sender.MXID || !isConfirmationReaction(content.RelatesTo.Key) {
+		portal.relayConfirmationsLock.Unlock()
+		return ok
+	}
+	pending.timer.Stop()
+	// A nil timer marks the message as confirmed for requestRelayConfirmation
+	pending.timer = nil
+	portal.relayConfirmationsLock.Unlock()
+
+	portal.log.Debugfln("%s confirmed relayed message %s", sender.MXID, pending.evt.ID)
+	_, _ = portal.MainIntent().RedactEvent(portal.MXID, evt.ID, mautrix.ReqRedact{Reason: "relay confirmation"})
+	_, _ = portal.MainIntent().RedactEvent(portal.MXID, noticeID, mautrix.ReqRedact{Reason: "message confirmed"})
+	portal.HandleMatrixMessage(pending.sender, pending.evt, pending.timings)
+	return true
+}
@@ -0,0 +1,162 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// ResourceMonitor watches system memory usage and CPU load, so that background work like history sync
+// and media conversion can be slowed down on constrained hardware to keep live messages responsive.
+type ResourceMonitor struct {
+	bridge *WABridge
+	log    log.Logger
+
+	lock          sync.RWMutex
+	constrained   bool
+	reason        string
+	memoryPercent float64
+	loadPerCPU    float64
+}
+
+func NewResourceMonitor(br *WABridge) *ResourceMonitor {
+	return &ResourceMonitor{
+		bridge: br,
+		log:    br.Log.Sub("ResourceMonitor"),
+	}
+}
+
+func (rm *ResourceMonitor) Loop() {
+	interval := time.Duration(rm.bridge.Config.Bridge.ResourcePressure.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	for {
+		rm.check()
+		time.Sleep(interval)
+	}
+}
+
+func (rm *ResourceMonitor) check() {
+	cfg := rm.bridge.Config.Bridge.ResourcePressure
+	memoryPercent, err := readMemoryUsage()
+	if err != nil {
+		rm.log.Debugln("Failed to read memory usage:", err)
+	}
+	loadPerCPU, err := readLoadPerCPU()
+	if err != nil {
+		rm.log.Debugln("Failed to read load average:", err)
+	}
+	var reason string
+	if cfg.MemoryThreshold > 0 && memoryPercent >= float64(cfg.MemoryThreshold) {
+		reason = fmt.Sprintf("memory usage is %.0f%% (threshold %d%%)", memoryPercent, cfg.MemoryThreshold)
+	} else if cfg.LoadThreshold > 0 && loadPerCPU >= cfg.LoadThreshold {
+		reason = fmt.Sprintf("load average is %.2f per CPU (threshold %.2f)", loadPerCPU, cfg.LoadThreshold)
+	}
+	constrained := len(reason) > 0
+
+	rm.lock.Lock()
+	changed := rm.constrained != constrained
+	rm.constrained = constrained
+	rm.reason = reason
+	rm.memoryPercent = memoryPercent
+	rm.loadPerCPU = loadPerCPU
+	rm.lock.Unlock()
+
+	if changed && constrained {
+		rm.log.Warnfln("Deferring history sync and media conversion because %s", reason)
+	} else if changed {
+		rm.log.Infofln("Resource usage is back to normal (memory: %.0f%%, load: %.2f per CPU), resuming history sync and media conversion at full speed", memoryPercent, loadPerCPU)
+	}
+	rm.bridge.Metrics.TrackResourcePressure(constrained, memoryPercent, loadPerCPU)
+}
+
+// IsConstrained returns true if the last check found memory usage or CPU load over the configured thresholds.
+func (rm *ResourceMonitor) IsConstrained() bool {
+	if rm == nil {
+		return false
+	}
+	rm.lock.RLock()
+	defer rm.lock.RUnlock()
+	return rm.constrained
+}
+
+// Throttle waits for the configured trickle delay if the system is currently constrained.
+func (rm *ResourceMonitor) Throttle(action string) {
+	if !rm.IsConstrained() {
+		return
+	}
+	delay := time.Duration(rm.bridge.Config.Bridge.ResourcePressure.TrickleDelay) * time.Second
+	rm.lock.RLock()
+	reason := rm.reason
+	rm.lock.RUnlock()
+	rm.log.Debugfln("Delaying %s by %s because %s", action, delay, reason)
+	time.Sleep(delay)
+}
+
+// readMemoryUsage returns the percentage of system memory that is in use, based on MemAvailable in /proc/meminfo.
+func readMemoryUsage() (float64, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	var total, available uint64
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "MemAvailable:":
+			available, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if total == 0 || available > total {
+		return 0, fmt.Errorf("unexpected /proc/meminfo contents")
+	}
+	return float64(total-available) / float64(total) * 100, nil
+}
+
+// readLoadPerCPU returns the one minute load average divided by the number of CPUs.
+func readLoadPerCPU() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/loadavg contents")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
@@ -0,0 +1,162 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	searchPageSize     = 20
+	searchContactLimit = 200
+	searchStateMaxAge  = 5 * time.Minute
+)
+
+type SearchResult struct {
+	JID     types.JID
+	Name    string
+	IsGroup bool
+}
+
+// searchState holds the results of the user's last search command, so that they can reply with
+// a number to open one of the results, or with "next" to see the next page.
+type searchState struct {
+	query   string
+	results []SearchResult
+	page    int
+	expires time.Time
+}
+
+func (user *User) searchContactsAndGroups(query string) ([]SearchResult, error) {
+	contacts, err := user.SearchContacts(query, searchContactLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search contacts: %w", err)
+	}
+	results := make([]SearchResult, 0, len(contacts))
+	for _, contact := range contacts {
+		name := contact.FullName
+		if len(name) == 0 {
+			name = contact.PushName
+		}
+		if len(name) == 0 {
+			name = contact.BusinessName
+		}
+		if len(name) == 0 {
+			name = "+" + contact.JID.User
+		}
+		results = append(results, SearchResult{JID: contact.JID, Name: name})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+
+	groups, err := user.getCachedGroupList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups: %w", err)
+	}
+	var groupResults []SearchResult
+	for _, group := range groups {
+		if matchesQuery(group.GroupName.Name, query) || matchesQuery(group.JID.User, query) {
+			groupResults = append(groupResults, SearchResult{JID: group.JID, Name: group.GroupName.Name, IsGroup: true})
+		}
+	}
+	sort.SliceStable(groupResults, func(i, j int) bool {
+		return strings.ToLower(groupResults[i].Name) < strings.ToLower(groupResults[j].Name)
+	})
+	return append(results, groupResults...), nil
+}
+
+func (user *User) startSearch(query string, results []SearchResult) {
+	user.searchLock.Lock()
+	user.search = &searchState{
+		query:   query,
+		results: results,
+		expires: time.Now().Add(searchStateMaxAge),
+	}
+	user.searchLock.Unlock()
+}
+
+func (user *User) clearSearch() {
+	user.searchLock.Lock()
+	user.search = nil
+	user.searchLock.Unlock()
+}
+
+func (user *User) hasActiveSearch() bool {
+	user.searchLock.Lock()
+	defer user.searchLock.Unlock()
+	if user.search != nil && user.search.expires.Before(time.Now()) {
+		user.search = nil
+	}
+	return user.search != nil
+}
+
+func (user *User) nextSearchPage() bool {
+	user.searchLock.Lock()
+	defer user.searchLock.Unlock()
+	if user.search == nil || (user.search.page+1)*searchPageSize >= len(user.search.results) {
+		return false
+	}
+	user.search.page++
+	user.search.expires = time.Now().Add(searchStateMaxAge)
+	return true
+}
+
+// getSearchResult returns the result with the given 1-based index from the last search.
+func (user *User) getSearchResult(index int) *SearchResult {
+	user.searchLock.Lock()
+	defer user.searchLock.Unlock()
+	if user.search == nil || index < 1 || index > len(user.search.results) {
+		return nil
+	}
+	result := user.search.results[index-1]
+	return &result
+}
+
+func (user *User) formatSearchPage() string {
+	user.searchLock.Lock()
+	defer user.searchLock.Unlock()
+	if user.search == nil {
+		return "No active search"
+	}
+	start := user.search.page * searchPageSize
+	end := start + searchPageSize
+	if end > len(user.search.results) {
+		end = len(user.search.results)
+	}
+	var lines []string
+	for i := start; i < end; i++ {
+		result := user.search.results[i]
+		if result.IsGroup {
+			lines = append(lines, fmt.Sprintf("%d. %s (group) - `%s`", i+1, result.Name, result.JID.User))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d. %s - `+%s`", i+1, result.Name, result.JID.User))
+		}
+	}
+	pages := (len(user.search.results) + searchPageSize - 1) / searchPageSize
+	footer := "Reply with a number to open that chat"
+	if end < len(user.search.results) {
+		footer += ", `next` to see more results"
+	}
+	footer += ". Any other command cancels the search."
+	return fmt.Sprintf("### Results for \"%s\" (page %d of %d)\n\n%s\n\n%s", user.search.query, user.search.page+1, pages, strings.Join(lines, "\n"), footer)
+}
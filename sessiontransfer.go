@@ -0,0 +1,289 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// sessionExportVersion is bumped whenever the export format changes incompatibly.
+const sessionExportVersion = 1
+
+// sessionTables are the whatsmeow store tables that make up a session, along with the column
+// that contains the device JID. The device table must be first, as the other tables reference it.
+var sessionTables = []struct {
+	Name      string
+	JIDColumn string
+}{
+	{"whatsmeow_device", "jid"},
+	{"whatsmeow_identity_keys", "our_jid"},
+	{"whatsmeow_pre_keys", "jid"},
+	{"whatsmeow_sessions", "our_jid"},
+	{"whatsmeow_sender_keys", "our_jid"},
+	{"whatsmeow_app_state_sync_keys", "jid"},
+	{"whatsmeow_app_state_version", "jid"},
+	{"whatsmeow_app_state_mutation_macs", "jid"},
+	{"whatsmeow_contacts", "our_jid"},
+	{"whatsmeow_chat_settings", "our_jid"},
+}
+
+var (
+	errNoSessionToExport      = errors.New("you're not logged into WhatsApp")
+	errNoSessionExport        = errors.New("there's no unconfirmed session export")
+	errSessionAlreadyExists   = errors.New("you're already logged into WhatsApp")
+	errSessionLoginInProgress = errors.New("you're currently logging into WhatsApp")
+	errSessionExportVersion   = errors.New("unsupported session export version")
+	errSessionExportInvalid   = errors.New("session export doesn't contain a device")
+	errSessionAccountInUse    = errors.New("that WhatsApp account is already logged into the bridge as another Matrix user")
+	errSessionExportMismatch  = errors.New("session export contains rows of a different device")
+)
+
+// SessionExport contains everything the bridge needs to use a WhatsApp session without linking it again:
+// the device keys, Signal sessions and app state. Binary values are stored separately from other values,
+// so that they can be inserted back with the right types.
+type SessionExport struct {
+	Version int                           `json:"version"`
+	JID     types.JID                     `json:"jid"`
+	Tables  map[string][]SessionExportRow `json:"tables"`
+}
+
+type SessionExportRow struct {
+	Values map[string]interface{} `json:"values,omitempty"`
+	Binary map[string][]byte      `json:"binary,omitempty"`
+}
+
+// ExportSession disconnects the user from WhatsApp and reads their session from the database, so that it can be
+// imported on another bridge. The session is only removed from this bridge once the export is confirmed with
+// ConfirmSessionExport, so a lost response doesn't lose the session. A session must never be used by two
+// bridges at once, as that would break the encryption sessions.
+func (user *User) ExportSession() (export *SessionExport, err error) {
+	user.connLock.Lock()
+	defer user.connLock.Unlock()
+	if user.Session == nil || user.Session.ID == nil {
+		return nil, errNoSessionToExport
+	}
+	jid := *user.Session.ID
+	// Disconnect before reading, so that whatsmeow can't store new Signal sessions, prekeys or app state
+	// that would be missing from the export.
+	user.unlockedDeleteConnection()
+	user.sessionExportPending = true
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: WANotConnected})
+	defer func() {
+		if err != nil {
+			// Connect waits for connLock, so this runs after the function returns
+			user.sessionExportPending = false
+			go user.Connect()
+		}
+	}()
+
+	export = &SessionExport{
+		Version: sessionExportVersion,
+		JID:     jid,
+		Tables:  make(map[string][]SessionExportRow, len(sessionTables)),
+	}
+	txn, err := user.bridge.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// The transaction is only used for reading
+	defer txn.Rollback()
+	for _, table := range sessionTables {
+		rows, err := readSessionTable(txn, table.Name, table.JIDColumn, jid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", table.Name, err)
+		}
+		export.Tables[table.Name] = rows
+	}
+	if len(export.Tables["whatsmeow_device"]) != 1 {
+		return nil, errSessionExportInvalid
+	}
+	user.log.Infofln("Exported WhatsApp session %s, waiting for confirmation before removing it", jid)
+	return export, nil
+}
+
+// ConfirmSessionExport removes a previously exported session from this bridge without logging out.
+// It fails if the session wasn't exported or if the user reconnected after exporting, as the export
+// would be outdated in that case.
+func (user *User) ConfirmSessionExport() error {
+	user.connLock.Lock()
+	if !user.sessionExportPending || user.Session == nil {
+		user.connLock.Unlock()
+		return errNoSessionExport
+	}
+	user.sessionExportPending = false
+	user.connLock.Unlock()
+
+	user.log.Infofln("Session export confirmed, removing WhatsApp session %s from this bridge", user.JID)
+	user.removeFromJIDMap(status.BridgeState{StateEvent: status.StateLoggedOut, Message: "Session exported to another bridge"})
+	user.DeleteSession()
+	return nil
+}
+
+func readSessionTable(txn *sql.Tx, table, jidColumn string, jid types.JID) ([]SessionExportRow, error) {
+	rows, err := txn.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s=$1", table, jidColumn), jid.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var output []SessionExportRow
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		row := SessionExportRow{
+			Values: make(map[string]interface{}),
+			Binary: make(map[string][]byte),
+		}
+		for i, column := range columns {
+			if data, isBinary := values[i].([]byte); isBinary {
+				row.Binary[column] = data
+			} else {
+				row.Values[column] = values[i]
+			}
+		}
+		output = append(output, row)
+	}
+	return output, rows.Err()
+}
+
+// ImportSession stores a session exported from another bridge and connects to WhatsApp with it.
+func (user *User) ImportSession(export *SessionExport) error {
+	if export.Version != sessionExportVersion {
+		return errSessionExportVersion
+	} else if len(export.Tables["whatsmeow_device"]) != 1 || export.JID.IsEmpty() {
+		return errSessionExportInvalid
+	}
+	user.connLock.Lock()
+	defer user.connLock.Unlock()
+	if user.Session != nil {
+		return errSessionAlreadyExists
+	} else if user.Client != nil {
+		return errSessionLoginInProgress
+	}
+	// The account is reserved for this user before inserting the session, so that concurrent imports
+	// or logins of the same account by other users fail instead of both succeeding.
+	user.bridge.usersLock.Lock()
+	existingUser, inUse := user.bridge.usersByUsername[export.JID.User]
+	if inUse && existingUser != user {
+		user.bridge.usersLock.Unlock()
+		return errSessionAccountInUse
+	}
+	user.bridge.usersByUsername[export.JID.User] = user
+	user.bridge.usersLock.Unlock()
+
+	err := user.insertImportedSession(export)
+	if err != nil {
+		if !inUse {
+			user.bridge.usersLock.Lock()
+			delete(user.bridge.usersByUsername, export.JID.User)
+			user.bridge.usersLock.Unlock()
+		}
+		return err
+	}
+	user.Session.Log = &waLogger{user.log.Sub("Session")}
+	user.JID = export.JID
+	user.Update()
+	user.log.Infofln("Imported WhatsApp session %s", export.JID)
+	go user.Connect()
+	return nil
+}
+
+func (user *User) insertImportedSession(export *SessionExport) error {
+	txn, err := user.bridge.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range sessionTables {
+		for _, row := range export.Tables[table.Name] {
+			err = insertSessionRow(txn, table.Name, table.JIDColumn, export.JID, row)
+			if err != nil {
+				_ = txn.Rollback()
+				return fmt.Errorf("failed to insert into %s: %w", table.Name, err)
+			}
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+
+	user.Session, err = user.bridge.WAContainer.GetDevice(export.JID)
+	if err != nil {
+		return fmt.Errorf("failed to load imported session: %w", err)
+	} else if user.Session == nil {
+		return errSessionExportInvalid
+	}
+	return nil
+}
+
+var sessionColumnNameRegex = regexp.MustCompile("^[a-z_]+$")
+
+func insertSessionRow(txn dbutil.Execable, table, jidColumn string, jid types.JID, row SessionExportRow) error {
+	columns := make([]string, 0, len(row.Values)+len(row.Binary))
+	args := make([]interface{}, 0, cap(columns))
+	for column, value := range row.Values {
+		if column == jidColumn && value != jid.String() {
+			return errSessionExportMismatch
+		}
+		if number, ok := value.(json.Number); ok {
+			var err error
+			value, err = number.Int64()
+			if err != nil {
+				return fmt.Errorf("invalid number in column %s: %w", column, err)
+			}
+		}
+		columns = append(columns, column)
+		args = append(args, value)
+	}
+	for column, value := range row.Binary {
+		columns = append(columns, column)
+		args = append(args, value)
+	}
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		// The column names come from the uploaded export, so make sure they can't be used for injection
+		if !sessionColumnNameRegex.MatchString(column) {
+			return fmt.Errorf("invalid column name %q", column)
+		}
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	if _, hasJID := row.Values[jidColumn]; !hasJID {
+		return errSessionExportMismatch
+	}
+	_, err := txn.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(placeholders, ", ")), args...)
+	return err
+}
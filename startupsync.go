@@ -0,0 +1,105 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+)
+
+// DeferToStartupSync returns true if the background startup sync hasn't finished yet,
+// which means that non-essential syncs should be left for it to do. The user is remembered,
+// so that they're synced even if the startup sync already went past them.
+func (br *WABridge) DeferToStartupSync(user *User) bool {
+	br.startupSyncLock.Lock()
+	defer br.startupSyncLock.Unlock()
+	select {
+	case <-br.startupSyncDone:
+		return false
+	default:
+		if !br.Config.Bridge.DeferredStartupSync.Enabled {
+			return false
+		}
+		br.startupSyncDeferred[user] = struct{}{}
+		return true
+	}
+}
+
+// finishStartupSync marks the startup sync as done and returns the users who were deferred
+// to it and haven't been synced since.
+func (br *WABridge) finishStartupSync() []*User {
+	br.startupSyncLock.Lock()
+	defer br.startupSyncLock.Unlock()
+	close(br.startupSyncDone)
+	users := make([]*User, 0, len(br.startupSyncDeferred))
+	for user := range br.startupSyncDeferred {
+		users = append(users, user)
+	}
+	br.startupSyncDeferred = nil
+	return users
+}
+
+func (br *WABridge) runUserStartupSync(user *User) {
+	user.syncContactsAfterConnect()
+	if br.Config.Bridge.PersonalFilteringSpaces {
+		user.GetSpaceRoom()
+		if added := user.AddMissingPortalsToSpace(); added > 0 {
+			user.log.Infofln("Added %d private chat portals to personal filtering space", added)
+		}
+	}
+}
+
+// RunStartupSync runs the non-essential syncs (puppet info and avatars, contact-based portal creation,
+// personal filtering space membership) for all logged-in users. It's called after all WhatsApp connections
+// have been started, so that a restart of a large instance doesn't delay live messages.
+func (br *WABridge) RunStartupSync() {
+	cfg := br.Config.Bridge.DeferredStartupSync
+	if !cfg.Enabled {
+		br.finishStartupSync()
+		return
+	}
+	if cfg.Delay > 0 {
+		br.Log.Debugfln("Waiting %d seconds before starting background startup sync", cfg.Delay)
+		time.Sleep(time.Duration(cfg.Delay) * time.Second)
+	}
+	var users []*User
+	for _, user := range br.GetAllUsers() {
+		if user.IsLoggedIn() {
+			users = append(users, user)
+		}
+	}
+	br.Log.Infofln("Starting background startup sync for %d users", len(users))
+	start := time.Now()
+	for i, user := range users {
+		if !user.IsLoggedIn() {
+			continue
+		}
+		br.Log.Infofln("Running startup sync for %s (%d/%d)", user.MXID, i+1, len(users))
+		// Anything deferred before this point is covered by this sync
+		br.startupSyncLock.Lock()
+		delete(br.startupSyncDeferred, user)
+		br.startupSyncLock.Unlock()
+		br.runUserStartupSync(user)
+	}
+	// Users who connected or were deferred after the loop went past them still need a sync
+	for _, user := range br.finishStartupSync() {
+		if user.IsLoggedIn() {
+			br.Log.Infofln("Running deferred startup sync for %s", user.MXID)
+			br.runUserStartupSync(user)
+		}
+	}
+	br.Log.Infofln("Background startup sync completed in %s", time.Since(start))
+}
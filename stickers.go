@@ -0,0 +1,305 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// EventSendSticker is a custom event that clients (or widgets) can send into a portal room to post
+// a previously imported sticker by its shortcode, e.g. {"shortcode": "catpack-3"}.
+var EventSendSticker = event.Type{Type: "fi.mau.whatsapp.send_sticker", Class: event.MessageEventType}
+
+const maxStickerPackSize = 1024 * 1024
+
+var (
+	errNoStickersInPack    = errors.New("no stickers found in pack")
+	errStickerPackTooLarge = errors.New("sticker pack file is too large")
+	errUnknownSticker      = errors.New("unknown sticker")
+	errAmbiguousSticker    = errors.New("several packs have a sticker with that shortcode")
+)
+
+// convertStickerToWebP converts a static or animated (GIF) image into a square WebP image of the size
+// WhatsApp clients expect for stickers. The returned bool tells whether the sticker is animated.
+func (tp *TranscodePool) convertStickerToWebP(ctx context.Context, data []byte, mimeType string) ([]byte, bool, error) {
+	if mimeType != "image/gif" {
+		converted, err := convertToWebP(data)
+		return converted, false, err
+	}
+	converted, err := tp.Convert(ctx, data, ".webp", []string{"-f", "gif"}, []string{
+		"-c:v", "libwebp", "-lossless", "0", "-q:v", "70", "-loop", "0", "-an", "-vsync", "0",
+		"-vf", fmt.Sprintf("scale=%[1]d:%[1]d:force_original_aspect_ratio=decrease,pad=%[1]d:%[1]d:-1:-1:color=0x00000000", WhatsAppStickerUploadSize),
+	})
+	return converted, true, err
+}
+
+// stickerPackImage is a single image in a MSC2545 or maunium stickerpicker pack.
+type stickerPackImage struct {
+	URL  id.ContentURIString `json:"url"`
+	Body string              `json:"body"`
+	Info *event.FileInfo     `json:"info,omitempty"`
+}
+
+// msc2545Pack is the im.ponies/MSC2545 image pack format used by Matrix clients for custom emotes and stickers.
+type msc2545Pack struct {
+	Pack struct {
+		DisplayName string `json:"display_name"`
+	} `json:"pack"`
+	Images map[string]stickerPackImage `json:"images"`
+}
+
+// stickerpickerPack is the pack format of maunium/stickerpicker, which is also produced by its Telegram importer.
+type stickerpickerPack struct {
+	ID       string             `json:"id"`
+	Title    string             `json:"title"`
+	Stickers []stickerPackImage `json:"stickers"`
+}
+
+type parsedStickerPack struct {
+	Name   string
+	Images map[string]stickerPackImage
+}
+
+var nonSlugChars = regexp.MustCompile("[^a-z0-9]+")
+
+func stickerSlug(name string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func parseStickerPack(data []byte) (*parsedStickerPack, error) {
+	var ponies msc2545Pack
+	if err := json.Unmarshal(data, &ponies); err != nil {
+		return nil, fmt.Errorf("failed to parse pack: %w", err)
+	} else if len(ponies.Images) > 0 {
+		return &parsedStickerPack{Name: ponies.Pack.DisplayName, Images: ponies.Images}, nil
+	}
+	var picker stickerpickerPack
+	if err := json.Unmarshal(data, &picker); err != nil {
+		return nil, fmt.Errorf("failed to parse pack: %w", err)
+	} else if len(picker.Stickers) == 0 {
+		return nil, errNoStickersInPack
+	}
+	name := picker.Title
+	if len(name) == 0 {
+		name = picker.ID
+	}
+	pack := &parsedStickerPack{Name: name, Images: make(map[string]stickerPackImage, len(picker.Stickers))}
+	prefix := stickerSlug(name)
+	if len(prefix) == 0 {
+		prefix = "sticker"
+	}
+	for i, sticker := range picker.Stickers {
+		pack.Images[fmt.Sprintf("%s-%d", prefix, i+1)] = sticker
+	}
+	return pack, nil
+}
+
+// fetchStickerPack downloads a sticker pack JSON file from a mxc:// URI. Arbitrary URLs aren't supported,
+// as that would let users make the bridge send requests to any host, including ones on its internal network.
+func (br *WABridge) fetchStickerPack(ctx context.Context, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "mxc://") {
+		return nil, fmt.Errorf("unsupported pack source %q, upload the pack JSON to Matrix and use its mxc:// URI", source)
+	}
+	mxc, err := id.ParseContentURI(source)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := br.Bot.DownloadContext(ctx, mxc)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxStickerPackSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxStickerPackSize {
+		return nil, errStickerPackTooLarge
+	}
+	return data, nil
+}
+
+// findSticker finds an imported sticker by its shortcode. If several packs have a sticker with the same
+// shortcode, the pack has to be specified as a prefix, e.g. `catpack/cat-3`.
+func (user *User) findSticker(ref string) (*database.Sticker, error) {
+	ref = strings.Trim(ref, ":")
+	var packSlug string
+	if slash := strings.LastIndexByte(ref, '/'); slash > 0 {
+		packSlug, ref = stickerSlug(ref[:slash]), ref[slash+1:]
+	}
+	var matches []*database.Sticker
+	for _, sticker := range user.bridge.DB.Sticker.GetByShortcode(user.MXID, ref) {
+		if len(packSlug) == 0 || stickerSlug(sticker.Pack) == packSlug {
+			matches = append(matches, sticker)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%w %q", errUnknownSticker, ref)
+	} else if len(matches) > 1 {
+		packs := make([]string, len(matches))
+		for i, sticker := range matches {
+			packs[i] = fmt.Sprintf("%s/%s", stickerSlug(sticker.Pack), sticker.Shortcode)
+		}
+		return nil, fmt.Errorf("%w, use one of %s", errAmbiguousSticker, strings.Join(packs, ", "))
+	}
+	return matches[0], nil
+}
+
+// ImportStickerPack converts every image of the given sticker pack into a WhatsApp-compatible WebP sticker
+// and stores it for the user. Reimporting a pack replaces the previously imported version.
+func (user *User) ImportStickerPack(ctx context.Context, source string) (name string, imported int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	data, err := user.bridge.fetchStickerPack(ctx, source)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to download pack: %w", err)
+	}
+	pack, err := parseStickerPack(data)
+	if err != nil {
+		return "", 0, err
+	}
+	name = pack.Name
+	if len(name) == 0 {
+		name = source
+	}
+	user.bridge.DB.Sticker.DeletePack(user.MXID, name)
+	for shortcode, image := range pack.Images {
+		mxc, parseErr := image.URL.Parse()
+		if parseErr != nil {
+			user.log.Warnfln("Skipping sticker %s in pack %s: invalid URL %q", shortcode, name, image.URL)
+			continue
+		}
+		stickerData, downloadErr := user.bridge.Bot.DownloadBytesContext(ctx, mxc)
+		if downloadErr != nil {
+			user.log.Warnfln("Failed to download sticker %s in pack %s: %v", shortcode, name, downloadErr)
+			continue
+		}
+		mimeType := http.DetectContentType(stickerData)
+		if image.Info != nil && len(image.Info.MimeType) > 0 {
+			mimeType = image.Info.MimeType
+		}
+		converted, animated, convertErr := user.bridge.Transcoder.convertStickerToWebP(ctx, stickerData, mimeType)
+		if convertErr != nil {
+			user.log.Warnfln("Failed to convert sticker %s in pack %s: %v", shortcode, name, convertErr)
+			continue
+		}
+		uploaded, uploadErr := user.bridge.Bot.UploadBytes(converted, "image/webp")
+		if uploadErr != nil {
+			user.log.Warnfln("Failed to reupload sticker %s in pack %s: %v", shortcode, name, uploadErr)
+			continue
+		}
+		sticker := user.bridge.DB.Sticker.New()
+		sticker.UserMXID = user.MXID
+		sticker.Shortcode = shortcode
+		sticker.Pack = name
+		sticker.Body = image.Body
+		sticker.MXC = uploaded.ContentURI
+		sticker.Data = converted
+		sticker.Animated = animated
+		sticker.Upsert()
+		imported++
+	}
+	if imported == 0 {
+		return name, 0, errNoStickersInPack
+	}
+	return name, imported, nil
+}
+
+// SendStoredSticker sends an imported sticker to WhatsApp and mirrors it into the portal room.
+func (portal *Portal) SendStoredSticker(sender *User, sticker *database.Sticker) error {
+	if !sender.IsLoggedIn() {
+		return errUserNotLoggedIn
+	}
+	ctx := context.Background()
+	uploaded, err := sender.Client.Upload(ctx, sticker.Data, whatsmeow.MediaImage)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMediaWhatsAppUploadFailed, err)
+	}
+	var ctxInfo *waProto.ContextInfo
+	if portal.ExpirationTime != 0 {
+		ctxInfo = &waProto.ContextInfo{Expiration: proto.Uint32(portal.ExpirationTime)}
+	}
+	info := portal.generateMessageInfo(sender)
+	_, err = sender.Client.SendMessage(ctx, portal.Key.JID, info.ID, &waProto.Message{
+		StickerMessage: &waProto.StickerMessage{
+			ContextInfo:   ctxInfo,
+			Url:           &uploaded.URL,
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String("image/webp"),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			Width:         proto.Uint32(WhatsAppStickerUploadSize),
+			Height:        proto.Uint32(WhatsAppStickerUploadSize),
+			IsAnimated:    proto.Bool(sticker.Animated),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	width, height := scaleStickerSize(WhatsAppStickerUploadSize, WhatsAppStickerUploadSize)
+	content := &event.MessageEventContent{
+		Body: sticker.Body,
+		URL:  sticker.MXC.CUString(),
+		Info: &event.FileInfo{
+			MimeType: "image/webp",
+			Width:    width,
+			Height:   height,
+			Size:     len(sticker.Data),
+		},
+	}
+	intent := portal.bridge.GetPuppetByJID(sender.JID).IntentFor(portal)
+	resp, err := portal.sendMessage(intent, event.EventSticker, content, nil, info.Timestamp.UnixMilli())
+	if err != nil {
+		portal.log.Warnfln("Failed to mirror sent sticker %s into Matrix: %v", info.ID, err)
+		return nil
+	}
+	portal.finishHandling(nil, info, resp.EventID, database.MsgNormal, database.MsgNoError)
+	return nil
+}
+
+// HandleMatrixStickerShortcode handles EventSendSticker events by sending the referenced imported sticker.
+func (portal *Portal) HandleMatrixStickerShortcode(sender *User, evt *event.Event) {
+	if err := portal.canBridgeFrom(sender, false); err != nil {
+		go portal.sendMessageMetrics(evt, err, "Ignoring", nil)
+		return
+	}
+	shortcode, _ := evt.Content.Raw["shortcode"].(string)
+	sticker, err := sender.findSticker(shortcode)
+	if err != nil {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w: %v", errUnknownMsgType, err), "Ignoring", nil)
+		return
+	}
+	err = portal.SendStoredSticker(sender, sticker)
+	go portal.sendMessageMetrics(evt, err, "Error sending", nil)
+}
@@ -0,0 +1,249 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const transcodeTempPrefix = "mautrix-whatsapp-ffmpeg-"
+
+var errFFmpegNotFound = errors.New("ffmpeg is not installed")
+
+// TranscodePool runs ffmpeg conversions with a bounded number of concurrent processes, so that large videos
+// can't starve the bridge of CPU and a stuck conversion can't block a portal forever.
+type TranscodePool struct {
+	log     log.Logger
+	slots   chan struct{}
+	timeout time.Duration
+	tempDir string
+	// ownsTempDir is true if tempDir was created by this process and can be removed when stopping.
+	ownsTempDir bool
+
+	// When the system is under resource pressure, conversions are additionally limited to one at a time.
+	monitor         *ResourceMonitor
+	constrainedSlot chan struct{}
+}
+
+func NewTranscodePool(br *WABridge) *TranscodePool {
+	cfg := br.Config.Bridge.MediaConversion
+	workers := cfg.MaxWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	tempDir := cfg.TempDir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+	pool := &TranscodePool{
+		log:     br.Log.Sub("FFmpeg"),
+		slots:   make(chan struct{}, workers),
+		timeout: timeout,
+		tempDir: tempDir,
+
+		monitor:         br.ResourceMonitor,
+		constrainedSlot: make(chan struct{}, 1),
+	}
+	// Conversions use a directory of their own inside a directory owned by this process,
+	// so that cleaning up can't touch files of other bridges using the same temp dir.
+	workDir, err := os.MkdirTemp(tempDir, transcodeTempPrefix)
+	if err != nil {
+		pool.log.Warnfln("Failed to create temporary directory in %s, using it directly: %v", tempDir, err)
+	} else {
+		pool.tempDir = workDir
+		pool.ownsTempDir = true
+	}
+	return pool
+}
+
+// Cleanup removes the temporary directory of this process, including files of conversions that are still running.
+// It's called when the bridge is stopped.
+func (tp *TranscodePool) Cleanup() {
+	if !tp.ownsTempDir {
+		return
+	}
+	if err := os.RemoveAll(tp.tempDir); err != nil {
+		tp.log.Warnfln("Failed to remove temporary directory %s: %v", tp.tempDir, err)
+	}
+}
+
+// Convert runs ffmpeg on the given data and returns the output file. The conversion waits for a free worker
+// and is cancelled if it doesn't finish within the configured timeout. Temporary files are always removed.
+func (tp *TranscodePool) Convert(ctx context.Context, data []byte, outputExt string, inputArgs, outputArgs []string) ([]byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, errFFmpegNotFound
+	}
+	return tp.run(ctx, "ffmpeg", data, "output"+outputExt, func(inputPath, outputPath string) []string {
+		args := []string{"-hide_banner", "-loglevel", "error"}
+		args = append(args, inputArgs...)
+		args = append(args, "-i", inputPath)
+		args = append(args, outputArgs...)
+		return append(args, outputPath)
+	})
+}
+
+// run executes the given program in a worker slot with the input data written to a temporary file.
+// The output file name is relative to the temporary directory, and the returned bytes are its contents.
+// If outputName is empty, the standard output of the program is returned instead.
+func (tp *TranscodePool) run(ctx context.Context, program string, data []byte, outputName string, makeArgs func(inputPath, outputPath string) []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, tp.timeout)
+	defer cancel()
+	select {
+	case tp.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out waiting for a free %s worker: %w", program, ctx.Err())
+	}
+	defer func() {
+		<-tp.slots
+	}()
+	if tp.monitor.IsConstrained() {
+		select {
+		case tp.constrainedSlot <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for a free %s worker while under resource pressure: %w", program, ctx.Err())
+		}
+		defer func() {
+			<-tp.constrainedSlot
+		}()
+	}
+
+	dir, err := os.MkdirTemp(tp.tempDir, "conversion-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			tp.log.Warnfln("Failed to remove temporary directory %s: %v", dir, err)
+		}
+	}()
+	inputPath := filepath.Join(dir, "input")
+	var outputPath string
+	if outputName != "" {
+		outputPath = filepath.Join(dir, outputName)
+	}
+	if err = os.WriteFile(inputPath, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write input file: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, program, makeArgs(inputPath, outputPath)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s timed out after %s", program, time.Since(start).Round(time.Second))
+		}
+		return nil, fmt.Errorf("%s failed: %w: %s", program, err, strings.TrimSpace(stderr.String()))
+	}
+	tp.log.Debugfln("Ran %s on %d bytes in %s", program, len(data), time.Since(start))
+	if outputName == "" {
+		return stdout.Bytes(), nil
+	}
+	output, err := os.ReadFile(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output file: %w", err)
+	}
+	return output, nil
+}
+
+// convertVideoToH264 converts a video (or GIF) into an H.264/AAC MP4 file, which all WhatsApp clients can play.
+func (tp *TranscodePool) convertVideoToH264(ctx context.Context, data []byte, mimeType string) ([]byte, error) {
+	var inputArgs []string
+	outputArgs := []string{
+		"-pix_fmt", "yuv420p", "-c:v", "libx264", "-movflags", "+faststart",
+		// H.264 with yuv420p requires even dimensions
+		"-filter:v", "crop='floor(in_w/2)*2:floor(in_h/2)*2'",
+	}
+	if mimeType == "image/gif" {
+		inputArgs = []string{"-f", "gif"}
+		outputArgs = append(outputArgs, "-an")
+	} else {
+		outputArgs = append(outputArgs, "-c:a", "aac", "-b:a", "128k")
+	}
+	return tp.Convert(ctx, data, ".mp4", inputArgs, outputArgs)
+}
+
+// probeVideoCodec returns the name of the codec of the first video stream in the given file, e.g. "h264".
+func (tp *TranscodePool) probeVideoCodec(ctx context.Context, data []byte) (string, error) {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return "", errFFmpegNotFound
+	}
+	output, err := tp.run(ctx, "ffprobe", data, "", func(inputPath, _ string) []string {
+		return []string{
+			"-v", "error", "-select_streams", "v:0",
+			"-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1",
+			inputPath,
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// extractVideoFrame extracts the first frame of a video as a JPEG that fits in a maxSize x maxSize box.
+func (tp *TranscodePool) extractVideoFrame(ctx context.Context, data []byte, maxSize int) ([]byte, error) {
+	return tp.Convert(ctx, data, ".jpg", nil, []string{
+		"-frames:v", "1", "-q:v", "3",
+		"-filter:v", fmt.Sprintf("scale=w='min(%[1]d,iw)':h='min(%[1]d,ih)':force_original_aspect_ratio=decrease", maxSize),
+	})
+}
+
+// convertAudioToOpus converts an audio file into Opus-in-OGG, which WhatsApp accepts for both voice messages
+// and normal audio files.
+func (tp *TranscodePool) convertAudioToOpus(ctx context.Context, data []byte) ([]byte, error) {
+	return tp.Convert(ctx, data, ".ogg", nil, []string{
+		"-vn", "-c:a", "libopus", "-b:a", "64k",
+	})
+}
+
+// convertImageToJPEG converts an image that WhatsApp doesn't support (like HEIC) into a JPEG.
+func (tp *TranscodePool) convertImageToJPEG(ctx context.Context, data []byte) ([]byte, error) {
+	return tp.Convert(ctx, data, ".jpg", nil, []string{
+		"-frames:v", "1", "-q:v", "2",
+	})
+}
+
+// convertIncomingVoice converts an Opus voice message from WhatsApp into the configured format
+// for Matrix clients that can't play Opus. The returned string is the new mime type.
+func (tp *TranscodePool) convertIncomingVoice(ctx context.Context, data []byte, format string) ([]byte, string, error) {
+	switch format {
+	case "m4a":
+		converted, err := tp.Convert(ctx, data, ".m4a", nil, []string{"-vn", "-c:a", "aac", "-b:a", "64k"})
+		return converted, "audio/mp4", err
+	case "mp3":
+		converted, err := tp.Convert(ctx, data, ".mp3", nil, []string{"-vn", "-c:a", "libmp3lame", "-q:a", "5"})
+		return converted, "audio/mpeg", err
+	default:
+		return nil, "", fmt.Errorf("unsupported voice message format %q", format)
+	}
+}
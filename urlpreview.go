@@ -61,6 +61,10 @@ func (portal *Portal) convertURLPreviewToBeeper(intent *appservice.IntentAPI, so
 	}
 	if len(output.CanonicalURL) == 0 {
 		output.CanonicalURL = output.MatchedURL
+		// WhatsApp also detects links without a scheme, but Matrix clients expect an absolute URL here.
+		if !strings.Contains(output.CanonicalURL, "://") {
+			output.CanonicalURL = "https://" + output.CanonicalURL
+		}
 	}
 
 	var thumbnailData []byte
@@ -116,7 +120,11 @@ var URLRegex = regexp.MustCompile(`https?://[^\s/_*]+(?:/\S*)?`)
 func (portal *Portal) convertURLPreviewToWhatsApp(ctx context.Context, sender *User, evt *event.Event, dest *waProto.ExtendedTextMessage) bool {
 	var preview *BeeperLinkPreview
 
-	rawPreview := gjson.GetBytes(evt.Content.VeryRaw, `com\.beeper\.linkpreviews`)
+	// Prefer the stable MSC4095 field and fall back to the unstable one.
+	rawPreview := gjson.GetBytes(evt.Content.VeryRaw, `m\.url_previews`)
+	if !rawPreview.Exists() {
+		rawPreview = gjson.GetBytes(evt.Content.VeryRaw, `com\.beeper\.linkpreviews`)
+	}
 	if rawPreview.Exists() && rawPreview.IsArray() {
 		var previews []BeeperLinkPreview
 		if err := json.Unmarshal([]byte(rawPreview.Raw), &previews); err != nil || len(previews) == 0 {
@@ -124,6 +132,11 @@ func (portal *Portal) convertURLPreviewToWhatsApp(ctx context.Context, sender *U
 		}
 		// WhatsApp only supports a single preview.
 		preview = &previews[0]
+		if !strings.Contains(evt.Content.AsMessage().Body, preview.MatchedURL) {
+			// WhatsApp clients won't render the preview if the matched URL isn't in the text.
+			portal.log.Debugfln("Ignoring link preview in %s: matched URL not found in message text", evt.ID)
+			return false
+		}
 	} else if portal.bridge.Config.Bridge.URLPreviews {
 		if matchedURL := URLRegex.FindString(evt.Content.AsMessage().Body); len(matchedURL) == 0 {
 			return false
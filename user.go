@@ -17,9 +17,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -32,6 +34,8 @@ import (
 	"sync"
 	"time"
 
+	"google.golang.org/protobuf/proto"
+
 	log "maunium.net/go/maulogger/v2"
 
 	"maunium.net/go/mautrix"
@@ -43,6 +47,7 @@ import (
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
+	"maunium.net/go/mautrix/util"
 
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/appstate"
@@ -63,18 +68,31 @@ type User struct {
 	bridge *WABridge
 	log    log.Logger
 
+	// debugLogsUntil is the Unix time in nanoseconds until which the debug logs of the user are written
+	// to the bridge log. It's accessed atomically.
+	debugLogsUntil int64
+
 	Admin            bool
 	Whitelisted      bool
 	RelayWhitelisted bool
 	PermissionLevel  bridgeconfig.PermissionLevel
 
-	mgmtCreateLock  sync.Mutex
-	spaceCreateLock sync.Mutex
-	connLock        sync.Mutex
+	mgmtCreateLock          sync.Mutex
+	spaceCreateLock         sync.Mutex
+	connLock                sync.Mutex
+	contactPortalCreateLock sync.Mutex
 
-	historySyncs chan *events.HistorySync
+	// sessionExportPending is set when the session has been exported, but the export hasn't been confirmed yet.
+	// It's protected by connLock.
+	sessionExportPending bool
+
+	historySyncs chan *database.PendingHistorySync
 	lastPresence types.Presence
 
+	// loopCtx is canceled when the user is deleted to stop the background loops started for the user.
+	loopCtx   context.Context
+	stopLoops context.CancelFunc
+
 	historySyncLoopsStarted bool
 	spaceMembershipChecked  bool
 	lastPhoneOfflineWarning time.Time
@@ -89,6 +107,38 @@ type User struct {
 	resyncQueue     map[types.JID]resyncQueueItem
 	resyncQueueLock sync.Mutex
 	nextResync      time.Time
+
+	contactSync     contactSyncProgress
+	contactSyncLock sync.Mutex
+
+	warmup       warmupState
+	offlineQueue offlineQueueState
+	catchUp      offlineCatchUpState
+
+	loginQR           string
+	loginQRExpiry     time.Time
+	loginQRImageToken string
+	loginQRLock       sync.Mutex
+
+	provEventSubs     map[chan *ProvisioningEvent]struct{}
+	provEventSubsLock sync.Mutex
+
+	// Settings are the preferences the user has changed through commands or the provisioning API.
+	Settings *database.UserSettings
+
+	testSendWaiters     map[types.MessageID]chan *events.Receipt
+	testSendWaitersLock sync.Mutex
+
+	search     *searchState
+	searchLock sync.Mutex
+
+	blockedContacts         map[types.JID]struct{}
+	blockedContactsLock     sync.Mutex
+	blocklistRefreshStarted bool
+
+	lastAppStateSync     time.Time
+	lastAppStateSyncName appstate.WAPatchName
+	lastAppStateSyncLock sync.Mutex
 }
 
 type resyncQueueItem struct {
@@ -139,7 +189,12 @@ func (user *User) GetMXID() id.UserID {
 }
 
 func (user *User) GetCommandState() map[string]interface{} {
-	return nil
+	if !user.hasActiveSearch() {
+		return nil
+	}
+	return map[string]interface{}{
+		"next": cmdSearchSelect,
+	}
 }
 
 func (br *WABridge) GetUserByMXIDIfExists(userID id.UserID) *User {
@@ -188,6 +243,20 @@ func (br *WABridge) GetAllUsers() []*User {
 	return output
 }
 
+// DeleteUser forgets the user completely. The session must already have been deleted.
+func (br *WABridge) DeleteUser(user *User) {
+	br.usersLock.Lock()
+	delete(br.usersByMXID, user.MXID)
+	br.usersLock.Unlock()
+	if len(user.ManagementRoom) > 0 {
+		br.managementRoomsLock.Lock()
+		delete(br.managementRooms, user.ManagementRoom)
+		br.managementRoomsLock.Unlock()
+	}
+	user.stopLoops()
+	user.User.Delete()
+}
+
 func (br *WABridge) loadDBUser(dbUser *database.User, mxid *id.UserID) *User {
 	if dbUser == nil {
 		if mxid == nil {
@@ -223,13 +292,16 @@ func (br *WABridge) NewUser(dbUser *database.User) *User {
 	user := &User{
 		User:   dbUser,
 		bridge: br,
-		log:    br.Log.Sub("User").Sub(string(dbUser.MXID)),
 
-		historySyncs: make(chan *events.HistorySync, 32),
+		historySyncs: make(chan *database.PendingHistorySync, 32),
 		lastPresence: types.PresenceUnavailable,
 
 		resyncQueue: make(map[types.JID]resyncQueueItem),
+
+		Settings: br.DB.Settings.Get(dbUser.MXID),
 	}
+	user.log = newUserLogger(br.Log.Sub("User").Sub(string(dbUser.MXID)), user)
+	user.loopCtx, user.stopLoops = context.WithCancel(context.Background())
 
 	user.PermissionLevel = user.bridge.Config.Bridge.Permissions.Get(user.MXID)
 	user.RelayWhitelisted = user.PermissionLevel >= bridgeconfig.PermissionLevelRelay
@@ -246,12 +318,25 @@ const resyncLoopInterval = 4 * time.Hour
 func (user *User) puppetResyncLoop() {
 	user.nextResync = time.Now().Add(resyncLoopInterval).Add(-time.Duration(rand.Intn(3600)) * time.Second)
 	for {
-		time.Sleep(user.nextResync.Sub(time.Now()))
+		if !user.waitOrStop(user.nextResync.Sub(time.Now())) {
+			return
+		}
 		user.nextResync = time.Now().Add(resyncLoopInterval)
 		user.doPuppetResync()
 	}
 }
 
+// waitOrStop sleeps for the given duration. It returns false if the user was deleted in the meantime,
+// in which case the calling loop should stop.
+func (user *User) waitOrStop(duration time.Duration) bool {
+	select {
+	case <-user.loopCtx.Done():
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
 func (user *User) EnqueuePuppetResync(puppet *Puppet) {
 	if puppet.LastSync.Add(resyncMinInterval).After(time.Now()) {
 		return
@@ -503,7 +588,28 @@ func (user *User) createClient(sess *store.Device) {
 	}
 }
 
-func (user *User) Login(ctx context.Context) (<-chan whatsmeow.QRChannelItem, error) {
+// WantsFullHistorySync returns whether the next login of the user should request a full history sync from the phone.
+// The user's own setting takes precedence over the config when it's set.
+func (user *User) WantsFullHistorySync() bool {
+	return boolOrDefault(user.Settings.RequestFullHistory, user.bridge.Config.Bridge.HistorySync.RequestFullSync)
+}
+
+// maxDeviceNameLength is the longest device name that the bridge accepts. WhatsApp cuts off long names
+// in the linked devices list anyway.
+const maxDeviceNameLength = 50
+
+// DeviceName returns the name that the linked device will be shown with in the WhatsApp mobile app
+// when the user logs in next time.
+func (user *User) DeviceName() string {
+	if name := user.GetDeviceName(); len(name) > 0 {
+		return name
+	}
+	return user.bridge.Config.FormatDeviceName(user.MXID)
+}
+
+// Login starts linking a new WhatsApp session. If requestFullSync is set, the phone is asked
+// to send up to a year of history instead of only the recent chats.
+func (user *User) Login(ctx context.Context, requestFullSync bool) (<-chan whatsmeow.QRChannelItem, error) {
 	user.connLock.Lock()
 	defer user.connLock.Unlock()
 	if user.Session != nil {
@@ -518,13 +624,80 @@ func (user *User) Login(ctx context.Context) (<-chan whatsmeow.QRChannelItem, er
 	if err != nil {
 		return nil, fmt.Errorf("failed to get QR channel: %w", err)
 	}
+	deviceName := user.DeviceName()
+	// The device props are only sent in the pairing handshake, which happens synchronously inside Connect
+	user.bridge.devicePropsLock.Lock()
+	store.DeviceProps.RequireFullSync = proto.Bool(requestFullSync)
+	store.DeviceProps.Os = proto.String(deviceName)
 	err = user.Client.Connect()
+	store.DeviceProps.RequireFullSync = proto.Bool(user.bridge.Config.Bridge.HistorySync.RequestFullSync)
+	store.DeviceProps.Os = proto.String(user.bridge.Config.FormatDeviceName(""))
+	user.bridge.devicePropsLock.Unlock()
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to WhatsApp: %w", err)
 	}
+	if requestFullSync {
+		user.log.Debugln("Requested full history sync for new login")
+	}
+	if user.Settings.RequestFullHistory != nil {
+		// The setting only applies to the next login
+		user.Settings.RequestFullHistory = nil
+		user.Settings.Upsert()
+	}
 	return qrChan, nil
 }
 
+// SetLoginQR stores the QR code of the in-flight login, so that it can be fetched through other channels
+// than the one that started the login. An empty code clears the stored QR.
+//
+// The first code of a login also creates a token that is only valid for fetching the QR image of that login,
+// so that it can be embedded in image tags, which can't send the provisioning secret in a header.
+func (user *User) SetLoginQR(code string, timeout time.Duration) {
+	user.loginQRLock.Lock()
+	defer user.loginQRLock.Unlock()
+	user.loginQR = code
+	if code == "" {
+		user.loginQRExpiry = time.Time{}
+		user.loginQRImageToken = ""
+	} else {
+		user.loginQRExpiry = time.Now().Add(timeout)
+		if user.loginQRImageToken == "" {
+			user.loginQRImageToken = util.RandomString(32)
+		}
+		user.publishProvisioningEvent(ProvEventLoginQR, ProvLoginQREvent{
+			Code:       code,
+			Timeout:    int(timeout.Seconds()),
+			ImageToken: user.loginQRImageToken,
+		})
+	}
+}
+
+// GetLoginQRImageToken returns the QR image token of the in-flight login.
+func (user *User) GetLoginQRImageToken() string {
+	user.loginQRLock.Lock()
+	defer user.loginQRLock.Unlock()
+	if user.loginQR == "" || user.loginQRExpiry.Before(time.Now()) {
+		return ""
+	}
+	return user.loginQRImageToken
+}
+
+// CheckLoginQRImageToken checks if the given token is the QR image token of the in-flight login.
+func (user *User) CheckLoginQRImageToken(token string) bool {
+	expected := user.GetLoginQRImageToken()
+	return len(expected) > 0 && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// GetLoginQR returns the QR code of the in-flight login and the time when it expires.
+func (user *User) GetLoginQR() (string, time.Time) {
+	user.loginQRLock.Lock()
+	defer user.loginQRLock.Unlock()
+	if user.loginQR == "" || user.loginQRExpiry.Before(time.Now()) {
+		return "", time.Time{}
+	}
+	return user.loginQR, user.loginQRExpiry
+}
+
 func (user *User) Connect() bool {
 	user.connLock.Lock()
 	defer user.connLock.Unlock()
@@ -534,6 +707,8 @@ func (user *User) Connect() bool {
 		return false
 	}
 	user.log.Debugln("Connecting to WhatsApp")
+	// Connecting again makes any previous session export outdated
+	user.sessionExportPending = false
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting, Error: WAConnecting})
 	user.createClient(user.Session)
 	err := user.Client.Connect()
@@ -580,6 +755,7 @@ func (user *User) DeleteSession() {
 		user.Session = nil
 	}
 	if !user.JID.IsEmpty() {
+		user.SetPreviousUsername(user.JID.User)
 		user.JID = types.EmptyJID
 		user.Update()
 	}
@@ -589,6 +765,7 @@ func (user *User) DeleteSession() {
 	user.bridge.DB.HistorySync.DeleteAllConversations(user.MXID)
 	user.bridge.DB.HistorySync.DeleteAllMessages(user.MXID)
 	user.bridge.DB.MediaBackfillRequest.DeleteAllMediaBackfillRequests(user.MXID)
+	user.bridge.DB.DeferredMedia.DeleteAll(user.MXID)
 }
 
 func (user *User) IsConnected() bool {
@@ -642,9 +819,9 @@ func (user *User) handleCallStart(sender types.JID, id, callType string, ts time
 		return
 	}
 	portal := user.GetPortalByJID(sender)
-	text := "Incoming call"
+	text := portal.formatNotice(noticeIncomingCall)
 	if callType != "" {
-		text = fmt.Sprintf("Incoming %s call", callType)
+		text = portal.formatNotice(noticeIncomingCallType, callType)
 	}
 	portal.messages <- PortalMessage{
 		fake: &fakeMessage{
@@ -718,6 +895,12 @@ func (user *User) phoneSeen(ts time.Time) {
 	go user.Update()
 }
 
+func (user *User) getLastAppStateSync() (time.Time, appstate.WAPatchName) {
+	user.lastAppStateSyncLock.Lock()
+	defer user.lastAppStateSyncLock.Unlock()
+	return user.lastAppStateSync, user.lastAppStateSyncName
+}
+
 func formatDisconnectTime(dur time.Duration) string {
 	days := int(math.Floor(dur.Hours() / 24))
 	hours := int(dur.Hours()) % 24
@@ -756,6 +939,12 @@ func (user *User) HandleEvent(event interface{}) {
 			}()
 		}
 		go user.tryAutomaticDoublePuppeting()
+		go user.FlushOfflineQueue()
+		go user.tryRefreshBlocklist()
+		if !user.blocklistRefreshStarted {
+			go user.blocklistRefreshLoop()
+			user.blocklistRefreshStarted = true
+		}
 
 		if user.bridge.Config.Bridge.HistorySync.Backfill && !user.historySyncLoopsStarted {
 			go user.handleHistorySyncsLoop()
@@ -767,7 +956,9 @@ func (user *User) HandleEvent(event interface{}) {
 			StateEvent: status.StateBackfilling,
 			Message:    fmt.Sprintf("backfilling %d messages and %d receipts", v.Messages, v.Receipts),
 		})
+		user.startOfflineCatchUp(v.Messages)
 	case *events.OfflineSyncCompleted:
+		user.finishOfflineCatchUp()
 		if !user.PhoneRecentlySeen(true) {
 			user.log.Infofln("Offline sync completed, but phone last seen date is still %s - sending phone offline bridge status", user.PhoneLastSeen)
 			go user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: WAPhoneOffline})
@@ -778,18 +969,21 @@ func (user *User) HandleEvent(event interface{}) {
 			go user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
 		}
 	case *events.AppStateSyncComplete:
+		user.lastAppStateSyncLock.Lock()
+		user.lastAppStateSync = time.Now()
+		user.lastAppStateSyncName = v.Name
+		user.lastAppStateSyncLock.Unlock()
 		if len(user.Client.Store.PushName) > 0 && v.Name == appstate.WAPatchCriticalBlock {
 			err := user.Client.SendPresence(user.lastPresence)
 			if err != nil {
 				user.log.Warnln("Failed to send presence after app state sync:", err)
 			}
 		} else if v.Name == appstate.WAPatchCriticalUnblockLow {
-			go func() {
-				err := user.ResyncContacts(false)
-				if err != nil {
-					user.log.Errorln("Failed to resync puppets: %v", err)
-				}
-			}()
+			if user.bridge.DeferToStartupSync(user) {
+				user.log.Debugln("Deferring contact resync to the background startup sync")
+			} else {
+				go user.syncContactsAfterConnect()
+			}
 		}
 	case *events.PushNameSetting:
 		// Send presence available when connecting and when the pushname is changed.
@@ -804,6 +998,13 @@ func (user *User) HandleEvent(event interface{}) {
 		user.JID = v.ID
 		user.addToJIDMap()
 		user.Update()
+		user.startWarmup()
+		go user.checkOwnNumberChange()
+		user.publishProvisioningEvent(ProvEventLoginSuccess, ProvLoginSuccessEvent{
+			JID:      v.ID,
+			Phone:    "+" + v.ID.User,
+			Platform: v.Platform,
+		})
 	case *events.StreamError:
 		var message string
 		if v.Code != "" {
@@ -859,12 +1060,17 @@ func (user *User) HandleEvent(event interface{}) {
 		if v.IsFromMe && v.Sender.Device == 0 {
 			user.phoneSeen(v.Timestamp)
 		}
+		user.notifyTestSendWaiters(v)
 		go user.handleReceipt(v)
 	case *events.ChatPresence:
 		go user.handleChatPresence(v)
 	case *events.Message:
-		portal := user.GetPortalByMessageSource(v.Info.MessageSource)
-		portal.messages <- PortalMessage{evt: v, source: user}
+		if v.Info.Chat.Server == types.DefaultUserServer && !v.Info.IsFromMe && user.IsContactBlocked(v.Info.Chat) {
+			user.log.Debugfln("Dropping message %s from blocked contact %s", v.Info.ID, v.Info.Chat)
+		} else if !user.bufferOfflineMessage(v) {
+			portal := user.GetPortalByMessageSource(v.Info.MessageSource)
+			portal.messages <- PortalMessage{evt: v, source: user}
+		}
 	case *events.MediaRetry:
 		user.phoneSeen(v.Timestamp)
 		portal := user.GetPortalByJID(v.ChatID)
@@ -877,9 +1083,9 @@ func (user *User) HandleEvent(event interface{}) {
 		puppet := user.bridge.GetPuppetByJID(v.JID)
 		portal := user.GetPortalByJID(v.JID)
 		if len(portal.MXID) > 0 && user.bridge.Config.Bridge.IdentityChangeNotices {
-			text := fmt.Sprintf("Your security code with %s changed.", puppet.Displayname)
+			text := portal.formatNotice(noticeSecurityCodeChanged, puppet.Displayname)
 			if v.Implicit {
-				text = fmt.Sprintf("Your security code with %s (device #%d) changed.", puppet.Displayname, v.JID.Device)
+				text = portal.formatNotice(noticeSecurityCodeChangedDev, puppet.Displayname, v.JID.Device)
 			}
 			portal.messages <- PortalMessage{
 				fake: &fakeMessage{
@@ -899,7 +1105,7 @@ func (user *User) HandleEvent(event interface{}) {
 		portal.messages <- PortalMessage{undecryptable: v, source: user}
 	case *events.HistorySync:
 		if user.bridge.Config.Bridge.HistorySync.Backfill {
-			user.historySyncs <- v
+			user.enqueueHistorySync(v.Data)
 		}
 	case *events.Mute:
 		portal := user.GetPortalByJID(v.JID)
@@ -1122,6 +1328,9 @@ func (user *User) handleLoggedOut(onConnect bool, reason events.ConnectFailureRe
 	user.removeFromJIDMap(status.BridgeState{StateEvent: status.StateBadCredentials, Error: errorCode})
 	user.DeleteConnection()
 	user.Session = nil
+	if !user.JID.IsEmpty() {
+		user.SetPreviousUsername(user.JID.User)
+	}
 	user.JID = types.EmptyJID
 	user.Update()
 	if onConnect {
@@ -1133,7 +1342,7 @@ func (user *User) handleLoggedOut(onConnect bool, reason events.ConnectFailureRe
 
 func (user *User) GetPortalByMessageSource(ms types.MessageSource) *Portal {
 	jid := ms.Chat
-	if ms.IsIncomingBroadcast() {
+	if ms.IsIncomingBroadcast() && !user.bridge.Config.Bridge.BroadcastListPortals {
 		if ms.IsFromMe {
 			jid = ms.BroadcastListOwner.ToNonAD()
 		} else {
@@ -1154,20 +1363,115 @@ func (user *User) syncPuppet(jid types.JID, reason string) {
 	user.bridge.GetPuppetByJID(jid).SyncContact(user, false, false, reason)
 }
 
-func (user *User) ResyncContacts(forceAvatarSync bool) error {
+// syncContactsAfterConnect resyncs puppets from the contact list and runs the other contact-based syncs
+// that are enabled in the config. It's called after the initial app state sync or during the startup sync.
+func (user *User) syncContactsAfterConnect() {
+	_, err := user.ResyncChangedContacts()
+	if err != nil {
+		user.log.Errorfln("Failed to resync puppets: %v", err)
+	}
+	if user.ShouldAutoCreateDMPortals() {
+		err = user.CreateContactPortals()
+		if err != nil {
+			user.log.Errorfln("Failed to create private chat portals for contacts: %v", err)
+		}
+	}
+	if user.bridge.Config.Bridge.DepartedContacts.Enabled {
+		err = user.CheckDepartedContacts()
+		if err != nil {
+			user.log.Warnfln("Failed to check for deleted contact accounts: %v", err)
+		}
+	}
+}
+
+// ResyncChangedContacts does a full contact resync only if the contact app state has changed in a way that
+// individual contact events don't cover, i.e. the contacts have never been synced before or the app state was reset.
+// Changes applied on top of the previously synced version are already synced one by one as the contact events come in.
+// The returned bool tells whether a full resync was done.
+func (user *User) ResyncChangedContacts() (bool, error) {
+	version, hash, err := user.Client.Store.AppState.GetAppStateVersion(string(appstate.WAPatchCriticalUnblockLow))
+	if err != nil {
+		return false, fmt.Errorf("failed to get contact app state version: %w", err)
+	}
+	syncedVersion, syncedHash := user.GetContactSyncState()
+	sameHash := bytes.Equal(hash[:], syncedHash)
+	if len(user.GetContactSyncProgress()) > 0 {
+		user.log.Debugln("Found unfinished contact resync, resuming it")
+	} else if version == 0 {
+		user.log.Debugln("Contact app state hasn't been synced yet, doing full contact resync")
+	} else if syncedVersion == 0 || version < syncedVersion || (version == syncedVersion && !sameHash) {
+		user.log.Debugfln("Contact app state changed from v%d to v%d without incremental patches, doing full contact resync", syncedVersion, version)
+	} else if version == syncedVersion {
+		user.log.Debugfln("Contact app state is still at v%d, skipping contact resync", version)
+		return false, nil
+	} else {
+		user.log.Debugfln("Contact app state changed from v%d to v%d, changed contacts were already synced individually", syncedVersion, version)
+		user.SetContactSyncState(version, hash[:])
+		return false, nil
+	}
+	err = user.ResyncContacts(false)
+	if err != nil {
+		return true, err
+	}
+	if version > 0 {
+		user.SetContactSyncState(version, hash[:])
+	}
+	return true, nil
+}
+
+// AddMissingPortalsToSpace adds private chat portals that aren't in the user's personal filtering space yet
+// to the space, and returns the number of portals that were added.
+func (user *User) AddMissingPortalsToSpace() int {
+	keys := user.bridge.DB.Portal.FindPrivateChatsNotInSpace(user.JID)
+	for _, key := range keys {
+		user.bridge.GetPortalByJID(key).addToSpace(user)
+	}
+	return len(keys)
+}
+
+// ShouldAutoCreateDMPortals returns whether private chat portals should be created for all contacts after login.
+func (user *User) ShouldAutoCreateDMPortals() bool {
+	if user.AutoCreateDMPortals != nil {
+		return *user.AutoCreateDMPortals
+	}
+	return user.bridge.Config.Bridge.AutoCreateDMPortals.Enabled
+}
+
+// CreateContactPortals creates private chat portals for all contacts in the phone's address book
+// that don't have one yet. Rooms are created one at a time with a configurable delay in between.
+func (user *User) CreateContactPortals() error {
+	if !user.contactPortalCreateLock.TryLock() {
+		user.log.Debugln("Not creating contact portals as it's already in progress")
+		return nil
+	}
+	defer user.contactPortalCreateLock.Unlock()
 	contacts, err := user.Client.Store.Contacts.GetAllContacts()
 	if err != nil {
 		return fmt.Errorf("failed to get cached contacts: %w", err)
 	}
-	user.log.Infofln("Resyncing displaynames with %d contacts", len(contacts))
+	delay := time.Duration(user.bridge.Config.Bridge.AutoCreateDMPortals.Delay) * time.Millisecond
+	created := 0
 	for jid, contact := range contacts {
-		puppet := user.bridge.GetPuppetByJID(jid)
-		if puppet != nil {
-			puppet.Sync(user, &contact, forceAvatarSync, true)
+		if jid.Server != types.DefaultUserServer || (len(contact.FullName) == 0 && len(contact.FirstName) == 0) {
+			continue
+		} else if !user.IsLoggedIn() {
+			return fmt.Errorf("disconnected after creating %d portals", created)
+		}
+		portal := user.GetPortalByJID(jid)
+		if len(portal.MXID) > 0 {
+			continue
+		}
+		err = portal.CreateMatrixRoom(user, nil, false, true)
+		if err != nil {
+			user.log.Warnfln("Failed to create private chat portal with %s: %v", jid, err)
 		} else {
-			user.log.Warnfln("Got a nil puppet for %s while syncing contacts", jid)
+			created++
+		}
+		if delay > 0 {
+			time.Sleep(delay)
 		}
 	}
+	user.log.Infofln("Created %d private chat portals for contacts", created)
 	return nil
 }
 
@@ -1216,6 +1520,36 @@ func (user *User) handleChatPresence(presence *events.ChatPresence) {
 	}
 }
 
+func (user *User) addTestSendWaiter(id types.MessageID) <-chan *events.Receipt {
+	user.testSendWaitersLock.Lock()
+	defer user.testSendWaitersLock.Unlock()
+	if user.testSendWaiters == nil {
+		user.testSendWaiters = make(map[types.MessageID]chan *events.Receipt)
+	}
+	ch := make(chan *events.Receipt, 1)
+	user.testSendWaiters[id] = ch
+	return ch
+}
+
+func (user *User) removeTestSendWaiter(id types.MessageID) {
+	user.testSendWaitersLock.Lock()
+	delete(user.testSendWaiters, id)
+	user.testSendWaitersLock.Unlock()
+}
+
+func (user *User) notifyTestSendWaiters(receipt *events.Receipt) {
+	user.testSendWaitersLock.Lock()
+	defer user.testSendWaitersLock.Unlock()
+	for _, id := range receipt.MessageIDs {
+		if ch, ok := user.testSendWaiters[id]; ok {
+			select {
+			case ch <- receipt:
+			default:
+			}
+		}
+	}
+}
+
 func (user *User) handleReceipt(receipt *events.Receipt) {
 	if receipt.Type != events.ReceiptTypeRead && receipt.Type != events.ReceiptTypeReadSelf {
 		return
@@ -1303,7 +1637,7 @@ func (user *User) handleGroupUpdate(evt *events.GroupInfo) {
 	}
 	switch {
 	case evt.Announce != nil:
-		portal.RestrictMessageSending(evt.Announce.IsAnnounce)
+		portal.UpdateAnnounce(evt.Sender, evt.Timestamp, evt.Announce.IsAnnounce)
 	case evt.Locked != nil:
 		portal.RestrictMetadataChanges(evt.Locked.IsLocked)
 	case evt.Name != nil:
@@ -0,0 +1,127 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func boolOrDefault(val *bool, def bool) bool {
+	if val == nil {
+		return def
+	}
+	return *val
+}
+
+func (user *User) PresenceBridgingEnabled() bool {
+	return boolOrDefault(user.Settings.EnablePresence, user.bridge.Config.Bridge.DefaultBridgePresence)
+}
+
+func (user *User) ReceiptBridgingEnabled() bool {
+	return boolOrDefault(user.Settings.EnableReceipts, user.bridge.Config.Bridge.DefaultBridgeReceipts)
+}
+
+// AllowsRelay returns whether messages the user sends while not logged in may be bridged through the relay user.
+func (user *User) AllowsRelay() bool {
+	return boolOrDefault(user.Settings.RelayOptIn, true)
+}
+
+type UserSettingsInfo struct {
+	EnablePresence     bool `json:"enable_presence"`
+	EnableReceipts     bool `json:"enable_receipts"`
+	RelayOptIn         bool `json:"relay_opt_in"`
+	RequestFullHistory bool `json:"request_full_history"`
+	AutoCreateDMs      bool `json:"auto_create_dm_portals"`
+	// DoublePuppeting tells clients whether the presence and receipt settings currently have any effect,
+	// as they're only used when double puppeting is enabled.
+	DoublePuppeting bool `json:"double_puppeting"`
+}
+
+type ReqUserSettings struct {
+	EnablePresence     *bool `json:"enable_presence"`
+	EnableReceipts     *bool `json:"enable_receipts"`
+	RelayOptIn         *bool `json:"relay_opt_in"`
+	RequestFullHistory *bool `json:"request_full_history"`
+	AutoCreateDMs      *bool `json:"auto_create_dm_portals"`
+}
+
+func (user *User) getSettingsInfo() UserSettingsInfo {
+	return UserSettingsInfo{
+		EnablePresence:     user.PresenceBridgingEnabled(),
+		EnableReceipts:     user.ReceiptBridgingEnabled(),
+		RelayOptIn:         user.AllowsRelay(),
+		RequestFullHistory: user.WantsFullHistorySync(),
+		AutoCreateDMs:      user.ShouldAutoCreateDMPortals(),
+		DoublePuppeting:    user.bridge.GetPuppetByCustomMXID(user.MXID) != nil,
+	}
+}
+
+func (prov *ProvisioningAPI) GetSettings(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	jsonResponse(w, http.StatusOK, user.getSettingsInfo())
+}
+
+// PutSettings changes the settings that are present in the request body and leaves the others as they are.
+func (prov *ProvisioningAPI) PutSettings(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	var req ReqUserSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Malformed request body",
+			ErrCode: "bad json",
+		})
+		return
+	}
+	if req.EnablePresence != nil {
+		user.Settings.EnablePresence = req.EnablePresence
+	}
+	if req.EnableReceipts != nil {
+		user.Settings.EnableReceipts = req.EnableReceipts
+	}
+	if req.RelayOptIn != nil {
+		user.Settings.RelayOptIn = req.RelayOptIn
+	}
+	if req.RequestFullHistory != nil {
+		user.Settings.RequestFullHistory = req.RequestFullHistory
+	}
+	user.Settings.Upsert()
+	if req.AutoCreateDMs != nil {
+		user.AutoCreateDMPortals = req.AutoCreateDMs
+		user.Update()
+	}
+
+	if customPuppet := prov.bridge.GetPuppetByCustomMXID(user.MXID); customPuppet != nil {
+		presenceChanged := customPuppet.EnablePresence != user.PresenceBridgingEnabled()
+		customPuppet.EnablePresence = user.PresenceBridgingEnabled()
+		customPuppet.EnableReceipts = user.ReceiptBridgingEnabled()
+		customPuppet.Update()
+		if presenceChanged && user.IsLoggedIn() {
+			newPresence := types.PresenceUnavailable
+			if customPuppet.EnablePresence {
+				newPresence = types.PresenceAvailable
+			}
+			err := user.Client.SendPresence(newPresence)
+			if err != nil {
+				user.log.Warnln("Failed to set presence:", err)
+			}
+		}
+	}
+	jsonResponse(w, http.StatusOK, user.getSettingsInfo())
+}
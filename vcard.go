@@ -0,0 +1,155 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// VCardValue is a single value of a multi-valued vCard property like TEL or EMAIL.
+type VCardValue struct {
+	Type  string
+	Value string
+	// WAID is the WhatsApp user ID that WhatsApp attaches to phone numbers of contacts who use WhatsApp.
+	WAID string
+}
+
+// VCard contains the human-readable parts of a vCard.
+type VCard struct {
+	FullName     string
+	Organization string
+	Phones       []VCardValue
+	Emails       []VCardValue
+	URLs         []VCardValue
+}
+
+func unescapeVCardValue(val string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(val)
+}
+
+// ParseVCard extracts the fields shown in the readable version of a contact card. It's not a complete vCard parser,
+// unknown properties and encodings are ignored.
+func ParseVCard(data string) *VCard {
+	var card VCard
+	// Unfold continuation lines first (RFC 6350 section 3.2)
+	data = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(data)
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		sep := strings.IndexByte(line, ':')
+		if sep <= 0 {
+			continue
+		}
+		params := strings.Split(line[:sep], ";")
+		value := VCardValue{Value: unescapeVCardValue(line[sep+1:])}
+		// Properties can be prefixed with a group name, e.g. item1.TEL
+		name := strings.ToUpper(params[0])
+		if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+			name = name[dot+1:]
+		}
+		for _, param := range params[1:] {
+			key, val, _ := strings.Cut(param, "=")
+			switch strings.ToLower(key) {
+			case "type":
+				if len(value.Type) == 0 && !strings.EqualFold(val, "pref") {
+					value.Type = strings.ToLower(val)
+				}
+			case "waid":
+				value.WAID = val
+			}
+		}
+		switch name {
+		case "FN":
+			card.FullName = value.Value
+		case "ORG":
+			card.Organization = strings.TrimRight(strings.ReplaceAll(value.Value, ";", ", "), ", ")
+		case "TEL":
+			card.Phones = append(card.Phones, value)
+		case "EMAIL":
+			card.Emails = append(card.Emails, value)
+		case "URL":
+			card.URLs = append(card.URLs, value)
+		}
+	}
+	return &card
+}
+
+func formatVCardValue(val VCardValue, htmlValue string) (string, string) {
+	if len(val.Type) > 0 {
+		return fmt.Sprintf("%s (%s)", val.Value, val.Type), fmt.Sprintf("%s (%s)", htmlValue, html.EscapeString(val.Type))
+	}
+	return val.Value, htmlValue
+}
+
+// formatVCardURL links a website of a contact card if it's a http(s) URL. Other URLs, like javascript: or data:,
+// are only shown as text.
+func formatVCardURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return html.EscapeString(value)
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(parsed.String()), html.EscapeString(value))
+}
+
+// formatVCard returns a readable plaintext and HTML representation of a contact card. Phone numbers that WhatsApp
+// knows to be on WhatsApp link to the corresponding bridge ghost.
+func (portal *Portal) formatVCard(displayName string, card *VCard) (string, string) {
+	name := card.FullName
+	if len(name) == 0 {
+		name = displayName
+	}
+	plain := []string{fmt.Sprintf("Contact: %s", name)}
+	formatted := []string{fmt.Sprintf("Contact: <strong>%s</strong>", html.EscapeString(name))}
+	if len(card.Organization) > 0 {
+		plain = append(plain, card.Organization)
+		formatted = append(formatted, html.EscapeString(card.Organization))
+	}
+	for _, phone := range card.Phones {
+		link := fmt.Sprintf(`<a href="tel:%s">%s</a>`, html.EscapeString(strings.ReplaceAll(phone.Value, " ", "")), html.EscapeString(phone.Value))
+		if len(phone.WAID) > 0 {
+			mxid := portal.bridge.FormatPuppetMXID(types.NewJID(phone.WAID, types.DefaultUserServer))
+			link = fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, mxid, html.EscapeString(phone.Value))
+		}
+		p, f := formatVCardValue(phone, link)
+		plain = append(plain, "Phone: "+p)
+		formatted = append(formatted, "Phone: "+f)
+	}
+	for _, email := range card.Emails {
+		p, f := formatVCardValue(email, fmt.Sprintf(`<a href="mailto:%[1]s">%[1]s</a>`, html.EscapeString(email.Value)))
+		plain = append(plain, "Email: "+p)
+		formatted = append(formatted, "Email: "+f)
+	}
+	for _, website := range card.URLs {
+		p, f := formatVCardValue(website, formatVCardURL(website.Value))
+		plain = append(plain, "Website: "+p)
+		formatted = append(formatted, "Website: "+f)
+	}
+	return strings.Join(plain, "\n"), strings.Join(formatted, "<br>")
+}
+
+// isVCardFile checks whether a Matrix file message is a contact card that should be sent as a WhatsApp contact message.
+func isVCardFile(mimeType, fileName string) bool {
+	switch strings.ToLower(mimeType) {
+	case "text/vcard", "text/x-vcard", "text/directory":
+		return true
+	}
+	return strings.HasSuffix(strings.ToLower(fileName), ".vcf")
+}
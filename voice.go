@@ -0,0 +1,157 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"strconv"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// WhatsApp voice note waveforms have 64 samples with values between 0 and 100.
+	voiceWaveformSamples = 64
+	voiceWaveformMax     = 100
+	voiceAnalysisRate    = 8000
+)
+
+// convertWaveformToMatrix converts a WhatsApp voice note waveform into an MSC1767 waveform. The values are
+// scaled so that the loudest sample is close to the MSC1767 maximum of 1024, which makes quiet recordings visible.
+func convertWaveformToMatrix(waveform []byte) []int {
+	if waveform == nil {
+		return nil
+	}
+	output := make([]int, len(waveform))
+	max := 0
+	for i, part := range waveform {
+		output[i] = int(part)
+		if output[i] > max {
+			max = output[i]
+		}
+	}
+	multiplier := 0
+	if max > 0 {
+		multiplier = 1024 / max
+	}
+	if multiplier > 32 {
+		multiplier = 32
+	}
+	for i := range output {
+		output[i] *= multiplier
+	}
+	return output
+}
+
+// getUnstableAudioDuration returns the duration of a Matrix audio message in milliseconds from the info object,
+// or from the MSC1767 audio metadata if the info doesn't have it. Zero is returned if neither has the duration.
+func getUnstableAudioDuration(content *event.MessageEventContent, raw map[string]interface{}) int {
+	if duration := content.GetInfo().Duration; duration > 0 {
+		return duration
+	}
+	audioInfo, ok := raw["org.matrix.msc1767.audio"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	duration, _ := audioInfo["duration"].(float64)
+	return int(duration)
+}
+
+// fillMissingAudioInfo computes the duration and waveform of incoming WhatsApp audio messages that don't include them,
+// e.g. voice notes sent from some WhatsApp Web clients, so Matrix clients can render them properly.
+func (portal *Portal) fillMissingAudioInfo(data []byte, converted *ConvertedMessage) {
+	needsDuration, needsWaveform := portal.getMissingAudioInfo(converted)
+	if !needsDuration && !needsWaveform {
+		return
+	}
+	audioInfo, _ := converted.Extra["org.matrix.msc1767.audio"].(map[string]interface{})
+	waveform, duration, err := portal.bridge.Transcoder.generateVoiceWaveform(context.Background(), data)
+	if err != nil {
+		portal.log.Warnfln("Failed to analyze audio to find duration and waveform: %v", err)
+		return
+	}
+	if audioInfo == nil {
+		audioInfo = map[string]interface{}{}
+		converted.Extra["org.matrix.msc1767.audio"] = audioInfo
+	}
+	if needsDuration {
+		converted.Content.Info.Duration = duration
+		audioInfo["duration"] = duration
+	}
+	if needsWaveform && len(waveform) > 0 {
+		audioInfo["waveform"] = convertWaveformToMatrix(waveform)
+	}
+}
+
+// getMissingAudioInfo checks whether fillMissingAudioInfo would need to analyze the audio file.
+func (portal *Portal) getMissingAudioInfo(converted *ConvertedMessage) (needsDuration, needsWaveform bool) {
+	if converted.Content.MsgType != event.MsgAudio {
+		return
+	}
+	audioInfo, _ := converted.Extra["org.matrix.msc1767.audio"].(map[string]interface{})
+	_, isVoice := converted.Extra["org.matrix.msc3245.voice"]
+	existingWaveform, _ := audioInfo["waveform"].([]int)
+	needsDuration = converted.Content.Info.Duration == 0
+	needsWaveform = isVoice && len(existingWaveform) == 0 && portal.bridge.Config.Bridge.AudioWaveforms
+	return
+}
+
+// convertVoiceToOpus transcodes an audio file into a mono Opus-in-OGG file, which is the only
+// format that WhatsApp clients render as a voice note.
+func (tp *TranscodePool) convertVoiceToOpus(ctx context.Context, data []byte) ([]byte, error) {
+	return tp.Convert(ctx, data, ".ogg", nil, []string{
+		"-vn", "-c:a", "libopus", "-b:a", "32k", "-ac", "1", "-ar", "48000", "-application", "voip",
+	})
+}
+
+// generateVoiceWaveform decodes the given audio file and returns a WhatsApp-style waveform along with
+// the duration of the audio in milliseconds.
+func (tp *TranscodePool) generateVoiceWaveform(ctx context.Context, data []byte) ([]byte, int, error) {
+	pcm, err := tp.Convert(ctx, data, ".pcm", nil, []string{
+		"-f", "s16le", "-ac", "1", "-ar", strconv.Itoa(voiceAnalysisRate),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sampleCount := len(pcm) / 2
+	duration := sampleCount * 1000 / voiceAnalysisRate
+	if sampleCount < voiceWaveformSamples {
+		return nil, duration, nil
+	}
+	peaks := make([]float64, voiceWaveformSamples)
+	bucketSize := sampleCount / voiceWaveformSamples
+	var maxPeak float64
+	for i := range peaks {
+		var sum float64
+		for j := 0; j < bucketSize; j++ {
+			offset := (i*bucketSize + j) * 2
+			sample := float64(int16(binary.LittleEndian.Uint16(pcm[offset:])))
+			sum += sample * sample
+		}
+		peaks[i] = math.Sqrt(sum / float64(bucketSize))
+		maxPeak = math.Max(maxPeak, peaks[i])
+	}
+	waveform := make([]byte, voiceWaveformSamples)
+	if maxPeak > 0 {
+		for i, peak := range peaks {
+			waveform[i] = byte(peak / maxPeak * voiceWaveformMax)
+		}
+	}
+	return waveform, duration, nil
+}
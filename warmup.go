@@ -0,0 +1,133 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// warmupState tracks the recent outgoing messages of a user whose WhatsApp session was linked recently.
+// The counters are only kept in memory, so they start over when the bridge is restarted.
+type warmupState struct {
+	lock          sync.Mutex
+	loaded        bool
+	firstActivity time.Time
+	sent          []time.Time
+	newChats      []time.Time
+	lastWarning   time.Time
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+func (user *User) getFirstActivity() time.Time {
+	if !user.warmup.loaded {
+		user.warmup.firstActivity = user.GetFirstActivity()
+		user.warmup.loaded = true
+	}
+	return user.warmup.firstActivity
+}
+
+// startWarmup starts the warmup period after the user links a new WhatsApp session.
+func (user *User) startWarmup() {
+	user.warmup.lock.Lock()
+	defer user.warmup.lock.Unlock()
+	user.warmup.firstActivity = time.Now()
+	user.warmup.loaded = true
+	user.warmup.sent = nil
+	user.warmup.newChats = nil
+	user.SetFirstActivity(user.warmup.firstActivity)
+}
+
+// EndWarmup lifts the warmup limits of the user before the warmup period is over.
+func (user *User) EndWarmup() {
+	user.warmup.lock.Lock()
+	defer user.warmup.lock.Unlock()
+	user.warmup.firstActivity = time.Time{}
+	user.warmup.loaded = true
+	user.SetFirstActivity(time.Time{})
+}
+
+// WarmupEnd returns when the warmup period of the user ends, or a zero time if the user isn't in the warmup period.
+func (user *User) WarmupEnd() time.Time {
+	days := user.bridge.Config.Bridge.Warmup.Days
+	if days <= 0 {
+		return time.Time{}
+	}
+	user.warmup.lock.Lock()
+	firstActivity := user.getFirstActivity()
+	user.warmup.lock.Unlock()
+	if firstActivity.IsZero() {
+		return time.Time{}
+	} else if end := firstActivity.AddDate(0, 0, days); end.After(time.Now()) {
+		return end
+	}
+	return time.Time{}
+}
+
+// WarmupUsage returns the number of messages sent in the past hour and new chats messaged in the past day.
+func (user *User) WarmupUsage() (messages, newChats int) {
+	user.warmup.lock.Lock()
+	defer user.warmup.lock.Unlock()
+	now := time.Now()
+	user.warmup.sent = pruneBefore(user.warmup.sent, now.Add(-time.Hour))
+	user.warmup.newChats = pruneBefore(user.warmup.newChats, now.Add(-24*time.Hour))
+	return len(user.warmup.sent), len(user.warmup.newChats)
+}
+
+// checkWarmupLimits counts an outgoing message in the given portal against the warmup limits of the user,
+// or returns an error if the message would go over them.
+func (user *User) checkWarmupLimits(portal *Portal) error {
+	cfg := user.bridge.Config.Bridge.Warmup
+	warmupEnd := user.WarmupEnd()
+	if warmupEnd.IsZero() {
+		return nil
+	}
+	isNewChat := cfg.NewChatsPerDay > 0 && !user.bridge.DB.Message.HasSentInChat(portal.Key, user.JID)
+
+	user.warmup.lock.Lock()
+	defer user.warmup.lock.Unlock()
+	now := time.Now()
+	user.warmup.sent = pruneBefore(user.warmup.sent, now.Add(-time.Hour))
+	user.warmup.newChats = pruneBefore(user.warmup.newChats, now.Add(-24*time.Hour))
+	var err error
+	if cfg.MessagesPerHour > 0 && len(user.warmup.sent) >= cfg.MessagesPerHour {
+		err = fmt.Errorf("%w: at most %d messages can be sent per hour until %s", errWarmupLimit, cfg.MessagesPerHour, warmupEnd.Format(time.RFC1123))
+	} else if isNewChat && len(user.warmup.newChats) >= cfg.NewChatsPerDay {
+		err = fmt.Errorf("%w: at most %d new chats can be started per day until %s", errWarmupLimit, cfg.NewChatsPerDay, warmupEnd.Format(time.RFC1123))
+	}
+	if err != nil {
+		if now.Sub(user.warmup.lastWarning) > time.Hour {
+			user.warmup.lastWarning = now
+			go user.sendMarkdownBridgeAlert("Your WhatsApp account was linked recently, so the bridge limits how many messages you can send "+
+				"to avoid getting the account banned. Messages over the limit are not sent (%v).", err)
+		}
+		return err
+	}
+	user.warmup.sent = append(user.warmup.sent, now)
+	if isNewChat {
+		user.warmup.newChats = append(user.warmup.newChats, now)
+	}
+	return nil
+}